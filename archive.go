@@ -0,0 +1,116 @@
+package githosts
+
+import (
+	"archive/tar"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	// archiveExtension ends the names of the archives of a generation's files, e.g. <repo>.<timestamp>.tar
+	archiveExtension = ".tar"
+	// partialExtension is appended to an archive's name until it's complete
+	partialExtension = ".partial"
+)
+
+// archiveLatestGeneration writes the latest bundle in backupPath, with its manifest and checksum,
+// to a tar archive named after the bundle and returns its path. The archived files are removed
+// unless keepFiles is set.
+func archiveLatestGeneration(logger Logger, backupPath string, keepFiles bool) (string, errors.E) {
+	bundlePath, err := getLatestBundlePath(backupPath)
+	if err != nil {
+		return "", errors.Errorf("failed to find bundle to archive: %s", err)
+	}
+
+	members := []string{bundlePath}
+
+	for _, path := range []string{manifestPathForBundle(bundlePath), checksumPathForBundle(bundlePath)} {
+		if _, sErr := os.Stat(path); sErr == nil {
+			members = append(members, path)
+		}
+	}
+
+	archivePath := strings.TrimSuffix(manifestPathForBundle(bundlePath), manifestExtension) + archiveExtension
+
+	// the archive is only given its name once complete, so a partial one is never mistaken for it
+	if wErr := writeArchive(archivePath+partialExtension, members); wErr != nil {
+		_ = os.Remove(archivePath + partialExtension)
+
+		return "", errors.Errorf("failed to write archive: %s: %s", archivePath, wErr)
+	}
+
+	if rErr := os.Rename(archivePath+partialExtension, archivePath); rErr != nil {
+		return "", errors.Errorf("failed to move archive: %s", rErr)
+	}
+
+	if keepFiles {
+		return archivePath, nil
+	}
+
+	for _, path := range members {
+		if rErr := os.Remove(path); rErr != nil {
+			logger.Printf("failed to remove archived file: %s", rErr)
+		}
+	}
+
+	return archivePath, nil
+}
+
+// writeArchive writes the files to a tar archive at archivePath, each named by its base name.
+func writeArchive(archivePath string, paths []string) error {
+	file, err := os.OpenFile(archivePath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, manifestFileMode)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(file)
+
+	for _, path := range paths {
+		if err = addArchiveMember(tw, path); err != nil {
+			_ = file.Close()
+
+			return err
+		}
+	}
+
+	if err = tw.Close(); err != nil {
+		_ = file.Close()
+
+		return err
+	}
+
+	return file.Close()
+}
+
+func addArchiveMember(tw *tar.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	header, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+
+	header.Name = filepath.Base(path)
+
+	if err = tw.WriteHeader(header); err != nil {
+		return err
+	}
+
+	_, err = io.Copy(tw, file)
+
+	return err
+}
@@ -0,0 +1,134 @@
+package githosts
+
+import (
+	"archive/tar"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// archiveMembers returns the names of the files in the tar archive.
+func archiveMembers(t *testing.T, archivePath string) []string {
+	t.Helper()
+
+	file, err := os.Open(archivePath)
+	require.NoError(t, err)
+
+	defer file.Close()
+
+	var names []string
+
+	tr := tar.NewReader(file)
+
+	for {
+		header, nErr := tr.Next()
+		if nErr == io.EOF {
+			return names
+		}
+
+		require.NoError(t, nErr)
+
+		names = append(names, header.Name)
+	}
+}
+
+func archivesIn(t *testing.T, dir string) []string {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+
+	var archives []string
+
+	for _, entry := range entries {
+		if strings.HasSuffix(entry.Name(), archiveExtension) {
+			archives = append(archives, filepath.Join(dir, entry.Name()))
+		}
+	}
+
+	return archives
+}
+
+func TestProcessBackupArchivePerRepo(t *testing.T) {
+	t.Parallel()
+
+	repoDir := setupTestRepo(t)
+
+	repo := repository{
+		Name:              "repo",
+		PathWithNameSpace: "owner/repo",
+		Domain:            "local",
+		HTTPSUrl:          "file://" + repoDir,
+	}
+
+	for _, keepFiles := range []bool{false, true} {
+		backupDir := t.TempDir()
+		backupPath := filepath.Join(backupDir, "local", "owner", "repo")
+
+		result, err := processBackup(context.Background(), processBackupInput{Repo: repo, BackupDIR: backupDir, ArchivePerRepo: true, KeepArchivedFiles: keepFiles})
+		require.NoError(t, err)
+		require.True(t, result.Updated)
+
+		archives := archivesIn(t, backupPath)
+		require.Len(t, archives, 1)
+
+		name := strings.TrimSuffix(filepath.Base(archives[0]), archiveExtension)
+		require.Regexp(t, `^repo\.[0-9]{14}$`, name)
+
+		bundleName := name + bundleExtension
+		require.Equal(t, []string{bundleName, name + manifestExtension, bundleName + checksumExtension}, archiveMembers(t, archives[0]))
+
+		// the archived files are only left in place when kept
+		require.Equal(t, keepFiles, dirHasBundles(logger, backupPath))
+
+		entries, rErr := os.ReadDir(backupPath)
+		require.NoError(t, rErr)
+
+		if keepFiles {
+			require.Len(t, entries, 4)
+		} else {
+			require.Len(t, entries, 1)
+		}
+	}
+}
+
+func TestProcessBackupArchivePerRepoPruned(t *testing.T) {
+	t.Parallel()
+
+	repoDir := setupTestRepo(t)
+	backupDir := t.TempDir()
+	backupPath := filepath.Join(backupDir, "local", "owner", "repo")
+
+	in := processBackupInput{
+		Repo: repository{
+			Name:              "repo",
+			PathWithNameSpace: "owner/repo",
+			Domain:            "local",
+			HTTPSUrl:          "file://" + repoDir,
+		},
+		BackupDIR:      backupDir,
+		BackupsToKeep:  1,
+		ArchivePerRepo: true,
+	}
+
+	// without the archived files, an unchanged repository is archived again
+	for range 2 {
+		result, err := processBackup(context.Background(), in)
+		require.NoError(t, err)
+		require.True(t, result.Updated)
+	}
+
+	// archives are pruned as generations of backups
+	require.Len(t, archivesIn(t, backupPath), 1)
+
+	in.BackupsToKeep = 0
+
+	_, err := processBackup(context.Background(), in)
+	require.NoError(t, err)
+	require.Len(t, archivesIn(t, backupPath), 2)
+}
@@ -9,7 +9,10 @@ import (
 	"log"
 	"net/http"
 	"net/url"
+	"regexp"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/hashicorp/go-retryablehttp"
@@ -24,13 +27,51 @@ const (
 	sUsingDefaultDiffRemoteMethod     = "using default diff remote method"
 	AzureDevOpsProviderName           = "AzureDevOps"
 	azureDevOpsDomain                 = "dev.azure.com"
+	azureDevOpsAPIURL                 = "https://" + azureDevOpsDomain
+	azureDevOpsAllProjects            = "*"
 	envAzureDevOpsUserName            = "AZURE_DEVOPS_USERNAME"
 	msgSkipAzureDevOpsUserNameMissing = "Skipping Azure DevOps test as " + envAzureDevOpsUserName + " is missing"
 )
 
 func (ad *AzureDevOpsHost) Backup() ProviderBackupResult {
+	return ad.BackupWithContext(context.Background())
+}
+
+// BackupWithContext backs up the host's repositories. Any not yet backed up when the context is
+// cancelled are reported as failed.
+func (ad *AzureDevOpsHost) BackupWithContext(ctx context.Context) ProviderBackupResult {
+	release, err := acquireBackupLocks(ctx, []GitProvider{ad})
+	if err != nil {
+		return ProviderBackupResult{Error: err}
+	}
+
+	defer release()
+
+	return ad.backupWithCloneTokens(ctx, nil)
+}
+
+// backupLock returns the directory locked while the host is backed up, and how long to wait for it.
+func (ad *AzureDevOpsHost) backupLock() (string, time.Duration) {
+	return ad.BackupDir, ad.LockTimeout
+}
+
+// backupWithCloneTokens backs up the host's repositories, each holding a token from cloneTokens, if
+// specified, while being backed up.
+func (ad *AzureDevOpsHost) backupWithCloneTokens(ctx context.Context, cloneTokens chan struct{}) ProviderBackupResult {
+	in := ad.backupInput()
+
+	result := ad.backup(ctx, in, cloneTokens)
+
+	updateBackupIndexes(ad.logger(), in, result.BackupResults)
+
+	notifyWebhook(ctx, ad.logger(), ad.HttpClient, ad.NotifyWebhookURL, AzureDevOpsProviderName, result)
+
+	return result
+}
+
+func (ad *AzureDevOpsHost) backup(ctx context.Context, in processBackupInput, cloneTokens chan struct{}) ProviderBackupResult {
 	if ad.BackupDir == "" {
-		logger.Printf("backup skipped as backup directory not specified")
+		ad.logger().Printf("backup skipped as backup directory not specified")
 
 		return ProviderBackupResult{
 			BackupResults: nil,
@@ -38,9 +79,7 @@ func (ad *AzureDevOpsHost) Backup() ProviderBackupResult {
 		}
 	}
 
-	maxConcurrent := 10
-
-	repoDesc, err := ad.describeRepos()
+	repoDesc, err := ad.describeRepos(ctx)
 	if err != nil {
 		return ProviderBackupResult{
 			BackupResults: nil,
@@ -48,102 +87,204 @@ func (ad *AzureDevOpsHost) Backup() ProviderBackupResult {
 		}
 	}
 
-	jobs := make(chan repository, len(repoDesc.Repos))
-	results := make(chan RepoBackupResults, maxConcurrent)
+	repoDesc.Repos = filterRepos(ad.logger(), repoDesc.Repos, ad.Include, ad.Exclude)
+	repoDesc.Repos = filterRepoList(ad.logger(), repoDesc.Repos, ad.RepoList, ad.RepoListMode)
 
-	for w := 1; w <= maxConcurrent; w++ {
-		go azureDevOpsWorker(ad.LogLevel, ad.BackupDir, ad.DiffRemoteMethod, ad.BackupsToRetain, jobs, results)
+	if mErr := checkMaxRepos(ad.logger(), AzureDevOpsProviderName, len(repoDesc.Repos), ad.MaxRepos); mErr != nil {
+		return ProviderBackupResult{Error: mErr}
 	}
 
-	for x := range repoDesc.Repos {
-		repo := repoDesc.Repos[x]
-		jobs <- repo
-	}
+	return runBackups(ctx, AzureDevOpsProviderName, in, nil, repoDesc.Repos, cloneTokens, backupRunOptions{
+		MaxConcurrent:    getMaxConcurrent(ad.MaxConcurrent, defaultMaxConcurrentAzure),
+		FailFast:         ad.FailFast,
+		FailOnAnyError:   ad.FailOnAnyError,
+		BackupSubmodules: ad.BackupSubmodules,
+		Progress:         ad.Progress,
+	})
+}
 
-	close(jobs)
+// return normalised method.
+func (ad *AzureDevOpsHost) diffRemoteMethod() string {
+	return normaliseDiffRemoteMethod(ad.logger(), ad.DiffRemoteMethod)
+}
 
-	var providerBackupResults ProviderBackupResult
+// logger returns the configured logger, or the package's default if none was specified.
+func (ad *AzureDevOpsHost) logger() Logger {
+	return getLogger(ad.Logger)
+}
 
-	for a := 1; a <= len(repoDesc.Repos); a++ {
-		res := <-results
-		if res.Error != nil {
-			logger.Printf("backup failed: %+v\n", res.Error)
-		}
+// backupInput returns the settings each of the host's repositories is backed up with.
+func (ad *AzureDevOpsHost) backupInput() processBackupInput {
+	return processBackupInput{
+		LogLevel:            ad.LogLevel,
+		Logger:              ad.logger(),
+		RemoteStore:         ad.RemoteStore,
+		StoreKeyPrefix:      ad.NamespacePrefix,
+		RepoBackupTimeout:   ad.RepoBackupTimeout,
+		Git:                 gitOptions{BinaryPath: ad.GitBinaryPath, ExtraConfig: ad.ExtraGitConfig, ProxyURL: ad.ProxyURL, CACertPath: ad.CACertPath, InsecureSkipTLSVerify: ad.InsecureSkipTLSVerify},
+		BackupDIR:           backupRoot(ad.BackupDir, ad.NamespacePrefix),
+		BackupsToKeep:       ad.BackupsToRetain,
+		KeepForDays:         ad.KeepForDays,
+		CloneRetries:        ad.CloneRetries,
+		MinFreeDiskMB:       ad.MinFreeDiskMB,
+		DiffRemoteMethod:    ad.diffRemoteMethod(),
+		BundleRefSpec:       ad.BundleRefSpec,
+		RefSpec:             ad.refSpecPatterns,
+		BundleNameTemplate:  ad.BundleNameTemplate,
+		FlatLayout:          ad.FlatLayout,
+		FlatLayoutSeparator: ad.FlatLayoutSeparator,
+		DateDir:             backupDateDir(ad.DateDirLayout),
+		DryRun:              ad.DryRun,
+		PartialClone:        ad.PartialClone,
+		KeepWorkingDir:      ad.KeepWorkingDir,
+		SkipVerify:          !ad.VerifyAfterCreate,
+		CompressBundles:     ad.CompressBundles,
+		ArchivePerRepo:      ad.ArchivePerRepo,
+		KeepArchivedFiles:   ad.KeepArchivedFiles,
+		SSHPrivateKeyPath:   ad.SSHPrivateKeyPath,
+		SSHKnownHostsPath:   ad.SSHKnownHostsPath,
+	}
+}
 
-		providerBackupResults.BackupResults = append(providerBackupResults.BackupResults, res)
+// validAzureDevOpsOrgs checks at least one organization is specified.
+func validAzureDevOpsOrgs(orgs []string) error {
+	if len(orgs) == 0 {
+		return errors.New("no organizations specified")
 	}
 
-	return providerBackupResults
+	return nil
 }
 
-func azureDevOpsWorker(logLevel int, backupDIR, diffRemoteMethod string, backupsToKeep int,
-	jobs <-chan repository, results chan<- RepoBackupResults,
-) {
-	for repo := range jobs {
-		err := processBackup(logLevel, repo, backupDIR, backupsToKeep, diffRemoteMethod)
-
-		backupResult := RepoBackupResults{
-			Repo: repo.PathWithNameSpace,
-		}
+// Validate checks the input's settings, returning an error listing each that's missing or invalid.
+func (input NewAzureDevOpsHostInput) Validate() error {
+	return errors.Join(
+		validRequired(input.BackupDir, "backup directory"),
+		validRequired(input.UserName, "username"),
+		validRequired(input.PAT, "personal access token"),
+		validAzureDevOpsOrgs(input.Orgs),
+		validBackupDir(input.BackupDir),
+		validDiffRemoteMethodSetting(input.DiffRemoteMethod),
+		validNamespacePrefix(input.NamespacePrefix),
+		validBundleRefSpec(input.BundleRefSpec, input.RefSpec),
+		validBundleNameTemplate(input.BundleNameTemplate),
+		validFlatLayoutSeparator(input.FlatLayoutSeparator),
+		validRepoFilters(input.Include, input.Exclude),
+		validRepoList(input.RepoListFile, input.RepoListMode),
+		validMaxConcurrent(input.MaxConcurrent),
+		validMaxRepos(input.MaxRepos),
+		validRetryConfig(input.RetryMax, input.RetryWaitMinSeconds, input.RetryWaitMaxSeconds),
+		validCloneRetries(input.CloneRetries),
+		validMinFreeDiskMB(input.MinFreeDiskMB),
+		validSSHAuth(input.SSHPrivateKeyPath, input.SSHKnownHostsPath),
+		validRepoBackupTimeout(input.RepoBackupTimeout),
+		validLockTimeout(input.LockTimeout),
+		validExtraGitConfig(input.ExtraGitConfig),
+		validNotifyWebhookURL(input.NotifyWebhookURL),
+		validProxyURL(input.ProxyURL),
+		validTLSConfig(input.CACertPath, input.InsecureSkipTLSVerify),
+	)
+}
 
-		status := statusOk
-		if err != nil {
-			status = statusFailed
-			backupResult.Error = err
-		}
+func NewAzureDevOpsHost(input NewAzureDevOpsHostInput) (*AzureDevOpsHost, error) {
+	if input.Logger == nil {
+		setLoggerPrefix(input.Caller)
+	}
 
-		backupResult.Status = status
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
 
-		results <- backupResult
+	diffRemoteMethod, err := getDiffRemoteMethod(getLogger(input.Logger), input.DiffRemoteMethod)
+	if err != nil {
+		return nil, err
 	}
-}
 
-func NewAzureDevOpsHost(input NewAzureDevOpsHostInput) (*AzureDevOpsHost, error) {
-	setLoggerPrefix(input.Caller)
+	bundleRefSpec, err := getBundleRefSpec(input.BundleRefSpec)
+	if err != nil {
+		return nil, err
+	}
 
-	switch {
-	case input.BackupDir == "":
-		return nil, errors.New("backup directory not specified")
-	case input.UserName == "":
-		return nil, errors.New("username not specified")
-	case input.PAT == "":
-		return nil, errors.New("personal access token not specified")
-	case len(input.Orgs) == 0:
-		return nil, errors.New("no organizations specified")
+	repoList, repoListMode, err := readRepoList(input.RepoListFile, input.RepoListMode)
+	if err != nil {
+		return nil, err
 	}
 
-	diffRemoteMethod, err := getDiffRemoteMethod(input.DiffRemoteMethod)
+	tlsConfig, err := getTLSConfig(input.CACertPath, input.InsecureSkipTLSVerify)
 	if err != nil {
 		return nil, err
 	}
 
-	if diffRemoteMethod == "" {
-		logger.Printf("%s: %s", sUsingDefaultDiffRemoteMethod, defaultRemoteMethod)
-		diffRemoteMethod = defaultRemoteMethod
-	} else {
-		logger.Printf("%s: %s", sUsingDiffRemoteMethod, diffRemoteMethod)
+	if input.InsecureSkipTLSVerify {
+		getLogger(input.Logger).Println("WARNING: TLS certificate verification is disabled")
 	}
 
 	httpClient := input.HTTPClient
 	if httpClient == nil {
-		httpClient = getHTTPClient()
+		httpClient = getHTTPClient(input.RetryMax, input.RetryWaitMinSeconds, input.RetryWaitMaxSeconds, input.ProxyURL, tlsConfig)
+	}
+
+	apiURL := azureDevOpsAPIURL
+	if input.APIURL != "" {
+		apiURL = strings.TrimSuffix(input.APIURL, "/")
 	}
 
 	return &AzureDevOpsHost{
-		Caller:           input.Caller,
-		HttpClient:       httpClient,
-		Provider:         AzureDevOpsProviderName,
-		PAT:              input.PAT,
-		Orgs:             input.Orgs,
-		UserName:         input.UserName,
-		DiffRemoteMethod: diffRemoteMethod,
-		BackupDir:        input.BackupDir,
-		BackupsToRetain:  input.BackupsToRetain,
-		LogLevel:         input.LogLevel,
+		Caller:                input.Caller,
+		HttpClient:            httpClient,
+		Provider:              AzureDevOpsProviderName,
+		APIURL:                apiURL,
+		PAT:                   input.PAT,
+		Orgs:                  input.Orgs,
+		Projects:              input.Projects,
+		UserName:              input.UserName,
+		DiffRemoteMethod:      diffRemoteMethod,
+		BackupDir:             input.BackupDir,
+		NamespacePrefix:       input.NamespacePrefix,
+		BundleRefSpec:         bundleRefSpec,
+		RefSpec:               input.RefSpec,
+		refSpecPatterns:       compileRefSpec(input.RefSpec),
+		BundleNameTemplate:    input.BundleNameTemplate,
+		FlatLayout:            input.FlatLayout,
+		FlatLayoutSeparator:   input.FlatLayoutSeparator,
+		DateDirLayout:         input.DateDirLayout,
+		Include:               input.Include,
+		Exclude:               input.Exclude,
+		RepoList:              repoList,
+		RepoListMode:          repoListMode,
+		MaxConcurrent:         input.MaxConcurrent,
+		MaxRepos:              input.MaxRepos,
+		DryRun:                input.DryRun,
+		FailFast:              input.FailFast,
+		FailOnAnyError:        input.FailOnAnyError,
+		PartialClone:          input.PartialClone,
+		KeepWorkingDir:        input.KeepWorkingDir,
+		BackupSubmodules:      input.BackupSubmodules,
+		VerifyAfterCreate:     input.VerifyAfterCreate == nil || *input.VerifyAfterCreate,
+		CompressBundles:       input.CompressBundles,
+		ArchivePerRepo:        input.ArchivePerRepo,
+		KeepArchivedFiles:     input.KeepArchivedFiles,
+		SSHPrivateKeyPath:     input.SSHPrivateKeyPath,
+		SSHKnownHostsPath:     input.SSHKnownHostsPath,
+		BackupsToRetain:       input.BackupsToRetain,
+		KeepForDays:           input.KeepForDays,
+		CloneRetries:          input.CloneRetries,
+		MinFreeDiskMB:         input.MinFreeDiskMB,
+		LogLevel:              input.LogLevel,
+		Logger:                input.Logger,
+		Progress:              input.Progress,
+		RemoteStore:           input.RemoteStore,
+		RepoBackupTimeout:     input.RepoBackupTimeout,
+		LockTimeout:           input.LockTimeout,
+		GitBinaryPath:         input.GitBinaryPath,
+		ExtraGitConfig:        input.ExtraGitConfig,
+		NotifyWebhookURL:      input.NotifyWebhookURL,
+		ProxyURL:              input.ProxyURL,
+		CACertPath:            input.CACertPath,
+		InsecureSkipTLSVerify: input.InsecureSkipTLSVerify,
 	}, nil
 }
 
-func (ad *AzureDevOpsHost) describeRepos() (describeReposOutput, errors.E) {
+func (ad *AzureDevOpsHost) describeRepos(ctx context.Context) (describeReposOutput, errors.E) {
 	var repos []repository
 
 	var org string
@@ -160,17 +301,17 @@ func (ad *AzureDevOpsHost) describeRepos() (describeReposOutput, errors.E) {
 	}
 
 	// append repos belonging to any orgs specified
-	logger.Printf("listing Azure DevOps organization %s's repositories", org)
+	ad.logger().Printf("listing Azure DevOps organization %s's repositories", org)
 
-	orgRepos, err := ad.describeAzureDevOpsOrgsRepos(org)
+	orgRepos, err := ad.describeAzureDevOpsOrgsRepos(ctx, org)
 	if err != nil {
-		logger.Printf("failed to get Azure DevOps organization %s repos", org)
+		ad.logger().Printf("failed to get Azure DevOps organization %s repos", org)
 
 		return describeReposOutput{}, errors.Wrapf(err, "failed to get Azure DevOps organization %s repos", org)
 	}
 
 	if len(orgRepos) == 0 {
-		logger.Printf("no repos found for organization: %s", org)
+		ad.logger().Printf("no repos found for organization: %s", org)
 
 		return describeReposOutput{}, nil
 	}
@@ -183,28 +324,114 @@ func (ad *AzureDevOpsHost) describeRepos() (describeReposOutput, errors.E) {
 }
 
 type NewAzureDevOpsHostInput struct {
-	HTTPClient       *retryablehttp.Client
-	Caller           string
-	BackupDir        string
-	DiffRemoteMethod string
-	UserName         string
-	PAT              string
-	Orgs             []string
-	BackupsToRetain  int
-	LogLevel         int
+	HTTPClient            *retryablehttp.Client
+	RetryMax              int // defaults to 2, -1 disables retries
+	RetryWaitMinSeconds   int
+	RetryWaitMaxSeconds   int
+	Caller                string
+	APIURL                string
+	BackupDir             string
+	NamespacePrefix       string
+	BundleRefSpec         string
+	BundleNameTemplate    string
+	FlatLayout            bool
+	FlatLayoutSeparator   string
+	DateDirLayout         bool
+	RefSpec               []string
+	Include               []string
+	Exclude               []string
+	RepoListFile          string
+	RepoListMode          string
+	MaxConcurrent         int
+	MaxRepos              int
+	DryRun                bool
+	FailFast              bool
+	FailOnAnyError        bool
+	PartialClone          bool
+	KeepWorkingDir        bool
+	BackupSubmodules      bool
+	VerifyAfterCreate     *bool // defaults to true
+	CompressBundles       bool
+	ArchivePerRepo        bool
+	KeepArchivedFiles     bool
+	SSHPrivateKeyPath     string
+	SSHKnownHostsPath     string
+	DiffRemoteMethod      string
+	UserName              string
+	PAT                   string
+	Orgs                  []string
+	Projects              []string // projects to back up, with all listed if empty or containing "*"
+	BackupsToRetain       int
+	KeepForDays           int
+	CloneRetries          int // defaults to 2, -1 disables retries
+	MinFreeDiskMB         int
+	LogLevel              int
+	Logger                Logger
+	Progress              func(done, total int, repo string)
+	RemoteStore           RemoteStore
+	RepoBackupTimeout     time.Duration
+	LockTimeout           time.Duration
+	GitBinaryPath         string
+	ExtraGitConfig        []string
+	NotifyWebhookURL      string
+	ProxyURL              string
+	CACertPath            string
+	InsecureSkipTLSVerify bool
 }
 
 type AzureDevOpsHost struct {
-	Caller           string
-	HttpClient       *retryablehttp.Client
-	Provider         string
-	PAT              string
-	Orgs             []string
-	UserName         string
-	DiffRemoteMethod string
-	BackupDir        string
-	BackupsToRetain  int
-	LogLevel         int
+	Caller                string
+	HttpClient            *retryablehttp.Client
+	Provider              string
+	APIURL                string
+	PAT                   string
+	Orgs                  []string
+	Projects              []string
+	UserName              string
+	DiffRemoteMethod      string
+	BackupDir             string
+	NamespacePrefix       string
+	BundleRefSpec         string
+	RefSpec               []string
+	refSpecPatterns       []*regexp.Regexp
+	BundleNameTemplate    string
+	FlatLayout            bool
+	FlatLayoutSeparator   string
+	DateDirLayout         bool
+	Include               []string
+	Exclude               []string
+	RepoList              []string
+	RepoListMode          string
+	MaxConcurrent         int
+	MaxRepos              int
+	DryRun                bool
+	FailFast              bool
+	FailOnAnyError        bool
+	PartialClone          bool
+	KeepWorkingDir        bool
+	BackupSubmodules      bool
+	VerifyAfterCreate     bool
+	CompressBundles       bool
+	ArchivePerRepo        bool
+	KeepArchivedFiles     bool
+	SSHPrivateKeyPath     string
+	SSHKnownHostsPath     string
+	BackupsToRetain       int
+	KeepForDays           int
+	CloneRetries          int
+	MinFreeDiskMB         int
+	LogLevel              int
+	Logger                Logger
+	Progress              func(done, total int, repo string)
+	RemoteStore           RemoteStore
+	RepoBackupTimeout     time.Duration
+	LockTimeout           time.Duration
+	GitBinaryPath         string
+	ExtraGitConfig        []string
+	NotifyWebhookURL      string
+	ProxyURL              string
+	CACertPath            string
+	InsecureSkipTLSVerify bool
 }
 
 func AddBasicAuthToURL(originalURL, username, password string) (string, error) {
@@ -218,43 +445,36 @@ func AddBasicAuthToURL(originalURL, username, password string) (string, error) {
 	return parsedURL.String(), nil
 }
 
-func (ad *AzureDevOpsHost) describeAzureDevOpsOrgsRepos(org string) ([]repository, errors.E) {
+func (ad *AzureDevOpsHost) describeAzureDevOpsOrgsRepos(ctx context.Context, org string) ([]repository, errors.E) {
 	if org == "" {
 		return nil, errors.New("organization not specified")
 	}
 
-	organizationUrl := fmt.Sprintf("https://%s/%s", azureDevOpsDomain, org)
-
 	basicAuth := generateBasicAuth(ad.UserName, ad.PAT)
 
-	connection := azuredevops.NewPatConnection(organizationUrl, ad.PAT)
+	projects := ad.Projects
 
-	ctx := context.Background()
+	if len(projects) == 0 || slices.Contains(projects, azureDevOpsAllProjects) {
+		var pErr errors.E
 
-	coreClient, err := azdevopscore.NewClient(ctx, connection)
-	if err != nil {
-		return nil, errors.Errorf("failed to create Azure DevOps core client: %s", err)
-	}
-
-	projects, err := listProjects(ctx, coreClient)
-	if err != nil {
-		return nil, errors.Errorf("failed to list projects: %s", err)
+		projects, pErr = ad.getAllProjects(ctx, org)
+		if pErr != nil {
+			return nil, errors.Wrap(pErr, "failed to list projects")
+		}
 	}
 
 	var allRepos []AzureDevOpsRepo
 
 	for _, project := range projects {
-		logger.Printf("listing Azure DevOps organization %s's project %s repositories", org, *project.Name)
-
-		var projectRepos []AzureDevOpsRepo
+		ad.logger().Printf("listing Azure DevOps organization %s's project %s repositories", org, project)
 
-		projectRepos, err = ListAllRepositories(ad.HttpClient, basicAuth, *project.Name, org)
+		projectRepos, err := listRepositories(ctx, ad.HttpClient, ad.apiURL(), basicAuth, project, org)
 		if err != nil {
-			return nil, errors.Errorf("failed to list repositories for organization: %s project: %s - %s", org, *project.Name, err)
+			return nil, errors.Errorf("failed to list repositories for organization: %s project: %s - %s", org, project, err)
 		}
 
 		if len(projectRepos) == 0 || projectRepos[0].Name == "" {
-			log.Printf("No repositories found for project: %v", *project.Name)
+			log.Printf("No repositories found for project: %v", project)
 
 			continue
 		}
@@ -265,9 +485,7 @@ func (ad *AzureDevOpsHost) describeAzureDevOpsOrgsRepos(org string) ([]repositor
 	var gRepos []repository
 
 	for _, repo := range allRepos {
-		var cloneURL string
-
-		cloneURL, err = AddBasicAuthToURL(repo.WebUrl, ad.UserName, ad.PAT)
+		cloneURL, err := AddBasicAuthToURL(repo.WebUrl, ad.UserName, ad.PAT)
 		if err != nil {
 			return nil, errors.Errorf("failed to add basic auth to URL: %s - %s", repo.WebUrl, err)
 		}
@@ -278,11 +496,38 @@ func (ad *AzureDevOpsHost) describeAzureDevOpsOrgsRepos(org string) ([]repositor
 			PathWithNameSpace: org + "/" + repo.Project.Name + "/" + repo.Name,
 			Domain:            azureDevOpsDomain,
 			HTTPSUrl:          repo.RemoteUrl,
+			SSHUrl:            repo.SshUrl,
 			URLWithToken:      cloneURL,
 		})
 	}
 
-	return gRepos, nil
+	// a project may be specified more than once
+	return removeDuplicates(gRepos), nil
+}
+
+// getAllProjects returns the names of every project in the organization that the user has access to.
+func (ad *AzureDevOpsHost) getAllProjects(ctx context.Context, org string) ([]string, errors.E) {
+	connection := azuredevops.NewPatConnection(fmt.Sprintf("%s/%s", ad.apiURL(), url.PathEscape(org)), ad.PAT)
+
+	coreClient, err := azdevopscore.NewClient(ctx, connection)
+	if err != nil {
+		return nil, errors.Errorf("failed to create Azure DevOps core client: %s", err)
+	}
+
+	projects, err := listProjects(ctx, coreClient)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to get projects")
+	}
+
+	names := make([]string, 0, len(projects))
+
+	for _, project := range projects {
+		if project.Name != nil {
+			names = append(names, *project.Name)
+		}
+	}
+
+	return names, nil
 }
 
 func listProjects(ctx context.Context, cClient azdevopscore.Client) ([]azdevopscore.TeamProjectReference, error) {
@@ -314,6 +559,19 @@ func listProjects(ctx context.Context, cClient azdevopscore.Client) ([]azdevopsc
 	return projects, nil
 }
 
+func (ad *AzureDevOpsHost) getAPIURL() string {
+	return ad.apiURL()
+}
+
+// apiURL returns the URL of the Azure DevOps API, without a trailing slash.
+func (ad *AzureDevOpsHost) apiURL() string {
+	if ad.APIURL == "" {
+		return azureDevOpsAPIURL
+	}
+
+	return strings.TrimSuffix(ad.APIURL, "/")
+}
+
 type AzureDevOpsRepo struct {
 	Id            string  `json:"id"`
 	Url           string  `json:"url"`
@@ -346,8 +604,12 @@ func generateBasicAuth(userName string, pat string) string {
 }
 
 func ListAllRepositories(httpClient *retryablehttp.Client, basicAuth, projectName, orgName string) ([]AzureDevOpsRepo, error) {
-	req, err := retryablehttp.NewRequest(http.MethodGet,
-		fmt.Sprintf("https://%s/%s/%s/_apis/git/repositories", azureDevOpsDomain, orgName, projectName), nil)
+	return listRepositories(context.Background(), httpClient, azureDevOpsAPIURL, basicAuth, projectName, orgName)
+}
+
+func listRepositories(ctx context.Context, httpClient *retryablehttp.Client, apiURL, basicAuth, projectName, orgName string) ([]AzureDevOpsRepo, error) {
+	req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodGet,
+		fmt.Sprintf("%s/%s/%s/_apis/git/repositories", apiURL, url.PathEscape(orgName), url.PathEscape(projectName)), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -371,6 +633,10 @@ func ListAllRepositories(httpClient *retryablehttp.Client, basicAuth, projectNam
 		return nil, fmt.Errorf("failed to read response body: %w", err)
 	}
 
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to list repositories due to unexpected response: %d (%s)", resp.StatusCode, resp.Status)
+	}
+
 	r := &repoListBody{}
 
 	if err = json.Unmarshal(body, r); err != nil {
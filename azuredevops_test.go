@@ -1,12 +1,19 @@
 package githosts
 
 import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strings"
+	"sync/atomic"
 	"testing"
 
+	"github.com/hashicorp/go-retryablehttp"
+	"github.com/microsoft/azure-devops-go-api/azuredevops/v7"
 	"github.com/stretchr/testify/require"
 )
 
@@ -76,11 +83,157 @@ func TestDescribeAzureDevOpsOrgsReposWithInvalidOrg(t *testing.T) {
 		BackupDir:        t.TempDir(),
 	}
 
-	_, err := azureDevOpsHost.describeAzureDevOpsOrgsRepos("")
+	_, err := azureDevOpsHost.describeAzureDevOpsOrgsRepos(context.Background(), "")
 
 	require.Error(t, err)
 }
 
+// azureDevOpsTestLocations are the resource locations the test server reports to the Azure DevOps
+// SDK: the resource areas, which are empty as for servers on premises, and the projects.
+var azureDevOpsTestLocations = []map[string]any{
+	{
+		"id":              "e81700f7-3be2-46de-8624-2eb35882fcaa",
+		"area":            "Location",
+		"resourceName":    "ResourceAreas",
+		"routeTemplate":   "_apis/{resource}/{areaId}",
+		"resourceVersion": 1,
+		"minVersion":      "3.2",
+		"maxVersion":      "7.1",
+		"releasedVersion": "0.0",
+	},
+	{
+		"id":              "603fe2ac-9723-48b9-88ad-09305aa6c6e1",
+		"area":            "core",
+		"resourceName":    "projects",
+		"routeTemplate":   "_apis/{resource}/{*projectId}",
+		"resourceVersion": 4,
+		"minVersion":      "1.0",
+		"maxVersion":      "7.1",
+		"releasedVersion": "7.1",
+	},
+}
+
+// newAzureDevOpsTestServer serves the projects of an organization, split across two pages, and
+// their repositories.
+func newAzureDevOpsTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	var srv *httptest.Server
+
+	repo := func(project, name string) AzureDevOpsRepo {
+		return AzureDevOpsRepo{
+			Name:      name,
+			Project:   Project{Name: project},
+			RemoteUrl: srv.URL + "/testorg/" + project + "/_git/" + name,
+			WebUrl:    srv.URL + "/testorg/" + project + "/_git/" + name,
+		}
+	}
+
+	collection := func(value any) map[string]any {
+		return map[string]any{"value": value}
+	}
+
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the SDK authenticates with the PAT alone
+		user, pass, ok := r.BasicAuth()
+		if !ok || (user != "testuser" && user != "") || pass != "testpat" {
+			w.WriteHeader(http.StatusUnauthorized)
+
+			return
+		}
+
+		var body any
+
+		switch {
+		case r.Method == http.MethodOptions && r.URL.Path == "/testorg/_apis":
+			body = collection(azureDevOpsTestLocations)
+		case r.URL.Path == "/testorg/_apis/ResourceAreas":
+			body = collection([]any{})
+		case r.URL.Path == "/testorg/_apis/projects":
+			if r.URL.Query().Get("continuationToken") == "" {
+				w.Header().Set(azuredevops.HeaderKeyContinuationToken, "1")
+
+				body = collection([]map[string]string{{"name": "alpha"}})
+			} else {
+				body = collection([]map[string]string{{"name": "beta project"}})
+			}
+		case r.URL.Path == "/testorg/alpha/_apis/git/repositories":
+			body = repoListBody{Value: []AzureDevOpsRepo{repo("alpha", "one"), repo("alpha", "two")}}
+		case r.URL.Path == "/testorg/beta project/_apis/git/repositories":
+			body = repoListBody{Value: []AzureDevOpsRepo{repo("beta project", "three")}}
+		default:
+			w.WriteHeader(http.StatusNotFound)
+
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(body); err != nil {
+			t.Errorf("failed to encode response: %s", err)
+		}
+	}))
+
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestDescribeAzureDevOpsOrgsReposAcrossProjects(t *testing.T) {
+	t.Parallel()
+
+	srv := newAzureDevOpsTestServer(t)
+
+	for _, projects := range [][]string{nil, {"*"}} {
+		host, err := NewAzureDevOpsHost(NewAzureDevOpsHostInput{
+			APIURL:    srv.URL + "/",
+			BackupDir: t.TempDir(),
+			UserName:  "testuser",
+			PAT:       "testpat",
+			Orgs:      []string{"testorg"},
+			Projects:  projects,
+		})
+		require.NoError(t, err)
+
+		repos, err := host.describeAzureDevOpsOrgsRepos(context.Background(), "testorg")
+		require.NoError(t, err)
+
+		var paths []string
+		for _, repo := range repos {
+			paths = append(paths, repo.PathWithNameSpace)
+		}
+
+		require.Equal(t, []string{"testorg/alpha/one", "testorg/alpha/two", "testorg/beta project/three"}, paths)
+		require.Equal(t, srv.URL+"/testorg/alpha/_git/one", repos[0].HTTPSUrl)
+	}
+}
+
+func TestDescribeAzureDevOpsOrgsReposWithProjects(t *testing.T) {
+	t.Parallel()
+
+	srv := newAzureDevOpsTestServer(t)
+
+	host, err := NewAzureDevOpsHost(NewAzureDevOpsHostInput{
+		APIURL:    srv.URL,
+		BackupDir: t.TempDir(),
+		UserName:  "testuser",
+		PAT:       "testpat",
+		Orgs:      []string{"testorg"},
+		Projects:  []string{"beta project", "beta project"},
+	})
+	require.NoError(t, err)
+
+	repos, err := host.describeAzureDevOpsOrgsRepos(context.Background(), "testorg")
+	require.NoError(t, err)
+	require.Len(t, repos, 1)
+	require.Equal(t, "testorg/beta project/three", repos[0].PathWithNameSpace)
+
+	host.PAT = "invalid"
+
+	_, err = host.describeAzureDevOpsOrgsRepos(context.Background(), "testorg")
+	require.ErrorContains(t, err, "401")
+}
+
 func TestAzureDevOpsOrgBackup(t *testing.T) {
 	if os.Getenv(envAzureDevOpsUserName) == "" {
 		t.Skip(msgSkipAzureDevOpsUserNameMissing)
@@ -88,8 +241,8 @@ func TestAzureDevOpsOrgBackup(t *testing.T) {
 
 	t.Parallel()
 
-	logger.SetOutput(&buf)
-	defer logger.SetOutput(os.Stdout)
+	buf, testLogger := newTestLogger()
+
 	resetBackups()
 
 	resetGlobals()
@@ -103,6 +256,7 @@ func TestAzureDevOpsOrgBackup(t *testing.T) {
 	backupDIR := os.Getenv(envVarGitBackupDir)
 
 	azureDevOpsHost, err := NewAzureDevOpsHost(NewAzureDevOpsHostInput{
+		Logger:           testLogger,
 		Caller:           "githosts-utils-test",
 		BackupDir:        backupDIR,
 		DiffRemoteMethod: refsMethod,
@@ -143,8 +297,6 @@ func TestAzureDevOpsOrgBackup(t *testing.T) {
 
 	var matches int
 
-	logger.SetOutput(os.Stdout)
-
 	for x := range logLines {
 		if reRepo0.MatchString(logLines[x]) {
 			matches++
@@ -161,3 +313,34 @@ func TestAzureDevOpsOrgBackup(t *testing.T) {
 
 	require.Equal(t, 3, matches)
 }
+
+func TestDescribeAzureDevOpsOrgsReposWithHTTPClient(t *testing.T) {
+	t.Parallel()
+
+	srv := newAzureDevOpsTestServer(t)
+
+	var requests atomic.Int32
+
+	client := retryablehttp.NewClient()
+	client.Logger = nil
+	client.RequestLogHook = func(_ retryablehttp.Logger, _ *http.Request, _ int) {
+		requests.Add(1)
+	}
+
+	host, err := NewAzureDevOpsHost(NewAzureDevOpsHostInput{
+		APIURL:     srv.URL,
+		BackupDir:  t.TempDir(),
+		UserName:   "testuser",
+		PAT:        "testpat",
+		Orgs:       []string{"testorg"},
+		HTTPClient: client,
+	})
+	require.NoError(t, err)
+
+	repos, err := host.describeAzureDevOpsOrgsRepos(context.Background(), "testorg")
+	require.NoError(t, err)
+	require.Len(t, repos, 3)
+
+	// the injected client made the requests
+	require.Positive(t, requests.Load())
+}
@@ -0,0 +1,72 @@
+package githosts
+
+import (
+	"context"
+	"sync"
+)
+
+// BackupAll backs up the hosts concurrently, with no more than globalMaxConcurrent repositories
+// being backed up at once across all of them, in addition to each host's own limit. A
+// globalMaxConcurrent of zero or less leaves only the hosts' limits. Results are returned in the
+// order of the hosts. If a backup directory is locked by another backup, no host is backed up and
+// each result has the error.
+func BackupAll(hosts []GitProvider, globalMaxConcurrent int) []ProviderBackupResult {
+	return BackupAllWithContext(context.Background(), hosts, globalMaxConcurrent)
+}
+
+// BackupAllWithContext is BackupAll with a context. Any repositories not yet backed up when the
+// context is cancelled are reported as failed.
+func BackupAllWithContext(ctx context.Context, hosts []GitProvider, globalMaxConcurrent int) []ProviderBackupResult {
+	results := make([]ProviderBackupResult, len(hosts))
+
+	// hosts sharing a backup directory hold its lock together
+	release, err := acquireBackupLocks(ctx, hosts)
+	if err != nil {
+		for x := range results {
+			results[x].Error = err
+		}
+
+		return results
+	}
+
+	defer release()
+
+	var cloneTokens chan struct{}
+
+	if globalMaxConcurrent > 0 {
+		cloneTokens = make(chan struct{}, globalMaxConcurrent)
+	}
+
+	var wg sync.WaitGroup
+
+	for x, host := range hosts {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			results[x] = host.backupWithCloneTokens(ctx, cloneTokens)
+		}()
+	}
+
+	wg.Wait()
+
+	return results
+}
+
+// acquireCloneToken waits for a token from cloneTokens, if specified, and returns the function
+// that releases it. If the context ends first, the repository is left to report the cancellation.
+func acquireCloneToken(ctx context.Context, cloneTokens chan struct{}) func() {
+	if cloneTokens == nil {
+		return func() {}
+	}
+
+	select {
+	case cloneTokens <- struct{}{}:
+		return func() {
+			<-cloneTokens
+		}
+	case <-ctx.Done():
+		return func() {}
+	}
+}
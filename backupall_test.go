@@ -0,0 +1,146 @@
+package githosts
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/tozd/go/errors"
+)
+
+// fakeProvider backs up its repositories concurrently, recording the number being backed up at
+// once across all fake providers sharing the counters.
+type fakeProvider struct {
+	name   string
+	repos  int
+	active *atomic.Int32
+	peak   *atomic.Int32
+}
+
+func (f *fakeProvider) getAPIURL() string {
+	return ""
+}
+
+func (f *fakeProvider) backupLock() (string, time.Duration) {
+	return "", 0
+}
+
+func (f *fakeProvider) describeRepos(_ context.Context) (describeReposOutput, errors.E) {
+	return describeReposOutput{}, nil
+}
+
+func (f *fakeProvider) Backup() ProviderBackupResult {
+	return f.BackupWithContext(context.Background())
+}
+
+func (f *fakeProvider) BackupWithContext(ctx context.Context) ProviderBackupResult {
+	return f.backupWithCloneTokens(ctx, nil)
+}
+
+func (f *fakeProvider) backupWithCloneTokens(ctx context.Context, cloneTokens chan struct{}) ProviderBackupResult {
+	results := make([]RepoBackupResults, f.repos)
+
+	var wg sync.WaitGroup
+
+	for x := range f.repos {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			release := acquireCloneToken(ctx, cloneTokens)
+			defer release()
+
+			active := f.active.Add(1)
+
+			for {
+				peak := f.peak.Load()
+				if active <= peak || f.peak.CompareAndSwap(peak, active) {
+					break
+				}
+			}
+
+			time.Sleep(20 * time.Millisecond)
+
+			f.active.Add(-1)
+
+			results[x] = RepoBackupResults{Repo: fmt.Sprintf("%s/repo%d", f.name, x), Status: statusOk}
+		}()
+	}
+
+	wg.Wait()
+
+	return ProviderBackupResult{BackupResults: results}
+}
+
+func (f *fakeProvider) diffRemoteMethod() string {
+	return cloneMethod
+}
+
+func (f *fakeProvider) Capabilities() Capabilities {
+	return Capabilities{}
+}
+
+func TestBackupAllGlobalMaxConcurrent(t *testing.T) {
+	t.Parallel()
+
+	for _, globalMaxConcurrent := range []int{1, 3} {
+		var active, peak atomic.Int32
+
+		var hosts []GitProvider
+
+		for _, name := range []string{"github", "gitlab", "gitea"} {
+			hosts = append(hosts, &fakeProvider{name: name, repos: 5, active: &active, peak: &peak})
+		}
+
+		results := BackupAll(hosts, globalMaxConcurrent)
+		require.Len(t, results, 3)
+
+		for x, name := range []string{"github", "gitlab", "gitea"} {
+			require.Len(t, results[x].BackupResults, 5)
+			require.Equal(t, name+"/repo0", results[x].BackupResults[0].Repo)
+		}
+
+		require.Positive(t, peak.Load())
+		require.LessOrEqual(t, peak.Load(), int32(globalMaxConcurrent))
+	}
+
+	// without a global limit the providers' own apply
+	var active, peak atomic.Int32
+
+	results := BackupAll([]GitProvider{&fakeProvider{name: "github", repos: 5, active: &active, peak: &peak}}, 0)
+	require.Len(t, results[0].BackupResults, 5)
+	require.Equal(t, int32(5), peak.Load())
+}
+
+func TestBackupAllHosts(t *testing.T) {
+	t.Parallel()
+
+	repoDir := setupTestRepo(t)
+
+	var hosts []GitProvider
+
+	for range 2 {
+		gh, err := NewGenericHost(NewGenericHostInput{
+			BackupDir: t.TempDir(),
+			URLs:      []string{"file://" + repoDir},
+		})
+		require.NoError(t, err)
+
+		hosts = append(hosts, gh)
+	}
+
+	results := BackupAll(hosts, 1)
+	require.Len(t, results, 2)
+
+	for _, result := range results {
+		require.NoError(t, result.Error)
+		require.Len(t, result.BackupResults, 1)
+		require.Equal(t, statusOk, result.BackupResults[0].Status)
+		require.True(t, result.BackupResults[0].Updated)
+	}
+}
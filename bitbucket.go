@@ -7,8 +7,13 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
 	"gitlab.com/tozd/go/errors"
 
@@ -21,56 +26,228 @@ const (
 	bitbucketEnvVarSecret = "BITBUCKET_SECRET"
 	bitbucketEnvVarUser   = "BITBUCKET_USER"
 	bitbucketDomain       = "bitbucket.com"
+	// bitbucketServerPageLimit is the number of repositories requested per page from Data Center
+	bitbucketServerPageLimit = 100
 )
 
 type NewBitBucketHostInput struct {
-	Caller           string
-	HTTPClient       *retryablehttp.Client
-	APIURL           string
-	DiffRemoteMethod string
-	BackupDir        string
-	User             string
-	Key              string
-	Secret           string
-	BackupsToRetain  int
-	LogLevel         int
+	Caller              string
+	HTTPClient          *retryablehttp.Client
+	RetryMax            int // defaults to 2, -1 disables retries
+	RetryWaitMinSeconds int
+	RetryWaitMaxSeconds int
+	APIURL              string
+	DiffRemoteMethod    string
+	BackupDir           string
+	NamespacePrefix     string
+	BundleRefSpec       string
+	BundleNameTemplate  string
+	FlatLayout          bool
+	FlatLayoutSeparator string
+	DateDirLayout       bool
+	RefSpec             []string
+	Include             []string
+	Exclude             []string
+	RepoListFile        string
+	RepoListMode        string
+	MaxConcurrent       int
+	MaxRepos            int
+	PageDelayMs         int
+	DryRun              bool
+	FailFast            *bool // defaults to true
+	FailOnAnyError      bool
+	PartialClone        bool
+	KeepWorkingDir      bool
+	BackupSubmodules    bool
+	VerifyAfterCreate   *bool // defaults to true
+	CompressBundles     bool
+	ArchivePerRepo      bool
+	KeepArchivedFiles   bool
+	SSHPrivateKeyPath   string
+	SSHKnownHostsPath   string
+	User                string
+	Key                 string
+	Secret              string
+	// ServerMode, when set, backs up a Bitbucket Data Center (server) instance, rather than
+	// Bitbucket Cloud, whose REST API at APIURL, e.g. https://bitbucket.example.com/rest/api/1.0,
+	// is authenticated with the user's HTTP access Token. Workspaces don't exist on Data Center,
+	// so only the Projects setting limits the repositories.
+	ServerMode bool
+	Token      string
+	// Workspaces, when set, limits the repositories to those of the workspaces, rather than all
+	// that the user is a member of, and Projects to those in the projects with the keys.
+	Workspaces            []string
+	Projects              []string
+	BackupsToRetain       int
+	KeepForDays           int
+	CloneRetries          int // defaults to 2, -1 disables retries
+	MinFreeDiskMB         int
+	LogLevel              int
+	Logger                Logger
+	Progress              func(done, total int, repo string)
+	RemoteStore           RemoteStore
+	RepoBackupTimeout     time.Duration
+	LockTimeout           time.Duration
+	GitBinaryPath         string
+	ExtraGitConfig        []string
+	NotifyWebhookURL      string
+	ProxyURL              string
+	CACertPath            string
+	InsecureSkipTLSVerify bool
+	ListCacheDir          string
+}
+
+// Validate checks the input's settings, returning an error listing each that's missing or invalid.
+func (input NewBitBucketHostInput) Validate() error {
+	return errors.Join(
+		validBitbucketCredentials(input),
+		validBackupDir(input.BackupDir),
+		validDiffRemoteMethodSetting(input.DiffRemoteMethod),
+		validNamespacePrefix(input.NamespacePrefix),
+		validBundleRefSpec(input.BundleRefSpec, input.RefSpec),
+		validBundleNameTemplate(input.BundleNameTemplate),
+		validFlatLayoutSeparator(input.FlatLayoutSeparator),
+		validRepoFilters(input.Include, input.Exclude),
+		validRepoList(input.RepoListFile, input.RepoListMode),
+		validMaxConcurrent(input.MaxConcurrent),
+		validMaxRepos(input.MaxRepos),
+		validRetryConfig(input.RetryMax, input.RetryWaitMinSeconds, input.RetryWaitMaxSeconds),
+		validCloneRetries(input.CloneRetries),
+		validMinFreeDiskMB(input.MinFreeDiskMB),
+		validPageDelay(input.PageDelayMs),
+		validSSHAuth(input.SSHPrivateKeyPath, input.SSHKnownHostsPath),
+		validRepoBackupTimeout(input.RepoBackupTimeout),
+		validLockTimeout(input.LockTimeout),
+		validExtraGitConfig(input.ExtraGitConfig),
+		validNotifyWebhookURL(input.NotifyWebhookURL),
+		validProxyURL(input.ProxyURL),
+		validTLSConfig(input.CACertPath, input.InsecureSkipTLSVerify),
+	)
+}
+
+// validBitbucketCredentials checks the settings needed to authenticate with Bitbucket Cloud's
+// OAuth consumer, or, in server mode, with Data Center's HTTP access token, are specified.
+func validBitbucketCredentials(input NewBitBucketHostInput) error {
+	if !input.ServerMode {
+		return errors.Join(
+			validRequired(input.User, "user"),
+			validRequired(input.Key, "OAuth consumer key"),
+			validRequired(input.Secret, "OAuth consumer secret"),
+		)
+	}
+
+	var workspacesErr error
+	if len(input.Workspaces) > 0 {
+		workspacesErr = errors.New("invalid workspaces: not supported by Bitbucket Data Center")
+	}
+
+	return errors.Join(
+		validRequired(input.APIURL, "Bitbucket Data Center API URL"),
+		validRequired(input.User, "user"),
+		validRequired(input.Token, "HTTP access token"),
+		workspacesErr,
+	)
 }
 
 func NewBitBucketHost(input NewBitBucketHostInput) (*BitbucketHost, error) {
-	setLoggerPrefix(input.Caller)
+	if input.Logger == nil {
+		setLoggerPrefix(input.Caller)
+	}
+
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
 
 	apiURL := bitbucketAPIURL
 	if input.APIURL != "" {
 		apiURL = input.APIURL
 	}
 
-	diffRemoteMethod, err := getDiffRemoteMethod(input.DiffRemoteMethod)
+	diffRemoteMethod, err := getDiffRemoteMethod(getLogger(input.Logger), input.DiffRemoteMethod)
 	if err != nil {
 		return nil, errors.Errorf("failed to get diff remote method: %s", err)
 	}
 
-	if diffRemoteMethod == "" {
-		logger.Print("using default diff remote method: " + defaultRemoteMethod)
-		diffRemoteMethod = defaultRemoteMethod
-	} else {
-		logger.Print("using diff remote method: " + diffRemoteMethod)
+	bundleRefSpec, err := getBundleRefSpec(input.BundleRefSpec)
+	if err != nil {
+		return nil, err
+	}
+
+	repoList, repoListMode, err := readRepoList(input.RepoListFile, input.RepoListMode)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := getTLSConfig(input.CACertPath, input.InsecureSkipTLSVerify)
+	if err != nil {
+		return nil, err
+	}
+
+	if input.InsecureSkipTLSVerify {
+		getLogger(input.Logger).Println("WARNING: TLS certificate verification is disabled")
 	}
 
 	httpClient := input.HTTPClient
 	if httpClient == nil {
-		httpClient = getHTTPClient()
+		httpClient = getHTTPClient(input.RetryMax, input.RetryWaitMinSeconds, input.RetryWaitMaxSeconds, input.ProxyURL, tlsConfig)
 	}
 
 	return &BitbucketHost{
-		HttpClient:       httpClient,
-		Provider:         BitbucketProviderName,
-		APIURL:           apiURL,
-		DiffRemoteMethod: diffRemoteMethod,
-		BackupDir:        input.BackupDir,
-		BackupsToRetain:  input.BackupsToRetain,
-		User:             input.User,
-		Key:              input.Key,
-		Secret:           input.Secret,
+		HttpClient:            httpClient,
+		Provider:              BitbucketProviderName,
+		APIURL:                apiURL,
+		DiffRemoteMethod:      diffRemoteMethod,
+		BackupDir:             input.BackupDir,
+		NamespacePrefix:       input.NamespacePrefix,
+		BundleRefSpec:         bundleRefSpec,
+		RefSpec:               input.RefSpec,
+		refSpecPatterns:       compileRefSpec(input.RefSpec),
+		BundleNameTemplate:    input.BundleNameTemplate,
+		FlatLayout:            input.FlatLayout,
+		FlatLayoutSeparator:   input.FlatLayoutSeparator,
+		DateDirLayout:         input.DateDirLayout,
+		Include:               input.Include,
+		Exclude:               input.Exclude,
+		RepoList:              repoList,
+		RepoListMode:          repoListMode,
+		MaxConcurrent:         input.MaxConcurrent,
+		MaxRepos:              input.MaxRepos,
+		PageDelayMs:           input.PageDelayMs,
+		DryRun:                input.DryRun,
+		FailFast:              input.FailFast == nil || *input.FailFast,
+		FailOnAnyError:        input.FailOnAnyError,
+		PartialClone:          input.PartialClone,
+		KeepWorkingDir:        input.KeepWorkingDir,
+		BackupSubmodules:      input.BackupSubmodules,
+		VerifyAfterCreate:     input.VerifyAfterCreate == nil || *input.VerifyAfterCreate,
+		CompressBundles:       input.CompressBundles,
+		ArchivePerRepo:        input.ArchivePerRepo,
+		KeepArchivedFiles:     input.KeepArchivedFiles,
+		SSHPrivateKeyPath:     input.SSHPrivateKeyPath,
+		SSHKnownHostsPath:     input.SSHKnownHostsPath,
+		BackupsToRetain:       input.BackupsToRetain,
+		KeepForDays:           input.KeepForDays,
+		CloneRetries:          input.CloneRetries,
+		MinFreeDiskMB:         input.MinFreeDiskMB,
+		Logger:                input.Logger,
+		Progress:              input.Progress,
+		RemoteStore:           input.RemoteStore,
+		RepoBackupTimeout:     input.RepoBackupTimeout,
+		LockTimeout:           input.LockTimeout,
+		GitBinaryPath:         input.GitBinaryPath,
+		ExtraGitConfig:        input.ExtraGitConfig,
+		NotifyWebhookURL:      input.NotifyWebhookURL,
+		ProxyURL:              input.ProxyURL,
+		CACertPath:            input.CACertPath,
+		InsecureSkipTLSVerify: input.InsecureSkipTLSVerify,
+		ListCacheDir:          input.ListCacheDir,
+		User:                  input.User,
+		Key:                   input.Key,
+		Secret:                input.Secret,
+		ServerMode:            input.ServerMode,
+		Token:                 input.Token,
+		Workspaces:            input.Workspaces,
+		Projects:              input.Projects,
 	}, nil
 }
 
@@ -129,8 +306,12 @@ type bitbucketAuthErrorResponse struct {
 	ErrorDescription string `json:"error_description"`
 }
 
-func (bb BitbucketHost) describeRepos() (describeReposOutput, errors.E) {
-	logger.Println("listing BitBucket repositories")
+func (bb BitbucketHost) describeRepos(ctx context.Context) (describeReposOutput, errors.E) {
+	bb.logger().Println("listing BitBucket repositories")
+
+	if bb.ServerMode {
+		return bb.listServerRepos(ctx, bb.Token)
+	}
 
 	var err error
 
@@ -144,61 +325,72 @@ func (bb BitbucketHost) describeRepos() (describeReposOutput, errors.E) {
 		return describeReposOutput{}, errors.Wrap(err, "failed to get bitbucket auth token")
 	}
 
-	var repos []repository
-
-	rawRequestURL := bb.APIURL + "/repositories?role=member"
-
-	ctx, cancel := context.WithTimeout(context.Background(), defaultHttpRequestTimeout)
-	defer cancel()
+	return bb.listRepos(ctx, token)
+}
 
-	for {
-		req, errNewReq := retryablehttp.NewRequestWithContext(ctx, http.MethodGet, rawRequestURL, nil)
-		if errNewReq != nil {
-			logger.Println(errNewReq)
+// listRepos returns the repositories of the workspaces, or all those the user is a member of if
+// none are specified, limited to those in the projects if specified.
+func (bb BitbucketHost) listRepos(ctx context.Context, token string) (describeReposOutput, errors.E) {
+	var repos []repository
 
-			return describeReposOutput{}, errors.Wrap(errNewReq, "failed to create new request")
+	if len(bb.Workspaces) == 0 {
+		memberRepos, err := bb.getRepos(ctx, token, bb.APIURL+"/repositories?role=member")
+		if err != nil {
+			return describeReposOutput{}, err
 		}
 
-		req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
-		req.Header.Set("Content-Type", contentTypeApplicationJSON)
-		req.Header.Set("Accept", contentTypeApplicationJSON)
+		repos = memberRepos
+	}
 
-		var resp *http.Response
+	for _, workspace := range bb.Workspaces {
+		bb.logger().Printf("listing repositories of workspace %s", workspace)
 
-		resp, err = bb.HttpClient.Do(req)
+		workspaceRepos, err := bb.getRepos(ctx, token, bb.APIURL+"/repositories/"+url.PathEscape(workspace))
 		if err != nil {
-			logger.Println(err)
-
-			return describeReposOutput{}, errors.Wrap(err, "failed to make request")
+			return describeReposOutput{}, err
 		}
 
-		var bodyB []byte
+		repos = append(repos, workspaceRepos...)
+	}
 
-		bodyB, err = io.ReadAll(resp.Body)
-		if err != nil {
-			return describeReposOutput{}, errors.Errorf("failed to read response body: %s", err)
-		}
+	return describeReposOutput{
+		Repos: repos,
+	}, nil
+}
 
-		bodyStr := string(bytes.ReplaceAll(bodyB, []byte("\r"), []byte("\r\n")))
+// getRepos returns the git repositories listed from the request URL, following each page.
+func (bb BitbucketHost) getRepos(ctx context.Context, token, rawRequestURL string) ([]repository, errors.E) {
+	var repos []repository
 
-		_ = resp.Body.Close()
+	for {
+		bodyB, err := bb.getReposPage(ctx, token, rawRequestURL)
+		if err != nil {
+			return nil, err
+		}
 
 		var respObj bitbucketGetProjectsResponse
-		if err = json.Unmarshal([]byte(bodyStr), &respObj); err != nil {
-			logger.Println(err)
+		if err := json.Unmarshal(bodyB, &respObj); err != nil {
+			bb.logger().Println(err)
 
-			return describeReposOutput{}, errors.Wrap(err, "failed to unmarshall bitbucket json response")
+			return nil, errors.Wrap(err, "failed to unmarshall bitbucket json response")
 		}
 
 		for _, r := range respObj.Values {
-			if r.Scm == "git" {
+			if r.Scm == "git" && bb.inProjects(r.Project.Key) {
 				repo := repository{
 					Name:              r.Name,
 					HTTPSUrl:          "https://bitbucket.org/" + r.FullName + ".git",
+					Owner:             ownerFromPath(r.FullName),
 					PathWithNameSpace: r.FullName,
 					Domain:            bitbucketDomain,
 				}
 
+				for _, clone := range r.Links.Clone {
+					if clone.Name == "ssh" {
+						repo.SSHUrl = clone.Href
+					}
+				}
+
 				repos = append(repos, repo)
 			}
 		}
@@ -206,113 +398,372 @@ func (bb BitbucketHost) describeRepos() (describeReposOutput, errors.E) {
 		if respObj.Next != "" {
 			rawRequestURL = respObj.Next
 
+			if sErr := sleepWithContext(ctx, time.Duration(bb.PageDelayMs)*time.Millisecond); sErr != nil {
+				return nil, sErr
+			}
+
 			continue
 		}
 
 		break
 	}
 
-	return describeReposOutput{
-		Repos: repos,
-	}, nil
+	return repos, nil
 }
 
-func (bb BitbucketHost) getAPIURL() string {
-	return bb.APIURL
+// getReposPage returns the body of the page of repositories at the request URL.
+func (bb BitbucketHost) getReposPage(ctx context.Context, token, rawRequestURL string) ([]byte, errors.E) {
+	// the timeout applies to each page, so the delays between them don't count towards it
+	ctx, cancel := context.WithTimeout(ctx, defaultHttpRequestTimeout)
+	defer cancel()
+
+	req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodGet, rawRequestURL, nil)
+	if err != nil {
+		bb.logger().Println(err)
+
+		return nil, errors.Wrap(err, "failed to create new request")
+	}
+
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+	req.Header.Set("Content-Type", contentTypeApplicationJSON)
+	req.Header.Set("Accept", contentTypeApplicationJSON)
+	setListCacheHeaders(bb.ListCacheDir, rawRequestURL, req)
+
+	resp, err := bb.HttpClient.Do(req)
+	if err != nil {
+		bb.logger().Println(err)
+
+		return nil, errors.Wrap(err, "failed to make request")
+	}
+
+	bodyB, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, errors.Errorf("failed to read response body: %s", err)
+	}
+
+	_ = resp.Body.Close()
+
+	resp, bodyB = useListCache(bb.logger(), bb.ListCacheDir, rawRequestURL, resp, bodyB)
+
+	// e.g. a workspace that doesn't exist or the user can't access
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("failed to list repositories: %s", resp.Status)
+	}
+
+	return bytes.ReplaceAll(bodyB, []byte("\r"), []byte("\r\n")), nil
 }
 
-func bitBucketWorker(logLevel int, user, token, backupDIR, diffRemoteMethod string, backupsToKeep int, jobs <-chan repository, results chan<- RepoBackupResults) {
-	for repo := range jobs {
-		parts := strings.Split(repo.HTTPSUrl, "//")
-		repo.URLWithBasicAuth = parts[0] + "//" + user + ":" + token + "@" + parts[1]
-		err := processBackup(logLevel, repo, backupDIR, backupsToKeep, diffRemoteMethod)
+// listServerRepos returns the repositories of a Bitbucket Data Center instance in the projects, or
+// all those the user can access if none are specified.
+func (bb BitbucketHost) listServerRepos(ctx context.Context, token string) (describeReposOutput, errors.E) {
+	if len(bb.Projects) == 0 {
+		repos, err := bb.getServerRepos(ctx, token, bb.APIURL+"/repos")
+		if err != nil {
+			return describeReposOutput{}, err
+		}
 
-		backupResult := RepoBackupResults{
-			Repo: repo.PathWithNameSpace,
+		return describeReposOutput{Repos: repos}, nil
+	}
+
+	var repos []repository
+
+	for _, project := range bb.Projects {
+		bb.logger().Printf("listing repositories of project %s", project)
+
+		projectRepos, err := bb.getServerRepos(ctx, token, bb.APIURL+"/projects/"+url.PathEscape(project)+"/repos")
+		if err != nil {
+			return describeReposOutput{}, err
 		}
 
-		status := statusOk
+		repos = append(repos, projectRepos...)
+	}
+
+	return describeReposOutput{Repos: repos}, nil
+}
+
+// getServerRepos returns the git repositories listed from the Data Center request URL, following
+// each page from the start of the next until the last.
+func (bb BitbucketHost) getServerRepos(ctx context.Context, token, rawRequestURL string) ([]repository, errors.E) {
+	requestURL, pErr := url.Parse(rawRequestURL)
+	if pErr != nil {
+		return nil, errors.Errorf("failed to parse request URL: %s", pErr)
+	}
+
+	domain := extractDomainFromAPIUrl(bb.logger(), bb.APIURL)
+
+	var repos []repository
+
+	start := 0
+
+	for {
+		query := requestURL.Query()
+		query.Set("start", strconv.Itoa(start))
+		query.Set("limit", strconv.Itoa(bitbucketServerPageLimit))
+		requestURL.RawQuery = query.Encode()
+
+		bodyB, err := bb.getReposPage(ctx, token, requestURL.String())
 		if err != nil {
-			status = statusFailed
-			backupResult.Error = err
+			return nil, err
 		}
 
-		backupResult.Status = status
+		var respObj bitbucketServerReposResponse
+		if err := json.Unmarshal(bodyB, &respObj); err != nil {
+			bb.logger().Println(err)
+
+			return nil, errors.Wrap(err, "failed to unmarshall bitbucket json response")
+		}
+
+		for _, r := range respObj.Values {
+			if r.ScmID != "git" || !bb.inProjects(r.Project.Key) {
+				continue
+			}
+
+			repo := repository{
+				Name:              r.Name,
+				Owner:             r.Project.Key,
+				PathWithNameSpace: r.Project.Key + "/" + r.Slug,
+				Domain:            domain,
+			}
+
+			for _, clone := range r.Links.Clone {
+				switch clone.Name {
+				case "http":
+					// the link includes the user's name, with the token added when cloning
+					repo.HTTPSUrl = redactURLCredentials(clone.Href)
+				case "ssh":
+					repo.SSHUrl = clone.Href
+				}
+			}
+
+			repos = append(repos, repo)
+		}
+
+		// an empty page is also the last, so a server that never reports one can't loop forever
+		if respObj.IsLastPage || len(respObj.Values) == 0 {
+			break
+		}
+
+		start = respObj.NextPageStart
+
+		if sErr := sleepWithContext(ctx, time.Duration(bb.PageDelayMs)*time.Millisecond); sErr != nil {
+			return nil, sErr
+		}
+	}
+
+	return repos, nil
+}
+
+// inProjects returns whether a repository in the project with the key should be backed up.
+func (bb BitbucketHost) inProjects(key string) bool {
+	if len(bb.Projects) == 0 {
+		return true
+	}
+
+	return slices.ContainsFunc(bb.Projects, func(project string) bool {
+		return strings.EqualFold(project, key)
+	})
+}
+
+func (bb BitbucketHost) getAPIURL() string {
+	return bb.APIURL
+}
 
-		results <- backupResult
+// backupInput returns the settings each of the host's repositories is backed up with.
+func (bb BitbucketHost) backupInput() processBackupInput {
+	return processBackupInput{
+		LogLevel:            bb.LogLevel,
+		Logger:              bb.logger(),
+		RemoteStore:         bb.RemoteStore,
+		StoreKeyPrefix:      bb.NamespacePrefix,
+		RepoBackupTimeout:   bb.RepoBackupTimeout,
+		Git:                 gitOptions{BinaryPath: bb.GitBinaryPath, ExtraConfig: bb.ExtraGitConfig, ProxyURL: bb.ProxyURL, CACertPath: bb.CACertPath, InsecureSkipTLSVerify: bb.InsecureSkipTLSVerify},
+		BackupDIR:           backupRoot(bb.BackupDir, bb.NamespacePrefix),
+		BackupsToKeep:       bb.BackupsToRetain,
+		KeepForDays:         bb.KeepForDays,
+		CloneRetries:        bb.CloneRetries,
+		MinFreeDiskMB:       bb.MinFreeDiskMB,
+		DiffRemoteMethod:    bb.diffRemoteMethod(),
+		BundleRefSpec:       bb.BundleRefSpec,
+		RefSpec:             bb.refSpecPatterns,
+		BundleNameTemplate:  bb.BundleNameTemplate,
+		FlatLayout:          bb.FlatLayout,
+		FlatLayoutSeparator: bb.FlatLayoutSeparator,
+		DateDir:             backupDateDir(bb.DateDirLayout),
+		DryRun:              bb.DryRun,
+		PartialClone:        bb.PartialClone,
+		KeepWorkingDir:      bb.KeepWorkingDir,
+		SkipVerify:          !bb.VerifyAfterCreate,
+		CompressBundles:     bb.CompressBundles,
+		ArchivePerRepo:      bb.ArchivePerRepo,
+		KeepArchivedFiles:   bb.KeepArchivedFiles,
+		SSHPrivateKeyPath:   bb.SSHPrivateKeyPath,
+		SSHKnownHostsPath:   bb.SSHKnownHostsPath,
 	}
 }
 
 func (bb BitbucketHost) Backup() ProviderBackupResult {
+	return bb.BackupWithContext(context.Background())
+}
+
+// BackupWithContext backs up the host's repositories. Any not yet backed up when the context is
+// cancelled are reported as failed.
+func (bb BitbucketHost) BackupWithContext(ctx context.Context) ProviderBackupResult {
+	release, err := acquireBackupLocks(ctx, []GitProvider{bb})
+	if err != nil {
+		return ProviderBackupResult{Error: err}
+	}
+
+	defer release()
+
+	return bb.backupWithCloneTokens(ctx, nil)
+}
+
+// backupLock returns the directory locked while the host is backed up, and how long to wait for it.
+func (bb BitbucketHost) backupLock() (string, time.Duration) {
+	return bb.BackupDir, bb.LockTimeout
+}
+
+// backupWithCloneTokens backs up the host's repositories, each holding a token from cloneTokens, if
+// specified, while being backed up.
+func (bb BitbucketHost) backupWithCloneTokens(ctx context.Context, cloneTokens chan struct{}) ProviderBackupResult {
+	in := bb.backupInput()
+
+	result := bb.backup(ctx, in, cloneTokens)
+
+	updateBackupIndexes(bb.logger(), in, result.BackupResults)
+
+	notifyWebhook(ctx, bb.logger(), bb.HttpClient, bb.NotifyWebhookURL, BitbucketProviderName, result)
+
+	return result
+}
+
+func (bb BitbucketHost) backup(ctx context.Context, in processBackupInput, cloneTokens chan struct{}) ProviderBackupResult {
 	if bb.BackupDir == "" {
-		logger.Printf("backup skipped as backup directory not specified")
+		bb.logger().Printf("backup skipped as backup directory not specified")
 
 		return ProviderBackupResult{}
 	}
 
-	maxConcurrent := 5
-
 	var err error
 
-	var token string
+	// Data Center's access token is used as is, rather than exchanged for one
+	token := bb.Token
 
-	token, err = bb.auth(bb.Key, bb.Secret)
-	if err != nil {
-		return ProviderBackupResult{
-			Error: errors.Errorf("failed to get bitbucket auth token: %s", err),
+	if !bb.ServerMode {
+		token, err = bb.auth(bb.Key, bb.Secret)
+		if err != nil {
+			return ProviderBackupResult{
+				Error: errors.Errorf("failed to get bitbucket auth token: %s", err),
+			}
 		}
 	}
 
-	drO, err := bb.describeRepos()
+	drO, err := bb.describeRepos(ctx)
 	if err != nil {
 		return ProviderBackupResult{}
 	}
 
-	jobs := make(chan repository, len(drO.Repos))
-
-	results := make(chan RepoBackupResults, maxConcurrent)
+	drO.Repos = filterRepos(bb.logger(), drO.Repos, bb.Include, bb.Exclude)
+	drO.Repos = filterRepoList(bb.logger(), drO.Repos, bb.RepoList, bb.RepoListMode)
 
-	for w := 1; w <= maxConcurrent; w++ {
-		go bitBucketWorker(bb.LogLevel, bb.User, token, bb.BackupDir, bb.diffRemoteMethod(), bb.BackupsToRetain, jobs, results)
+	if mErr := checkMaxRepos(bb.logger(), BitbucketProviderName, len(drO.Repos), bb.MaxRepos); mErr != nil {
+		return ProviderBackupResult{Error: mErr}
 	}
 
-	for x := range drO.Repos {
-		repo := drO.Repos[x]
-		jobs <- repo
+	setupRepo := func(repo repository) repository {
+		return bb.withBasicAuth(repo, token)
 	}
 
-	close(jobs)
-
-	var providerBackupResults ProviderBackupResult
+	return runBackups(ctx, BitbucketProviderName, in, setupRepo, drO.Repos, cloneTokens, backupRunOptions{
+		MaxConcurrent:    getMaxConcurrent(bb.MaxConcurrent, defaultMaxConcurrentBitbucket),
+		FailFast:         bb.FailFast,
+		FailOnAnyError:   bb.FailOnAnyError,
+		BackupSubmodules: bb.BackupSubmodules,
+		Progress:         bb.Progress,
+	})
+}
 
-	for a := 1; a <= len(drO.Repos); a++ {
-		res := <-results
-		if res.Error != nil {
-			logger.Printf("backup failed: %+v\n", res.Error)
+// withBasicAuth returns the repository with the URL it's cloned with over HTTPS, including the
+// user's name and token. Data Center repositories without an HTTP clone link, e.g. as the server
+// only permits cloning over SSH, are left to be cloned with their SSH URL.
+func (bb BitbucketHost) withBasicAuth(repo repository, token string) repository {
+	if repo.HTTPSUrl == "" {
+		bb.logger().Printf("no HTTP clone URL for %s repo '%s', cloning with SSH", repo.Domain, repo.PathWithNameSpace)
 
-			providerBackupResults.Error = res.Error
+		return repo
+	}
 
-			return providerBackupResults
-		}
+	u, err := url.Parse(repo.HTTPSUrl)
+	if err != nil {
+		bb.logger().Printf("failed to parse clone URL of %s repo '%s': %s", repo.Domain, repo.PathWithNameSpace, err)
 
-		providerBackupResults.BackupResults = append(providerBackupResults.BackupResults, res)
+		return repo
 	}
 
-	return providerBackupResults
+	u.User = url.UserPassword(bb.User, token)
+	repo.URLWithBasicAuth = u.String()
+
+	return repo
 }
 
 type BitbucketHost struct {
-	Caller           string
-	HttpClient       *retryablehttp.Client
-	Provider         string
-	APIURL           string
-	DiffRemoteMethod string
-	BackupDir        string
-	BackupsToRetain  int
-	User             string
-	Key              string
-	Secret           string
-	LogLevel         int
+	Caller                string
+	HttpClient            *retryablehttp.Client
+	Provider              string
+	APIURL                string
+	DiffRemoteMethod      string
+	BackupDir             string
+	NamespacePrefix       string
+	BundleRefSpec         string
+	RefSpec               []string
+	refSpecPatterns       []*regexp.Regexp
+	BundleNameTemplate    string
+	FlatLayout            bool
+	FlatLayoutSeparator   string
+	DateDirLayout         bool
+	Include               []string
+	Exclude               []string
+	RepoList              []string
+	RepoListMode          string
+	MaxConcurrent         int
+	MaxRepos              int
+	PageDelayMs           int
+	DryRun                bool
+	FailFast              bool
+	FailOnAnyError        bool
+	PartialClone          bool
+	KeepWorkingDir        bool
+	BackupSubmodules      bool
+	VerifyAfterCreate     bool
+	CompressBundles       bool
+	ArchivePerRepo        bool
+	KeepArchivedFiles     bool
+	SSHPrivateKeyPath     string
+	SSHKnownHostsPath     string
+	BackupsToRetain       int
+	KeepForDays           int
+	CloneRetries          int
+	MinFreeDiskMB         int
+	User                  string
+	Key                   string
+	Secret                string
+	ServerMode            bool
+	Token                 string
+	Workspaces            []string
+	Projects              []string
+	LogLevel              int
+	Logger                Logger
+	Progress              func(done, total int, repo string)
+	RemoteStore           RemoteStore
+	RepoBackupTimeout     time.Duration
+	LockTimeout           time.Duration
+	GitBinaryPath         string
+	ExtraGitConfig        []string
+	NotifyWebhookURL      string
+	ProxyURL              string
+	CACertPath            string
+	InsecureSkipTLSVerify bool
+	ListCacheDir          string
 }
 
 type bitbucketOwner struct {
@@ -322,10 +773,16 @@ type bitbucketOwner struct {
 type bitbucketProject struct {
 	Scm       string `json:"scm"`
 	Owner     bitbucketOwner
-	Name      string            `json:"name"`
-	FullName  string            `json:"full_name"`
-	IsPrivate bool              `json:"is_private"`
-	Links     bitbucketRepoLink `json:"links"`
+	Name      string               `json:"name"`
+	FullName  string               `json:"full_name"`
+	IsPrivate bool                 `json:"is_private"`
+	Links     bitbucketRepoLink    `json:"links"`
+	Project   bitbucketRepoProject `json:"project"`
+}
+
+// bitbucketRepoProject is the project a repository belongs to within its workspace.
+type bitbucketRepoProject struct {
+	Key string `json:"key"`
 }
 
 type bitbucketCloneDetail struct {
@@ -337,6 +794,22 @@ type bitbucketRepoLink struct {
 	Clone []bitbucketCloneDetail `json:"clone"`
 }
 
+// bitbucketServerRepo is a repository listed by Bitbucket Data Center.
+type bitbucketServerRepo struct {
+	Slug    string               `json:"slug"`
+	Name    string               `json:"name"`
+	ScmID   string               `json:"scmId"`
+	Project bitbucketRepoProject `json:"project"`
+	Links   bitbucketRepoLink    `json:"links"`
+}
+
+// bitbucketServerReposResponse is a page of repositories listed by Bitbucket Data Center.
+type bitbucketServerReposResponse struct {
+	Values        []bitbucketServerRepo `json:"values"`
+	IsLastPage    bool                  `json:"isLastPage"`
+	NextPageStart int                   `json:"nextPageStart"`
+}
+
 type bitbucketGetProjectsResponse struct {
 	Pagelen int                `json:"pagelen"`
 	Values  []bitbucketProject `json:"values"`
@@ -345,17 +818,10 @@ type bitbucketGetProjectsResponse struct {
 
 // return normalised method.
 func (bb BitbucketHost) diffRemoteMethod() string {
-	switch strings.ToLower(bb.DiffRemoteMethod) {
-	case refsMethod:
-		return refsMethod
-	case cloneMethod:
-		return cloneMethod
-	case "":
-		return cloneMethod
-	default:
-		logger.Printf("unexpected diff remote method: %s", bb.DiffRemoteMethod)
-
-		// default to bundle as safest
-		return cloneMethod
-	}
+	return normaliseDiffRemoteMethod(bb.logger(), bb.DiffRemoteMethod)
+}
+
+// logger returns the configured logger, or the package's default if none was specified.
+func (bb BitbucketHost) logger() Logger {
+	return getLogger(bb.Logger)
 }
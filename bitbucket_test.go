@@ -1,12 +1,18 @@
 package githosts
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
@@ -15,9 +21,7 @@ func TestPublicBitbucketRepositoryRefsCompare(t *testing.T) {
 		t.Skip("Skipping Bitbucket test as BITBUCKET_KEY is missing")
 	}
 
-	// need to set output to buffer in order to test output
-	logger.SetOutput(&buf)
-	defer logger.SetOutput(os.Stdout)
+	buf, testLogger := newTestLogger()
 
 	resetBackups()
 
@@ -30,6 +34,7 @@ func TestPublicBitbucketRepositoryRefsCompare(t *testing.T) {
 	unsetEnvVars([]string{envVarGitBackupDir, bitbucketEnvVarKey, bitbucketEnvVarSecret, bitbucketEnvVarUser})
 
 	bbHost, err := NewBitBucketHost(NewBitBucketHostInput{
+		Logger:           testLogger,
 		Caller:           "TestPublicBitbucketRepositoryRefsCompare",
 		APIURL:           bitbucketAPIURL,
 		DiffRemoteMethod: refsMethod,
@@ -64,8 +69,6 @@ func TestPublicBitbucketRepositoryRefsCompare(t *testing.T) {
 
 	var matches int
 
-	logger.SetOutput(os.Stdout)
-
 	for x := range logLines {
 		if strings.TrimSpace(logLines[x]) == "" {
 			continue
@@ -88,9 +91,7 @@ func TestPublicBitbucketRepositoryCloneCompare(t *testing.T) {
 		t.Skip("Skipping Bitbucket test as BITBUCKET_KEY is missing")
 	}
 
-	// need to set output to buffer in order to test output
-	logger.SetOutput(&buf)
-	defer logger.SetOutput(os.Stdout)
+	buf, testLogger := newTestLogger()
 
 	resetBackups()
 
@@ -101,6 +102,7 @@ func TestPublicBitbucketRepositoryCloneCompare(t *testing.T) {
 	unsetEnvVars([]string{envVarGitBackupDir, bitbucketEnvVarKey, bitbucketEnvVarSecret, bitbucketEnvVarUser})
 
 	bbHost, err := NewBitBucketHost(NewBitBucketHostInput{
+		Logger:           testLogger,
 		APIURL:           bitbucketAPIURL,
 		DiffRemoteMethod: cloneMethod,
 		BackupDir:        os.Getenv(envVarGitBackupDir),
@@ -132,8 +134,6 @@ func TestPublicBitbucketRepositoryCloneCompare(t *testing.T) {
 	reRepo1 := regexp.MustCompile(`skipping.*teamsoba/teamsobarepoone`)
 	var matches int
 
-	logger.SetOutput(os.Stdout)
-
 	for x := range logLines {
 		if reRepo0.MatchString(logLines[x]) {
 			matches++
@@ -145,3 +145,268 @@ func TestPublicBitbucketRepositoryCloneCompare(t *testing.T) {
 
 	require.Equal(t, 2, matches)
 }
+
+// bitbucketTestRepos returns a page of repositories, with the full names and project keys given
+// as pairs, linking to the next page if specified.
+func bitbucketTestRepos(next string, repos ...string) string {
+	var values []string
+	for x := 0; x < len(repos); x += 2 {
+		values = append(values, `{"scm":"git","name":"`+filepath.Base(repos[x])+`","full_name":"`+repos[x]+`","project":{"key":"`+repos[x+1]+`"}}`)
+	}
+
+	return `{"values":[` + strings.Join(values, ",") + `],"next":"` + next + `"}`
+}
+
+func TestBitbucketListReposWithWorkspaces(t *testing.T) {
+	t.Parallel()
+
+	var srvURL string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer test-token", r.Header.Get("Authorization"))
+
+		switch {
+		case r.URL.Path == "/repositories" && r.URL.Query().Get("role") == "member":
+			_, _ = w.Write([]byte(bitbucketTestRepos("", "ws-one/repo-one", "ONE", "ws-two/repo-three", "TWO")))
+		case r.URL.Path == "/repositories/ws-one" && r.URL.Query().Get("page") == "":
+			_, _ = w.Write([]byte(bitbucketTestRepos(srvURL+"/repositories/ws-one?page=2", "ws-one/repo-one", "ONE")))
+		case r.URL.Path == "/repositories/ws-one":
+			_, _ = w.Write([]byte(bitbucketTestRepos("", "ws-one/repo-two", "OTHER")))
+		case r.URL.Path == "/repositories/ws-two":
+			_, _ = w.Write([]byte(bitbucketTestRepos("", "ws-two/repo-three", "TWO")))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	srvURL = srv.URL
+
+	_, testLogger := newTestLogger()
+
+	bb, err := NewBitBucketHost(NewBitBucketHostInput{
+		APIURL:     srv.URL,
+		User:       "user",
+		Key:        "key",
+		Secret:     "secret",
+		Logger:     testLogger,
+		Workspaces: []string{"ws-one"},
+	})
+	require.NoError(t, err)
+
+	paths := func() []string {
+		desc, lErr := bb.listRepos(context.Background(), "test-token")
+		require.NoError(t, lErr)
+
+		var paths []string
+		for _, repo := range desc.Repos {
+			paths = append(paths, repo.PathWithNameSpace)
+		}
+
+		return paths
+	}
+
+	require.Equal(t, []string{"ws-one/repo-one", "ws-one/repo-two"}, paths())
+
+	// only the repositories of the projects are included
+	bb.Projects = []string{"one"}
+	require.Equal(t, []string{"ws-one/repo-one"}, paths())
+
+	// without workspaces, those the user is a member of are listed
+	bb.Workspaces = nil
+	bb.Projects = nil
+	require.Equal(t, []string{"ws-one/repo-one", "ws-two/repo-three"}, paths())
+
+	bb.Workspaces = []string{"missing"}
+	_, lErr := bb.listRepos(context.Background(), "test-token")
+	require.ErrorContains(t, lErr, "404")
+}
+
+func TestBitbucketListReposWithPageDelay(t *testing.T) {
+	t.Parallel()
+
+	var srvURL string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("page") == "" {
+			_, _ = w.Write([]byte(bitbucketTestRepos(srvURL+"/repositories/ws-one?page=2", "ws-one/repo-one", "ONE")))
+
+			return
+		}
+
+		_, _ = w.Write([]byte(bitbucketTestRepos("", "ws-one/repo-two", "ONE")))
+	}))
+	defer srv.Close()
+
+	srvURL = srv.URL
+
+	_, testLogger := newTestLogger()
+
+	_, err := NewBitBucketHost(NewBitBucketHostInput{APIURL: srv.URL, Logger: testLogger, PageDelayMs: -1})
+	require.ErrorContains(t, err, "invalid page delay")
+
+	bb, err := NewBitBucketHost(NewBitBucketHostInput{
+		APIURL:      srv.URL,
+		User:        "user",
+		Key:         "key",
+		Secret:      "secret",
+		Logger:      testLogger,
+		Workspaces:  []string{"ws-one"},
+		PageDelayMs: 200,
+	})
+	require.NoError(t, err)
+
+	start := time.Now()
+
+	desc, lErr := bb.listRepos(context.Background(), "test-token")
+	require.NoError(t, lErr)
+	require.Len(t, desc.Repos, 2)
+
+	// the second page is only requested after the delay
+	require.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+}
+
+// bitbucketServerTestRepos returns a Data Center page of repositories, listed as project key and
+// slug pairs, on the server with the host.
+func bitbucketServerTestRepos(host string, last bool, nextPageStart int, repos ...string) string {
+	var values []string
+
+	for i := 0; i < len(repos); i += 2 {
+		key, slug := repos[i], repos[i+1]
+		path := strings.ToLower(key) + "/" + slug
+
+		values = append(values, `{"slug":"`+slug+`","name":"`+slug+`","scmId":"git","project":{"key":"`+key+`"},`+
+			`"links":{"clone":[{"href":"https://user@`+host+`/scm/`+path+`.git","name":"http"},`+
+			`{"href":"ssh://git@`+host+`:7999/`+path+`.git","name":"ssh"}]}}`)
+	}
+
+	return `{"values":[` + strings.Join(values, ",") + `],"isLastPage":` + strconv.FormatBool(last) +
+		`,"nextPageStart":` + strconv.Itoa(nextPageStart) + `}`
+}
+
+func TestBitbucketListServerRepos(t *testing.T) {
+	t.Parallel()
+
+	var host string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "Bearer test-token", r.Header.Get("Authorization"))
+		assert.Equal(t, strconv.Itoa(bitbucketServerPageLimit), r.URL.Query().Get("limit"))
+
+		switch {
+		case r.URL.Path == "/rest/api/1.0/repos" && r.URL.Query().Get("start") == "0":
+			_, _ = w.Write([]byte(bitbucketServerTestRepos(host, false, 2, "ONE", "repo-one", "ONE", "repo-two")))
+		case r.URL.Path == "/rest/api/1.0/repos" && r.URL.Query().Get("start") == "2":
+			_, _ = w.Write([]byte(bitbucketServerTestRepos(host, true, 0, "TWO", "repo-three")))
+		case r.URL.Path == "/rest/api/1.0/projects/TWO/repos":
+			_, _ = w.Write([]byte(bitbucketServerTestRepos(host, true, 0, "TWO", "repo-three")))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	host = strings.TrimPrefix(srv.URL, "http://")
+
+	_, testLogger := newTestLogger()
+
+	_, err := NewBitBucketHost(NewBitBucketHostInput{ServerMode: true, User: "user", Workspaces: []string{"ws"}, Logger: testLogger})
+	require.ErrorContains(t, err, "Bitbucket Data Center API URL not specified")
+	require.ErrorContains(t, err, "HTTP access token not specified")
+	require.ErrorContains(t, err, "invalid workspaces")
+
+	bb, err := NewBitBucketHost(NewBitBucketHostInput{
+		APIURL:     srv.URL + "/rest/api/1.0",
+		ServerMode: true,
+		User:       "user",
+		Token:      "test-token",
+		Logger:     testLogger,
+	})
+	require.NoError(t, err)
+
+	// the repositories of every page are listed
+	desc, lErr := bb.describeRepos(context.Background())
+	require.NoError(t, lErr)
+	require.Len(t, desc.Repos, 3)
+
+	repo := desc.Repos[2]
+	require.Equal(t, "TWO/repo-three", repo.PathWithNameSpace)
+	require.Equal(t, "TWO", repo.Owner)
+	require.Equal(t, "127.0.0.1", repo.Domain)
+	require.Equal(t, "https://"+host+"/scm/two/repo-three.git", repo.HTTPSUrl)
+	require.Equal(t, "ssh://git@"+host+":7999/two/repo-three.git", repo.SSHUrl)
+
+	// only the repositories of the projects are listed
+	bb.Projects = []string{"TWO"}
+
+	desc, lErr = bb.describeRepos(context.Background())
+	require.NoError(t, lErr)
+	require.Len(t, desc.Repos, 1)
+	require.Equal(t, "TWO/repo-three", desc.Repos[0].PathWithNameSpace)
+}
+
+func TestBitbucketServerSSHOnlyRepo(t *testing.T) {
+	t.Parallel()
+
+	var host string
+
+	// the server only permits cloning over SSH, so repositories have no HTTP clone link
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/rest/api/1.0/repos" {
+			w.WriteHeader(http.StatusNotFound)
+
+			return
+		}
+
+		_, _ = w.Write([]byte(`{"values":[{"slug":"repo","name":"repo","scmId":"git","project":{"key":"ONE"},` +
+			`"links":{"clone":[{"href":"ssh://git@` + host + `:7999/one/repo.git","name":"ssh"}]}}],"isLastPage":true}`))
+	}))
+	defer srv.Close()
+
+	host = strings.TrimPrefix(srv.URL, "http://")
+
+	bb, err := NewBitBucketHost(NewBitBucketHostInput{
+		APIURL:     srv.URL + "/rest/api/1.0",
+		ServerMode: true,
+		User:       "user",
+		Token:      "test-token",
+	})
+	require.NoError(t, err)
+
+	desc, lErr := bb.describeRepos(context.Background())
+	require.NoError(t, lErr)
+	require.Len(t, desc.Repos, 1)
+	require.Empty(t, desc.Repos[0].HTTPSUrl)
+
+	// the repository is cloned with its SSH URL
+	repo := bb.withBasicAuth(desc.Repos[0], "test-token")
+	require.Empty(t, repo.URLWithBasicAuth)
+	require.Equal(t, "ssh://git@"+host+":7999/one/repo.git", getCloneURL(repo, ""))
+
+	// those with an HTTP clone link are cloned with the user's name and token
+	repo = bb.withBasicAuth(repository{HTTPSUrl: "https://" + host + "/scm/one/repo.git"}, "test-token")
+	require.Equal(t, "https://user:test-token@"+host+"/scm/one/repo.git", repo.URLWithBasicAuth)
+}
+
+func TestNewBitBucketHostFailFast(t *testing.T) {
+	t.Parallel()
+
+	input := NewBitBucketHostInput{
+		User:      "user",
+		Key:       "key",
+		Secret:    "secret",
+		BackupDir: t.TempDir(),
+	}
+
+	// backups stop at the first failure unless told to continue
+	bb, err := NewBitBucketHost(input)
+	require.NoError(t, err)
+	require.True(t, bb.FailFast)
+
+	failFast := false
+	input.FailFast = &failFast
+
+	bb, err = NewBitBucketHost(input)
+	require.NoError(t, err)
+	require.False(t, bb.FailFast)
+}
@@ -1,31 +1,53 @@
 package githosts
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha1" //nolint:gosec // git checksums packs with SHA-1
 	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"reflect"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"text/template"
 	"time"
 
 	"gitlab.com/tozd/go/errors"
 )
 
 const (
-	bundleExtension = ".bundle"
+	bundleExtension   = ".bundle"
+	manifestExtension = ".manifest"
+	// compressedBundleExtension ends the names of bundles compressed with gzip when written
+	compressedBundleExtension = bundleExtension + ".gz"
+	// checksumExtension is appended to a bundle's name for its checksum file, in sha256sum format
+	checksumExtension = ".sha256"
+	// invalidExtension is appended to bundles that git can't read so they're kept for inspection but not used
+	invalidExtension = ".invalid"
 	// invalidBundleStringCheck checks for a portion of the following in the command output
 	// to determine if valid: "does not look like a v2 or v3 bundle file".
 	invalidBundleStringCheck = "does not look like"
 	bundleTimestampChars     = 14
-	minBundleFileNameTokens  = 3
+	// defaultBundleNameTemplate names bundles <repo>.<timestamp>.bundle
+	defaultBundleNameTemplate = "{{.Repo}}.{{.Timestamp}}.bundle"
+	manifestFileMode          = 0o600
+	// packSignature starts the pack of each bundle, followed by its version and object count
+	packSignature   = "PACK"
+	packHeaderBytes = 12
 )
 
+// digitsRegex matches the numbers in file names, of which timestamps are those of 14 digits.
+var digitsRegex = regexp.MustCompile(`[0-9]+`)
+
 func getLatestBundlePath(backupPath string) (string, error) {
 	bFiles, err := getBundleFiles(backupPath)
 	if err != nil {
@@ -67,8 +89,15 @@ func getLatestBundlePath(backupPath string) (string, error) {
 	return filepath.Join(backupPath, ss[0].Key), nil
 }
 
-func getBundleRefs(bundlePath string) (gitRefs, error) {
-	bundleRefsCmd := exec.Command("git", "bundle", "list-heads", bundlePath)
+func getBundleRefs(ctx context.Context, gitOpts gitOptions, bundlePath string) (gitRefs, error) {
+	bundlePath, remove, rErr := readableBundlePath(bundlePath)
+	if rErr != nil {
+		return nil, rErr
+	}
+
+	defer remove()
+
+	bundleRefsCmd := gitCommand(ctx, gitOpts, "", "bundle", "list-heads", bundlePath)
 
 	out, bundleRefsCmdErr := bundleRefsCmd.CombinedOutput()
 	if bundleRefsCmdErr != nil {
@@ -83,7 +112,7 @@ func getBundleRefs(bundlePath string) (gitRefs, error) {
 	return refs, nil
 }
 
-func dirHasBundles(dir string) bool {
+func dirHasBundles(logger Logger, dir string) bool {
 	f, err := os.Open(dir)
 	if err != nil {
 		return false
@@ -91,22 +120,18 @@ func dirHasBundles(dir string) bool {
 
 	defer func() {
 		if err = f.Close(); err != nil {
-			logger.Print(err.Error())
+			logger.Println(err.Error())
 		}
 	}()
 
-	// TODO: why limit to 1?
-	names, err := f.Readdirnames(1)
-	if errors.Is(err, io.EOF) {
-		return false
-	}
-
+	// read all names as bundles may be accompanied by other files, such as manifests
+	names, err := f.Readdirnames(-1)
 	if err != nil {
 		logger.Printf("failed to read bundle directory contents: %s", err.Error())
 	}
 
 	for _, name := range names {
-		if strings.HasSuffix(name, bundleExtension) {
+		if isBundleFileName(name) {
 			return true
 		}
 	}
@@ -114,7 +139,7 @@ func dirHasBundles(dir string) bool {
 	return false
 }
 
-func getLatestBundleRefs(backupPath string) (gitRefs, error) {
+func getLatestBundleRefs(ctx context.Context, logger Logger, gitOpts gitOptions, backupPath string) (gitRefs, error) {
 	// if we encounter an invalid bundle, then we need to repeat until we find a valid one or run out
 	for {
 		path, err := getLatestBundlePath(backupPath)
@@ -125,15 +150,15 @@ func getLatestBundleRefs(backupPath string) (gitRefs, error) {
 		// get refs for bundle
 		var refs gitRefs
 
-		if refs, err = getBundleRefs(path); err != nil {
+		if refs, err = getBundleRefs(ctx, gitOpts, path); err != nil {
 			// failed to get refs
 			if strings.Contains(err.Error(), invalidBundleStringCheck) {
 				// rename the invalid bundle
-				logger.Printf("renaming invalid bundle to %s.invalid",
-					path)
+				logger.Printf("renaming invalid bundle to %s%s",
+					path, invalidExtension)
 
 				if err = os.Rename(path,
-					path+".invalid"); err != nil {
+					path+invalidExtension); err != nil {
 					// failed to rename, meaning a filesystem or permissions issue
 					return nil, fmt.Errorf("failed to rename invalid bundle %w", err)
 				}
@@ -148,25 +173,45 @@ func getLatestBundleRefs(backupPath string) (gitRefs, error) {
 	}
 }
 
-func createBundle(logLevel int, workingPath, backupPath string, repo repository) errors.E {
-	objectsPath := filepath.Join(workingPath, "objects")
+func createBundle(ctx context.Context, logger Logger, gitOpts gitOptions, logLevel int, workingPath, backupPath string, repo repository, bundleRefSpec string, refSpec []*regexp.Regexp, bundleNameTemplate string, verify, compress bool) errors.E {
+	refArgs := bundleRefSpecArgs(bundleRefSpec)
 
-	dirs, readErr := os.ReadDir(objectsPath)
-	if readErr != nil {
-		return errors.Errorf("failed to read objectsPath: %s: %s", objectsPath, readErr)
-	}
+	var refsIn io.Reader
 
-	emptyClone, err := isEmpty(workingPath)
-	if err != nil {
-		return errors.Errorf("failed to check if clone is empty: %s", err)
+	if len(refSpec) > 0 {
+		refs, err := getRefSpecRefs(ctx, gitOpts, workingPath, refSpec)
+		if err != nil {
+			return errors.Errorf("failed to check if clone is empty: %s", err)
+		}
+
+		if len(refs) == 0 {
+			return errors.Errorf("%s is empty", repo.PathWithNameSpace)
+		}
+
+		// the matching refs are passed by name as git bundle create fails on patterns that match
+		// nothing, and on stdin as there may be too many for the command line
+		refArgs = []string{"--stdin"}
+		refsIn = strings.NewReader(strings.Join(refs, "\n") + "\n")
+	} else {
+		emptyClone, err := isEmpty(ctx, gitOpts, workingPath, bundleRefSpec)
+		if err != nil {
+			return errors.Errorf("failed to check if clone is empty: %s", err)
+		}
+
+		if emptyClone {
+			return errors.Errorf("%s is empty", repo.PathWithNameSpace)
+		}
 	}
 
-	if len(dirs) == 2 && emptyClone {
-		return errors.Errorf("%s is empty", repo.PathWithNameSpace)
+	backupFile, err := newBundleFileName(backupPath, bundleNameTemplate, repo, time.Now())
+	if err != nil {
+		return err
 	}
 
-	backupFile := repo.Name + "." + getTimestamp() + bundleExtension
 	backupFilePath := filepath.Join(backupPath, backupFile)
+	// the bundle is written to the working clone and only moved to the backup path once complete,
+	// so a partial bundle left by an interrupted backup is never mistaken for a valid one
+	workingFilePath := filepath.Join(workingPath, backupFile)
 
 	createErr := createDirIfAbsent(backupPath)
 	if createErr != nil {
@@ -175,8 +220,9 @@ func createBundle(logLevel int, workingPath, backupPath string, repo repository)
 
 	logger.Printf("creating bundle for: %s", repo.Name)
 
-	bundleCmd := exec.Command("git", "bundle", "create", backupFilePath, "--all")
+	bundleCmd := gitCommand(ctx, gitOpts, "", append([]string{"bundle", "create", workingFilePath}, refArgs...)...)
 	bundleCmd.Dir = workingPath
+	bundleCmd.Stdin = refsIn
 
 	var bundleOut bytes.Buffer
 
@@ -193,6 +239,307 @@ func createBundle(logLevel int, workingPath, backupPath string, repo repository)
 		logger.Printf("git bundle create time for %s %s: %s", repo.Domain, repo.Name, time.Since(startBundle).String())
 	}
 
+	// an unreadable bundle is worse than none as it may replace a good one during pruning
+	if verify {
+		if verifyErr := verifyBundle(ctx, gitOpts, workingPath, workingFilePath); verifyErr != nil {
+			if rErr := os.Remove(workingFilePath); rErr != nil {
+				logger.Printf("failed to remove invalid bundle: %s: %s", workingFilePath, rErr)
+			}
+
+			return verifyErr
+		}
+	}
+
+	if compress {
+		compressedPath, cErr := compressBundle(workingFilePath)
+		if cErr != nil {
+			return cErr
+		}
+
+		workingFilePath = compressedPath
+		backupFilePath += filepath.Ext(compressedPath)
+	}
+
+	if manifestErr := createBundleManifest(ctx, gitOpts, workingPath, workingFilePath, repo.ID); manifestErr != nil {
+		return manifestErr
+	}
+
+	// the manifest is moved first as one without its bundle is ignored
+	if mErr := os.Rename(manifestPathForBundle(workingFilePath), manifestPathForBundle(backupFilePath)); mErr != nil {
+		return errors.Errorf("failed to move bundle manifest: %s", mErr)
+	}
+
+	if mErr := os.Rename(workingFilePath, backupFilePath); mErr != nil {
+		return errors.Errorf("failed to move bundle: %s", mErr)
+	}
+
+	return createBundleChecksum(backupFilePath)
+}
+
+// newBundleFileName returns the name of a new bundle of the repository in backupPath. Timestamps
+// have a resolution of a second, so if a bundle, or archive of one, from a backup within the same
+// second exists the next free second is used rather than overwriting it.
+func newBundleFileName(backupPath, bundleNameTemplate string, repo repository, created time.Time) (string, errors.E) {
+	for {
+		name, err := bundleFileName(bundleNameTemplate, repo.Owner, repo.Name, created)
+		if err != nil {
+			return "", err
+		}
+
+		manifestPath := manifestPathForBundle(filepath.Join(backupPath, name))
+
+		_, bundleErr := os.Stat(filepath.Join(backupPath, name))
+		_, manifestErr := os.Stat(manifestPath)
+		_, archiveErr := os.Stat(strings.TrimSuffix(manifestPath, manifestExtension) + archiveExtension)
+
+		if bundleErr != nil && manifestErr != nil && archiveErr != nil {
+			return name, nil
+		}
+
+		created = created.Add(time.Second)
+	}
+}
+
+// bundleNameData is the data bundle name templates are executed with.
+type bundleNameData struct {
+	Repo      string
+	Owner     string
+	Timestamp string
+}
+
+// bundleFileName returns the name of the repository's bundle created at the time specified, using
+// the template if specified and otherwise <repo>.<timestamp>.bundle.
+func bundleFileName(bundleNameTemplate, owner, repoName string, created time.Time) (string, errors.E) {
+	if bundleNameTemplate == "" {
+		bundleNameTemplate = defaultBundleNameTemplate
+	}
+
+	tmpl, err := template.New("bundle name").Option("missingkey=error").Parse(bundleNameTemplate)
+	if err != nil {
+		return "", errors.Errorf("invalid bundle name template: %s", err)
+	}
+
+	var name strings.Builder
+
+	if err = tmpl.Execute(&name, bundleNameData{Repo: repoName, Owner: owner, Timestamp: created.Format(timeStampFormat)}); err != nil {
+		return "", errors.Errorf("invalid bundle name template: %s", err)
+	}
+
+	// names must remain in the repository's backup directory
+	if strings.ContainsAny(name.String(), `/\`) {
+		return "", errors.Errorf("invalid bundle name: %s", name.String())
+	}
+
+	return name.String(), nil
+}
+
+// checksumPathForBundle returns the path of the checksum file that accompanies the bundle.
+func checksumPathForBundle(bundlePath string) string {
+	return bundlePath + checksumExtension
+}
+
+// createBundleChecksum writes the bundle's SHA-256 checksum in the format of sha256sum, so it can be
+// checked with sha256sum -c from the bundle's directory.
+func createBundleChecksum(bundlePath string) errors.E {
+	hash, err := getSHA2Hash(bundlePath)
+	if err != nil {
+		return errors.Errorf("failed to get bundle hash: %s", err)
+	}
+
+	checksum := hex.EncodeToString(hash) + "  " + filepath.Base(bundlePath) + "\n"
+
+	if err = os.WriteFile(checksumPathForBundle(bundlePath), []byte(checksum), manifestFileMode); err != nil {
+		return errors.Errorf("failed to write bundle checksum: %s", err)
+	}
+
+	return nil
+}
+
+// isBundleFileName returns whether the file is a bundle, compressed or not, excluding those renamed
+// as invalid.
+func isBundleFileName(name string) bool {
+	return strings.HasSuffix(name, bundleExtension) || strings.HasSuffix(name, compressedBundleExtension)
+}
+
+// isCompressedBundle returns whether the bundle was compressed when written.
+func isCompressedBundle(bundlePath string) bool {
+	return strings.HasSuffix(bundlePath, compressedBundleExtension)
+}
+
+// compressBundle replaces the bundle with a copy compressed with gzip, returning its path.
+func compressBundle(bundlePath string) (string, errors.E) {
+	compressedPath := bundlePath + filepath.Ext(compressedBundleExtension)
+
+	if err := copyCompressed(bundlePath, compressedPath); err != nil {
+		_ = os.Remove(compressedPath)
+
+		return "", errors.Errorf("failed to compress bundle: %s: %s", bundlePath, err)
+	}
+
+	if err := os.Remove(bundlePath); err != nil {
+		return "", errors.Errorf("failed to remove uncompressed bundle: %s", err)
+	}
+
+	return compressedPath, nil
+}
+
+func copyCompressed(srcPath, dstPath string) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+
+	defer src.Close()
+
+	dst, err := os.OpenFile(dstPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, manifestFileMode)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(dst)
+
+	if _, err = io.Copy(gz, src); err != nil {
+		_ = dst.Close()
+
+		return err
+	}
+
+	if err = gz.Close(); err != nil {
+		_ = dst.Close()
+
+		return err
+	}
+
+	return dst.Close()
+}
+
+// readableBundlePath returns the path of the bundle that git can read, which for a compressed
+// bundle is a temporary, decompressed copy, along with a function to remove the copy once done.
+func readableBundlePath(bundlePath string) (string, func(), errors.E) {
+	if !isCompressedBundle(bundlePath) {
+		return bundlePath, func() {}, nil
+	}
+
+	src, err := os.Open(bundlePath)
+	if err != nil {
+		return "", nil, errors.Wrap(err, "failed to open bundle")
+	}
+
+	defer src.Close()
+
+	gz, err := gzip.NewReader(src)
+	if err != nil {
+		return "", nil, errors.Errorf("failed to decompress bundle: %s: %s", bundlePath, err)
+	}
+
+	dst, err := os.CreateTemp("", "githosts-*"+bundleExtension)
+	if err != nil {
+		return "", nil, errors.Errorf("failed to create decompressed bundle: %s", err)
+	}
+
+	remove := func() {
+		_ = os.Remove(dst.Name())
+	}
+
+	_, err = io.Copy(dst, gz) //nolint:gosec // bundles are written by this package
+
+	if cErr := dst.Close(); err == nil {
+		err = cErr
+	}
+
+	if err != nil {
+		remove()
+
+		return "", nil, errors.Errorf("failed to decompress bundle: %s: %s", bundlePath, err)
+	}
+
+	return dst.Name(), remove, nil
+}
+
+// verifyBundle checks the bundle at bundlePath is a valid git bundle that can be restored.
+func verifyBundle(ctx context.Context, gitOpts gitOptions, repoPath, bundlePath string) errors.E {
+	readablePath, remove, err := readableBundlePath(bundlePath)
+	if err != nil {
+		return errors.Errorf("bundle verification failed: %s: %s", bundlePath, err)
+	}
+
+	defer remove()
+
+	verifyCmd := gitCommand(ctx, gitOpts, "", "bundle", "verify", readablePath)
+	verifyCmd.Dir = repoPath
+
+	if out, vErr := verifyCmd.CombinedOutput(); vErr != nil {
+		return errors.Errorf("bundle verification failed: %s: %s: %s", bundlePath, strings.TrimSpace(string(out)), vErr)
+	}
+
+	// git only checks the header, so a bundle whose pack was corrupted when written would pass
+	if err = verifyBundlePack(readablePath); err != nil {
+		return errors.Errorf("bundle verification failed: %s: %s", bundlePath, err)
+	}
+
+	return nil
+}
+
+// verifyBundlePack checks the pack following the bundle's header is complete and matches the
+// checksum git appends to it.
+func verifyBundlePack(bundlePath string) errors.E {
+	file, err := os.Open(bundlePath)
+	if err != nil {
+		return errors.Wrap(err, "failed to open bundle")
+	}
+
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return errors.Wrap(err, "failed to stat bundle")
+	}
+
+	reader := bufio.NewReader(file)
+
+	// the header ends with an empty line, and declares the hash of repositories not using SHA-1
+	var headerBytes int64
+
+	newHash := sha1.New
+
+	for {
+		line, rErr := reader.ReadString('\n')
+		if rErr != nil {
+			return errors.New("pack is missing")
+		}
+
+		headerBytes += int64(len(line))
+
+		if line == "\n" {
+			break
+		}
+
+		if strings.TrimSpace(line) == "@object-format=sha256" {
+			newHash = sha256.New
+		}
+	}
+
+	hash := newHash()
+	packBytes := info.Size() - headerBytes - int64(hash.Size())
+
+	signature, err := reader.Peek(len(packSignature))
+	if err != nil || packBytes < packHeaderBytes || string(signature) != packSignature {
+		return errors.New("pack is incomplete")
+	}
+
+	if _, err = io.CopyN(hash, reader, packBytes); err != nil {
+		return errors.Wrap(err, "failed to read pack")
+	}
+
+	checksum := make([]byte, hash.Size())
+	if _, err = io.ReadFull(reader, checksum); err != nil {
+		return errors.Wrap(err, "failed to read pack checksum")
+	}
+
+	if !bytes.Equal(hash.Sum(nil), checksum) {
+		return errors.New("pack checksum mismatch")
+	}
+
 	return nil
 }
 
@@ -205,7 +552,7 @@ func getBundleFiles(backupPath string) (bundleFiles, error) {
 	var bfs bundleFiles
 
 	for _, f := range files {
-		if !strings.HasSuffix(f.Name(), bundleExtension) {
+		if !isBundleFileName(f.Name()) {
 			continue
 		}
 
@@ -234,61 +581,140 @@ func getBundleFiles(backupPath string) (bundleFiles, error) {
 	return bfs, err
 }
 
-func pruneBackups(backupPath string, keep int) errors.E {
-	files, readErr := os.ReadDir(backupPath)
-	if readErr != nil {
-		return errors.Wrap(readErr, "backup path read failed")
+// pruneBackups keeps the newest keep generations of backups in backupPaths, the directories of a
+// repository's backups. A generation is every file sharing a timestamp, e.g. a bundle and its
+// manifest, so that older ones are removed together.
+func pruneBackups(logger Logger, backupPaths []string, keep int) errors.E {
+	generations, timestamps, err := getBackupGenerations(logger, backupPaths)
+	if err != nil {
+		return err
 	}
 
-	if len(files) > 0 {
-		logger.Printf("pruning %s to keep %d newest only", backupPath, keep)
+	if len(timestamps) > 0 {
+		logger.Printf("pruning %s to keep %d newest only", strings.Join(backupPaths, ", "), keep)
 	}
 
-	var bfs bundleFiles
+	return removeBackupGenerations(generations, timestamps[:max(len(timestamps)-keep, 0)])
+}
 
-	for _, f := range files {
-		if !strings.HasSuffix(f.Name(), bundleExtension) {
-			logger.Printf("skipping non bundle file '%s'", f.Name())
+// pruneBackupsByAge removes the generations of backups in backupPaths older than maxAge, always
+// keeping the newest so that a repository that hasn't changed is still backed up.
+func pruneBackupsByAge(logger Logger, backupPaths []string, maxAge time.Duration) errors.E {
+	generations, timestamps, err := getBackupGenerations(logger, backupPaths)
+	if err != nil {
+		return err
+	}
 
-			continue
-		}
+	if len(timestamps) == 0 {
+		return nil
+	}
 
-		var ts time.Time
+	logger.Printf("pruning %s to keep those from the last %s only", strings.Join(backupPaths, ", "), maxAge)
 
-		ts, err := timeStampFromBundleName(f.Name())
-		if err != nil {
-			return err
+	// timestamps in file names are local times without a zone, so the cutoff is compared in the same terms
+	cutoff, pErr := time.Parse(timeStampFormat, time.Now().Add(-maxAge).Format(timeStampFormat))
+	if pErr != nil {
+		return errors.Wrap(pErr, "failed to get prune cutoff")
+	}
+
+	var expired []time.Time
+
+	for _, ts := range timestamps[:len(timestamps)-1] {
+		if ts.Before(cutoff) {
+			expired = append(expired, ts)
 		}
+	}
 
-		var info os.FileInfo
+	return removeBackupGenerations(generations, expired)
+}
 
-		info, infoErr := f.Info()
-		if infoErr != nil {
-			return errors.Wrap(infoErr, "failed to get file info")
+// getBackupGenerations returns the paths of the files in backupPaths grouped by generation, along
+// with the generations' timestamps from oldest to newest.
+func getBackupGenerations(logger Logger, backupPaths []string) (map[time.Time][]string, []time.Time, errors.E) {
+	generations := map[time.Time][]string{}
+
+	for _, backupPath := range backupPaths {
+		files, readErr := os.ReadDir(backupPath)
+		if readErr != nil {
+			return nil, nil, errors.Wrap(readErr, "backup path read failed")
 		}
 
-		bfs = append(bfs, bundleFile{
-			info:    info,
-			created: ts,
-		})
+		for _, f := range files {
+			// invalid bundles are left for inspection and don't count towards those kept
+			if strings.HasSuffix(f.Name(), invalidExtension) {
+				continue
+			}
+
+			ts, ok := generationTimeStamp(f.Name())
+			if !ok {
+				logger.Printf("skipping non bundle file '%s'", f.Name())
+
+				continue
+			}
+
+			generations[ts] = append(generations[ts], filepath.Join(backupPath, f.Name()))
+		}
 	}
 
-	sort.Sort(bfs)
+	timestamps := make([]time.Time, 0, len(generations))
+	for ts := range generations {
+		timestamps = append(timestamps, ts)
+	}
 
-	firstFilesToDelete := len(bfs) - keep
+	sort.Slice(timestamps, func(i, j int) bool {
+		return timestamps[i].Before(timestamps[j])
+	})
 
-	var err errors.E
+	return generations, timestamps, nil
+}
 
-	for x, f := range files {
-		if x < firstFilesToDelete {
-			if removeErr := os.Remove(filepath.Join(backupPath, f.Name())); err != nil {
-				return errors.Wrap(removeErr, "failed to remove file")
+// removeBackupGenerations removes the files of the generations with the timestamps.
+func removeBackupGenerations(generations map[time.Time][]string, timestamps []time.Time) errors.E {
+	for _, ts := range timestamps {
+		for _, path := range generations[ts] {
+			if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+				return errors.Wrap(err, "failed to remove file")
 			}
+		}
+	}
+
+	return nil
+}
 
+// generationTimeStamp returns the timestamp of the backup generation the file belongs to, e.g.
+// repo.20200401111111.bundle or repo.20200401111111.manifest. As bundle names are configurable
+// the timestamp can be anywhere in the name, but must be followed by its extensions.
+func generationTimeStamp(name string) (time.Time, bool) {
+	matches := digitsRegex.FindAllStringIndex(name, -1)
+
+	// the last is used as the repository's name may also contain a timestamp
+	for x := len(matches) - 1; x >= 0; x-- {
+		start, end := matches[x][0], matches[x][1]
+
+		// a name needs more than a timestamp and extensions
+		if end-start != bundleTimestampChars || !strings.Contains(name[end:], ".") || strings.HasPrefix(name[:start]+name[end:], ".") {
 			continue
 		}
 
-		break
+		if ts, err := timeStampToTime(name[start:end]); err == nil {
+			return ts, true
+		}
+	}
+
+	return time.Time{}, false
+}
+
+func removeBundle(bundlePath string) errors.E {
+	if err := os.Remove(bundlePath); err != nil {
+		return errors.Wrap(err, "failed to remove file")
+	}
+
+	if err := os.Remove(manifestPathForBundle(bundlePath)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove manifest")
+	}
+
+	if err := os.Remove(checksumPathForBundle(bundlePath)); err != nil && !os.IsNotExist(err) {
+		return errors.Wrap(err, "failed to remove checksum")
 	}
 
 	return nil
@@ -314,37 +740,37 @@ func (b bundleFiles) Swap(i, j int) {
 }
 
 func timeStampFromBundleName(i string) (time.Time, errors.E) {
-	tokens := strings.Split(i, ".")
-	if len(tokens) < minBundleFileNameTokens {
-		return time.Time{}, errors.New("invalid bundle name")
-	}
-
-	sTime := tokens[len(tokens)-2]
-	if len(sTime) != bundleTimestampChars {
+	ts, ok := generationTimeStamp(i)
+	if !ok {
 		return time.Time{}, errors.Errorf("bundle '%s' has an invalid timestamp", i)
 	}
 
-	return timeStampToTime(sTime)
+	return ts, nil
 }
 
 func getTimeStampPartFromFileName(name string) (int, error) {
-	if strings.Count(name, ".") >= minBundleFileNameTokens-1 {
-		parts := strings.Split(name, ".")
-
-		strTimestamp := parts[len(parts)-2]
+	if !isBundleFileName(name) {
+		return 0, fmt.Errorf("filename '%s' does not match bundle format <name with timestamp>.bundle[.gz]", name)
+	}
 
-		return strconv.Atoi(strTimestamp)
+	ts, ok := generationTimeStamp(name)
+	if !ok {
+		return 0, fmt.Errorf("filename '%s' does not contain a bundle timestamp", name)
 	}
 
-	return 0, fmt.Errorf("filename '%s' does not match bundle format <repo-name>.<timestamp>.bundle",
-		name)
+	return strconv.Atoi(ts.Format(timeStampFormat))
 }
 
-func filesIdentical(path1, path2 string) bool {
+func filesIdentical(logger Logger, path1, path2 string) bool {
+	// use the hashes recorded in the manifests, if both bundles have one, to avoid re-hashing
+	if hash1, hash2, ok := manifestHashes(path1, path2); ok {
+		return hash1 == hash2
+	}
+
 	// check if file sizes are same
-	latestBundleSize := getFileSize(path1)
+	latestBundleSize := getFileSize(logger, path1)
 
-	previousBundleSize := getFileSize(path2)
+	previousBundleSize := getFileSize(logger, path2)
 
 	if latestBundleSize == previousBundleSize {
 		// check if hashes match
@@ -367,16 +793,32 @@ func filesIdentical(path1, path2 string) bool {
 	return false
 }
 
-func removeBundleIfDuplicate(dir string) {
+func manifestHashes(path1, path2 string) (hash1, hash2 string, ok bool) {
+	manifest1, err := readBundleManifest(manifestPathForBundle(path1))
+	if err != nil || manifest1.BundleHash == "" {
+		return "", "", false
+	}
+
+	manifest2, err := readBundleManifest(manifestPathForBundle(path2))
+	if err != nil || manifest2.BundleHash == "" {
+		return "", "", false
+	}
+
+	return manifest1.BundleHash, manifest2.BundleHash, true
+}
+
+// removeBundleIfDuplicate removes the latest bundle if it's identical to the previous one, returning
+// whether it was removed.
+func removeBundleIfDuplicate(logger Logger, dir string) bool {
 	files, err := getBundleFiles(dir)
 	if err != nil {
 		logger.Println(err)
 
-		return
+		return false
 	}
 
 	if len(files) == 1 {
-		return
+		return false
 	}
 	// get timestamps in filenames for sorting
 	fNameTimes := map[string]int{}
@@ -406,22 +848,20 @@ func removeBundleIfDuplicate(dir string) {
 	latestBundleFilePath := filepath.Join(dir, ss[0].Key)
 	previousBundleFilePath := filepath.Join(dir, ss[1].Key)
 
-	if filesIdentical(latestBundleFilePath, previousBundleFilePath) {
+	if filesIdentical(logger, latestBundleFilePath, previousBundleFilePath) {
 		logger.Printf("no change since previous bundle: %s", ss[1].Key)
 		logger.Printf("deleting duplicate bundle: %s", ss[0].Key)
 
-		if deleteFile(filepath.Join(dir, ss[0].Key)) != nil {
+		if removeBundle(filepath.Join(dir, ss[0].Key)) != nil {
 			logger.Println("failed to remove duplicate bundle")
+
+			return false
 		}
-	}
-}
 
-func deleteFile(path string) error {
-	if err := os.Remove(path); err != nil {
-		return errors.Wrap(err, "failed to remove file")
+		return true
 	}
 
-	return nil
+	return false
 }
 
 func getSHA2Hash(filePath string) ([]byte, error) {
@@ -446,7 +886,108 @@ func getSHA2Hash(filePath string) ([]byte, error) {
 	return hash.Sum(result), nil
 }
 
-func getFileSize(path string) int64 {
+// BundleManifest describes a bundle so its integrity and refs can be checked without reading it.
+type BundleManifest struct {
+	CreationTime string  `json:"creation_time"`
+	BundleHash   string  `json:"bundle_hash"`
+	BundleFile   string  `json:"bundle_file"`
+	GitRefs      gitRefs `json:"git_refs"`
+	// DefaultBranch is the branch HEAD referred to when the bundle was created, if it's in the bundle
+	DefaultBranch string `json:"default_branch,omitempty"`
+	// RepoID is the provider's ID of the repository, if known, used to detect it being renamed
+	RepoID string `json:"repo_id,omitempty"`
+}
+
+// manifestPathForBundle returns the path of the manifest that accompanies the bundle.
+func manifestPathForBundle(bundlePath string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(bundlePath, compressedBundleExtension), bundleExtension) + manifestExtension
+}
+
+// createBundleManifest writes the manifest of the bundle created from the repository at repoPath.
+func createBundleManifest(ctx context.Context, gitOpts gitOptions, repoPath, bundlePath, repoID string) errors.E {
+	hash, err := getSHA2Hash(bundlePath)
+	if err != nil {
+		return errors.Errorf("failed to get bundle hash: %s", err)
+	}
+
+	refs, err := getBundleRefs(ctx, gitOpts, bundlePath)
+	if err != nil {
+		return errors.Errorf("failed to get bundle refs: %s", err)
+	}
+
+	bundleFile := filepath.Base(bundlePath)
+
+	created, tsErr := timeStampFromBundleName(bundleFile)
+	if tsErr != nil {
+		return tsErr
+	}
+
+	manifest := BundleManifest{
+		CreationTime:  created.Format(timeStampFormat),
+		BundleHash:    hex.EncodeToString(hash),
+		BundleFile:    bundleFile,
+		GitRefs:       refs,
+		DefaultBranch: getDefaultBranch(ctx, gitOpts, repoPath, refs),
+		RepoID:        repoID,
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return errors.Errorf("failed to marshal bundle manifest: %s", err)
+	}
+
+	if err = os.WriteFile(manifestPathForBundle(bundlePath), data, manifestFileMode); err != nil {
+		return errors.Errorf("failed to write bundle manifest: %s", err)
+	}
+
+	return nil
+}
+
+// getDefaultBranch returns the branch HEAD of the repository at repoPath refers to, which for a
+// mirror clone is the provider's default branch, or an empty string if it's not in the refs.
+func getDefaultBranch(ctx context.Context, gitOpts gitOptions, repoPath string, refs gitRefs) string {
+	headCmd := gitCommand(ctx, gitOpts, "", "symbolic-ref", "--quiet", "HEAD")
+	headCmd.Dir = repoPath
+
+	out, err := headCmd.Output()
+	if err != nil {
+		return ""
+	}
+
+	ref := strings.TrimSpace(string(out))
+	if _, ok := refs[ref]; !ok {
+		return ""
+	}
+
+	return strings.TrimPrefix(ref, "refs/heads/")
+}
+
+func readBundleManifest(manifestPath string) (BundleManifest, errors.E) {
+	var manifest BundleManifest
+
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return manifest, errors.Wrap(err, "failed to read bundle manifest")
+	}
+
+	if err = json.Unmarshal(data, &manifest); err != nil {
+		return manifest, errors.Errorf("failed to unmarshal bundle manifest: %s: %s", manifestPath, err)
+	}
+
+	return manifest, nil
+}
+
+// latestBundleSize returns the size of the latest bundle in the backup path, or zero if there are none.
+func latestBundleSize(logger Logger, backupPath string) int64 {
+	bundlePath, err := getLatestBundlePath(backupPath)
+	if err != nil {
+		return 0
+	}
+
+	return getFileSize(logger, bundlePath)
+}
+
+func getFileSize(logger Logger, path string) int64 {
 	fi, err := os.Stat(path)
 	if err != nil {
 		logger.Println(err)
@@ -1,10 +1,17 @@
 package githosts
 
 import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"os"
+	"os/exec"
 	"path"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -66,3 +73,705 @@ func TestRenameInvalidBundle(t *testing.T) {
 
 	require.Equal(t, 1, renamedFound)
 }
+
+func TestVerifyBundle(t *testing.T) {
+	t.Parallel()
+
+	repoDir := setupTestRepo(t)
+	bundlePath := filepath.Join(t.TempDir(), testBundleName1)
+
+	runGitCmd(t, repoDir, "bundle", "create", bundlePath, "--all")
+	require.NoError(t, verifyBundle(context.Background(), gitOptions{}, repoDir, bundlePath))
+
+	// a truncated pack is detected although git only checks the header
+	data, err := os.ReadFile(bundlePath)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(bundlePath, data[:len(data)-20], 0o600))
+	require.ErrorContains(t, verifyBundle(context.Background(), gitOptions{}, repoDir, bundlePath), "pack checksum mismatch")
+
+	require.NoError(t, os.WriteFile(bundlePath, []byte("not a bundle"), 0o600))
+	require.Error(t, verifyBundle(context.Background(), gitOptions{}, repoDir, bundlePath))
+
+	// repositories using SHA-256 checksum their packs with it
+	sha256Dir := t.TempDir()
+	runGitCmd(t, sha256Dir, "init", "--object-format=sha256", "-b", "main")
+	require.NoError(t, os.WriteFile(filepath.Join(sha256Dir, "test.txt"), []byte("test"), 0o600))
+	runGitCmd(t, sha256Dir, "add", "test.txt")
+	runGitCmd(t, sha256Dir, "commit", "-m", "initial commit")
+	runGitCmd(t, sha256Dir, "bundle", "create", bundlePath, "--all")
+	require.NoError(t, verifyBundle(context.Background(), gitOptions{}, sha256Dir, bundlePath))
+
+	// verification stops with the repository's backup, e.g. when it times out
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	require.Error(t, verifyBundle(ctx, gitOptions{}, sha256Dir, bundlePath))
+}
+
+func TestCreateBundleWithRefSpec(t *testing.T) {
+	t.Parallel()
+
+	repoDir := setupTestRepo(t)
+	runGitCmd(t, repoDir, "tag", "v1.0.0")
+	runGitCmd(t, repoDir, "update-ref", "refs/remotes/origin/main", "HEAD")
+	runGitCmd(t, repoDir, "update-ref", "refs/pull/1/head", "HEAD")
+
+	workingPath := filepath.Join(t.TempDir(), "repo.git")
+	runGitCmd(t, repoDir, "clone", "--mirror", repoDir, workingPath)
+
+	repo := repository{Name: "repo", PathWithNameSpace: "owner/repo", Domain: "local"}
+
+	bundleRefs := func(bundleRefSpec string) gitRefs {
+		backupPath := t.TempDir()
+		require.NoError(t, createBundle(context.Background(), logger, gitOptions{}, 0, workingPath, backupPath, repo, bundleRefSpec, nil, "", true, false))
+
+		refs, err := getLatestBundleRefs(context.Background(), logger, gitOptions{}, backupPath)
+		require.NoError(t, err)
+
+		return refs
+	}
+
+	allRefs := bundleRefs(defaultBundleRefSpec)
+	require.Contains(t, allRefs, "refs/heads/main")
+	require.Contains(t, allRefs, "refs/tags/v1.0.0")
+	require.Contains(t, allRefs, "refs/remotes/origin/main")
+	require.Contains(t, allRefs, "refs/pull/1/head")
+
+	selectedRefs := bundleRefs("--branches --tags")
+	require.Len(t, selectedRefs, 2)
+	require.Contains(t, selectedRefs, "refs/heads/main")
+	require.Contains(t, selectedRefs, "refs/tags/v1.0.0")
+
+	// refs comparison must use the same selection as the bundle
+	require.Equal(t, selectedRefs, filterRefsByBundleRefSpec(allRefs, "--branches --tags"))
+	require.Equal(t, allRefs, filterRefsByBundleRefSpec(allRefs, ""))
+}
+
+func TestCreateBundlesWithinOneSecond(t *testing.T) {
+	t.Parallel()
+
+	repoDir := setupTestRepo(t)
+
+	workingPath := filepath.Join(t.TempDir(), "repo.git")
+	runGitCmd(t, repoDir, "clone", "--mirror", repoDir, workingPath)
+
+	repo := repository{Name: "repo", PathWithNameSpace: "owner/repo", Domain: "local"}
+	backupPath := t.TempDir()
+
+	for range 3 {
+		require.NoError(t, createBundle(context.Background(), logger, gitOptions{}, 0, workingPath, backupPath, repo, defaultBundleRefSpec, nil, "", true, false))
+	}
+
+	bundles, err := getBundleFiles(backupPath)
+	require.NoError(t, err)
+	require.Len(t, bundles, 3)
+
+	// each bundle keeps its own name and a timestamp that can be parsed
+	names := make(map[string]bool)
+
+	for _, bundle := range bundles {
+		names[bundle.info.Name()] = true
+
+		_, tsErr := timeStampFromBundleName(bundle.info.Name())
+		require.NoError(t, tsErr)
+		require.FileExists(t, manifestPathForBundle(filepath.Join(backupPath, bundle.info.Name())))
+	}
+
+	require.Len(t, names, 3)
+	require.True(t, bundles[0].created.Before(bundles[1].created))
+	require.True(t, bundles[1].created.Before(bundles[2].created))
+}
+
+func TestCreateBundleWithRefPatterns(t *testing.T) {
+	t.Parallel()
+
+	repoDir := setupTestRepo(t)
+	runGitCmd(t, repoDir, "branch", "release/1.0")
+	runGitCmd(t, repoDir, "branch", "release/2.0/hotfix")
+	runGitCmd(t, repoDir, "branch", "secret")
+	runGitCmd(t, repoDir, "tag", "v1.0.0")
+
+	workingPath := filepath.Join(t.TempDir(), "repo.git")
+	runGitCmd(t, repoDir, "clone", "--mirror", repoDir, workingPath)
+
+	repo := repository{Name: "repo", PathWithNameSpace: "owner/repo", Domain: "local"}
+
+	refSpec := []string{"refs/heads/main", "refs/heads/release/*", "refs/heads/missing"}
+
+	backupPath := t.TempDir()
+	require.NoError(t, createBundle(context.Background(), logger, gitOptions{}, 0, workingPath, backupPath, repo, "", compileRefSpec(refSpec), "", true, false))
+
+	refs, err := getLatestBundleRefs(context.Background(), logger, gitOptions{}, backupPath)
+	require.NoError(t, err)
+	require.Len(t, refs, 3)
+	require.Contains(t, refs, "refs/heads/main")
+	require.Contains(t, refs, "refs/heads/release/1.0")
+	require.Contains(t, refs, "refs/heads/release/2.0/hotfix")
+
+	// the manifest records only the refs included
+	bundles, err := getBundleFiles(backupPath)
+	require.NoError(t, err)
+	require.Len(t, bundles, 1)
+
+	manifest, mErr := readBundleManifest(manifestPathForBundle(filepath.Join(backupPath, bundles[0].info.Name())))
+	require.NoError(t, mErr)
+	require.Equal(t, refs, manifest.GitRefs)
+
+	// refs comparison must use the same selection as the bundle
+	allRefs, err := getLocalRefs(context.Background(), gitOptions{}, workingPath)
+	require.NoError(t, err)
+	require.Len(t, allRefs, 5)
+	require.Equal(t, refs, filterRefsByRefSpec(allRefs, compileRefSpec(refSpec)))
+
+	// a clone without any of the refs specified has nothing to back up
+	err = createBundle(context.Background(), logger, gitOptions{}, 0, workingPath, t.TempDir(), repo, "", compileRefSpec([]string{"refs/heads/missing"}), "", true, false)
+	require.ErrorContains(t, err, "owner/repo is empty")
+}
+
+func TestCompileRefSpec(t *testing.T) {
+	t.Parallel()
+
+	require.Nil(t, compileRefSpec(nil))
+
+	matches := func(pattern, ref string) bool {
+		return compileRefSpec([]string{pattern})[0].MatchString(ref)
+	}
+
+	require.True(t, matches("refs/heads/main", "refs/heads/main"))
+	require.False(t, matches("refs/heads/main", "refs/heads/main2"))
+	require.True(t, matches("refs/heads/release/*", "refs/heads/release/1.0"))
+	require.True(t, matches("refs/heads/release/*", "refs/heads/release/2.0/hotfix"))
+	require.False(t, matches("refs/heads/release/*", "refs/heads/releases"))
+	require.False(t, matches("refs/tags/v1.0", "refs/tags/v1x0"))
+}
+
+func TestCreateBundleEmptyDetection(t *testing.T) {
+	t.Parallel()
+
+	repo := repository{Name: "repo", PathWithNameSpace: "owner/repo", Domain: "local"}
+
+	mirror := func(t *testing.T, dir string) string {
+		t.Helper()
+
+		workingPath := filepath.Join(t.TempDir(), "repo.git")
+		runGitCmd(t, dir, "clone", "--mirror", dir, workingPath)
+
+		return workingPath
+	}
+
+	// a repository without any commits
+	emptyDir := t.TempDir()
+	runGitCmd(t, emptyDir, "init", "-b", "main")
+	err := createBundle(context.Background(), logger, gitOptions{}, 0, mirror(t, emptyDir), t.TempDir(), repo, "", nil, "", true, false)
+	require.ErrorContains(t, err, "is empty")
+
+	// a repository with only a tag
+	tagsOnlyDir := setupTestRepo(t)
+	runGitCmd(t, tagsOnlyDir, "tag", "v1.0.0")
+	runGitCmd(t, tagsOnlyDir, "update-ref", "-d", "refs/heads/main")
+	tagsOnlyPath := mirror(t, tagsOnlyDir)
+	require.NoError(t, createBundle(context.Background(), logger, gitOptions{}, 0, tagsOnlyPath, t.TempDir(), repo, "", nil, "", true, false))
+
+	// no refs would be bundled when only branches are selected
+	err = createBundle(context.Background(), logger, gitOptions{}, 0, tagsOnlyPath, t.TempDir(), repo, "--branches", nil, "", true, false)
+	require.ErrorContains(t, err, "is empty")
+
+	// a repository with only a non-default branch
+	branchOnlyDir := setupTestRepo(t)
+	runGitCmd(t, branchOnlyDir, "branch", "-m", "main", "feature")
+	require.NoError(t, createBundle(context.Background(), logger, gitOptions{}, 0, mirror(t, branchOnlyDir), t.TempDir(), repo, "", nil, "", true, false))
+}
+
+func TestCreateBundleManifest(t *testing.T) {
+	t.Parallel()
+
+	repoDir := setupTestRepo(t)
+	bundlePath := filepath.Join(t.TempDir(), testBundleName1)
+	runGitCmd(t, repoDir, "bundle", "create", bundlePath, "--all")
+
+	require.NoError(t, createBundleManifest(context.Background(), gitOptions{}, repoDir, bundlePath, ""))
+
+	manifestPath := manifestPathForBundle(bundlePath)
+	require.Equal(t, "repo0.20200401111111.manifest", filepath.Base(manifestPath))
+
+	manifest, err := readBundleManifest(manifestPath)
+	require.NoError(t, err)
+	require.Equal(t, testBundleName1, manifest.BundleFile)
+	require.Equal(t, "20200401111111", manifest.CreationTime)
+	require.Contains(t, manifest.GitRefs, "refs/heads/main")
+
+	hash, hErr := getSHA2Hash(bundlePath)
+	require.NoError(t, hErr)
+	require.Equal(t, fmt.Sprintf("%x", hash), manifest.BundleHash)
+}
+
+func TestBackupManifestDefaultBranch(t *testing.T) {
+	t.Parallel()
+
+	for _, defaultBranch := range []string{"main", "master"} {
+		repoDir := setupTestRepo(t)
+		runGitCmd(t, repoDir, "branch", "-m", "main", defaultBranch)
+		// another branch at the same commit mustn't be mistaken for the default
+		runGitCmd(t, repoDir, "branch", "feature")
+
+		backupDir := t.TempDir()
+
+		repo := repository{
+			Name:              "repo",
+			PathWithNameSpace: "owner/repo",
+			Domain:            "local",
+			HTTPSUrl:          "file://" + repoDir,
+		}
+
+		_, pErr := processBackup(context.Background(), processBackupInput{Repo: repo, BackupDIR: backupDir})
+		require.NoError(t, pErr)
+
+		bundlePath, err := getLatestBundlePath(filepath.Join(backupDir, "local", "owner", "repo"))
+		require.NoError(t, err)
+
+		manifest, mErr := readBundleManifest(manifestPathForBundle(bundlePath))
+		require.NoError(t, mErr)
+		require.Equal(t, defaultBranch, manifest.DefaultBranch)
+	}
+
+	// the default branch isn't recorded if it's not in the bundle
+	repoDir := setupTestRepo(t)
+	runGitCmd(t, repoDir, "branch", "feature")
+
+	bundlePath := filepath.Join(t.TempDir(), testBundleName1)
+	runGitCmd(t, repoDir, "bundle", "create", bundlePath, "refs/heads/feature")
+	require.NoError(t, createBundleManifest(context.Background(), gitOptions{}, repoDir, bundlePath, ""))
+
+	manifest, mErr := readBundleManifest(manifestPathForBundle(bundlePath))
+	require.NoError(t, mErr)
+	require.Empty(t, manifest.DefaultBranch)
+}
+
+func TestBackupCreatesManifest(t *testing.T) {
+	t.Parallel()
+
+	repoDir := setupTestRepo(t)
+	backupDir := t.TempDir()
+
+	repo := repository{
+		Name:              "repo",
+		PathWithNameSpace: "owner/repo",
+		Domain:            "local",
+		HTTPSUrl:          "file://" + repoDir,
+	}
+
+	result, pErr := processBackup(context.Background(), processBackupInput{Repo: repo, BackupDIR: backupDir})
+	require.NoError(t, pErr)
+	require.True(t, result.Updated)
+
+	backupPath := filepath.Join(backupDir, "local", "owner", "repo")
+
+	bundlePath, err := getLatestBundlePath(backupPath)
+	require.NoError(t, err)
+
+	manifest, mErr := readBundleManifest(manifestPathForBundle(bundlePath))
+	require.NoError(t, mErr)
+	require.Equal(t, filepath.Base(bundlePath), manifest.BundleFile)
+	require.NotEmpty(t, manifest.BundleHash)
+	require.Contains(t, manifest.GitRefs, "refs/heads/main")
+}
+
+func TestBackupCreatesChecksum(t *testing.T) {
+	t.Parallel()
+
+	repoDir := setupTestRepo(t)
+	backupDir := t.TempDir()
+
+	repo := repository{
+		Name:              "repo",
+		PathWithNameSpace: "owner/repo",
+		Domain:            "local",
+		HTTPSUrl:          "file://" + repoDir,
+	}
+
+	_, pErr := processBackup(context.Background(), processBackupInput{Repo: repo, BackupDIR: backupDir})
+	require.NoError(t, pErr)
+
+	backupPath := filepath.Join(backupDir, "local", "owner", "repo")
+
+	bundlePath, err := getLatestBundlePath(backupPath)
+	require.NoError(t, err)
+
+	checksumPath := checksumPathForBundle(bundlePath)
+	require.Equal(t, filepath.Base(bundlePath)+".sha256", filepath.Base(checksumPath))
+
+	hash, err := getSHA2Hash(bundlePath)
+	require.NoError(t, err)
+
+	checksum, err := os.ReadFile(checksumPath)
+	require.NoError(t, err)
+	require.Equal(t, hex.EncodeToString(hash)+"  "+filepath.Base(bundlePath)+"\n", string(checksum))
+
+	// the checksum can be checked with sha256sum
+	if _, lErr := exec.LookPath("sha256sum"); lErr == nil {
+		cmd := exec.Command("sha256sum", "-c", filepath.Base(checksumPath))
+		cmd.Dir = backupPath
+
+		out, cErr := cmd.CombinedOutput()
+		require.NoError(t, cErr, string(out))
+	}
+
+	// and is removed with the bundle
+	require.NoError(t, removeBundle(bundlePath))
+	require.NoFileExists(t, checksumPath)
+}
+
+func TestFilesIdenticalUsesManifests(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	path1 := filepath.Join(dir, "repo.20200401111111.bundle")
+	path2 := filepath.Join(dir, "repo.20200501111111.bundle")
+
+	require.NoError(t, os.WriteFile(path1, []byte("content one"), 0o600))
+	require.NoError(t, os.WriteFile(path2, []byte("content two"), 0o600))
+
+	// without manifests the contents are compared
+	require.False(t, filesIdentical(logger, path1, path2))
+
+	// with manifests the recorded hashes are compared instead of the contents
+	for _, p := range []string{path1, path2} {
+		data, err := json.Marshal(BundleManifest{BundleFile: filepath.Base(p), BundleHash: "same"})
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(manifestPathForBundle(p), data, 0o600))
+	}
+
+	require.True(t, filesIdentical(logger, path1, path2))
+
+	// a duplicate's manifest is removed along with it
+	removeBundleIfDuplicate(logger, dir)
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+
+	require.Equal(t, []string{"repo.20200401111111.bundle", "repo.20200401111111.manifest"}, names)
+}
+
+func TestPruneBackupsRemovesManifests(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	for _, ts := range []string{"20200101111111", "20200201111111", "20200301111111"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "repo."+ts+bundleExtension), nil, 0o600))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "repo."+ts+manifestExtension), nil, 0o600))
+	}
+
+	// a bundle created before manifests were introduced
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "repo.20191201111111"+bundleExtension), nil, 0o600))
+
+	require.NoError(t, pruneBackups(logger, []string{dir}, 2))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+
+	require.Equal(t, []string{
+		"repo.20200201111111.bundle",
+		"repo.20200201111111.manifest",
+		"repo.20200301111111.bundle",
+		"repo.20200301111111.manifest",
+	}, names)
+}
+
+func TestPruneBackupsRemovesWholeGenerations(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	timestamps := []string{"20200101111111", "20200201111111", "20200301111111", "20200401111111", "20200501111111"}
+	suffixes := []string{bundleExtension, manifestExtension, bundleExtension + ".age", manifestExtension + ".age", ".lfs.tar.gz"}
+
+	for _, ts := range timestamps {
+		for _, suffix := range suffixes {
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "repo.name."+ts+suffix), nil, 0o600))
+		}
+	}
+
+	// files without a timestamp aren't part of any generation
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0o600))
+
+	require.NoError(t, pruneBackups(logger, []string{dir}, 2))
+
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+
+	var names []string
+	for _, e := range entries {
+		names = append(names, e.Name())
+	}
+
+	expected := []string{"notes.txt"}
+
+	for _, ts := range timestamps[3:] {
+		for _, suffix := range suffixes {
+			expected = append(expected, "repo.name."+ts+suffix)
+		}
+	}
+
+	require.ElementsMatch(t, expected, names)
+}
+
+func TestPruneBackupsByAge(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	day := hoursPerDay * time.Hour
+
+	var timestamps []string
+	// bundles dated monthly over five months
+	for _, days := range []int{130, 100, 70, 40, 10} {
+		timestamps = append(timestamps, time.Now().Add(-time.Duration(days)*day).Format(timeStampFormat))
+	}
+
+	for _, ts := range timestamps {
+		for _, suffix := range []string{bundleExtension, manifestExtension} {
+			require.NoError(t, os.WriteFile(filepath.Join(dir, "repo."+ts+suffix), nil, 0o600))
+		}
+	}
+
+	require.NoError(t, pruneBackupsByAge(logger, []string{dir}, 90*day))
+
+	names := func() []string {
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+
+		return names
+	}
+
+	var expected []string
+	for _, ts := range timestamps[2:] {
+		expected = append(expected, "repo."+ts+bundleExtension, "repo."+ts+manifestExtension)
+	}
+
+	require.ElementsMatch(t, expected, names())
+
+	// the newest is kept even if it's too old
+	require.NoError(t, pruneBackupsByAge(logger, []string{dir}, day))
+	require.ElementsMatch(t, expected[4:], names())
+}
+
+func TestProcessBackupPrunesByCountThenAge(t *testing.T) {
+	t.Parallel()
+
+	repoDir := setupTestRepo(t)
+	backupDir := t.TempDir()
+
+	repo := repository{
+		Name:              "repo",
+		PathWithNameSpace: "owner/repo",
+		Domain:            "local",
+		HTTPSUrl:          "file://" + repoDir,
+	}
+
+	backupPath := filepath.Join(backupDir, "local", "owner", "repo")
+	require.NoError(t, os.MkdirAll(backupPath, 0o755))
+
+	day := hoursPerDay * time.Hour
+
+	for _, days := range []int{100, 60, 20} {
+		ts := time.Now().Add(-time.Duration(days) * day).Format(timeStampFormat)
+		require.NoError(t, os.WriteFile(filepath.Join(backupPath, "repo."+ts+bundleExtension), []byte(ts), 0o600))
+	}
+
+	// the two newest are kept by count, and then the older of those by age
+	_, pErr := processBackup(context.Background(), processBackupInput{
+		Repo:             repo,
+		BackupDIR:        backupDir,
+		DiffRemoteMethod: cloneMethod,
+		BackupsToKeep:    2,
+		KeepForDays:      10,
+	})
+	require.NoError(t, pErr)
+
+	files, err := getBundleFiles(backupPath)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+
+	bundlePath, err := getLatestBundlePath(backupPath)
+	require.NoError(t, err)
+	require.NoError(t, CheckRepoHealth(bundlePath))
+}
+
+func TestGenerationTimeStamp(t *testing.T) {
+	t.Parallel()
+
+	expected, err := time.Parse(timeStampFormat, "20200401111111")
+	require.NoError(t, err)
+
+	for _, name := range []string{
+		"repo.20200401111111.bundle",
+		"repo.20200401111111.manifest",
+		"repo.20200401111111.bundle.age",
+		"repo.20200401111111.lfs.tar.gz",
+		"repo.20190101000000.20200401111111.bundle",
+		"20200401111111-repo.bundle",
+		"owner_repo_20200401111111.bundle",
+	} {
+		ts, ok := generationTimeStamp(name)
+		require.True(t, ok, name)
+		require.Equal(t, expected, ts, name)
+	}
+
+	for _, name := range []string{"notes.txt", "repo.bundle", "repo.bundle.20200401111111", "20200401111111.bundle"} {
+		_, ok := generationTimeStamp(name)
+		require.False(t, ok, name)
+	}
+}
+
+func TestBundleFileName(t *testing.T) {
+	t.Parallel()
+
+	created := time.Date(2020, time.April, 1, 11, 11, 11, 0, time.UTC)
+
+	for tmpl, expected := range map[string]string{
+		"":                                "repo.20200401111111.bundle",
+		defaultBundleNameTemplate:         "repo.20200401111111.bundle",
+		"{{.Timestamp}}-{{.Repo}}.bundle": "20200401111111-repo.bundle",
+		"{{.Owner}}_{{.Repo}}_{{.Timestamp}}.bundle": "owner_repo_20200401111111.bundle",
+	} {
+		name, err := bundleFileName(tmpl, "owner", "repo", created)
+		require.NoError(t, err, tmpl)
+		require.Equal(t, expected, name, tmpl)
+
+		// the timestamp must be recoverable from the name
+		ts, tErr := timeStampFromBundleName(name)
+		require.NoError(t, tErr, tmpl)
+		require.Equal(t, created, ts, tmpl)
+
+		tsPart, pErr := getTimeStampPartFromFileName(name)
+		require.NoError(t, pErr, tmpl)
+		require.Equal(t, 20200401111111, tsPart, tmpl)
+	}
+
+	_, err := bundleFileName("{{.Owner}}/{{.Repo}}.{{.Timestamp}}.bundle", "owner", "repo", created)
+	require.ErrorContains(t, err, "invalid bundle name")
+
+	_, err = bundleFileName("{{.Missing}}.{{.Timestamp}}.bundle", "owner", "repo", created)
+	require.ErrorContains(t, err, "invalid bundle name template")
+}
+
+func TestCreateBundleWithNameTemplate(t *testing.T) {
+	t.Parallel()
+
+	repoDir := setupTestRepo(t)
+	workingPath := filepath.Join(t.TempDir(), "repo.git")
+	runGitCmd(t, repoDir, "clone", "--mirror", repoDir, workingPath)
+
+	repo := repository{Name: "repo", Owner: "owner", PathWithNameSpace: "owner/repo", Domain: "local"}
+	backupPath := t.TempDir()
+	nameTemplate := "{{.Timestamp}}-{{.Owner}}-{{.Repo}}.bundle"
+
+	for range 2 {
+		require.NoError(t, createBundle(context.Background(), logger, gitOptions{}, 0, workingPath, backupPath, repo, "", nil, nameTemplate, true, false))
+	}
+
+	bundles, err := getBundleFiles(backupPath)
+	require.NoError(t, err)
+	require.Len(t, bundles, 2)
+
+	for _, bundle := range bundles {
+		require.Regexp(t, `^[0-9]{14}-owner-repo\.bundle$`, bundle.info.Name())
+		require.FileExists(t, manifestPathForBundle(filepath.Join(backupPath, bundle.info.Name())))
+	}
+
+	latest, err := getLatestBundlePath(backupPath)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(backupPath, bundles[1].info.Name()), latest)
+	require.NoError(t, CheckRepoHealth(latest))
+}
+
+func TestInvalidBundlesIgnored(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	invalidPath := filepath.Join(dir, "repo.20240101000000.bundle"+invalidExtension)
+	require.NoError(t, os.WriteFile(invalidPath, []byte("not a bundle"), 0o600))
+
+	require.False(t, dirHasBundles(logger, dir))
+
+	_, err := getLatestBundlePath(dir)
+	require.Error(t, err)
+
+	validPath := filepath.Join(dir, "repo.20231201000000.bundle")
+	require.NoError(t, os.WriteFile(validPath, nil, 0o600))
+
+	require.True(t, dirHasBundles(logger, dir))
+
+	latest, err := getLatestBundlePath(dir)
+	require.NoError(t, err)
+	require.Equal(t, validPath, latest)
+
+	// the invalid bundle neither takes the place of a valid one nor is removed
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "repo.20231101000000.bundle"), nil, 0o600))
+	require.NoError(t, pruneBackups(logger, []string{dir}, 1))
+	require.FileExists(t, validPath)
+	require.FileExists(t, invalidPath)
+	require.NoFileExists(t, filepath.Join(dir, "repo.20231101000000.bundle"))
+}
+
+func TestCreateBundleCompressed(t *testing.T) {
+	t.Parallel()
+
+	repoDir := setupTestRepo(t)
+	workingPath := filepath.Join(t.TempDir(), "repo.git")
+	runGitCmd(t, repoDir, "clone", "--mirror", repoDir, workingPath)
+
+	repo := repository{Name: "repo", PathWithNameSpace: "owner/repo", Domain: "local"}
+	backupPath := t.TempDir()
+
+	require.NoError(t, createBundle(context.Background(), logger, gitOptions{}, 0, workingPath, backupPath, repo, "", nil, "", true, true))
+	require.True(t, dirHasBundles(logger, backupPath))
+
+	latest, err := getLatestBundlePath(backupPath)
+	require.NoError(t, err)
+	require.True(t, strings.HasSuffix(latest, compressedBundleExtension))
+	require.NoFileExists(t, strings.TrimSuffix(latest, filepath.Ext(latest)))
+	require.FileExists(t, manifestPathForBundle(latest))
+	require.FileExists(t, checksumPathForBundle(latest))
+
+	refs, err := getLatestBundleRefs(context.Background(), logger, gitOptions{}, backupPath)
+	require.NoError(t, err)
+	require.Contains(t, refs, "refs/heads/main")
+
+	manifest, mErr := readBundleManifest(manifestPathForBundle(latest))
+	require.NoError(t, mErr)
+	require.Equal(t, filepath.Base(latest), manifest.BundleFile)
+	require.Equal(t, refs, manifest.GitRefs)
+
+	require.NoError(t, CheckRepoHealth(latest))
+
+	// compression is deterministic, so an unchanged repository's bundle is still a duplicate
+	require.NoError(t, createBundle(context.Background(), logger, gitOptions{}, 0, workingPath, backupPath, repo, "", nil, "", true, true))
+	require.True(t, removeBundleIfDuplicate(logger, backupPath))
+
+	results, vErr := VerifyBackup(backupPath)
+	require.NoError(t, vErr)
+	require.Len(t, results, 1)
+	require.Equal(t, verifyStatusOk, results[0].Status)
+
+	restorePath := filepath.Join(t.TempDir(), "restored")
+	require.NoError(t, RestoreBundle(RestoreBundleInput{BundlePath: backupPath, TargetDir: restorePath}))
+	require.FileExists(t, filepath.Join(restorePath, "test.txt"))
+}
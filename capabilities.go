@@ -0,0 +1,100 @@
+package githosts
+
+import (
+	"slices"
+	"sort"
+)
+
+const (
+	authMethodToken  = "token"
+	authMethodOAuth2 = "oauth2"
+	authMethodPAT    = "pat"
+	authMethodBasic  = "basic"
+)
+
+// Capabilities describes the features a provider supports so callers can
+// enable or disable options without hardcoding provider differences.
+type Capabilities struct {
+	Provider            string   `json:"provider"`
+	SupportsLFS         bool     `json:"supportsLFS"`
+	SupportsWikis       bool     `json:"supportsWikis"`
+	SupportsOrgWildcard bool     `json:"supportsOrgWildcard"`
+	RequiresAdmin       bool     `json:"requiresAdmin"` // listing all users' repos needs an admin token
+	AuthMethods         []string `json:"authMethods"`
+}
+
+var providerCapabilities = map[string]Capabilities{
+	AzureDevOpsProviderName: {
+		Provider:    AzureDevOpsProviderName,
+		AuthMethods: []string{authMethodPAT},
+	},
+	BitbucketProviderName: {
+		Provider:    BitbucketProviderName,
+		AuthMethods: []string{authMethodOAuth2},
+	},
+	genericProviderName: {
+		Provider:    genericProviderName,
+		AuthMethods: []string{authMethodBasic},
+	},
+	giteaProviderName: {
+		Provider:            giteaProviderName,
+		SupportsOrgWildcard: true,
+		RequiresAdmin:       true,
+		AuthMethods:         []string{authMethodToken},
+	},
+	gitHubProviderName: {
+		Provider:            gitHubProviderName,
+		SupportsOrgWildcard: true,
+		AuthMethods:         []string{authMethodToken},
+	},
+	gitLabProviderName: {
+		Provider:    gitLabProviderName,
+		AuthMethods: []string{authMethodToken},
+	},
+}
+
+func getCapabilities(provider string) Capabilities {
+	c := providerCapabilities[provider]
+	c.AuthMethods = slices.Clone(c.AuthMethods)
+
+	return c
+}
+
+// ListProviders returns the capabilities of every supported provider, sorted by provider name.
+func ListProviders() []Capabilities {
+	providers := make([]Capabilities, 0, len(providerCapabilities))
+
+	for name := range providerCapabilities {
+		providers = append(providers, getCapabilities(name))
+	}
+
+	sort.Slice(providers, func(i, j int) bool {
+		return providers[i].Provider < providers[j].Provider
+	})
+
+	return providers
+}
+
+func (ad *AzureDevOpsHost) Capabilities() Capabilities {
+	return getCapabilities(AzureDevOpsProviderName)
+}
+
+func (bb BitbucketHost) Capabilities() Capabilities {
+	return getCapabilities(BitbucketProviderName)
+}
+
+func (gh *GenericHost) Capabilities() Capabilities {
+	return getCapabilities(genericProviderName)
+}
+
+func (g *GiteaHost) Capabilities() Capabilities {
+	return getCapabilities(giteaProviderName)
+}
+
+func (gh *GitHubHost) Capabilities() Capabilities {
+	return getCapabilities(gitHubProviderName)
+}
+
+func (gl *GitLabHost) Capabilities() Capabilities {
+	return getCapabilities(gitLabProviderName)
+}
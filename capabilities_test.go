@@ -0,0 +1,43 @@
+package githosts
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListProviders(t *testing.T) {
+	t.Parallel()
+
+	providers := ListProviders()
+	require.Len(t, providers, 6)
+
+	var names []string
+	for _, p := range providers {
+		names = append(names, p.Provider)
+		require.NotEmpty(t, p.AuthMethods)
+	}
+
+	require.Equal(t, []string{AzureDevOpsProviderName, BitbucketProviderName, genericProviderName, gitHubProviderName, gitLabProviderName, giteaProviderName}, names)
+}
+
+func TestHostCapabilities(t *testing.T) {
+	t.Parallel()
+
+	gh := GitHubHost{}
+	require.Equal(t, gitHubProviderName, gh.Capabilities().Provider)
+	require.True(t, gh.Capabilities().SupportsOrgWildcard)
+
+	g := GiteaHost{}
+	require.True(t, g.Capabilities().RequiresAdmin)
+
+	bb := BitbucketHost{}
+	require.False(t, bb.Capabilities().SupportsOrgWildcard)
+	require.Equal(t, []string{authMethodOAuth2}, bb.Capabilities().AuthMethods)
+
+	// modifying the returned auth methods must not alter the registered capabilities
+	gl := GitLabHost{}
+	c := gl.Capabilities()
+	c.AuthMethods[0] = "modified"
+	require.Equal(t, []string{authMethodToken}, gl.Capabilities().AuthMethods)
+}
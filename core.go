@@ -1,13 +1,21 @@
 package githosts
 
 import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
 	"fmt"
+	"math"
+	"math/rand/v2"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"reflect"
+	"regexp"
 	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -21,12 +29,32 @@ const (
 	refsMethod          = "refs"
 	cloneMethod         = "clone"
 	defaultRemoteMethod = cloneMethod
-	logEntryPrefix      = "githosts-utils: "
-	statusOk            = "ok"
-	statusFailed        = "failed"
+	// defaultBundleRefSpec selects the refs included in bundles when no alternative is specified
+	defaultBundleRefSpec = "--all"
+	defaultGitBinary     = "git"
+	logEntryPrefix       = "githosts-utils: "
+	statusOk             = "ok"
+	statusFailed         = "failed"
+	statusWouldBackup    = "would-backup"
+	statusWouldSkip      = "would-skip"
+	// reasons a repository's backup was skipped
+	skipReasonRefsMatch       = "refs-match"
+	skipReasonEmptyRepo       = "empty-repo"
+	skipReasonDuplicateBundle = "duplicate-bundle"
+	skipReasonNotUpdated      = "not-updated"
+	skipReasonFork            = "fork"
+	// skipReasonSSORequired is the reason of a failed backup whose credentials must be authorized
+	// for the repository's organization, e.g. by SAML SSO
+	skipReasonSSORequired = "sso-required"
+	// backupStateExtension is appended to the working path to name the state file of a backup in progress
+	backupStateExtension = ".backup-state"
+	backupStateFileMode  = 0o600
+	hoursPerDay          = 24
 )
 
 type repository struct {
+	// ID is the provider's identifier of the repository, if known, which is kept when it's renamed
+	ID                string
 	Name              string
 	Owner             string
 	PathWithNameSpace string
@@ -35,6 +63,27 @@ type repository struct {
 	SSHUrl            string
 	URLWithToken      string
 	URLWithBasicAuth  string
+	IsFork            bool
+	ForkParent        string // PathWithNameSpace of the upstream repository if a fork
+	// UpdatedAt is when the repository was last updated, if the provider returns it
+	UpdatedAt time.Time
+	// Description, Topics, DefaultBranch, and Visibility are the repository's metadata, if the
+	// provider returns it
+	Description   string
+	Topics        []string
+	DefaultBranch string
+	Visibility    string
+	// ReportedEmpty is whether the provider reports the repository as empty, e.g. by its statistics
+	ReportedEmpty bool
+}
+
+// providerRepoID returns the provider's ID of a repository, or empty if it wasn't returned.
+func providerRepoID(id int64) string {
+	if id == 0 {
+		return ""
+	}
+
+	return strconv.FormatInt(id, 10)
 }
 
 type describeReposOutput struct {
@@ -43,8 +92,49 @@ type describeReposOutput struct {
 
 type RepoBackupResults struct {
 	Repo   string   `json:"repo,omitempty"`
+	Domain string   `json:"domain,omitempty"`
 	Status string   `json:"status,omitempty"` // ok, failed
 	Error  errors.E `json:"error,omitempty"`
+	// Updated is set when a new bundle was kept, and Skipped when one wasn't needed, with
+	// SkipReason one of refs-match, empty-repo, duplicate-bundle, not-updated, or fork. A failed
+	// backup's SkipReason is sso-required if the credentials must be authorized for the organization.
+	Updated    bool   `json:"updated,omitempty"`
+	Skipped    bool   `json:"skipped,omitempty"`
+	SkipReason string `json:"skip_reason,omitempty"`
+	// BundleBytes is the size of the latest bundle, whether new or existing
+	BundleBytes int64 `json:"bundle_bytes,omitempty"`
+	DurationMs  int64 `json:"duration_ms,omitempty"`
+}
+
+// phases of a repository's backup in which it can fail
+const (
+	BackupPhaseClone    = "clone"
+	BackupPhaseBundle   = "bundle"
+	BackupPhasePrune    = "prune"
+	BackupPhaseUpload   = "upload"
+	BackupPhaseReleases = "releases"
+	BackupPhaseMetadata = "metadata"
+)
+
+// BackupError is the error of a repository's backup, identifying the phase in which it failed.
+// It's retrieved from a RepoBackupResults Error with errors.As.
+type BackupError struct {
+	RepoPath string // path of the repository, including its namespace
+	Phase    string // one of clone, bundle, prune, upload, releases, or metadata
+	Err      error
+}
+
+func (e *BackupError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *BackupError) Unwrap() error {
+	return e.Err
+}
+
+// newBackupError returns the error of the repository's backup failing in the phase specified.
+func newBackupError(repo repository, phase string, err error) errors.E {
+	return errors.WithStack(&BackupError{RepoPath: repo.PathWithNameSpace, Phase: phase, Err: err})
 }
 
 // type ProviderBackupResult []RepoBackupResults
@@ -53,24 +143,29 @@ type ProviderBackupResult struct {
 	Error         errors.E
 }
 
-type gitProvider interface {
+// GitProvider is implemented by each of the hosts.
+type GitProvider interface {
 	getAPIURL() string
-	describeRepos() (describeReposOutput, errors.E)
+	describeRepos(ctx context.Context) (describeReposOutput, errors.E)
 	Backup() ProviderBackupResult
+	BackupWithContext(ctx context.Context) ProviderBackupResult
+	backupWithCloneTokens(ctx context.Context, cloneTokens chan struct{}) ProviderBackupResult
+	backupLock() (string, time.Duration)
 	diffRemoteMethod() string
+	Capabilities() Capabilities
 }
 
 // gitRefs is a mapping of references to SHAs.
 type gitRefs map[string]string
 
-func remoteRefsMatchLocalRefs(cloneURL, backupPath string) bool {
+func remoteRefsMatchLocalRefs(ctx context.Context, logger Logger, gitOpts gitOptions, cloneURL, sshCommand, backupPath, bundleRefSpec string, refSpec []*regexp.Regexp) bool {
 	// if there's no backup path then return false
 	if _, err := os.Stat(backupPath); os.IsNotExist(err) {
 		return false
 	}
 
 	// if there are no backups
-	if !dirHasBundles(backupPath) {
+	if !dirHasBundles(logger, backupPath) {
 		return false
 	}
 
@@ -78,21 +173,28 @@ func remoteRefsMatchLocalRefs(cloneURL, backupPath string) bool {
 
 	var err error
 
-	lHeads, err = getLatestBundleRefs(backupPath)
+	lHeads, err = getLatestBundleRefs(ctx, logger, gitOpts, backupPath)
 	if err != nil {
 		logger.Printf("failed to get latest bundle refs for %s", backupPath)
 
 		return false
 	}
 
-	rHeads, err = getRemoteRefs(cloneURL)
+	rHeads, err = getRemoteRefs(ctx, gitOpts, cloneURL, sshCommand)
 	if err != nil {
 		logger.Printf("failed to get remote refs")
 
 		return false
 	}
 
-	if reflect.DeepEqual(lHeads, rHeads) {
+	// only the refs that would be bundled can be compared with those of the latest bundle
+	if len(refSpec) > 0 {
+		rHeads = filterRefsByRefSpec(rHeads, refSpec)
+	} else {
+		rHeads = filterRefsByBundleRefSpec(rHeads, bundleRefSpec)
+	}
+
+	if reflect.DeepEqual(normalizeRefs(lHeads), normalizeRefs(rHeads)) {
 		return true
 	}
 
@@ -158,10 +260,10 @@ func generateMapFromRefsCmdOutput(in []byte) (refs gitRefs, err error) {
 	return
 }
 
-func getRemoteRefs(cloneURL string) (refs gitRefs, err error) {
+func getRemoteRefs(ctx context.Context, gitOpts gitOptions, cloneURL, sshCommand string) (refs gitRefs, err error) {
 	// --refs ignores pseudo-refs like HEAD and FETCH_HEAD, and also peeled tags that reference other objects
 	// this enables comparison with refs from existing bundles
-	remoteHeadsCmd := exec.Command("git", "ls-remote", "--refs", cloneURL)
+	remoteHeadsCmd := gitCommand(ctx, gitOpts, sshCommand, "ls-remote", "--refs", cloneURL)
 
 	out, err := remoteHeadsCmd.CombinedOutput()
 	if err != nil {
@@ -173,41 +275,562 @@ func getRemoteRefs(cloneURL string) (refs gitRefs, err error) {
 	return
 }
 
-func processBackup(logLevel int, repo repository, backupDIR string, backupsToKeep int, diffRemoteMethod string) errors.E {
-	// create backup path
-	workingPath := filepath.Join(backupDIR, workingDIRName, repo.Domain, repo.PathWithNameSpace)
-	backupPath := filepath.Join(backupDIR, repo.Domain, repo.PathWithNameSpace)
-	// clean existing working directory
-	delErr := os.RemoveAll(workingPath)
-	if delErr != nil {
-		return errors.Errorf("failed to remove working directory: %s: %s", workingPath, delErr)
+// fetchMissingObjects fetches the objects omitted from the partial clone at repoPath. They're
+// requested together as git would otherwise fetch each one separately as the bundle is created.
+func fetchMissingObjects(ctx context.Context, gitOpts gitOptions, sshCommand, repoPath string) errors.E {
+	listCmd := gitCommand(ctx, gitOpts, "", "rev-list", "--objects", "--all", "--missing=print")
+	listCmd.Dir = repoPath
+
+	out, err := listCmd.Output()
+	if err != nil {
+		return errors.Errorf("failed to list missing objects: %s", err)
 	}
 
-	var cloneURL string
+	var missing strings.Builder
 
-	if repo.URLWithToken != "" {
-		cloneURL = repo.URLWithToken
-	} else if repo.URLWithBasicAuth != "" {
-		cloneURL = repo.URLWithBasicAuth
+	for _, line := range strings.Split(string(out), "\n") {
+		if oid, found := strings.CutPrefix(line, "?"); found {
+			missing.WriteString(oid + "\n")
+		}
 	}
 
-	// Check if existing, latest bundle refs, already match the remote
-	if diffRemoteMethod == refsMethod {
-		// check backup path exists before attempting to compare remote and local heads
-		if remoteRefsMatchLocalRefs(cloneURL, backupPath) {
-			logger.Printf("skipping clone of %s repo '%s' as refs match existing bundle", repo.Domain, repo.PathWithNameSpace)
+	if missing.Len() == 0 {
+		return nil
+	}
+
+	// as with git's own fetches of missing objects, those requested are sent without negotiation
+	fetchCmd := gitCommand(ctx, gitOpts, sshCommand, "-c", "fetch.negotiationAlgorithm=noop",
+		"fetch", "origin", "--no-tags", "--no-write-fetch-head", "--recurse-submodules=no", "--stdin")
+	fetchCmd.Dir = repoPath
+	fetchCmd.Stdin = strings.NewReader(missing.String())
+
+	if fetchOut, fetchErr := fetchCmd.CombinedOutput(); fetchErr != nil {
+		return errors.Errorf("failed to fetch missing objects: %s: %s", strings.TrimSpace(string(fetchOut)), fetchErr)
+	}
+
+	return nil
+}
+
+// bundleRefSpecArgs returns the ref selection arguments passed to git bundle create.
+func bundleRefSpecArgs(bundleRefSpec string) []string {
+	args := strings.Fields(bundleRefSpec)
+	if len(args) == 0 {
+		return []string{defaultBundleRefSpec}
+	}
+
+	return args
+}
+
+// compileRefSpec returns the regular expression matching the refs of each ref spec pattern, so
+// they're compiled once rather than for every ref. As with git's ref globs, * matches any
+// characters, including /.
+func compileRefSpec(refSpec []string) []*regexp.Regexp {
+	if len(refSpec) == 0 {
+		return nil
+	}
+
+	patterns := make([]*regexp.Regexp, 0, len(refSpec))
+
+	for _, pattern := range refSpec {
+		parts := strings.Split(pattern, "*")
+		for i, part := range parts {
+			parts[i] = regexp.QuoteMeta(part)
+		}
+
+		patterns = append(patterns, regexp.MustCompile("^"+strings.Join(parts, ".*")+"$"))
+	}
+
+	return patterns
+}
+
+// filterRefsByBundleRefSpec returns the refs that the bundle ref spec would include in a bundle.
+func filterRefsByBundleRefSpec(refs gitRefs, bundleRefSpec string) gitRefs {
+	args := bundleRefSpecArgs(bundleRefSpec)
+	if slices.Contains(args, "--all") {
+		return refs
+	}
+
+	filtered := make(gitRefs)
+
+	for ref, sha := range refs {
+		for _, arg := range args {
+			if strings.HasPrefix(ref, bundleRefSpecPrefixes[arg]) {
+				filtered[ref] = sha
+
+				break
+			}
+		}
+	}
+
+	return filtered
+}
+
+// filterRefsByRefSpec returns the refs that match any of the ref spec patterns.
+func filterRefsByRefSpec(refs gitRefs, refSpec []*regexp.Regexp) gitRefs {
+	filtered := make(gitRefs)
+
+	for ref, sha := range refs {
+		for _, pattern := range refSpec {
+			if pattern.MatchString(ref) {
+				filtered[ref] = sha
+
+				break
+			}
+		}
+	}
+
+	return filtered
+}
+
+// reviewRefPrefixes are the prefixes of the refs providers keep for pull and merge requests.
+var reviewRefPrefixes = []string{"refs/pull/", "refs/merge-requests/"}
+
+// normalizeRefs returns the refs without peeled tags or the refs of pull and merge requests, so
+// the refs of a bundle and its remote are compared alike however each lists them.
+func normalizeRefs(refs gitRefs) gitRefs {
+	normalized := make(gitRefs, len(refs))
+
+	for ref, sha := range refs {
+		if strings.HasSuffix(ref, "^{}") || slices.ContainsFunc(reviewRefPrefixes, func(prefix string) bool {
+			return strings.HasPrefix(ref, prefix)
+		}) {
+			continue
+		}
+
+		normalized[ref] = sha
+	}
+
+	return normalized
+}
+
+type processBackupInput struct {
+	LogLevel      int
+	Repo          repository
+	BackupDIR     string
+	BackupsToKeep int
+	// KeepForDays, when set, removes bundles older than the number of days, keeping the newest
+	KeepForDays      int
+	DiffRemoteMethod string
+	UseAlternates    bool
+	// ForkParents are the paths of the repositories whose working clones are kept, when using
+	// alternates, for the forks of them in the run to borrow objects from
+	ForkParents   map[string]bool
+	BundleRefSpec string
+	// RefSpec, when set, selects the refs to bundle with the compiled ref spec patterns, instead of
+	// BundleRefSpec
+	RefSpec []*regexp.Regexp
+	// BundleNameTemplate, when set, is the text/template bundles are named with
+	BundleNameTemplate string
+	// FlatLayout, when set, keeps backups in <domain><separator><path> directories rather than
+	// nested <domain>/<path> directories, with the separator defaulting to __
+	FlatLayout          bool
+	FlatLayoutSeparator string
+	// DateDir, when set, is the directory of the date the backup started, e.g. 2024-01-31, that
+	// bundles are kept under rather than directly under the backup directory
+	DateDir string
+	// DetectRenames, when set, moves the backups of a renamed repository to its new path
+	DetectRenames bool
+	// RepoIDs, when set, is the index of the backups by repository ID shared by the host's backups,
+	// to find those of renamed repositories
+	RepoIDs *repoIDIndex
+	DryRun  bool
+	// PartialClone, when set, clones without blobs, fetching them all before the bundle is created
+	PartialClone bool
+	// KeepWorkingDir, when set, keeps each repository's working clone for inspection, with any
+	// credentials removed from its remote's URL, rather than removing it once backed up
+	KeepWorkingDir bool
+	// Submodules, when set, is where the repositories of the submodules found are queued to be
+	// backed up
+	Submodules *submoduleQueue
+	// SkipVerify, when set, keeps each new bundle without checking it's valid
+	SkipVerify bool
+	// CompressBundles, when set, compresses each new bundle with gzip
+	CompressBundles bool
+	// ArchivePerRepo, when set, writes each new bundle, its manifest and checksum to a tar archive,
+	// removing them unless KeepArchivedFiles is set. Without them changes can't be detected, so
+	// each backup then creates a new archive.
+	ArchivePerRepo    bool
+	KeepArchivedFiles bool
+	// CloneRetries is the number of times a clone failing with a transient error is retried: 2 if
+	// not set, and none if negative
+	CloneRetries int
+	// MinFreeDiskMB is the space, in megabytes, that must be free on the backup volume for a
+	// repository to be cloned
+	MinFreeDiskMB int
+	// SSHPrivateKeyPath, when set, clones repositories with SSH URLs using the key
+	SSHPrivateKeyPath string
+	SSHKnownHostsPath string
+	Logger            Logger
+	// RemoteStore, when set, is where new bundles are uploaded to
+	RemoteStore RemoteStore
+	// StoreKeyPrefix is prepended to the keys bundles are uploaded with, so those of hosts sharing
+	// a store under different namespace prefixes don't collide
+	StoreKeyPrefix string
+	// Releases, when set, is where the assets of the repository's releases are downloaded from
+	Releases releaseSource
+	// BackupMetadata, when set, writes the repository's metadata alongside its bundles
+	BackupMetadata    bool
+	RepoBackupTimeout time.Duration
+	Git               gitOptions
+}
+
+// backupRunOptions are a host's settings that apply to a run of its backups as a whole, rather
+// than to each repository's.
+type backupRunOptions struct {
+	MaxConcurrent    int
+	FailFast         bool
+	FailOnAnyError   bool
+	UseAlternates    bool
+	BackupSubmodules bool
+	DetectRenames    bool
+	Progress         func(done, total int, repo string)
+	// Skipped are the results of the repositories the host filtered out, reported before the rest
+	Skipped []RepoBackupResults
+}
+
+// runBackups backs up the repositories with the host's settings in in, followed by the submodules
+// found in them, with up to opts.MaxConcurrent backups in progress at once. Each repository is
+// prepared with setupRepo, if specified, and its backup holds a token from cloneTokens, if
+// specified, while in progress.
+func runBackups(ctx context.Context, provider string, in processBackupInput, setupRepo func(repository) repository, repos []repository, cloneTokens chan struct{}, opts backupRunOptions) ProviderBackupResult {
+	logger := getLogger(in.Logger)
+
+	in.Submodules = newSubmoduleQueue(opts.BackupSubmodules, repos)
+	in.RepoIDs = newRepoIDIndex(opts.DetectRenames)
+
+	if opts.UseAlternates {
+		in.ForkParents = forkParents(repos)
+
+		// the upstreams' working clones are only needed until their forks have been backed up
+		defer removeForkParentClones(logger, in, repos)
+	}
+
+	providerBackupResults := ProviderBackupResult{BackupResults: opts.Skipped}
+
+	// backups still in progress are cancelled when failing fast
+	cancel := func() {}
+	if opts.FailFast {
+		ctx, cancel = context.WithCancel(ctx)
+	}
+
+	defer cancel()
+
+	var done int
+
+	for _, batch := range backupBatches(repos, opts.UseAlternates) {
+		jobs := make(chan repository, len(batch))
+		results := make(chan RepoBackupResults, opts.MaxConcurrent)
+
+		for w := 1; w <= opts.MaxConcurrent; w++ {
+			go backupWorker(ctx, provider, in, setupRepo, cloneTokens, jobs, results)
+		}
+
+		for _, repo := range batch {
+			jobs <- repo
+		}
+
+		close(jobs)
+
+		for a := 1; a <= len(batch); a++ {
+			res := <-results
+
+			done++
+			reportProgress(opts.Progress, done, len(repos), res.Repo)
+
+			providerBackupResults.BackupResults = append(providerBackupResults.BackupResults, res)
+
+			if res.Error != nil {
+				logger.Printf("backup failed: %+v\n", res.Error)
+
+				if opts.FailFast {
+					providerBackupResults.Error = res.Error
+					cancel()
+					drainResults(results, len(batch)-a)
+
+					return providerBackupResults
+				}
+			}
+		}
+	}
+
+	// submodules are backed up once those of all the repositories have been found
+	for _, res := range backupSubmodules(ctx, provider, in, setupRepo, cloneTokens, opts.FailFast) {
+		providerBackupResults.BackupResults = append(providerBackupResults.BackupResults, res)
+
+		if res.Error != nil && opts.FailFast {
+			providerBackupResults.Error = res.Error
+
+			return providerBackupResults
+		}
+	}
+
+	if opts.FailOnAnyError {
+		providerBackupResults.Error = failedBackupsError(providerBackupResults.BackupResults)
+	}
+
+	return providerBackupResults
+}
+
+// backupWorker backs up each of the repositories received from jobs with the host's settings in
+// in, having prepared it with setupRepo, if specified, e.g. to add the host's credentials to its
+// URL. Each backup holds a token from cloneTokens, if specified, while in progress.
+func backupWorker(ctx context.Context, provider string, in processBackupInput, setupRepo func(repository) repository, cloneTokens chan struct{}, jobs <-chan repository, results chan<- RepoBackupResults) {
+	for repo := range jobs {
+		if setupRepo != nil {
+			repo = setupRepo(repo)
+		}
+
+		release := acquireCloneToken(ctx, cloneTokens)
+
+		in.Repo = repo
+		result := backupRepository(ctx, provider, in)
+
+		release()
+
+		results <- result
+	}
+}
+
+// backupRepository backs up the repository, or when a dry run reports whether it would be, and returns the result.
+func backupRepository(ctx context.Context, provider string, in processBackupInput) RepoBackupResults {
+	result := RepoBackupResults{
+		Repo:   in.Repo.PathWithNameSpace,
+		Domain: in.Repo.Domain,
+	}
+
+	if in.DryRun {
+		result.Status = statusWouldBackup
+
+		if shouldSkipBackup(ctx, in) {
+			result.Status = statusWouldSkip
+		}
+
+		return result
+	}
+
+	result.Status = statusOk
+
+	start := time.Now()
+
+	processed, err := processBackup(ctx, in)
+
+	result.DurationMs = time.Since(start).Milliseconds()
+
+	// releases are backed up even if the repository hasn't changed, as assets can be added at any time
+	if err == nil && in.Releases != nil {
+		backupPath := repoBackupPath(datedBackupDIR(in.BackupDIR, in.DateDir), in.Repo, in.FlatLayout, in.FlatLayoutSeparator)
+
+		if rErr := backupReleases(ctx, getLogger(in.Logger), in.Releases, backupPath, in.Repo); rErr != nil {
+			err = newBackupError(in.Repo, BackupPhaseReleases, rErr)
+		}
+	}
+
+	// as with releases, the metadata can change without the repository changing
+	if err == nil && in.BackupMetadata {
+		backupPath := repoBackupPath(datedBackupDIR(in.BackupDIR, in.DateDir), in.Repo, in.FlatLayout, in.FlatLayoutSeparator)
+
+		if mErr := writeRepoMetadata(backupPath, in.Repo); mErr != nil {
+			err = newBackupError(in.Repo, BackupPhaseMetadata, mErr)
+		}
+	}
+
+	if err != nil {
+		result.Status = statusFailed
+		result.Error = repoBackupError(provider, in.Repo, err)
+	}
+
+	// a bundle may have been kept even if it couldn't be uploaded
+	result.Updated = processed.Updated
+	result.Skipped = processed.Skipped
+	result.SkipReason = processed.SkipReason
+	result.BundleBytes = processed.BundleBytes
+
+	return result
+}
+
+// failedBackupsError returns an error listing the repositories whose backups failed, or nil if
+// none did.
+func failedBackupsError(results []RepoBackupResults) errors.E {
+	var failed []string
 
-			return nil
+	for _, result := range results {
+		if result.Error != nil {
+			failed = append(failed, result.Repo)
 		}
 	}
 
+	if len(failed) == 0 {
+		return nil
+	}
+
+	return errors.Errorf("backups of %d repositories failed: %s", len(failed), strings.Join(failed, ", "))
+}
+
+// drainResults waits for, and discards, the results of the backups remaining when a host fails
+// fast, so no worker is left behind. They finish promptly as the backups have been cancelled.
+func drainResults(results <-chan RepoBackupResults, remaining int) {
+	for range remaining {
+		<-results
+	}
+}
+
+// reportProgress calls the progress callback, if specified, with the number of repositories whose
+// backups have finished. It's only called by the goroutine receiving the results, so calls for a
+// host are never concurrent.
+func reportProgress(progress func(done, total int, repo string), done, total int, repo string) {
+	if progress != nil {
+		progress(done, total, repo)
+	}
+}
+
+// getCloneURL returns the URL to clone the repository with. If an SSH key is configured the SSH URL is
+// used, otherwise those with credentials are preferred.
+func getCloneURL(repo repository, sshPrivateKeyPath string) string {
+	if sshPrivateKeyPath != "" && repo.SSHUrl != "" {
+		return repo.SSHUrl
+	}
+
+	switch {
+	case repo.URLWithToken != "":
+		return repo.URLWithToken
+	case repo.URLWithBasicAuth != "":
+		return repo.URLWithBasicAuth
+	case repo.HTTPSUrl != "":
+		// repositories without credentials, e.g. public or local, are cloned directly
+		return repo.HTTPSUrl
+	default:
+		return repo.SSHUrl
+	}
+}
+
+// latestBackupPath returns the backup path of the repository containing its latest bundles. When
+// grouping backups by date, that's the path in the directory of the most recent date with any, or
+// an empty string if there are none.
+func latestBackupPath(in processBackupInput) string {
+	if in.DateDir == "" {
+		return repoBackupPath(in.BackupDIR, in.Repo, in.FlatLayout, in.FlatLayoutSeparator)
+	}
+
+	return latestDatedBackupPath(getLogger(in.Logger), in.BackupDIR, in.Repo, in.FlatLayout, in.FlatLayoutSeparator)
+}
+
+// shouldSkipBackup returns whether the refs of the latest bundle already match the remote's, so
+// there's nothing new to back up. This is only checked when using the refs diff remote method.
+func shouldSkipBackup(ctx context.Context, in processBackupInput) bool {
+	if in.DiffRemoteMethod != refsMethod {
+		return false
+	}
+
+	backupPath := latestBackupPath(in)
+	if backupPath == "" {
+		return false
+	}
+
+	return remoteRefsMatchLocalRefs(ctx, getLogger(in.Logger), in.Git, getCloneURL(in.Repo, in.SSHPrivateKeyPath),
+		gitSSHCommand(in.SSHPrivateKeyPath, in.SSHKnownHostsPath), backupPath, in.BundleRefSpec, in.RefSpec)
+}
+
+// processBackupResult describes the outcome of a successful backup.
+type processBackupResult struct {
+	Updated     bool
+	Skipped     bool
+	SkipReason  string
+	BundleBytes int64
+}
+
+func processBackup(ctx context.Context, in processBackupInput) (result processBackupResult, err errors.E) {
+	logger := getLogger(in.Logger)
+	repo := in.Repo
+	backupDIR := in.BackupDIR
+
+	// remaining jobs are still received after cancellation so each is reported
+	if err := ctx.Err(); err != nil {
+		return processBackupResult{}, newBackupError(repo, BackupPhaseClone, errors.Wrap(err, "backup cancelled"))
+	}
+
+	// a hung clone would otherwise occupy the worker indefinitely
+	timeout := getRepoBackupTimeout(in.RepoBackupTimeout)
+
+	parentCtx := ctx
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	workingPath, backupPath, setupErr := setupBackupPaths(logger, backupDIR, in.DateDir, repo, in.FlatLayout, in.FlatLayoutSeparator)
+	if setupErr != nil {
+		return processBackupResult{}, newBackupError(repo, BackupPhaseClone, setupErr)
+	}
+
+	// a failed or interrupted backup leaves its state file for the next to recover from
+	defer func() {
+		if err == nil {
+			removeBackupState(logger, workingPath)
+		}
+	}()
+
+	// the working clone is kept, or removed, whatever the outcome of the backup
+	defer finishWorkingClone(logger, in, workingPath)
+
+	if in.DetectRenames {
+		// the repository is backed up to its new path regardless
+		for root, rootBackupPath := range renameSearchRoots(in, backupPath) {
+			if mErr := migrateRenamedBackup(logger, in, root, rootBackupPath); mErr != nil {
+				logger.Printf("failed to migrate backups of %s repo '%s': %s", repo.Domain, repo.PathWithNameSpace, mErr)
+			}
+		}
+	}
+
+	cloneURL := getCloneURL(repo, in.SSHPrivateKeyPath)
+
+	// Check if existing, latest bundle refs, already match the remote
+	if shouldSkipBackup(ctx, in) {
+		logger.Printf("skipping clone of %s repo '%s' as refs match existing bundle", repo.Domain, repo.PathWithNameSpace)
+
+		return processBackupResult{
+			Skipped:     true,
+			SkipReason:  skipReasonRefsMatch,
+			BundleBytes: latestBundleSize(logger, latestBackupPath(in)),
+		}, nil
+	}
+
+	// a full volume would otherwise leave a truncated bundle
+	if err := checkFreeDiskSpace(logger, backupDIR, in.MinFreeDiskMB); err != nil {
+		return processBackupResult{}, newBackupError(repo, BackupPhaseClone, err)
+	}
+
 	// clone repo
 	logger.Printf("cloning: %s to: %s", repo.HTTPSUrl, workingPath)
 
-	cloneCmd := exec.Command("git", "clone", "-v", "--mirror", cloneURL, workingPath)
-	cloneCmd.Dir = backupDIR
+	cloneIn := in
+
+	cloneOut, cloneErr := buildCloneCommand(ctx, cloneIn, cloneURL, workingPath).CombinedOutput()
+
+	// servers that reject partial clones are cloned in full instead
+	if cloneErr != nil && in.PartialClone && ctx.Err() == nil && isPartialCloneUnsupportedError(string(cloneOut)) {
+		logger.Printf("partial clone of %s failed, retrying with a full clone", repo.PathWithNameSpace)
+
+		if err := os.RemoveAll(workingPath); err != nil {
+			return processBackupResult{}, newBackupError(repo, BackupPhaseClone, errors.Errorf("failed to remove working path: %s: %s", workingPath, err))
+		}
+
+		cloneIn.PartialClone = false
+
+		cloneOut, cloneErr = buildCloneCommand(ctx, cloneIn, cloneURL, workingPath).CombinedOutput()
+	}
+
+	// connections dropped part way through a clone are retried from the start
+	cloneRetries := getRetryCount(in.CloneRetries, defaultCloneRetries)
+
+	for attempt := 1; cloneErr != nil && attempt <= cloneRetries && ctx.Err() == nil && isTransientCloneError(string(cloneOut)); attempt++ {
+		logger.Printf("clone of %s failed with a transient error, retrying (%d/%d)", repo.PathWithNameSpace, attempt, cloneRetries)
+
+		if err := os.RemoveAll(workingPath); err != nil {
+			return processBackupResult{}, newBackupError(repo, BackupPhaseClone, errors.Errorf("failed to remove working path: %s: %s", workingPath, err))
+		}
+
+		cloneOut, cloneErr = buildCloneCommand(ctx, cloneIn, cloneURL, workingPath).CombinedOutput()
+	}
 
-	cloneOut, cloneErr := cloneCmd.CombinedOutput()
 	if cloneErr != nil {
 		fmt.Printf("cloning failed for repository: %s - %s\n", repo.Name, cloneErr)
 	}
@@ -215,39 +838,580 @@ func processBackup(logLevel int, repo repository, backupDIR string, backupsToKee
 	cloneOutLines := strings.Split(string(cloneOut), "\n")
 
 	if cloneErr != nil {
+		if ctxErr := backupContextError(parentCtx, ctx, logger, timeout, workingPath); ctxErr != nil {
+			return processBackupResult{}, newBackupError(repo, BackupPhaseClone, ctxErr)
+		}
+
+		// the run continues with the remaining repositories, which the credentials may be authorized for
+		if isSSORequiredCloneError(string(cloneOut)) {
+			logger.Printf("cloning %s repo '%s' requires the credentials to be authorized for its organization", repo.Domain, repo.PathWithNameSpace)
+
+			return processBackupResult{SkipReason: skipReasonSSORequired}, newBackupError(repo, BackupPhaseClone,
+				errors.Errorf("%w: authorize the token, or SSH key, for the organization of %s, e.g. for SAML SSO, and retry", errSSORequired, repo.PathWithNameSpace))
+		}
+
 		if os.Getenv(envVarGitHostsLog) == "debug" {
 			fmt.Printf("debug: cloning failed for repository: %s - %s\n", repo.Name, strings.Join(cloneOutLines, ", "))
 
-			return errors.Errorf("cloning failed: %s: %s", strings.Join(cloneOutLines, ", "), cloneErr)
+			return processBackupResult{}, newBackupError(repo, BackupPhaseClone,
+				errors.Errorf("cloning failed: %s: %s", strings.Join(cloneOutLines, ", "), cloneErr))
 		}
 
-		return errors.Errorf("cloning failed for repository: %s - %s", repo.Name, cloneErr)
+		return processBackupResult{}, newBackupError(repo, BackupPhaseClone,
+			errors.Errorf("cloning failed for repository: %s - %s", repo.Name, cloneErr))
+	}
+
+	// the bundle must include the blobs a partial clone omits
+	if cloneIn.PartialClone {
+		if err := fetchMissingObjects(ctx, in.Git, gitSSHCommand(in.SSHPrivateKeyPath, in.SSHKnownHostsPath), workingPath); err != nil {
+			if ctxErr := backupContextError(parentCtx, ctx, logger, timeout, workingPath); ctxErr != nil {
+				return processBackupResult{}, newBackupError(repo, BackupPhaseClone, ctxErr)
+			}
+
+			return processBackupResult{}, newBackupError(repo, BackupPhaseClone, err)
+		}
+	}
+
+	if in.Submodules != nil {
+		in.Submodules.add(findSubmodules(ctx, logger, in, workingPath)...)
 	}
 
 	// create bundle
-	if err := createBundle(logLevel, workingPath, backupPath, repo); err != nil {
+	if err := createBundle(ctx, logger, in.Git, in.LogLevel, workingPath, backupPath, repo, in.BundleRefSpec, in.RefSpec, in.BundleNameTemplate, !in.SkipVerify, in.CompressBundles); err != nil {
 		if strings.HasSuffix(err.Error(), "is empty") {
 			logger.Printf("skipping empty %s repository %s", repo.Domain, repo.PathWithNameSpace)
 
-			return nil
+			return processBackupResult{Skipped: true, SkipReason: skipReasonEmptyRepo}, nil
 		}
 
-		return err
+		if ctxErr := backupContextError(parentCtx, ctx, logger, timeout, workingPath); ctxErr != nil {
+			return processBackupResult{}, newBackupError(repo, BackupPhaseBundle, ctxErr)
+		}
+
+		return processBackupResult{}, newBackupError(repo, BackupPhaseBundle, err)
+	}
+
+	// the new bundle isn't kept if it's identical to the previous
+	if removeBundleIfDuplicate(logger, backupPath) {
+		result.Skipped = true
+		result.SkipReason = skipReasonDuplicateBundle
+	} else {
+		result.Updated = true
 	}
 
-	removeBundleIfDuplicate(backupPath)
+	// the latest bundle is the new one, or the previous if they were identical
+	bundlePath, lErr := getLatestBundlePath(backupPath)
+	if lErr == nil {
+		result.BundleBytes = getFileSize(logger, bundlePath)
+	}
+
+	// when grouping backups by date, those in every date directory are counted together
+	backupPaths := prunePaths(in, backupPath)
 
-	if backupsToKeep > 0 {
-		if err := pruneBackups(backupPath, backupsToKeep); err != nil {
-			return err
+	if in.BackupsToKeep > 0 {
+		if pErr := pruneBackups(logger, backupPaths, in.BackupsToKeep); pErr != nil {
+			return processBackupResult{}, newBackupError(repo, BackupPhasePrune, pErr)
 		}
 	}
 
-	return nil
+	// those beyond the number to keep are removed before any that are too old
+	if in.KeepForDays > 0 {
+		if pErr := pruneBackupsByAge(logger, backupPaths, time.Duration(in.KeepForDays)*hoursPerDay*time.Hour); pErr != nil {
+			return processBackupResult{}, newBackupError(repo, BackupPhasePrune, pErr)
+		}
+	}
+
+	if in.DateDir != "" {
+		removeEmptyDatedBackupPaths(logger, backupDIR, backupPath, backupPaths)
+	}
+
+	// the local copy is kept regardless of whether it's uploaded
+	if in.RemoteStore != nil && result.Updated && bundlePath != "" {
+		if uErr := uploadBundle(ctx, in.RemoteStore, in.StoreKeyPrefix, backupDIR, bundlePath); uErr != nil {
+			logger.Printf("failed to upload bundle for %s repo '%s': %s", repo.Domain, repo.PathWithNameSpace, uErr)
+
+			return result, newBackupError(repo, BackupPhaseUpload, uErr)
+		}
+	}
+
+	if in.ArchivePerRepo && result.Updated {
+		if _, aErr := archiveLatestGeneration(logger, backupPath, in.KeepArchivedFiles); aErr != nil {
+			return result, newBackupError(repo, BackupPhaseBundle, aErr)
+		}
+	}
+
+	return result, nil
+}
+
+// transientCloneErrors are output by git when the connection to the remote is lost during a clone.
+var transientCloneErrors = []string{
+	"early EOF",
+	"unexpected disconnect",
+	"the remote end hung up unexpectedly",
+	"RPC failed",
+	"Connection reset by peer",
+	"Connection timed out",
+}
+
+// permanentCloneErrors are output by git when a clone can't succeed however often it's retried.
+var permanentCloneErrors = []string{
+	"Authentication failed",
+	"Permission denied",
+	"not found",
+	"does not exist",
+	"could not read Username",
+}
+
+// partialCloneUnsupportedErrors are output by git when the server rejects the filter of a partial
+// clone.
+var partialCloneUnsupportedErrors = []string{
+	"filtering not recognized by server",
+	"filtering capability not negotiated",
+	"git upload-pack: filter",
+}
+
+// isPartialCloneUnsupportedError returns whether the output of a failed clone shows the server
+// doesn't permit partial clones.
+func isPartialCloneUnsupportedError(output string) bool {
+	for _, pattern := range partialCloneUnsupportedErrors {
+		if strings.Contains(output, pattern) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ssoRequiredCloneErrors are output by git when GitHub requires the credentials to be authorized
+// for the organization's SAML SSO before its repositories are cloned.
+var ssoRequiredCloneErrors = []string{
+	"organization has enabled or enforced SAML SSO",
+	"Resource protected by organization SAML enforcement",
+	"you must re-authorize the OAuth Application",
+}
+
+// errSSORequired is returned when a clone fails as the credentials aren't authorized for the
+// repository's organization.
+var errSSORequired = errors.Base("credentials not authorized for organization")
+
+// isSSORequiredCloneError returns whether the output of a failed clone shows the credentials must
+// be authorized for the repository's organization.
+func isSSORequiredCloneError(output string) bool {
+	for _, pattern := range ssoRequiredCloneErrors {
+		if strings.Contains(output, pattern) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// isTransientCloneError returns whether the output of a failed clone shows it may succeed if retried.
+func isTransientCloneError(output string) bool {
+	for _, permanent := range permanentCloneErrors {
+		if strings.Contains(output, permanent) {
+			return false
+		}
+	}
+
+	for _, transient := range transientCloneErrors {
+		if strings.Contains(output, transient) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// backupState is written to the working directory while a repository is being backed up.
+type backupState struct {
+	Repo    string `json:"repo"`
+	Started string `json:"started"`
+}
+
+// backupStatePath returns the path of the state file of the backup using the working path.
+func backupStatePath(workingPath string) string {
+	return workingPath + backupStateExtension
+}
+
+// setupBackupPaths returns the working and backup paths of the repository, having cleaned the
+// working path and recorded that a backup is in progress. If the state file of a previous backup
+// remains then it failed or was interrupted, and anything it left in the working path is discarded. The
+// backup path is in the date directory, if specified, while the working path never is.
+func setupBackupPaths(logger Logger, backupDIR, dateDir string, repo repository, flatLayout bool, flatLayoutSeparator string) (workingPath, backupPath string, err errors.E) {
+	// the backup directory may be a namespaced subdirectory that's yet to be created
+	if cErr := createDirIfAbsent(backupDIR); cErr != nil {
+		return "", "", errors.Errorf("failed to create backup directory: %s: %s", backupDIR, cErr)
+	}
+
+	workingPath = filepath.Join(backupDIR, workingDIRName, repo.Domain, repo.PathWithNameSpace)
+	backupPath = repoBackupPath(datedBackupDIR(backupDIR, dateDir), repo, flatLayout, flatLayoutSeparator)
+	statePath := backupStatePath(workingPath)
+
+	if data, rErr := os.ReadFile(statePath); rErr == nil {
+		var state backupState
+		if uErr := json.Unmarshal(data, &state); uErr != nil {
+			logger.Printf("recovering from unfinished backup of %s repo '%s'", repo.Domain, repo.PathWithNameSpace)
+		} else {
+			logger.Printf("recovering from unfinished backup of %s repo '%s' started at %s", repo.Domain, repo.PathWithNameSpace, state.Started)
+		}
+	}
+
+	// clean existing working directory, including any partial bundle
+	if delErr := os.RemoveAll(workingPath); delErr != nil {
+		return "", "", errors.Errorf("failed to remove working directory: %s: %s", workingPath, delErr)
+	}
+
+	if cErr := createDirIfAbsent(filepath.Dir(workingPath)); cErr != nil {
+		return "", "", errors.Errorf("failed to create working directory: %s: %s", filepath.Dir(workingPath), cErr)
+	}
+
+	data, mErr := json.Marshal(backupState{Repo: repo.PathWithNameSpace, Started: getTimestamp()})
+	if mErr != nil {
+		return "", "", errors.Errorf("failed to marshal backup state: %s", mErr)
+	}
+
+	if wErr := os.WriteFile(statePath, data, backupStateFileMode); wErr != nil {
+		return "", "", errors.Errorf("failed to write backup state: %s: %s", statePath, wErr)
+	}
+
+	return workingPath, backupPath, nil
+}
+
+// removeBackupState removes the state file once the backup has succeeded.
+func removeBackupState(logger Logger, workingPath string) {
+	if err := os.Remove(backupStatePath(workingPath)); err != nil && !os.IsNotExist(err) {
+		logger.Printf("failed to remove backup state: %s", err)
+	}
+}
+
+// finishWorkingClone removes the repository's working clone once it's been backed up, unless the
+// clones are to be kept. When using alternates, those of repositories with forks in the run are
+// kept until it ends, as the forks borrow objects from them. A clone that's kept has the
+// credentials removed from its remote's URL, so they aren't left on disk.
+func finishWorkingClone(logger Logger, in processBackupInput, workingPath string) {
+	if !in.KeepWorkingDir && !in.ForkParents[in.Repo.PathWithNameSpace] {
+		if err := os.RemoveAll(workingPath); err != nil {
+			logger.Printf("failed to remove working directory: %s: %s", workingPath, err)
+		}
+
+		return
+	}
+
+	if _, err := os.Stat(workingPath); err != nil {
+		return
+	}
+
+	// the backup's context may have ended, but the credentials must still be removed
+	setURLCmd := gitCommand(context.Background(), in.Git, "", "remote", "set-url", "origin",
+		redactURLCredentials(getCloneURL(in.Repo, in.SSHPrivateKeyPath)))
+	setURLCmd.Dir = workingPath
+
+	if out, err := setURLCmd.CombinedOutput(); err != nil {
+		logger.Printf("failed to remove credentials from working clone, so removing it: %s: %s: %s", workingPath, strings.TrimSpace(string(out)), err)
+
+		if rErr := os.RemoveAll(workingPath); rErr != nil {
+			logger.Printf("failed to remove working directory: %s: %s", workingPath, rErr)
+		}
+
+		return
+	}
+
+	logger.Printf("kept working clone of %s repo '%s' at %s", in.Repo.Domain, in.Repo.PathWithNameSpace, workingPath)
+}
+
+// redactURLCredentials returns the URL without any user information, e.g. a token.
+func redactURLCredentials(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		// the user information of a URL that can't be parsed is cut from its authority as text
+		scheme, rest, found := strings.Cut(rawURL, "://")
+		authority, _, _ := strings.Cut(rest, "/")
+
+		if at := strings.LastIndex(authority, "@"); found && at >= 0 {
+			return scheme + "://" + rest[at+1:]
+		}
+
+		return rawURL
+	}
+
+	if u.User == nil {
+		return rawURL
+	}
+
+	u.User = nil
+
+	return u.String()
+}
+
+// backupContextError returns the reason a backup's context has ended, if it has, distinguishing
+// the backup timing out from it being cancelled. The partial working clone of a timed out backup is removed.
+func backupContextError(parentCtx, ctx context.Context, logger Logger, timeout time.Duration, workingPath string) errors.E {
+	ctxErr := ctx.Err()
+	if ctxErr == nil {
+		return nil
+	}
+
+	if parentCtx.Err() != nil || !errors.Is(ctxErr, context.DeadlineExceeded) {
+		return errors.Wrap(ctxErr, "backup cancelled")
+	}
+
+	if err := os.RemoveAll(workingPath); err != nil {
+		logger.Printf("failed to remove working directory: %s: %s", workingPath, err)
+	}
+
+	return errors.Wrapf(ctxErr, "backup timed out after %s", timeout)
+}
+
+// buildCloneCommand returns the command that mirrors the repository to the working path.
+func buildCloneCommand(ctx context.Context, in processBackupInput, cloneURL, workingPath string) *exec.Cmd {
+	cloneArgs := []string{"clone", "-v", "--mirror"}
+
+	if in.PartialClone {
+		cloneArgs = append(cloneArgs, "--filter=blob:none")
+	}
+
+	if in.UseAlternates {
+		cloneArgs = append(cloneArgs, alternatesCloneArgs(getLogger(in.Logger), in.BackupDIR, in.Repo)...)
+	}
+
+	cloneCmd := gitCommand(ctx, in.Git, gitSSHCommand(in.SSHPrivateKeyPath, in.SSHKnownHostsPath), append(cloneArgs, cloneURL, workingPath)...)
+	cloneCmd.Dir = in.BackupDIR
+
+	return cloneCmd
+}
+
+// gitOptions are how git is run: the binary, configuration passed to every command with -c, and the
+// proxy and TLS verification to use for HTTPS remotes. The zero value runs git from the PATH without
+// any extra configuration.
+type gitOptions struct {
+	BinaryPath            string
+	ExtraConfig           []string
+	ProxyURL              string
+	CACertPath            string
+	InsecureSkipTLSVerify bool
 }
 
-func getHTTPClient() *retryablehttp.Client {
+// binary returns the git binary to run.
+func (o gitOptions) binary() string {
+	if o.BinaryPath == "" {
+		return defaultGitBinary
+	}
+
+	return o.BinaryPath
+}
+
+// args returns the arguments of a git command, preceded by the extra configuration in order.
+func (o gitOptions) args(args ...string) []string {
+	gitArgs := make([]string, 0, len(o.ExtraConfig)*2+len(args))
+
+	for _, config := range o.ExtraConfig {
+		gitArgs = append(gitArgs, "-c", config)
+	}
+
+	return append(gitArgs, args...)
+}
+
+// gitCommand returns a git command that, if an SSH command is specified, connects to SSH remotes with it.
+func gitCommand(ctx context.Context, gitOpts gitOptions, sshCommand string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, gitOpts.binary(), gitOpts.args(args...)...)
+
+	// without a terminal git, or a credential manager, would wait on a prompt for credentials that
+	// can never be answered rather than failing
+	env := []string{"GIT_TERMINAL_PROMPT=0", "GCM_INTERACTIVE=never"}
+
+	if sshCommand != "" {
+		env = append(env, "GIT_SSH_COMMAND="+sshCommand)
+	}
+
+	// the proxy is passed in the environment, rather than as configuration, to keep any credentials
+	// out of the process list
+	if gitOpts.ProxyURL != "" {
+		env = append(env, "http_proxy="+gitOpts.ProxyURL, "https_proxy="+gitOpts.ProxyURL)
+	}
+
+	if gitOpts.CACertPath != "" {
+		env = append(env, "GIT_SSL_CAINFO="+gitOpts.CACertPath)
+	}
+
+	if gitOpts.InsecureSkipTLSVerify {
+		env = append(env, "GIT_SSL_NO_VERIFY=true")
+	}
+
+	cmd.Env = append(os.Environ(), env...)
+
+	return cmd
+}
+
+// gitSSHCommand returns the command git should use to connect to SSH remotes with the private key,
+// or an empty string if no key is configured.
+func gitSSHCommand(sshPrivateKeyPath, sshKnownHostsPath string) string {
+	if sshPrivateKeyPath == "" {
+		return ""
+	}
+
+	// git runs the command with the shell so paths are quoted
+	sshCommand := "ssh -i " + shellQuote(sshPrivateKeyPath)
+
+	if sshKnownHostsPath != "" {
+		sshCommand += " -o UserKnownHostsFile=" + shellQuote(sshKnownHostsPath)
+	}
+
+	return sshCommand
+}
+
+func shellQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// repoBackupError adds the provider and repository to an error returned when backing up a repository
+// so it can be diagnosed without the logs. Any credentials from the clone URLs are masked.
+func repoBackupError(provider string, repo repository, err errors.E) errors.E {
+	if err == nil {
+		return nil
+	}
+
+	msg := err.Error()
+
+	masked := maskSecrets(msg, repoSecrets(repo))
+	if masked != msg {
+		// the original can't be retained as its details would expose the credentials
+		maskedErr := errors.Errorf("%s: %s: %s", provider, repo.PathWithNameSpace, masked)
+
+		var backupErr *BackupError
+		if errors.As(err, &backupErr) {
+			return errors.WithStack(&BackupError{RepoPath: backupErr.RepoPath, Phase: backupErr.Phase, Err: maskedErr})
+		}
+
+		return maskedErr
+	}
+
+	return errors.WithMessagef(err, "%s: %s", provider, repo.PathWithNameSpace)
+}
+
+// repoSecrets returns the credentials embedded in a repository's clone URLs.
+func repoSecrets(repo repository) []string {
+	var secrets []string
+
+	for _, cloneURL := range []string{repo.URLWithToken, repo.URLWithBasicAuth} {
+		u, err := url.Parse(cloneURL)
+		if err != nil || u.User == nil {
+			continue
+		}
+
+		// tokens without a password are passed as the username
+		if password, ok := u.User.Password(); ok {
+			secrets = append(secrets, password)
+		} else {
+			secrets = append(secrets, u.User.Username())
+		}
+	}
+
+	return secrets
+}
+
+// backupRoot returns the directory that a host's backups, and their working clones, are written under.
+// A namespace prefix keeps the backups of multiple accounts on the same domain apart.
+func backupRoot(backupDir, namespacePrefix string) string {
+	return filepath.Join(backupDir, namespacePrefix)
+}
+
+// repoBackupPath returns the directory the repository's bundles are kept in: <domain>/<path>, or
+// when using the flat layout, a single directory named with the domain and each part of the path
+// joined by the separator, e.g. github.com__owner__repo.
+func repoBackupPath(backupDIR string, repo repository, flatLayout bool, flatLayoutSeparator string) string {
+	if !flatLayout {
+		return filepath.Join(backupDIR, repo.Domain, repo.PathWithNameSpace)
+	}
+
+	if flatLayoutSeparator == "" {
+		flatLayoutSeparator = defaultFlatLayoutSeparator
+	}
+
+	parts := append([]string{repo.Domain}, strings.Split(repo.PathWithNameSpace, "/")...)
+
+	return filepath.Join(backupDIR, strings.Join(parts, flatLayoutSeparator))
+}
+
+// alternatesCloneArgs returns the clone arguments needed to borrow objects from the working clone
+// of a fork's upstream repository. The clone is dissociated once complete so that neither it nor
+// the resulting bundle depend on the upstream's object store.
+func alternatesCloneArgs(logger Logger, backupDIR string, repo repository) []string {
+	if repo.ForkParent == "" {
+		return nil
+	}
+
+	parentWorkingPath := filepath.Join(backupDIR, workingDIRName, repo.Domain, repo.ForkParent)
+	if _, err := os.Stat(filepath.Join(parentWorkingPath, "objects")); err != nil {
+		return nil
+	}
+
+	logger.Printf("using objects from %s working clone for fork %s", repo.ForkParent, repo.PathWithNameSpace)
+
+	return []string{"--reference-if-able", parentWorkingPath, "--dissociate"}
+}
+
+// forkParents returns the paths of the repositories that others in repos are forks of.
+func forkParents(repos []repository) map[string]bool {
+	parents := make(map[string]bool)
+
+	for _, repo := range repos {
+		if repo.ForkParent != "" {
+			parents[repo.ForkParent] = true
+		}
+	}
+
+	return parents
+}
+
+// removeForkParentClones removes the working clones kept for forks to borrow objects from, once
+// the run's backups have finished, unless every working clone is kept.
+func removeForkParentClones(logger Logger, in processBackupInput, repos []repository) {
+	if in.KeepWorkingDir {
+		return
+	}
+
+	for _, repo := range repos {
+		if !in.ForkParents[repo.PathWithNameSpace] {
+			continue
+		}
+
+		workingPath := filepath.Join(in.BackupDIR, workingDIRName, repo.Domain, repo.PathWithNameSpace)
+		if err := os.RemoveAll(workingPath); err != nil {
+			logger.Printf("failed to remove working directory: %s: %s", workingPath, err)
+		}
+	}
+}
+
+// backupBatches returns the repositories in the order they should be backed up.
+// When alternates are used, forks are deferred to a second batch so that their
+// upstream's working clone is complete before it's referenced.
+func backupBatches(repos []repository, useAlternates bool) [][]repository {
+	if !useAlternates {
+		return [][]repository{repos}
+	}
+
+	var upstreams, forks []repository
+
+	for _, repo := range repos {
+		if repo.ForkParent != "" {
+			forks = append(forks, repo)
+
+			continue
+		}
+
+		upstreams = append(upstreams, repo)
+	}
+
+	return [][]repository{upstreams, forks}
+}
+
+// getHTTPClient returns a client that retries failed requests, using the default retry settings
+// for any not specified. The TLS configuration, if specified, is used to connect to HTTPS servers.
+func getHTTPClient(retryMax, retryWaitMinSeconds, retryWaitMaxSeconds int, proxyURL string, tlsConfig *tls.Config) *retryablehttp.Client {
 	tr := &http.Transport{
+		Proxy:              getProxy(proxyURL),
+		TLSClientConfig:    tlsConfig,
 		DisableKeepAlives:  false,
 		DisableCompression: true,
 		MaxIdleConns:       maxIdleConns,
@@ -262,13 +1426,52 @@ func getHTTPClient() *retryablehttp.Client {
 	}
 
 	rc.Logger = nil
-	rc.RetryWaitMax = 120 * time.Second
-	rc.RetryWaitMin = 60 * time.Second
-	rc.RetryMax = 2
+	rc.RetryWaitMax = time.Duration(getRetrySetting(retryWaitMaxSeconds, defaultRetryWaitMaxSeconds)) * time.Second
+	rc.RetryWaitMin = time.Duration(getRetrySetting(retryWaitMinSeconds, defaultRetryWaitMinSeconds)) * time.Second
+	rc.RetryMax = getRetryCount(retryMax, defaultRetryMax)
+	rc.Backoff = jitterBackoff
 
 	return rc
 }
 
+// getProxy returns how the proxy for a request is chosen: the proxy URL if specified, and otherwise
+// those set with the HTTP_PROXY, HTTPS_PROXY, and NO_PROXY environment variables.
+func getProxy(proxyURL string) func(*http.Request) (*url.URL, error) {
+	if proxyURL == "" {
+		return http.ProxyFromEnvironment
+	}
+
+	u, err := url.Parse(proxyURL)
+	if err != nil {
+		return func(*http.Request) (*url.URL, error) {
+			return nil, errors.New("invalid proxy URL")
+		}
+	}
+
+	return http.ProxyURL(u)
+}
+
+// jitterBackoff doubles the wait after each attempt, up to the maximum, and then picks a random wait
+// between half and all of it so that concurrent workers don't retry in lockstep.
+// Any wait requested by the server with Retry-After is respected instead.
+func jitterBackoff(minWait, maxWait time.Duration, attemptNum int, resp *http.Response) time.Duration {
+	if resp != nil && resp.Header.Get("Retry-After") != "" &&
+		(resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable) {
+		return retryablehttp.DefaultBackoff(minWait, maxWait, attemptNum, resp)
+	}
+
+	exp := math.Pow(2, float64(attemptNum)) * float64(minWait)
+
+	wait := time.Duration(exp)
+	if exp > float64(maxWait) {
+		wait = maxWait
+	}
+
+	half := wait / 2
+
+	return half + time.Duration(rand.Int64N(int64(wait-half)+1))
+}
+
 func validDiffRemoteMethod(method string) error {
 	if !slices.Contains([]string{cloneMethod, refsMethod}, method) {
 		return fmt.Errorf("invalid diff remote method: %s", method)
@@ -0,0 +1,133 @@
+package githosts
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"time"
+)
+
+// dateDirFormat is the format of the names of the directories backups are grouped under by date.
+const dateDirFormat = "2006-01-02"
+
+// backupDateDir returns the name of the directory of today's date that a backup starting now groups
+// its bundles under, or an empty string if they're not grouped by date.
+func backupDateDir(dateDirLayout bool) string {
+	if !dateDirLayout {
+		return ""
+	}
+
+	return time.Now().Format(dateDirFormat)
+}
+
+// datedBackupDIR returns the directory that the repositories' backups are kept under: the backup
+// directory itself, or its directory of the date specified.
+func datedBackupDIR(backupDIR, dateDir string) string {
+	return filepath.Join(backupDIR, dateDir)
+}
+
+// dateDirNames returns the names of the date directories in backupDIR, newest first. Directories
+// not named as dates, such as the working directory, are ignored.
+func dateDirNames(backupDIR string) []string {
+	entries, err := os.ReadDir(backupDIR)
+	if err != nil {
+		return nil
+	}
+
+	var dateDirs []string
+
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+
+		if isDateDirName(entry.Name()) {
+			dateDirs = append(dateDirs, entry.Name())
+		}
+	}
+
+	// the names sort in date order
+	sort.Sort(sort.Reverse(sort.StringSlice(dateDirs)))
+
+	return dateDirs
+}
+
+// isDateDirName returns whether the directory is named as those backups are grouped under by date.
+func isDateDirName(name string) bool {
+	_, err := time.Parse(dateDirFormat, name)
+
+	return err == nil
+}
+
+// datedBackupPaths returns the backup paths of the repository that exist in each date directory,
+// newest first.
+func datedBackupPaths(backupDIR string, repo repository, flatLayout bool, flatLayoutSeparator string) []string {
+	var paths []string
+
+	for _, dateDir := range dateDirNames(backupDIR) {
+		backupPath := repoBackupPath(datedBackupDIR(backupDIR, dateDir), repo, flatLayout, flatLayoutSeparator)
+		if _, err := os.Stat(backupPath); err == nil {
+			paths = append(paths, backupPath)
+		}
+	}
+
+	return paths
+}
+
+// latestDatedBackupPath returns the backup path of the repository, in the directory of the most
+// recent date, that contains bundles, or an empty string if none do.
+func latestDatedBackupPath(logger Logger, backupDIR string, repo repository, flatLayout bool, flatLayoutSeparator string) string {
+	for _, backupPath := range datedBackupPaths(backupDIR, repo, flatLayout, flatLayoutSeparator) {
+		if dirHasBundles(logger, backupPath) {
+			return backupPath
+		}
+	}
+
+	return ""
+}
+
+// prunePaths returns the directories of the repository's backups that retention applies to: its
+// backup path or, when grouping backups by date, those in every date directory.
+func prunePaths(in processBackupInput, backupPath string) []string {
+	if in.DateDir == "" {
+		return []string{backupPath}
+	}
+
+	paths := datedBackupPaths(in.BackupDIR, in.Repo, in.FlatLayout, in.FlatLayoutSeparator)
+	if !slices.Contains(paths, backupPath) {
+		paths = append(paths, backupPath)
+	}
+
+	return paths
+}
+
+// removeEmptyDatedBackupPaths removes the directories of the repository's backups, other than
+// backupPath, left empty by pruning, along with any of their parents, up to the date directories
+// themselves, that are then empty.
+func removeEmptyDatedBackupPaths(logger Logger, backupDIR, backupPath string, paths []string) {
+	for _, path := range paths {
+		if path != backupPath {
+			removeEmptyParents(logger, path, backupDIR)
+		}
+	}
+}
+
+// renameSearchRoots returns the directories searched for the backups of a renamed repository,
+// along with the repository's backup path in each: the directory its backups are kept under or,
+// when grouping backups by date, every date directory, so its earlier backups are kept together.
+func renameSearchRoots(in processBackupInput, backupPath string) map[string]string {
+	root := datedBackupDIR(in.BackupDIR, in.DateDir)
+	roots := map[string]string{root: backupPath}
+
+	if in.DateDir == "" {
+		return roots
+	}
+
+	for _, dateDir := range dateDirNames(in.BackupDIR) {
+		dateRoot := datedBackupDIR(in.BackupDIR, dateDir)
+		roots[dateRoot] = repoBackupPath(dateRoot, in.Repo, in.FlatLayout, in.FlatLayoutSeparator)
+	}
+
+	return roots
+}
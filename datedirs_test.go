@@ -0,0 +1,172 @@
+package githosts
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatestDatedBackupPath(t *testing.T) {
+	t.Parallel()
+
+	backupDir := t.TempDir()
+	repo := repository{Domain: "example.com", PathWithNameSpace: "owner/repo"}
+
+	require.Empty(t, latestDatedBackupPath(logger, backupDir, repo, false, ""))
+
+	for _, dir := range []string{
+		filepath.Join(backupDir, "2024-01-01", "example.com", "owner", "repo"),
+		filepath.Join(backupDir, "2024-01-02", "example.com", "owner", "repo"),
+		// directories not named as dates are ignored
+		filepath.Join(backupDir, workingDIRName, "example.com", "owner", "repo"),
+	} {
+		require.NoError(t, os.MkdirAll(dir, 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "repo.20240101000000.bundle"), nil, 0o600))
+	}
+
+	// a more recent date without bundles of the repository is passed over
+	require.NoError(t, os.MkdirAll(filepath.Join(backupDir, "2024-01-03", "example.com", "owner", "repo"), 0o755))
+
+	require.Equal(t, filepath.Join(backupDir, "2024-01-02", "example.com", "owner", "repo"),
+		latestDatedBackupPath(logger, backupDir, repo, false, ""))
+}
+
+func TestProcessBackupDateDirLayout(t *testing.T) {
+	t.Parallel()
+
+	repoDir := setupTestRepo(t)
+	backupDir := t.TempDir()
+
+	repo := repository{
+		Name:              "repo",
+		PathWithNameSpace: "owner/repo",
+		Domain:            "local",
+		HTTPSUrl:          "file://" + repoDir,
+	}
+
+	backup := func(dateDir string) processBackupResult {
+		t.Helper()
+
+		result, err := processBackup(context.Background(), processBackupInput{
+			Repo:             repo,
+			BackupDIR:        backupDir,
+			DateDir:          dateDir,
+			DiffRemoteMethod: refsMethod,
+		})
+		require.NoError(t, err)
+
+		return result
+	}
+
+	bundleCount := func(dateDir string) int {
+		t.Helper()
+
+		files, err := getBundleFiles(filepath.Join(backupDir, dateDir, "local", "owner", "repo"))
+		require.NoError(t, err)
+
+		return len(files)
+	}
+
+	require.True(t, backup("2024-01-01").Updated)
+	require.Equal(t, 1, bundleCount("2024-01-01"))
+
+	// the repository changes, so the next date's bundle differs from the first's
+	require.NoError(t, os.WriteFile(filepath.Join(repoDir, "test.txt"), []byte("updated"), 0o600))
+	runGitCmd(t, repoDir, "commit", "-am", "update")
+
+	require.True(t, backup("2024-01-02").Updated)
+	require.Equal(t, 1, bundleCount("2024-01-02"))
+
+	// the refs match those of the newest bundle, in the previous date's directory, so nothing is
+	// backed up to the current date's
+	result := backup("2024-01-03")
+	require.True(t, result.Skipped)
+	require.Equal(t, skipReasonRefsMatch, result.SkipReason)
+	require.Positive(t, result.BundleBytes)
+
+	_, err := os.Stat(filepath.Join(backupDir, "2024-01-03", "local", "owner", "repo"))
+	require.True(t, os.IsNotExist(err))
+
+	// the working clones aren't kept in the date directories
+	_, err = os.Stat(filepath.Join(backupDir, "2024-01-01", workingDIRName))
+	require.True(t, os.IsNotExist(err))
+}
+
+func TestProcessBackupDateDirLayoutRetention(t *testing.T) {
+	t.Parallel()
+
+	repoDir := setupTestRepo(t)
+	backupDir := t.TempDir()
+
+	backup := func(dateDir string) {
+		t.Helper()
+
+		_, err := processBackup(context.Background(), processBackupInput{
+			Repo:          repository{Name: "repo", PathWithNameSpace: "owner/repo", Domain: "local", HTTPSUrl: "file://" + repoDir},
+			BackupDIR:     backupDir,
+			DateDir:       dateDir,
+			BackupsToKeep: 1,
+		})
+		require.NoError(t, err)
+	}
+
+	// an earlier date's backup
+	oldPath := filepath.Join(backupDir, "2024-01-01", "local", "owner", "repo")
+	require.NoError(t, os.MkdirAll(oldPath, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(oldPath, "repo.20240101000000.bundle"), nil, 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(oldPath, "repo.20240101000000.manifest"), nil, 0o600))
+
+	backup("2024-01-02")
+
+	// the bundles kept are counted across the date directories, and those left empty are removed
+	require.Equal(t, []string{"2024-01-02"}, dateDirNames(backupDir))
+	require.True(t, dirHasBundles(logger, filepath.Join(backupDir, "2024-01-02", "local", "owner", "repo")))
+}
+
+func TestProcessBackupDateDirLayoutRename(t *testing.T) {
+	t.Parallel()
+
+	repoDir := setupTestRepo(t)
+	backupDir := t.TempDir()
+
+	repo := repository{ID: "42", Name: "repo", PathWithNameSpace: "owner/repo", Domain: "local", HTTPSUrl: "file://" + repoDir}
+
+	backup := func(repo repository, dateDir string) {
+		t.Helper()
+
+		_, err := processBackup(context.Background(), processBackupInput{
+			Repo:          repo,
+			BackupDIR:     backupDir,
+			DateDir:       dateDir,
+			DetectRenames: true,
+		})
+		require.NoError(t, err)
+	}
+
+	backup(repo, "2024-01-01")
+	backup(repo, "2024-01-02")
+
+	renamed := repo
+	renamed.PathWithNameSpace = "owner/renamed"
+
+	backup(renamed, "2024-01-03")
+
+	// the earlier backups are moved to the new path within their date directories
+	for _, dateDir := range []string{"2024-01-01", "2024-01-02"} {
+		require.True(t, dirHasBundles(logger, filepath.Join(backupDir, dateDir, "local", "owner", "renamed")), dateDir)
+
+		_, err := os.Stat(filepath.Join(backupDir, dateDir, "local", "owner", "repo"))
+		require.True(t, os.IsNotExist(err), dateDir)
+	}
+
+	// the repository's backups are listed together, whichever date directories they're in
+	infos, err := ListBackups(backupDir, "")
+	require.NoError(t, err)
+	require.Len(t, infos, 1)
+	require.Equal(t, "local/owner/renamed", infos[0].Repo)
+	require.Equal(t, "local", infos[0].Domain)
+	require.Equal(t, 3, infos[0].Bundles)
+}
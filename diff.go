@@ -0,0 +1,50 @@
+package githosts
+
+import (
+	"context"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// DiffBundleRefs compares the refs of two bundles, such as generations of a repository's backups,
+// returning those only in the second as added, those only in the first as removed, and those in
+// both that point to different objects as changed. Added and changed refs map to their object in
+// the second bundle, and removed refs to theirs in the first. Either bundle may be compressed.
+func DiffBundleRefs(pathA, pathB string) (added, removed, changed map[string]string, err error) {
+	if pathA == "" || pathB == "" {
+		return nil, nil, nil, errors.New("bundle paths not specified")
+	}
+
+	refsA, err := getBundleRefs(context.Background(), gitOptions{}, pathA)
+	if err != nil {
+		return nil, nil, nil, errors.Errorf("failed to read bundle refs: %s: %s", pathA, err)
+	}
+
+	refsB, err := getBundleRefs(context.Background(), gitOptions{}, pathB)
+	if err != nil {
+		return nil, nil, nil, errors.Errorf("failed to read bundle refs: %s: %s", pathB, err)
+	}
+
+	added = map[string]string{}
+	removed = map[string]string{}
+	changed = map[string]string{}
+
+	for ref, sha := range refsB {
+		previous, ok := refsA[ref]
+
+		switch {
+		case !ok:
+			added[ref] = sha
+		case previous != sha:
+			changed[ref] = sha
+		}
+	}
+
+	for ref, sha := range refsA {
+		if _, ok := refsB[ref]; !ok {
+			removed[ref] = sha
+		}
+	}
+
+	return added, removed, changed, nil
+}
@@ -0,0 +1,52 @@
+package githosts
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffBundleRefs(t *testing.T) {
+	t.Parallel()
+
+	repoDir := setupTestRepo(t)
+	bundlesDir := t.TempDir()
+	runGitCmd(t, repoDir, "branch", "removed")
+
+	previous := filepath.Join(bundlesDir, "repo.20200101000000.bundle")
+	runGitCmd(t, repoDir, "bundle", "create", previous, "--all")
+
+	previousMain := strings.TrimSpace(runGitCmd(t, repoDir, "rev-parse", "main"))
+
+	// the next generation gains a branch, loses one, and main moves on
+	require.NoError(t, os.WriteFile(filepath.Join(repoDir, "second.txt"), []byte("second"), 0o600))
+	runGitCmd(t, repoDir, "add", "second.txt")
+	runGitCmd(t, repoDir, "commit", "-m", "second commit")
+	runGitCmd(t, repoDir, "branch", "feature")
+	runGitCmd(t, repoDir, "branch", "-D", "removed")
+
+	latest := filepath.Join(bundlesDir, "repo.20200102000000.bundle")
+	runGitCmd(t, repoDir, "bundle", "create", latest, "--all")
+
+	latestMain := strings.TrimSpace(runGitCmd(t, repoDir, "rev-parse", "main"))
+
+	added, removed, changed, err := DiffBundleRefs(previous, latest)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"refs/heads/feature": latestMain}, added)
+	require.Equal(t, map[string]string{"refs/heads/removed": previousMain}, removed)
+	require.Equal(t, latestMain, changed["refs/heads/main"])
+	require.NotContains(t, changed, "refs/heads/feature")
+
+	// identical generations don't differ
+	added, removed, changed, err = DiffBundleRefs(latest, latest)
+	require.NoError(t, err)
+	require.Empty(t, added)
+	require.Empty(t, removed)
+	require.Empty(t, changed)
+
+	_, _, _, err = DiffBundleRefs(previous, filepath.Join(bundlesDir, "missing.bundle"))
+	require.ErrorContains(t, err, "failed to read bundle refs")
+}
@@ -0,0 +1,33 @@
+package githosts
+
+import (
+	"gitlab.com/tozd/go/errors"
+)
+
+const bytesPerMB = 1024 * 1024
+
+// checkFreeDiskSpace returns an error if less than minFreeDiskMB megabytes are free on the volume
+// holding path. The check is skipped if minFreeDiskMB isn't set, or the free space can't be found.
+func checkFreeDiskSpace(logger Logger, path string, minFreeDiskMB int) errors.E {
+	if minFreeDiskMB <= 0 {
+		return nil
+	}
+
+	free, ok, err := freeDiskSpace(path)
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		logger.Printf("skipping free disk space check as it isn't supported on this platform")
+
+		return nil
+	}
+
+	if free < uint64(minFreeDiskMB)*bytesPerMB {
+		return errors.Errorf("insufficient disk space: %d MB free on the volume holding %s, %d MB required",
+			free/bytesPerMB, path, minFreeDiskMB)
+	}
+
+	return nil
+}
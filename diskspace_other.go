@@ -0,0 +1,12 @@
+//go:build !(linux || darwin || freebsd)
+
+package githosts
+
+import (
+	"gitlab.com/tozd/go/errors"
+)
+
+// freeDiskSpace reports that the free disk space can't be found on this platform.
+func freeDiskSpace(_ string) (uint64, bool, errors.E) {
+	return 0, false, nil
+}
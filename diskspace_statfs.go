@@ -0,0 +1,20 @@
+//go:build linux || darwin || freebsd
+
+package githosts
+
+import (
+	"syscall"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// freeDiskSpace returns the bytes available to unprivileged users on the volume holding path.
+func freeDiskSpace(path string) (uint64, bool, errors.E) {
+	var stat syscall.Statfs_t
+
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, false, errors.Errorf("failed to get free disk space of %s: %s", path, err)
+	}
+
+	return uint64(stat.Bavail) * uint64(stat.Bsize), true, nil //nolint:unconvert // the types differ between platforms
+}
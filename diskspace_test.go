@@ -0,0 +1,56 @@
+package githosts
+
+import (
+	"context"
+	"math"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessBackupMinFreeDiskSpace(t *testing.T) {
+	t.Parallel()
+
+	repoDir := setupTestRepo(t)
+
+	repo := repository{
+		Name:              "repo",
+		PathWithNameSpace: "owner/repo",
+		Domain:            "local",
+		HTTPSUrl:          "file://" + repoDir,
+	}
+
+	// more space than any volume has
+	backupDir := t.TempDir()
+	in := processBackupInput{Repo: repo, BackupDIR: backupDir, MinFreeDiskMB: math.MaxInt32}
+
+	result := backupRepository(context.Background(), genericProviderName, in)
+	require.Equal(t, statusFailed, result.Status)
+	require.ErrorContains(t, result.Error, "insufficient disk space")
+
+	var backupErr *BackupError
+
+	require.ErrorAs(t, result.Error, &backupErr)
+	require.Equal(t, BackupPhaseClone, backupErr.Phase)
+	require.False(t, dirHasBundles(logger, filepath.Join(backupDir, "local", "owner", "repo")))
+
+	// a megabyte is free on any volume the tests can run on
+	in.MinFreeDiskMB = 1
+
+	result = backupRepository(context.Background(), genericProviderName, in)
+	require.NoError(t, result.Error)
+	require.Equal(t, statusOk, result.Status)
+	require.True(t, dirHasBundles(logger, filepath.Join(backupDir, "local", "owner", "repo")))
+}
+
+func TestValidMinFreeDiskMB(t *testing.T) {
+	t.Parallel()
+
+	require.NoError(t, validMinFreeDiskMB(0))
+	require.NoError(t, validMinFreeDiskMB(512))
+	require.Error(t, validMinFreeDiskMB(-1))
+
+	_, err := NewGitHubHost(NewGitHubHostInput{MinFreeDiskMB: -1})
+	require.ErrorContains(t, err, "invalid minimum free disk space")
+}
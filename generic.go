@@ -0,0 +1,450 @@
+package githosts
+
+import (
+	"context"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	genericProviderName = "Generic"
+	// genericLocalDomain is used as the domain for repositories cloned from the local filesystem.
+	genericLocalDomain = "local"
+)
+
+// GenericCredentials are the optional basic auth credentials used to clone a repository.
+type GenericCredentials struct {
+	Username string
+	Password string
+}
+
+type NewGenericHostInput struct {
+	Caller                string
+	DiffRemoteMethod      string
+	BackupDir             string
+	NamespacePrefix       string
+	BundleRefSpec         string
+	BundleNameTemplate    string
+	FlatLayout            bool
+	FlatLayoutSeparator   string
+	DateDirLayout         bool
+	RefSpec               []string
+	MaxConcurrent         int
+	MaxRepos              int
+	DryRun                bool
+	FailFast              bool
+	FailOnAnyError        bool
+	PartialClone          bool
+	KeepWorkingDir        bool
+	BackupSubmodules      bool
+	VerifyAfterCreate     *bool // defaults to true
+	CompressBundles       bool
+	ArchivePerRepo        bool
+	KeepArchivedFiles     bool
+	SSHPrivateKeyPath     string
+	SSHKnownHostsPath     string
+	URLs                  []string
+	Credentials           map[string]GenericCredentials // keyed by clone URL
+	BackupsToRetain       int
+	KeepForDays           int
+	CloneRetries          int // defaults to 2, -1 disables retries
+	MinFreeDiskMB         int
+	LogLevel              int
+	Logger                Logger
+	Progress              func(done, total int, repo string)
+	RemoteStore           RemoteStore
+	RepoBackupTimeout     time.Duration
+	LockTimeout           time.Duration
+	GitBinaryPath         string
+	ExtraGitConfig        []string
+	NotifyWebhookURL      string
+	ProxyURL              string
+	CACertPath            string
+	InsecureSkipTLSVerify bool
+}
+
+// GenericHost backs up an explicit list of repository clone URLs without using a provider API.
+type GenericHost struct {
+	Caller                string
+	Provider              string
+	DiffRemoteMethod      string
+	BackupDir             string
+	NamespacePrefix       string
+	BundleRefSpec         string
+	RefSpec               []string
+	refSpecPatterns       []*regexp.Regexp
+	BundleNameTemplate    string
+	FlatLayout            bool
+	FlatLayoutSeparator   string
+	DateDirLayout         bool
+	MaxConcurrent         int
+	MaxRepos              int
+	DryRun                bool
+	FailFast              bool
+	FailOnAnyError        bool
+	PartialClone          bool
+	KeepWorkingDir        bool
+	BackupSubmodules      bool
+	VerifyAfterCreate     bool
+	CompressBundles       bool
+	ArchivePerRepo        bool
+	KeepArchivedFiles     bool
+	SSHPrivateKeyPath     string
+	SSHKnownHostsPath     string
+	URLs                  []string
+	Credentials           map[string]GenericCredentials
+	BackupsToRetain       int
+	KeepForDays           int
+	CloneRetries          int
+	MinFreeDiskMB         int
+	LogLevel              int
+	Logger                Logger
+	Progress              func(done, total int, repo string)
+	RemoteStore           RemoteStore
+	RepoBackupTimeout     time.Duration
+	LockTimeout           time.Duration
+	GitBinaryPath         string
+	ExtraGitConfig        []string
+	NotifyWebhookURL      string
+	ProxyURL              string
+	CACertPath            string
+	InsecureSkipTLSVerify bool
+}
+
+// validGenericURLs checks at least one repository URL is specified, and each can be parsed.
+func validGenericURLs(urls []string) error {
+	if len(urls) == 0 {
+		return errors.New("no repository URLs specified")
+	}
+
+	for _, u := range urls {
+		if _, err := parseCloneURL(u); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Validate checks the input's settings, returning an error listing each that's missing or invalid.
+func (input NewGenericHostInput) Validate() error {
+	return errors.Join(
+		validGenericURLs(input.URLs),
+		validBackupDir(input.BackupDir),
+		validDiffRemoteMethodSetting(input.DiffRemoteMethod),
+		validNamespacePrefix(input.NamespacePrefix),
+		validBundleRefSpec(input.BundleRefSpec, input.RefSpec),
+		validBundleNameTemplate(input.BundleNameTemplate),
+		validFlatLayoutSeparator(input.FlatLayoutSeparator),
+		validMaxConcurrent(input.MaxConcurrent),
+		validMaxRepos(input.MaxRepos),
+		validCloneRetries(input.CloneRetries),
+		validMinFreeDiskMB(input.MinFreeDiskMB),
+		validSSHAuth(input.SSHPrivateKeyPath, input.SSHKnownHostsPath),
+		validRepoBackupTimeout(input.RepoBackupTimeout),
+		validLockTimeout(input.LockTimeout),
+		validExtraGitConfig(input.ExtraGitConfig),
+		validNotifyWebhookURL(input.NotifyWebhookURL),
+		validProxyURL(input.ProxyURL),
+		validTLSConfig(input.CACertPath, input.InsecureSkipTLSVerify),
+	)
+}
+
+func NewGenericHost(input NewGenericHostInput) (*GenericHost, error) {
+	if input.Logger == nil {
+		setLoggerPrefix(input.Caller)
+	}
+
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
+
+	diffRemoteMethod, err := getDiffRemoteMethod(getLogger(input.Logger), input.DiffRemoteMethod)
+	if err != nil {
+		return nil, err
+	}
+
+	bundleRefSpec, err := getBundleRefSpec(input.BundleRefSpec)
+	if err != nil {
+		return nil, err
+	}
+
+	if input.InsecureSkipTLSVerify {
+		getLogger(input.Logger).Println("WARNING: TLS certificate verification is disabled")
+	}
+
+	return &GenericHost{
+		Caller:                input.Caller,
+		Provider:              genericProviderName,
+		DiffRemoteMethod:      diffRemoteMethod,
+		BackupDir:             input.BackupDir,
+		NamespacePrefix:       input.NamespacePrefix,
+		BundleRefSpec:         bundleRefSpec,
+		RefSpec:               input.RefSpec,
+		refSpecPatterns:       compileRefSpec(input.RefSpec),
+		BundleNameTemplate:    input.BundleNameTemplate,
+		FlatLayout:            input.FlatLayout,
+		FlatLayoutSeparator:   input.FlatLayoutSeparator,
+		DateDirLayout:         input.DateDirLayout,
+		MaxConcurrent:         input.MaxConcurrent,
+		MaxRepos:              input.MaxRepos,
+		DryRun:                input.DryRun,
+		FailFast:              input.FailFast,
+		FailOnAnyError:        input.FailOnAnyError,
+		PartialClone:          input.PartialClone,
+		KeepWorkingDir:        input.KeepWorkingDir,
+		BackupSubmodules:      input.BackupSubmodules,
+		VerifyAfterCreate:     input.VerifyAfterCreate == nil || *input.VerifyAfterCreate,
+		CompressBundles:       input.CompressBundles,
+		ArchivePerRepo:        input.ArchivePerRepo,
+		KeepArchivedFiles:     input.KeepArchivedFiles,
+		SSHPrivateKeyPath:     input.SSHPrivateKeyPath,
+		SSHKnownHostsPath:     input.SSHKnownHostsPath,
+		URLs:                  input.URLs,
+		Credentials:           input.Credentials,
+		BackupsToRetain:       input.BackupsToRetain,
+		KeepForDays:           input.KeepForDays,
+		CloneRetries:          input.CloneRetries,
+		MinFreeDiskMB:         input.MinFreeDiskMB,
+		LogLevel:              input.LogLevel,
+		Logger:                input.Logger,
+		Progress:              input.Progress,
+		RemoteStore:           input.RemoteStore,
+		RepoBackupTimeout:     input.RepoBackupTimeout,
+		LockTimeout:           input.LockTimeout,
+		GitBinaryPath:         input.GitBinaryPath,
+		ExtraGitConfig:        input.ExtraGitConfig,
+		NotifyWebhookURL:      input.NotifyWebhookURL,
+		ProxyURL:              input.ProxyURL,
+		CACertPath:            input.CACertPath,
+		InsecureSkipTLSVerify: input.InsecureSkipTLSVerify,
+	}, nil
+}
+
+// parseCloneURL derives a repository from a clone URL in either URL or scp-like (user@host:path) form.
+func parseCloneURL(rawURL string) (repository, errors.E) {
+	rawURL = strings.TrimSpace(rawURL)
+	if rawURL == "" {
+		return repository{}, errors.New("repository URL not specified")
+	}
+
+	var domain, repoPath string
+
+	var isSSH bool
+
+	if !strings.Contains(rawURL, "://") {
+		// scp-like syntax, e.g. git@example.com:owner/repo.git
+		hostPart, pathPart, found := strings.Cut(rawURL, ":")
+		if !found || strings.Contains(hostPart, "/") {
+			return repository{}, errors.Errorf("unsupported repository URL: %s", rawURL)
+		}
+
+		if _, host, hasUser := strings.Cut(hostPart, "@"); hasUser {
+			hostPart = host
+		}
+
+		domain = hostPart
+		repoPath = pathPart
+		isSSH = true
+	} else {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return repository{}, errors.Errorf("failed to parse repository URL: %s", redactURLCredentials(rawURL))
+		}
+
+		switch u.Scheme {
+		case "file":
+			domain = genericLocalDomain
+		case "http", "https", "ssh", "git":
+			domain = u.Hostname()
+		default:
+			return repository{}, errors.Errorf("unsupported repository URL scheme: %s", u.Scheme)
+		}
+
+		repoPath = u.Path
+		isSSH = u.Scheme == "ssh"
+	}
+
+	repoPath = strings.TrimSuffix(strings.Trim(repoPath, "/"), ".git")
+	if domain == "" || repoPath == "" {
+		return repository{}, errors.Errorf("unable to determine repository from URL: %s", redactURLCredentials(rawURL))
+	}
+
+	// the domain and path form the backup path, so they mustn't lead outside the backup directory
+	if domain == "." || domain == ".." || slices.Contains(strings.Split(repoPath, "/"), "..") {
+		return repository{}, errors.Errorf("repository URL path must not contain '..': %s", redactURLCredentials(rawURL))
+	}
+
+	repo := repository{
+		Name:              repoPath[strings.LastIndex(repoPath, "/")+1:],
+		Owner:             ownerFromPath(repoPath),
+		PathWithNameSpace: repoPath,
+		Domain:            domain,
+	}
+
+	if isSSH {
+		repo.SSHUrl = rawURL
+	} else {
+		repo.HTTPSUrl = rawURL
+	}
+
+	return repo, nil
+}
+
+func (gh *GenericHost) describeRepos(ctx context.Context) (describeReposOutput, errors.E) {
+	var repos []repository
+
+	// the same path may exist on more than one host so dedupe by domain and path
+	seen := make(map[string]bool)
+
+	for _, u := range gh.URLs {
+		repo, err := parseCloneURL(u)
+		if err != nil {
+			return describeReposOutput{}, err
+		}
+
+		key := repo.Domain + "/" + repo.PathWithNameSpace
+		if seen[key] {
+			continue
+		}
+
+		seen[key] = true
+
+		if creds, ok := gh.Credentials[u]; ok && repo.HTTPSUrl != "" {
+			cloneURL, aErr := AddBasicAuthToURL(repo.HTTPSUrl, creds.Username, creds.Password)
+			if aErr != nil {
+				return describeReposOutput{}, errors.Errorf("failed to add basic auth to URL: %s", aErr)
+			}
+
+			repo.URLWithBasicAuth = cloneURL
+		}
+
+		repos = append(repos, repo)
+	}
+
+	return describeReposOutput{
+		Repos: repos,
+	}, nil
+}
+
+func (gh *GenericHost) getAPIURL() string {
+	return ""
+}
+
+// return normalised method.
+func (gh *GenericHost) diffRemoteMethod() string {
+	return normaliseDiffRemoteMethod(gh.logger(), gh.DiffRemoteMethod)
+}
+
+// logger returns the configured logger, or the package's default if none was specified.
+func (gh *GenericHost) logger() Logger {
+	return getLogger(gh.Logger)
+}
+
+// backupInput returns the settings each of the host's repositories is backed up with.
+func (gh *GenericHost) backupInput() processBackupInput {
+	return processBackupInput{
+		LogLevel:            gh.LogLevel,
+		Logger:              gh.logger(),
+		RemoteStore:         gh.RemoteStore,
+		StoreKeyPrefix:      gh.NamespacePrefix,
+		RepoBackupTimeout:   gh.RepoBackupTimeout,
+		Git:                 gitOptions{BinaryPath: gh.GitBinaryPath, ExtraConfig: gh.ExtraGitConfig, ProxyURL: gh.ProxyURL, CACertPath: gh.CACertPath, InsecureSkipTLSVerify: gh.InsecureSkipTLSVerify},
+		BackupDIR:           backupRoot(gh.BackupDir, gh.NamespacePrefix),
+		BackupsToKeep:       gh.BackupsToRetain,
+		KeepForDays:         gh.KeepForDays,
+		CloneRetries:        gh.CloneRetries,
+		MinFreeDiskMB:       gh.MinFreeDiskMB,
+		DiffRemoteMethod:    gh.diffRemoteMethod(),
+		BundleRefSpec:       gh.BundleRefSpec,
+		RefSpec:             gh.refSpecPatterns,
+		BundleNameTemplate:  gh.BundleNameTemplate,
+		FlatLayout:          gh.FlatLayout,
+		FlatLayoutSeparator: gh.FlatLayoutSeparator,
+		DateDir:             backupDateDir(gh.DateDirLayout),
+		DryRun:              gh.DryRun,
+		PartialClone:        gh.PartialClone,
+		KeepWorkingDir:      gh.KeepWorkingDir,
+		SkipVerify:          !gh.VerifyAfterCreate,
+		CompressBundles:     gh.CompressBundles,
+		ArchivePerRepo:      gh.ArchivePerRepo,
+		KeepArchivedFiles:   gh.KeepArchivedFiles,
+		SSHPrivateKeyPath:   gh.SSHPrivateKeyPath,
+		SSHKnownHostsPath:   gh.SSHKnownHostsPath,
+	}
+}
+
+func (gh *GenericHost) Backup() ProviderBackupResult {
+	return gh.BackupWithContext(context.Background())
+}
+
+// BackupWithContext backs up the host's repositories. Any not yet backed up when the context is
+// cancelled are reported as failed.
+func (gh *GenericHost) BackupWithContext(ctx context.Context) ProviderBackupResult {
+	release, err := acquireBackupLocks(ctx, []GitProvider{gh})
+	if err != nil {
+		return ProviderBackupResult{Error: err}
+	}
+
+	defer release()
+
+	return gh.backupWithCloneTokens(ctx, nil)
+}
+
+// backupLock returns the directory locked while the host is backed up, and how long to wait for it.
+func (gh *GenericHost) backupLock() (string, time.Duration) {
+	return gh.BackupDir, gh.LockTimeout
+}
+
+// backupWithCloneTokens backs up the host's repositories, each holding a token from cloneTokens, if
+// specified, while being backed up.
+func (gh *GenericHost) backupWithCloneTokens(ctx context.Context, cloneTokens chan struct{}) ProviderBackupResult {
+	in := gh.backupInput()
+
+	result := gh.backup(ctx, in, cloneTokens)
+
+	updateBackupIndexes(gh.logger(), in, result.BackupResults)
+
+	// the CA certificate was read successfully when the host was created
+	tlsConfig, _ := getTLSConfig(gh.CACertPath, gh.InsecureSkipTLSVerify)
+
+	notifyWebhook(ctx, gh.logger(), getHTTPClient(0, 0, 0, gh.ProxyURL, tlsConfig), gh.NotifyWebhookURL, genericProviderName, result)
+
+	return result
+}
+
+func (gh *GenericHost) backup(ctx context.Context, in processBackupInput, cloneTokens chan struct{}) ProviderBackupResult {
+	if gh.BackupDir == "" {
+		gh.logger().Printf("backup skipped as backup directory not specified")
+
+		return ProviderBackupResult{
+			BackupResults: nil,
+			Error:         errors.New("backup directory not specified"),
+		}
+	}
+
+	repoDesc, err := gh.describeRepos(ctx)
+	if err != nil {
+		return ProviderBackupResult{
+			BackupResults: nil,
+			Error:         err,
+		}
+	}
+
+	if mErr := checkMaxRepos(gh.logger(), genericProviderName, len(repoDesc.Repos), gh.MaxRepos); mErr != nil {
+		return ProviderBackupResult{Error: mErr}
+	}
+
+	return runBackups(ctx, genericProviderName, in, nil, repoDesc.Repos, cloneTokens, backupRunOptions{
+		MaxConcurrent:    getMaxConcurrent(gh.MaxConcurrent, defaultMaxConcurrentGeneric),
+		FailFast:         gh.FailFast,
+		FailOnAnyError:   gh.FailOnAnyError,
+		BackupSubmodules: gh.BackupSubmodules,
+		Progress:         gh.Progress,
+	})
+}
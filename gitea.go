@@ -8,6 +8,7 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"regexp"
 	"slices"
 	"strconv"
 	"strings"
@@ -34,62 +35,264 @@ const (
 )
 
 type NewGiteaHostInput struct {
-	Caller           string
-	HTTPClient       *retryablehttp.Client
-	APIURL           string
-	DiffRemoteMethod string
-	BackupDir        string
-	Token            string
-	Orgs             []string
-	BackupsToRetain  int
-	LogLevel         int
+	Caller                string
+	HTTPClient            *retryablehttp.Client
+	RetryMax              int // defaults to 2, -1 disables retries
+	RetryWaitMinSeconds   int
+	RetryWaitMaxSeconds   int
+	APIURL                string
+	DiffRemoteMethod      string
+	BackupDir             string
+	NamespacePrefix       string
+	BundleRefSpec         string
+	BundleNameTemplate    string
+	FlatLayout            bool
+	FlatLayoutSeparator   string
+	DateDirLayout         bool
+	DetectRenames         bool
+	RefSpec               []string
+	Include               []string
+	Exclude               []string
+	RepoListFile          string
+	RepoListMode          string
+	MaxConcurrent         int
+	MaxRepos              int
+	PageDelayMs           int
+	DryRun                bool
+	FailFast              bool
+	FailOnAnyError        bool
+	PartialClone          bool
+	KeepWorkingDir        bool
+	BackupSubmodules      bool
+	VerifyAfterCreate     *bool // defaults to true
+	CompressBundles       bool
+	ArchivePerRepo        bool
+	KeepArchivedFiles     bool
+	SSHPrivateKeyPath     string
+	SSHKnownHostsPath     string
+	Token                 string
+	Orgs                  []string
+	BackupsToRetain       int
+	KeepForDays           int
+	CloneRetries          int // defaults to 2, -1 disables retries
+	MinFreeDiskMB         int
+	UpdatedSince          time.Time
+	LogLevel              int
+	Logger                Logger
+	Progress              func(done, total int, repo string)
+	RemoteStore           RemoteStore
+	RepoBackupTimeout     time.Duration
+	LockTimeout           time.Duration
+	GitBinaryPath         string
+	ExtraGitConfig        []string
+	NotifyWebhookURL      string
+	ProxyURL              string
+	CACertPath            string
+	InsecureSkipTLSVerify bool
+	ListCacheDir          string
+	UseAlternates         bool
+	SkipArchived          bool
+	SkipForks             bool
+	IncludeMirrors        *bool // defaults to true
 }
 
 type GiteaHost struct {
-	Caller           string
-	httpClient       *retryablehttp.Client
-	APIURL           string
-	DiffRemoteMethod string
-	BackupDir        string
-	BackupsToRetain  int
-	Token            string
-	Orgs             []string
-	LogLevel         int
+	Caller                string
+	httpClient            *retryablehttp.Client
+	APIURL                string
+	DiffRemoteMethod      string
+	BackupDir             string
+	NamespacePrefix       string
+	BundleRefSpec         string
+	RefSpec               []string
+	refSpecPatterns       []*regexp.Regexp
+	BundleNameTemplate    string
+	FlatLayout            bool
+	FlatLayoutSeparator   string
+	DateDirLayout         bool
+	DetectRenames         bool
+	Include               []string
+	Exclude               []string
+	RepoList              []string
+	RepoListMode          string
+	MaxConcurrent         int
+	MaxRepos              int
+	PageDelayMs           int
+	DryRun                bool
+	FailFast              bool
+	FailOnAnyError        bool
+	PartialClone          bool
+	KeepWorkingDir        bool
+	BackupSubmodules      bool
+	VerifyAfterCreate     bool
+	CompressBundles       bool
+	ArchivePerRepo        bool
+	KeepArchivedFiles     bool
+	SSHPrivateKeyPath     string
+	SSHKnownHostsPath     string
+	BackupsToRetain       int
+	KeepForDays           int
+	CloneRetries          int
+	MinFreeDiskMB         int
+	UpdatedSince          time.Time
+	Token                 string
+	Orgs                  []string
+	LogLevel              int
+	Logger                Logger
+	Progress              func(done, total int, repo string)
+	RemoteStore           RemoteStore
+	RepoBackupTimeout     time.Duration
+	LockTimeout           time.Duration
+	GitBinaryPath         string
+	ExtraGitConfig        []string
+	NotifyWebhookURL      string
+	ProxyURL              string
+	CACertPath            string
+	InsecureSkipTLSVerify bool
+	ListCacheDir          string
+	UseAlternates         bool
+	SkipArchived          bool
+	SkipForks             bool
+	IncludeMirrors        bool
+}
+
+// validGiteaAPIURL checks the API URL is specified and has a domain.
+func validGiteaAPIURL(logger Logger, apiURL string) error {
+	if apiURL == "" {
+		return fmt.Errorf("%s API URL missing", giteaProviderName)
+	}
+
+	if extractDomainFromAPIUrl(logger, apiURL) == "" {
+		return fmt.Errorf("%s API URL invalid: %s", giteaProviderName, apiURL)
+	}
+
+	return nil
+}
+
+// Validate checks the input's settings, returning an error listing each that's missing or invalid.
+func (input NewGiteaHostInput) Validate() error {
+	return errors.Join(
+		validGiteaAPIURL(getLogger(input.Logger), input.APIURL),
+		validRequired(input.Token, "token"),
+		validBackupDir(input.BackupDir),
+		validDiffRemoteMethodSetting(input.DiffRemoteMethod),
+		validNamespacePrefix(input.NamespacePrefix),
+		validBundleRefSpec(input.BundleRefSpec, input.RefSpec),
+		validBundleNameTemplate(input.BundleNameTemplate),
+		validFlatLayoutSeparator(input.FlatLayoutSeparator),
+		validRepoFilters(input.Include, input.Exclude),
+		validRepoList(input.RepoListFile, input.RepoListMode),
+		validMaxConcurrent(input.MaxConcurrent),
+		validMaxRepos(input.MaxRepos),
+		validRetryConfig(input.RetryMax, input.RetryWaitMinSeconds, input.RetryWaitMaxSeconds),
+		validCloneRetries(input.CloneRetries),
+		validMinFreeDiskMB(input.MinFreeDiskMB),
+		validPageDelay(input.PageDelayMs),
+		validSSHAuth(input.SSHPrivateKeyPath, input.SSHKnownHostsPath),
+		validRepoBackupTimeout(input.RepoBackupTimeout),
+		validLockTimeout(input.LockTimeout),
+		validExtraGitConfig(input.ExtraGitConfig),
+		validNotifyWebhookURL(input.NotifyWebhookURL),
+		validProxyURL(input.ProxyURL),
+		validTLSConfig(input.CACertPath, input.InsecureSkipTLSVerify),
+	)
 }
 
 func NewGiteaHost(input NewGiteaHostInput) (*GiteaHost, error) {
-	setLoggerPrefix(input.Caller)
+	if input.Logger == nil {
+		setLoggerPrefix(input.Caller)
+	}
 
-	if input.APIURL == "" {
-		return nil, fmt.Errorf("%s API URL missing", giteaProviderName)
+	if err := input.Validate(); err != nil {
+		return nil, err
 	}
 
-	diffRemoteMethod, err := getDiffRemoteMethod(input.DiffRemoteMethod)
+	diffRemoteMethod, err := getDiffRemoteMethod(getLogger(input.Logger), input.DiffRemoteMethod)
 	if err != nil {
 		return nil, err
 	}
 
-	if diffRemoteMethod == "" {
-		logger.Print("using default diff remote method: " + defaultRemoteMethod)
-		diffRemoteMethod = defaultRemoteMethod
-	} else {
-		logger.Print("using diff remote method: " + diffRemoteMethod)
+	bundleRefSpec, err := getBundleRefSpec(input.BundleRefSpec)
+	if err != nil {
+		return nil, err
+	}
+
+	repoList, repoListMode, err := readRepoList(input.RepoListFile, input.RepoListMode)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := getTLSConfig(input.CACertPath, input.InsecureSkipTLSVerify)
+	if err != nil {
+		return nil, err
+	}
+
+	if input.InsecureSkipTLSVerify {
+		getLogger(input.Logger).Println("WARNING: TLS certificate verification is disabled")
 	}
 
 	httpClient := input.HTTPClient
 	if httpClient == nil {
-		httpClient = getHTTPClient()
+		httpClient = getHTTPClient(input.RetryMax, input.RetryWaitMinSeconds, input.RetryWaitMaxSeconds, input.ProxyURL, tlsConfig)
 	}
 
 	return &GiteaHost{
-		httpClient:       httpClient,
-		APIURL:           input.APIURL,
-		DiffRemoteMethod: diffRemoteMethod,
-		BackupDir:        input.BackupDir,
-		BackupsToRetain:  input.BackupsToRetain,
-		Token:            input.Token,
-		Orgs:             input.Orgs,
-		LogLevel:         input.LogLevel,
+		httpClient:            httpClient,
+		APIURL:                strings.TrimSuffix(input.APIURL, "/"),
+		DiffRemoteMethod:      diffRemoteMethod,
+		BackupDir:             input.BackupDir,
+		NamespacePrefix:       input.NamespacePrefix,
+		BundleRefSpec:         bundleRefSpec,
+		RefSpec:               input.RefSpec,
+		refSpecPatterns:       compileRefSpec(input.RefSpec),
+		BundleNameTemplate:    input.BundleNameTemplate,
+		FlatLayout:            input.FlatLayout,
+		FlatLayoutSeparator:   input.FlatLayoutSeparator,
+		DateDirLayout:         input.DateDirLayout,
+		DetectRenames:         input.DetectRenames,
+		Include:               input.Include,
+		Exclude:               input.Exclude,
+		RepoList:              repoList,
+		RepoListMode:          repoListMode,
+		MaxConcurrent:         input.MaxConcurrent,
+		MaxRepos:              input.MaxRepos,
+		PageDelayMs:           input.PageDelayMs,
+		DryRun:                input.DryRun,
+		FailFast:              input.FailFast,
+		FailOnAnyError:        input.FailOnAnyError,
+		PartialClone:          input.PartialClone,
+		KeepWorkingDir:        input.KeepWorkingDir,
+		BackupSubmodules:      input.BackupSubmodules,
+		VerifyAfterCreate:     input.VerifyAfterCreate == nil || *input.VerifyAfterCreate,
+		CompressBundles:       input.CompressBundles,
+		ArchivePerRepo:        input.ArchivePerRepo,
+		KeepArchivedFiles:     input.KeepArchivedFiles,
+		SSHPrivateKeyPath:     input.SSHPrivateKeyPath,
+		SSHKnownHostsPath:     input.SSHKnownHostsPath,
+		BackupsToRetain:       input.BackupsToRetain,
+		KeepForDays:           input.KeepForDays,
+		CloneRetries:          input.CloneRetries,
+		MinFreeDiskMB:         input.MinFreeDiskMB,
+		UpdatedSince:          input.UpdatedSince,
+		Token:                 input.Token,
+		Orgs:                  input.Orgs,
+		LogLevel:              input.LogLevel,
+		Logger:                input.Logger,
+		Progress:              input.Progress,
+		RemoteStore:           input.RemoteStore,
+		RepoBackupTimeout:     input.RepoBackupTimeout,
+		LockTimeout:           input.LockTimeout,
+		GitBinaryPath:         input.GitBinaryPath,
+		ExtraGitConfig:        input.ExtraGitConfig,
+		NotifyWebhookURL:      input.NotifyWebhookURL,
+		ProxyURL:              input.ProxyURL,
+		CACertPath:            input.CACertPath,
+		InsecureSkipTLSVerify: input.InsecureSkipTLSVerify,
+		ListCacheDir:          input.ListCacheDir,
+		UseAlternates:         input.UseAlternates,
+		SkipArchived:          input.SkipArchived,
+		SkipForks:             input.SkipForks,
+		IncludeMirrors:        input.IncludeMirrors == nil || *input.IncludeMirrors,
 	}, nil
 }
 
@@ -120,8 +323,8 @@ type (
 	giteaGetOrganizationsResponse []giteaOrganization
 )
 
-func (g *GiteaHost) makeGiteaRequest(reqUrl string) (*http.Response, []byte, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultHttpRequestTimeout)
+func (g *GiteaHost) makeGiteaRequest(ctx context.Context, reqUrl string) (*http.Response, []byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultHttpRequestTimeout)
 	defer cancel()
 
 	req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodGet, reqUrl, nil)
@@ -132,6 +335,7 @@ func (g *GiteaHost) makeGiteaRequest(reqUrl string) (*http.Response, []byte, err
 	req.Header.Set("Authorization", "token "+g.Token)
 	req.Header.Set("Content-Type", contentTypeApplicationJSON)
 	req.Header.Set("Accept", contentTypeApplicationJSON)
+	setListCacheHeaders(g.ListCacheDir, reqUrl, req)
 
 	resp, err := g.httpClient.Do(req)
 	if err != nil {
@@ -147,6 +351,8 @@ func (g *GiteaHost) makeGiteaRequest(reqUrl string) (*http.Response, []byte, err
 
 	_ = resp.Body.Close()
 
+	resp, body = useListCache(g.logger(), g.ListCacheDir, reqUrl, resp, body)
+
 	return resp, body, err
 }
 
@@ -162,6 +368,7 @@ type repoExistsInput struct {
 	urlWithToken      string
 	urlWithBasicAuth  string
 	logLevel          int
+	logger            Logger
 }
 
 type userExistsInput struct {
@@ -181,6 +388,8 @@ type organizationExistsInput struct {
 }
 
 func repoExists(in repoExistsInput) bool {
+	logger := getLogger(in.logger)
+
 	switch in.matchBy {
 	case giteaMatchByExact:
 		if in.logLevel > 0 {
@@ -332,22 +541,22 @@ func organisationExists(in organizationExistsInput) bool {
 	return false
 }
 
-func (g *GiteaHost) describeRepos() (describeReposOutput, errors.E) {
-	logger.Println("listing repositories")
+func (g *GiteaHost) describeRepos(ctx context.Context) (describeReposOutput, errors.E) {
+	g.logger().Println("listing repositories")
 
-	userRepos, err := g.getAllUserRepositories()
+	userRepos, err := g.getAllUserRepositories(ctx)
 	if err != nil {
 		return describeReposOutput{}, errors.Errorf("failed to get user repositories: %s", err)
 	}
 
-	orgs, err := g.getOrganizations()
+	orgs, err := g.getOrganizations(ctx)
 	if err != nil {
 		return describeReposOutput{}, errors.Errorf("failed to get organizations: %s", err)
 	}
 
 	var orgsRepos []repository
 	if len(orgs) > 0 {
-		orgsRepos, err = g.getOrganizationsRepos(orgs)
+		orgsRepos, err = g.getOrganizationsRepos(ctx, orgs)
 		if err != nil {
 			return describeReposOutput{}, errors.Errorf("failed to get organizations repos: %s", err)
 		}
@@ -358,38 +567,77 @@ func (g *GiteaHost) describeRepos() (describeReposOutput, errors.E) {
 	}, nil
 }
 
-func extractDomainFromAPIUrl(apiUrl string) string {
+// filterGiteaRepos returns the repositories to back up, optionally omitting those that are archived
+// or mirrors of other repositories.
+func filterGiteaRepos(repos []giteaRepository, skipArchived, includeMirrors bool) []giteaRepository {
+	var filtered []giteaRepository
+
+	for _, repo := range repos {
+		if (skipArchived && repo.Archived) || (!includeMirrors && repo.Mirror) {
+			continue
+		}
+
+		filtered = append(filtered, repo)
+	}
+
+	return filtered
+}
+
+// extractDomainFromAPIUrl returns the host name of the API URL, used as the domain of the instance's
+// repositories. Ports and paths, such as /api/v1 or one the instance is served under, are ignored.
+func extractDomainFromAPIUrl(logger Logger, apiUrl string) string {
+	apiUrl = strings.TrimSpace(apiUrl)
+	if !strings.Contains(apiUrl, "://") {
+		apiUrl = "https://" + apiUrl
+	}
+
 	u, err := url.Parse(apiUrl)
 	if err != nil {
 		logger.Printf("failed to parse apiUrl %s: %v", apiUrl, err)
+
+		return ""
 	}
 
-	return u.Hostname()
+	return strings.ToLower(u.Hostname())
 }
 
-func (g *GiteaHost) getOrganizationsRepos(organizations []giteaOrganization) ([]repository, errors.E) {
-	domain := extractDomainFromAPIUrl(g.APIURL)
+// errGiteaOrganizationNotFound is returned when a specified organization doesn't exist, in which case
+// it's skipped rather than failing the backup of the remaining organizations.
+var errGiteaOrganizationNotFound = errors.Base("organization not found")
+
+func (g *GiteaHost) getOrganizationsRepos(ctx context.Context, organizations []giteaOrganization) ([]repository, errors.E) {
+	domain := extractDomainFromAPIUrl(g.logger(), g.APIURL)
 
 	var repos []repository
 
 	for _, org := range organizations {
 		if g.LogLevel > 0 {
-			logger.Printf("getting repositories from gitea organization %s", org.Name)
+			g.logger().Printf("getting repositories from gitea organization %s", org.Name)
+		}
+
+		orgRepos, err := g.getOrganizationRepos(ctx, org.Name)
+		if errors.Is(err, errGiteaOrganizationNotFound) {
+			g.logger().Printf("organization %s not found, skipping", org.Name)
+
+			continue
 		}
 
-		orgRepos, err := g.getOrganizationRepos(org.Name)
 		if err != nil {
 			return nil, errors.Errorf("failed to get organization %s repos: %s", org.Name, err)
 		}
 
 		for _, orgRepo := range orgRepos {
 			repos = append(repos, repository{
+				ID:                providerRepoID(int64(orgRepo.Id)),
 				Name:              orgRepo.Name,
 				Owner:             orgRepo.Owner.Login,
 				HTTPSUrl:          orgRepo.CloneUrl,
 				SSHUrl:            orgRepo.SshUrl,
 				PathWithNameSpace: orgRepo.FullName,
 				Domain:            domain,
+				IsFork:            orgRepo.Fork,
+				ForkParent:        orgRepo.forkParent(),
+				UpdatedAt:         orgRepo.UpdatedAt,
 			})
 		}
 	}
@@ -397,20 +645,20 @@ func (g *GiteaHost) getOrganizationsRepos(organizations []giteaOrganization) ([]
 	return repos, nil
 }
 
-func (g *GiteaHost) getAllUsers() ([]giteaUser, errors.E) {
+func (g *GiteaHost) getAllUsers(ctx context.Context) ([]giteaUser, errors.E) {
 	if strings.TrimSpace(g.APIURL) == "" {
 		g.APIURL = gitlabAPIURL
 	}
 
 	getUsersURL := g.APIURL + "/admin/users"
 	if g.LogLevel > 0 {
-		logger.Printf("get users url: %s", getUsersURL)
+		g.logger().Printf("get users url: %s", getUsersURL)
 	}
 
 	// Initial request
 	u, err := url.Parse(getUsersURL)
 	if err != nil {
-		logger.Printf("failed to parse get users URL %s: %v", getUsersURL, err)
+		g.logger().Printf("failed to parse get users URL %s: %v", getUsersURL, err)
 
 		return nil, errors.Wrap(err, "failed to parse get users URL")
 	}
@@ -430,28 +678,28 @@ func (g *GiteaHost) getAllUsers() ([]giteaUser, errors.E) {
 	for {
 		var resp *http.Response
 
-		resp, body, err = g.makeGiteaRequest(reqUrl)
+		resp, body, err = g.makeGiteaRequest(ctx, reqUrl)
 		if err != nil {
-			logger.Printf("failed to get users: %v", err)
+			g.logger().Printf("failed to get users: %v", err)
 
 			return nil, errors.Wrap(err, "failed to make Gitea request")
 		}
 
 		if g.LogLevel > 0 {
-			logger.Printf(string(body))
+			g.logger().Printf(string(body))
 		}
 
 		switch resp.StatusCode {
 		case http.StatusOK:
 			if g.LogLevel > 0 {
-				logger.Println("users retrieved successfully")
+				g.logger().Println("users retrieved successfully")
 			}
 		case http.StatusForbidden:
-			logger.Println("failed to get users due to invalid or missing credentials (HTTP 403)")
+			g.logger().Println("failed to get users due to invalid or missing credentials (HTTP 403)")
 
 			return nil, errors.Wrap(err, "forbidden response to Gitea request")
 		default:
-			logger.Printf("failed to get users with unexpected response: %d (%s)", resp.StatusCode, resp.Status)
+			g.logger().Printf("failed to get users with unexpected response: %d (%s)", resp.StatusCode, resp.Status)
 
 			return nil, errors.Wrap(err, "unexpected errors making Gitea request")
 		}
@@ -459,7 +707,7 @@ func (g *GiteaHost) getAllUsers() ([]giteaUser, errors.E) {
 		var respObj giteaGetUsersResponse
 
 		if err = json.Unmarshal(body, &respObj); err != nil {
-			logger.Println(err)
+			g.logger().Println(err)
 
 			return nil, errors.Wrap(err, "failed to unmarshal Gitea response")
 		}
@@ -477,15 +725,19 @@ func (g *GiteaHost) getAllUsers() ([]giteaUser, errors.E) {
 		if reqUrl == "" {
 			break
 		}
+
+		if sErr := sleepWithContext(ctx, time.Duration(g.PageDelayMs)*time.Millisecond); sErr != nil {
+			return nil, sErr
+		}
 	}
 
 	return users, nil
 }
 
-func (g *GiteaHost) getOrganizations() ([]giteaOrganization, errors.E) {
+func (g *GiteaHost) getOrganizations(ctx context.Context) ([]giteaOrganization, errors.E) {
 	if len(g.Orgs) == 0 {
 		if g.LogLevel > 0 {
-			logger.Print("no organizations specified")
+			g.logger().Println("no organizations specified")
 		}
 
 		return nil, nil
@@ -500,13 +752,19 @@ func (g *GiteaHost) getOrganizations() ([]giteaOrganization, errors.E) {
 	if slices.Contains(g.Orgs, "*") {
 		var err errors.E
 
-		organizations, err = g.getAllOrganizations()
+		organizations, err = g.getAllOrganizations(ctx)
 		if err != nil {
 			return nil, errors.Errorf("failed to get all organizations: %s", err.Error())
 		}
 	} else {
 		for _, orgName := range g.Orgs {
-			org, err := g.getOrganization(orgName)
+			org, err := g.getOrganization(ctx, orgName)
+			if errors.Is(err, errGiteaOrganizationNotFound) {
+				g.logger().Printf("organization %s not found, skipping", orgName)
+
+				continue
+			}
+
 			if err != nil {
 				return nil, errors.Errorf("failed to get organization %s: %s", orgName, err.Error())
 			}
@@ -518,9 +776,9 @@ func (g *GiteaHost) getOrganizations() ([]giteaOrganization, errors.E) {
 	return organizations, nil
 }
 
-func (g *GiteaHost) getOrganization(orgName string) (giteaOrganization, errors.E) {
+func (g *GiteaHost) getOrganization(ctx context.Context, orgName string) (giteaOrganization, errors.E) {
 	if g.LogLevel > 0 {
-		logger.Printf("retrieving organization %s", orgName)
+		g.logger().Printf("retrieving organization %s", orgName)
 	}
 
 	if strings.TrimSpace(g.APIURL) == "" {
@@ -530,13 +788,13 @@ func (g *GiteaHost) getOrganization(orgName string) (giteaOrganization, errors.E
 	getOrganizationsURL := fmt.Sprintf("%s%s", g.APIURL+"/orgs/", orgName)
 
 	if g.LogLevel > 0 {
-		logger.Printf("get organization url: %s", getOrganizationsURL)
+		g.logger().Printf("get organization url: %s", getOrganizationsURL)
 	}
 
 	// Initial request
 	u, err := url.Parse(getOrganizationsURL)
 	if err != nil {
-		logger.Printf("failed to parse get organization URL %s: %v", getOrganizationsURL, err)
+		g.logger().Printf("failed to parse get organization URL %s: %v", getOrganizationsURL, err)
 
 		return giteaOrganization{}, errors.Errorf("failed to parse get organization URL: %s", err.Error())
 	}
@@ -548,13 +806,13 @@ func (g *GiteaHost) getOrganization(orgName string) (giteaOrganization, errors.E
 
 	var resp *http.Response
 
-	resp, body, err = g.makeGiteaRequest(reqUrl)
+	resp, body, err = g.makeGiteaRequest(ctx, reqUrl)
 	if err != nil {
 		return giteaOrganization{}, errors.Wrap(err, fmt.Sprintf("failed to get organization: %s", orgName))
 	}
 
 	if g.LogLevel > 0 {
-		logger.Print(string(body))
+		g.logger().Println(string(body))
 	}
 
 	var organization giteaOrganization
@@ -562,20 +820,22 @@ func (g *GiteaHost) getOrganization(orgName string) (giteaOrganization, errors.E
 	switch resp.StatusCode {
 	case http.StatusOK:
 		if g.LogLevel > 0 {
-			logger.Println("organizations retrieved successfully")
+			g.logger().Println("organizations retrieved successfully")
 		}
 	case http.StatusForbidden:
-		logger.Println("failed to get organizations due to invalid or missing credentials (HTTP 403)")
+		g.logger().Println("failed to get organizations due to invalid or missing credentials (HTTP 403)")
 
 		return giteaOrganization{}, errors.Errorf("failed to get organizations due to invalid or missing credentials (HTTP 403)")
+	case http.StatusNotFound:
+		return giteaOrganization{}, errors.WithStack(errGiteaOrganizationNotFound)
 	default:
-		logger.Printf("failed to get organizations with unexpected response: %d (%s)", resp.StatusCode, resp.Status)
+		g.logger().Printf("failed to get organizations with unexpected response: %d (%s)", resp.StatusCode, resp.Status)
 
 		return giteaOrganization{}, errors.Errorf("failed to get organizations with unexpected response: %d (%s)", resp.StatusCode, resp.Status)
 	}
 
 	if err = json.Unmarshal(body, &organization); err != nil {
-		logger.Printf("failed to unmarshal organization json response: %v", err.Error())
+		g.logger().Printf("failed to unmarshal organization json response: %v", err.Error())
 
 		return giteaOrganization{}, errors.Errorf("failed to unmarshal organization json response: %s", err.Error())
 	}
@@ -587,8 +847,8 @@ func (g *GiteaHost) getOrganization(orgName string) (giteaOrganization, errors.E
 	return organization, nil
 }
 
-func (g *GiteaHost) getAllOrganizations() ([]giteaOrganization, errors.E) {
-	logger.Printf("retrieving organizations")
+func (g *GiteaHost) getAllOrganizations(ctx context.Context) ([]giteaOrganization, errors.E) {
+	g.logger().Printf("retrieving organizations")
 
 	if strings.TrimSpace(g.APIURL) == "" {
 		g.APIURL = gitlabAPIURL
@@ -596,13 +856,13 @@ func (g *GiteaHost) getAllOrganizations() ([]giteaOrganization, errors.E) {
 
 	getOrganizationsURL := g.APIURL + "/orgs"
 	if g.LogLevel > 0 {
-		logger.Printf("get organizations url: %s", getOrganizationsURL)
+		g.logger().Printf("get organizations url: %s", getOrganizationsURL)
 	}
 
 	// Initial request
 	u, err := url.Parse(getOrganizationsURL)
 	if err != nil {
-		logger.Printf("failed to parse get organizations URL %s: %v", getOrganizationsURL, err)
+		g.logger().Printf("failed to parse get organizations URL %s: %v", getOrganizationsURL, err)
 
 		return nil, nil
 	}
@@ -622,28 +882,28 @@ func (g *GiteaHost) getAllOrganizations() ([]giteaOrganization, errors.E) {
 	for {
 		var resp *http.Response
 
-		resp, body, err = g.makeGiteaRequest(reqUrl)
+		resp, body, err = g.makeGiteaRequest(ctx, reqUrl)
 		if err != nil {
-			logger.Printf("failed to get organizations: %v", err.Error())
+			g.logger().Printf("failed to get organizations: %v", err.Error())
 
 			return nil, nil
 		}
 
 		if g.LogLevel > 0 {
-			logger.Print(string(body))
+			g.logger().Println(string(body))
 		}
 
 		switch resp.StatusCode {
 		case http.StatusOK:
 			if g.LogLevel > 0 {
-				logger.Println("organizations retrieved successfully")
+				g.logger().Println("organizations retrieved successfully")
 			}
 		case http.StatusForbidden:
-			logger.Println("failed to get organizations due to invalid or missing credentials (HTTP 403)")
+			g.logger().Println("failed to get organizations due to invalid or missing credentials (HTTP 403)")
 
 			return organizations, nil
 		default:
-			logger.Printf("failed to get organizations with unexpected response: %d (%s)",
+			g.logger().Printf("failed to get organizations with unexpected response: %d (%s)",
 				resp.StatusCode, resp.Status)
 
 			return organizations, nil
@@ -671,6 +931,10 @@ func (g *GiteaHost) getAllOrganizations() ([]giteaOrganization, errors.E) {
 		if reqUrl == "" {
 			break
 		}
+
+		if sErr := sleepWithContext(ctx, time.Duration(g.PageDelayMs)*time.Millisecond); sErr != nil {
+			return nil, sErr
+		}
 	}
 
 	return organizations, nil
@@ -701,35 +965,35 @@ type giteaRepository struct {
 		StarredReposCount int       `json:"starred_repos_count"`
 		Username          string    `json:"username"`
 	} `json:"owner"`
-	Name            string      `json:"name"`
-	FullName        string      `json:"full_name"`
-	Description     string      `json:"description"`
-	Empty           bool        `json:"empty"`
-	Private         bool        `json:"private"`
-	Fork            bool        `json:"fork"`
-	Template        bool        `json:"template"`
-	Parent          interface{} `json:"parent"`
-	Mirror          bool        `json:"mirror"`
-	Size            int         `json:"size"`
-	Language        string      `json:"language"`
-	LanguagesUrl    string      `json:"languages_url"`
-	HtmlUrl         string      `json:"html_url"`
-	Link            string      `json:"link"`
-	SshUrl          string      `json:"ssh_url"`
-	CloneUrl        string      `json:"clone_url"`
-	OriginalUrl     string      `json:"original_url"`
-	Website         string      `json:"website"`
-	StarsCount      int         `json:"stars_count"`
-	ForksCount      int         `json:"forks_count"`
-	WatchersCount   int         `json:"watchers_count"`
-	OpenIssuesCount int         `json:"open_issues_count"`
-	OpenPrCounter   int         `json:"open_pr_counter"`
-	ReleaseCounter  int         `json:"release_counter"`
-	DefaultBranch   string      `json:"default_branch"`
-	Archived        bool        `json:"archived"`
-	CreatedAt       time.Time   `json:"created_at"`
-	UpdatedAt       time.Time   `json:"updated_at"`
-	ArchivedAt      time.Time   `json:"archived_at"`
+	Name            string           `json:"name"`
+	FullName        string           `json:"full_name"`
+	Description     string           `json:"description"`
+	Empty           bool             `json:"empty"`
+	Private         bool             `json:"private"`
+	Fork            bool             `json:"fork"`
+	Template        bool             `json:"template"`
+	Parent          *giteaRepository `json:"parent"`
+	Mirror          bool             `json:"mirror"`
+	Size            int              `json:"size"`
+	Language        string           `json:"language"`
+	LanguagesUrl    string           `json:"languages_url"`
+	HtmlUrl         string           `json:"html_url"`
+	Link            string           `json:"link"`
+	SshUrl          string           `json:"ssh_url"`
+	CloneUrl        string           `json:"clone_url"`
+	OriginalUrl     string           `json:"original_url"`
+	Website         string           `json:"website"`
+	StarsCount      int              `json:"stars_count"`
+	ForksCount      int              `json:"forks_count"`
+	WatchersCount   int              `json:"watchers_count"`
+	OpenIssuesCount int              `json:"open_issues_count"`
+	OpenPrCounter   int              `json:"open_pr_counter"`
+	ReleaseCounter  int              `json:"release_counter"`
+	DefaultBranch   string           `json:"default_branch"`
+	Archived        bool             `json:"archived"`
+	CreatedAt       time.Time        `json:"created_at"`
+	UpdatedAt       time.Time        `json:"updated_at"`
+	ArchivedAt      time.Time        `json:"archived_at"`
 	Permissions     struct {
 		Admin bool `json:"admin"`
 		Push  bool `json:"push"`
@@ -763,8 +1027,16 @@ type giteaRepository struct {
 	RepoTransfer                  interface{} `json:"repo_transfer"`
 }
 
-func (g *GiteaHost) getOrganizationRepos(organizationName string) ([]giteaRepository, errors.E) {
-	logger.Printf("retrieving repositories for organization %s", organizationName)
+func (r giteaRepository) forkParent() string {
+	if !r.Fork || r.Parent == nil {
+		return ""
+	}
+
+	return r.Parent.FullName
+}
+
+func (g *GiteaHost) getOrganizationRepos(ctx context.Context, organizationName string) ([]giteaRepository, errors.E) {
+	g.logger().Printf("retrieving repositories for organization %s", organizationName)
 
 	if strings.TrimSpace(g.APIURL) == "" {
 		g.APIURL = gitlabAPIURL
@@ -772,7 +1044,7 @@ func (g *GiteaHost) getOrganizationRepos(organizationName string) ([]giteaReposi
 
 	getOrganizationReposURL := g.APIURL + fmt.Sprintf("/orgs/%s/repos", organizationName)
 	if g.LogLevel > 0 {
-		logger.Printf("get %s organization repos url: %s", organizationName, getOrganizationReposURL)
+		g.logger().Printf("get %s organization repos url: %s", organizationName, getOrganizationReposURL)
 	}
 
 	// Initial request
@@ -796,24 +1068,26 @@ func (g *GiteaHost) getOrganizationRepos(organizationName string) ([]giteaReposi
 	for {
 		var resp *http.Response
 
-		resp, body, err = g.makeGiteaRequest(reqUrl)
+		resp, body, err = g.makeGiteaRequest(ctx, reqUrl)
 		if err != nil {
 			return nil, errors.Errorf("failed to make Gitea request: %s", err)
 		}
 
 		if g.LogLevel > 0 {
-			logger.Print(string(body))
+			g.logger().Println(string(body))
 		}
 
 		switch resp.StatusCode {
 		case http.StatusOK:
 			if g.LogLevel > 0 {
-				logger.Println("repos retrieved successfully")
+				g.logger().Println("repos retrieved successfully")
 			}
 		case http.StatusForbidden:
 			return nil, errors.Errorf("failed to get repos due to invalid or missing credentials (HTTP 403)")
+		case http.StatusNotFound:
+			return nil, errors.WithStack(errGiteaOrganizationNotFound)
 		default:
-			logger.Printf("failed to get repos with unexpected response: %d (%s)", resp.StatusCode, resp.Status)
+			g.logger().Printf("failed to get repos with unexpected response: %d (%s)", resp.StatusCode, resp.Status)
 
 			return nil, nil
 		}
@@ -824,7 +1098,7 @@ func (g *GiteaHost) getOrganizationRepos(organizationName string) ([]giteaReposi
 			return nil, errors.Errorf("failed to unmarshal organization repos json response: %s", err)
 		}
 
-		repos = append(repos, respObj...)
+		repos = append(repos, filterGiteaRepos(respObj, g.SkipArchived, g.IncludeMirrors)...)
 
 		// if we got a link response then
 		// reset request url
@@ -840,27 +1114,34 @@ func (g *GiteaHost) getOrganizationRepos(organizationName string) ([]giteaReposi
 		if reqUrl == "" {
 			break
 		}
+
+		if sErr := sleepWithContext(ctx, time.Duration(g.PageDelayMs)*time.Millisecond); sErr != nil {
+			return nil, sErr
+		}
 	}
 
 	return repos, nil
 }
 
-func (g *GiteaHost) getAllUserRepos(userName string) ([]repository, errors.E) {
-	logger.Printf("retrieving all repositories for user %s", userName)
+func (g *GiteaHost) getAllUserRepos(ctx context.Context, userName string) ([]repository, errors.E) {
+	g.logger().Printf("retrieving all repositories for user %s", userName)
 
 	if strings.TrimSpace(g.APIURL) == "" {
 		g.APIURL = gitlabAPIURL
 	}
 
+	// the same domain as organizations' repositories so the instance's backups are stored together
+	domain := extractDomainFromAPIUrl(g.logger(), g.APIURL)
+
 	getOrganizationReposURL := g.APIURL + fmt.Sprintf("/users/%s/repos", userName)
 	if g.LogLevel > 0 {
-		logger.Printf("get %s user repos url: %s", userName, getOrganizationReposURL)
+		g.logger().Printf("get %s user repos url: %s", userName, getOrganizationReposURL)
 	}
 
 	// Initial request
 	u, err := url.Parse(getOrganizationReposURL)
 	if err != nil {
-		logger.Printf("failed to parse get %s user repos URL %s: %v", userName, getOrganizationReposURL, err)
+		g.logger().Printf("failed to parse get %s user repos URL %s: %v", userName, getOrganizationReposURL, err)
 
 		return nil, errors.Wrap(err, "failed to parse get user repos URL")
 	}
@@ -880,28 +1161,28 @@ func (g *GiteaHost) getAllUserRepos(userName string) ([]repository, errors.E) {
 	for {
 		var resp *http.Response
 
-		resp, body, err = g.makeGiteaRequest(reqUrl)
+		resp, body, err = g.makeGiteaRequest(ctx, reqUrl)
 		if err != nil {
-			logger.Printf("failed to get repos: %v", err)
+			g.logger().Printf("failed to get repos: %v", err)
 
 			return nil, errors.Wrap(err, "failed to parse get user repos URL")
 		}
 
 		if g.LogLevel > 0 {
-			logger.Print(string(body))
+			g.logger().Println(string(body))
 		}
 
 		switch resp.StatusCode {
 		case http.StatusOK:
 			if g.LogLevel > 0 {
-				logger.Println("repos retrieved successfully")
+				g.logger().Println("repos retrieved successfully")
 			}
 		case http.StatusForbidden:
-			logger.Println("failed to get repos due to invalid or missing credentials (HTTP 403)")
+			g.logger().Println("failed to get repos due to invalid or missing credentials (HTTP 403)")
 
 			return nil, errors.Wrap(err, "failed to get repos due to invalid or missing credentials (HTTP 403)")
 		default:
-			logger.Printf("failed to get repos with unexpected response: %d (%s)", resp.StatusCode, resp.Status)
+			g.logger().Printf("failed to get repos with unexpected response: %d (%s)", resp.StatusCode, resp.Status)
 
 			return nil, errors.Wrap(err, "failed to parse get user repos URL")
 		}
@@ -912,23 +1193,18 @@ func (g *GiteaHost) getAllUserRepos(userName string) ([]repository, errors.E) {
 			return nil, errors.Wrap(err, "failed to unmarshal user repos json response")
 		}
 
-		for _, r := range respObj {
-			var ru *url.URL
-
-			ru, err = url.Parse(r.CloneUrl)
-			if err != nil {
-				logger.Printf("failed to parse clone url for %s\n", r.Name)
-
-				return nil, errors.Wrap(err, fmt.Sprintf("failed to parse clone url for: %s", r.CloneUrl))
-			}
-
+		for _, r := range filterGiteaRepos(respObj, g.SkipArchived, g.IncludeMirrors) {
 			repos = append(repos, repository{
+				ID:                providerRepoID(int64(r.Id)),
 				Name:              r.Name,
 				Owner:             r.Owner.Login,
 				HTTPSUrl:          r.CloneUrl,
 				SSHUrl:            r.SshUrl,
-				Domain:            ru.Host,
+				Domain:            domain,
 				PathWithNameSpace: r.FullName,
+				IsFork:            r.Fork,
+				ForkParent:        r.forkParent(),
+				UpdatedAt:         r.UpdatedAt,
 			})
 		}
 
@@ -943,6 +1219,10 @@ func (g *GiteaHost) getAllUserRepos(userName string) ([]repository, errors.E) {
 		if reqUrl == "" {
 			break
 		}
+
+		if sErr := sleepWithContext(ctx, time.Duration(g.PageDelayMs)*time.Millisecond); sErr != nil {
+			return nil, sErr
+		}
 	}
 
 	return repos, nil
@@ -954,50 +1234,102 @@ func (g *GiteaHost) getAPIURL() string {
 
 // return normalised method.
 func (g *GiteaHost) diffRemoteMethod() string {
-	switch strings.ToLower(g.DiffRemoteMethod) {
-	case refsMethod:
-		return refsMethod
-	case cloneMethod:
-		return cloneMethod
-	default:
-		logger.Printf("unexpected diff remote method: %s", g.DiffRemoteMethod)
+	return normaliseDiffRemoteMethod(g.logger(), g.DiffRemoteMethod)
+}
 
-		return "invalid remote comparison method"
-	}
+// logger returns the configured logger, or the package's default if none was specified, masking
+// the token in any lines logged.
+func (g *GiteaHost) logger() Logger {
+	return newMaskingLogger(getLogger(g.Logger), g.Token, strings.TrimSpace(g.Token))
 }
 
-func giteaWorker(token string, logLevel int, backupDIR, diffRemoteMethod string, backupsToKeep int, jobs <-chan repository, results chan<- RepoBackupResults) {
-	for repo := range jobs {
-		firstPos := strings.Index(repo.HTTPSUrl, "//")
-		repo.URLWithToken = fmt.Sprintf("%s%s@%s", repo.HTTPSUrl[:firstPos+2], token, repo.HTTPSUrl[firstPos+2:])
-		err := processBackup(logLevel, repo, backupDIR, backupsToKeep, diffRemoteMethod)
+// backupInput returns the settings each of the host's repositories is backed up with.
+func (g *GiteaHost) backupInput() processBackupInput {
+	return processBackupInput{
+		LogLevel:            g.LogLevel,
+		Logger:              g.logger(),
+		RemoteStore:         g.RemoteStore,
+		StoreKeyPrefix:      g.NamespacePrefix,
+		RepoBackupTimeout:   g.RepoBackupTimeout,
+		Git:                 gitOptions{BinaryPath: g.GitBinaryPath, ExtraConfig: g.ExtraGitConfig, ProxyURL: g.ProxyURL, CACertPath: g.CACertPath, InsecureSkipTLSVerify: g.InsecureSkipTLSVerify},
+		BackupDIR:           backupRoot(g.BackupDir, g.NamespacePrefix),
+		BackupsToKeep:       g.BackupsToRetain,
+		KeepForDays:         g.KeepForDays,
+		CloneRetries:        g.CloneRetries,
+		MinFreeDiskMB:       g.MinFreeDiskMB,
+		DiffRemoteMethod:    g.diffRemoteMethod(),
+		BundleRefSpec:       g.BundleRefSpec,
+		RefSpec:             g.refSpecPatterns,
+		BundleNameTemplate:  g.BundleNameTemplate,
+		FlatLayout:          g.FlatLayout,
+		FlatLayoutSeparator: g.FlatLayoutSeparator,
+		DateDir:             backupDateDir(g.DateDirLayout),
+		DetectRenames:       g.DetectRenames,
+		UseAlternates:       g.UseAlternates,
+		DryRun:              g.DryRun,
+		PartialClone:        g.PartialClone,
+		KeepWorkingDir:      g.KeepWorkingDir,
+		SkipVerify:          !g.VerifyAfterCreate,
+		CompressBundles:     g.CompressBundles,
+		ArchivePerRepo:      g.ArchivePerRepo,
+		KeepArchivedFiles:   g.KeepArchivedFiles,
+		SSHPrivateKeyPath:   g.SSHPrivateKeyPath,
+		SSHKnownHostsPath:   g.SSHKnownHostsPath,
+	}
+}
 
-		backupResult := RepoBackupResults{
-			Repo: repo.PathWithNameSpace,
-		}
+// setupRepo adds the token to the repository's URL so it can be cloned.
+func (g *GiteaHost) setupRepo(repo repository) repository {
+	firstPos := strings.Index(repo.HTTPSUrl, "//")
+	repo.URLWithToken = fmt.Sprintf("%s%s@%s", repo.HTTPSUrl[:firstPos+2], g.Token, repo.HTTPSUrl[firstPos+2:])
 
-		status := statusOk
-		if err != nil {
-			status = statusFailed
-			backupResult.Error = err
-		}
+	return repo
+}
 
-		backupResult.Status = status
+func (g *GiteaHost) Backup() ProviderBackupResult {
+	return g.BackupWithContext(context.Background())
+}
 
-		results <- backupResult
+// BackupWithContext backs up the host's repositories. Any not yet backed up when the context is
+// cancelled are reported as failed.
+func (g *GiteaHost) BackupWithContext(ctx context.Context) ProviderBackupResult {
+	release, err := acquireBackupLocks(ctx, []GitProvider{g})
+	if err != nil {
+		return ProviderBackupResult{Error: err}
 	}
+
+	defer release()
+
+	return g.backupWithCloneTokens(ctx, nil)
 }
 
-func (g *GiteaHost) Backup() ProviderBackupResult {
+// backupLock returns the directory locked while the host is backed up, and how long to wait for it.
+func (g *GiteaHost) backupLock() (string, time.Duration) {
+	return g.BackupDir, g.LockTimeout
+}
+
+// backupWithCloneTokens backs up the host's repositories, each holding a token from cloneTokens, if
+// specified, while being backed up.
+func (g *GiteaHost) backupWithCloneTokens(ctx context.Context, cloneTokens chan struct{}) ProviderBackupResult {
+	in := g.backupInput()
+
+	result := g.backup(ctx, in, cloneTokens)
+
+	updateBackupIndexes(g.logger(), in, result.BackupResults)
+
+	notifyWebhook(ctx, g.logger(), g.httpClient, g.NotifyWebhookURL, giteaProviderName, result)
+
+	return result
+}
+
+func (g *GiteaHost) backup(ctx context.Context, in processBackupInput, cloneTokens chan struct{}) ProviderBackupResult {
 	if g.BackupDir == "" {
-		logger.Printf("backup skipped as backup directory not specified")
+		g.logger().Printf("backup skipped as backup directory not specified")
 
 		return ProviderBackupResult{}
 	}
 
-	maxConcurrent := 5
-
-	repoDesc, err := g.describeRepos()
+	repoDesc, err := g.describeRepos(ctx)
 	if err != nil {
 		return ProviderBackupResult{
 			BackupResults: nil,
@@ -1005,38 +1337,36 @@ func (g *GiteaHost) Backup() ProviderBackupResult {
 		}
 	}
 
-	jobs := make(chan repository, len(repoDesc.Repos))
-	results := make(chan RepoBackupResults, maxConcurrent)
-
-	for w := 1; w <= maxConcurrent; w++ {
-		go giteaWorker(g.Token, g.LogLevel, g.BackupDir, g.diffRemoteMethod(), g.BackupsToRetain, jobs, results)
-	}
-
-	for x := range repoDesc.Repos {
-		repo := repoDesc.Repos[x]
-		jobs <- repo
-	}
-
-	close(jobs)
-
-	var providerBackupResults ProviderBackupResult
-
-	for a := 1; a <= len(repoDesc.Repos); a++ {
-		res := <-results
-		if res.Error != nil {
-			logger.Printf("backup failed: %+v\n", res.Error)
-		}
+	repoDesc.Repos = filterRepos(g.logger(), repoDesc.Repos, g.Include, g.Exclude)
+	repoDesc.Repos = filterRepoList(g.logger(), repoDesc.Repos, g.RepoList, g.RepoListMode)
 
-		providerBackupResults.BackupResults = append(providerBackupResults.BackupResults, res)
+	if mErr := checkMaxRepos(g.logger(), giteaProviderName, len(repoDesc.Repos), g.MaxRepos); mErr != nil {
+		return ProviderBackupResult{Error: mErr}
 	}
 
-	return providerBackupResults
+	repos, skipped := filterSkippedRepos(g.logger(), repoDesc.Repos, g.DryRun, skipReasonFork, func(repo repository) bool {
+		return g.SkipForks && repo.IsFork
+	})
+
+	repos, notUpdatedResults := filterSkippedRepos(g.logger(), repos, g.DryRun, skipReasonNotUpdated, notUpdatedSince(g.UpdatedSince))
+	skipped = append(skipped, notUpdatedResults...)
+
+	return runBackups(ctx, giteaProviderName, in, g.setupRepo, repos, cloneTokens, backupRunOptions{
+		MaxConcurrent:    getMaxConcurrent(g.MaxConcurrent, defaultMaxConcurrentGitea),
+		FailFast:         g.FailFast,
+		FailOnAnyError:   g.FailOnAnyError,
+		UseAlternates:    g.UseAlternates,
+		BackupSubmodules: g.BackupSubmodules,
+		DetectRenames:    g.DetectRenames,
+		Progress:         g.Progress,
+		Skipped:          skipped,
+	})
 }
 
-func (g *GiteaHost) getAllUserRepositories() ([]repository, errors.E) {
-	users, err := g.getAllUsers()
+func (g *GiteaHost) getAllUserRepositories(ctx context.Context) ([]repository, errors.E) {
+	users, err := g.getAllUsers(ctx)
 	if err != nil {
-		logger.Print("failed to get all users")
+		g.logger().Println("failed to get all users")
 
 		return nil, errors.Wrap(err, "failed to get all users")
 	}
@@ -1050,9 +1380,9 @@ func (g *GiteaHost) getAllUserRepositories() ([]repository, errors.E) {
 
 		var userRepos []repository
 
-		userRepos, err = g.getAllUserRepos(user.Login)
+		userRepos, err = g.getAllUserRepos(ctx, user.Login)
 		if err != nil {
-			logger.Print("failed to get all user repositories")
+			g.logger().Println("failed to get all user repositories")
 
 			return nil, errors.Wrap(err, "failed to get all user repositories")
 		}
@@ -1063,12 +1393,16 @@ func (g *GiteaHost) getAllUserRepositories() ([]repository, errors.E) {
 	var repositories []repository
 	for _, repo := range repos {
 		repositories = append(repositories, repository{
+			ID:                repo.ID,
 			Name:              repo.Name,
 			Owner:             repo.Owner,
 			PathWithNameSpace: repo.PathWithNameSpace,
 			Domain:            repo.Domain,
 			HTTPSUrl:          repo.HTTPSUrl,
 			SSHUrl:            repo.SSHUrl,
+			IsFork:            repo.IsFork,
+			ForkParent:        repo.ForkParent,
+			UpdatedAt:         repo.UpdatedAt,
 		})
 	}
 
@@ -1,11 +1,16 @@
 package githosts
 
 import (
+	"context"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -49,7 +54,7 @@ func TestGiteaGetUsers(t *testing.T) {
 
 	gHost.Token = giteaToken
 
-	users, _ := gHost.getAllUsers()
+	users, _ := gHost.getAllUsers(context.Background())
 	require.True(t, userExists(userExistsInput{
 		matchBy:  giteaMatchByIfDefined,
 		users:    users,
@@ -89,14 +94,14 @@ func TestGiteaGetOrganisations(t *testing.T) {
 	require.NoError(t, err)
 
 	// without org names we should get no orgs
-	organizations, err := gHost.getOrganizations()
+	organizations, err := gHost.getOrganizations(context.Background())
 	require.NoError(t, err)
 
 	require.Empty(t, organizations)
 
 	// with single org name we should only get that org
 	gHost.Orgs = []string{"soba-org-two"}
-	organizations, err = gHost.getOrganizations()
+	organizations, err = gHost.getOrganizations(context.Background())
 	require.NoError(t, err)
 
 	require.False(t, organisationExists(organizationExistsInput{
@@ -142,7 +147,7 @@ func TestGetOrganizationsRepos(t *testing.T) {
 	require.NoError(t, err)
 
 	// without env vars, we shouldn't get any orgs
-	repos, _ := gHost.getOrganizationsRepos([]giteaOrganization{
+	repos, _ := gHost.getOrganizationsRepos(context.Background(), []giteaOrganization{
 		{Name: "soba-org-one", FullName: "soba org one"},
 	})
 
@@ -195,7 +200,7 @@ func TestGetAllOrganizationRepos(t *testing.T) {
 
 	require.NoError(t, err)
 
-	organizations, _ := gHost.getOrganizations()
+	organizations, _ := gHost.getOrganizations(context.Background())
 	require.GreaterOrEqual(t, len(organizations), 0)
 	require.False(t, organisationExists(organizationExistsInput{
 		matchBy:       giteaMatchByIfDefined,
@@ -206,7 +211,7 @@ func TestGetAllOrganizationRepos(t *testing.T) {
 	// gHost.Orgs = []string{"soba-org-two"}
 
 	gHost.Orgs = []string{"soba-org-two"}
-	organizations, _ = gHost.getOrganizations()
+	organizations, _ = gHost.getOrganizations(context.Background())
 
 	require.GreaterOrEqual(t, len(organizations), 1)
 	require.False(t, organisationExists(organizationExistsInput{
@@ -225,7 +230,7 @@ func TestGetAllOrganizationRepos(t *testing.T) {
 
 	// * should return all orgs
 	gHost.Orgs = []string{"*"}
-	organizations, _ = gHost.getOrganizations()
+	organizations, _ = gHost.getOrganizations(context.Background())
 
 	require.GreaterOrEqual(t, len(organizations), 2)
 	require.True(t, organisationExists(organizationExistsInput{
@@ -270,7 +275,7 @@ func TestGetAllUserRepos(t *testing.T) {
 	})
 	require.NoError(t, err)
 
-	users, _ := gHost.getAllUsers()
+	users, _ := gHost.getAllUsers(context.Background())
 
 	var repos []repository
 
@@ -280,7 +285,7 @@ func TestGetAllUserRepos(t *testing.T) {
 		userCount++
 
 		var allUserRepos []repository
-		allUserRepos, err = gHost.getAllUserRepos(user.Login)
+		allUserRepos, err = gHost.getAllUserRepos(context.Background(), user.Login)
 
 		require.NoError(t, err)
 
@@ -302,7 +307,7 @@ func TestGetAPIURL(t *testing.T) {
 	gh, err := NewGiteaHost(NewGiteaHostInput{
 		APIURL:           apiURL,
 		DiffRemoteMethod: cloneMethod,
-		Token:            os.Getenv("GITEA_TOKEN"),
+		Token:            "test-token",
 	})
 	require.NoError(t, err)
 	require.Equal(t, apiURL, gh.getAPIURL())
@@ -314,7 +319,7 @@ func TestGiteaDiffRemoteMethod(t *testing.T) {
 	gh, err := NewGiteaHost(NewGiteaHostInput{
 		APIURL:           apiURL,
 		DiffRemoteMethod: refsMethod,
-		Token:            os.Getenv("GITEA_TOKEN"),
+		Token:            "test-token",
 	})
 	require.NoError(t, err)
 	require.Equal(t, refsMethod, gh.diffRemoteMethod())
@@ -322,7 +327,7 @@ func TestGiteaDiffRemoteMethod(t *testing.T) {
 	gh, err = NewGiteaHost(NewGiteaHostInput{
 		APIURL:           apiURL,
 		DiffRemoteMethod: cloneMethod,
-		Token:            os.Getenv("GITEA_TOKEN"),
+		Token:            "test-token",
 	})
 	require.NoError(t, err)
 	require.Equal(t, cloneMethod, gh.diffRemoteMethod())
@@ -677,3 +682,231 @@ func TestUserExistsIfDefinedMatch(t *testing.T) {
 		fullName:  "fullname1",
 	}))
 }
+
+func TestExtractDomainFromAPIUrl(t *testing.T) {
+	t.Parallel()
+
+	for apiURL, domain := range map[string]string{
+		"https://codeberg.org/api/v1":         "codeberg.org",
+		"https://git.example.com:3000/api/v1": "git.example.com",
+		"http://localhost/gitea/api/v1":       "localhost",
+		"https://Git.Example.com/api/v1/":     "git.example.com",
+		"codeberg.org/api/v1":                 "codeberg.org",
+		"https://":                            "",
+	} {
+		require.Equal(t, domain, extractDomainFromAPIUrl(logger, apiURL), apiURL)
+	}
+
+	_, err := NewGiteaHost(NewGiteaHostInput{APIURL: "https://"})
+	require.ErrorContains(t, err, "API URL invalid")
+}
+
+func TestGiteaReposDomainWithAPIPathPrefix(t *testing.T) {
+	t.Parallel()
+
+	mux := http.NewServeMux()
+
+	var srvURL string
+
+	mux.HandleFunc("/gitea/api/v1/users/soba/repos", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[{"name":"user-repo","full_name":"soba/user-repo","clone_url":"` + srvURL + `/gitea/soba/user-repo.git","owner":{"login":"soba"}}]`))
+	})
+	mux.HandleFunc("/gitea/api/v1/orgs/soba-org/repos", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`[{"name":"org-repo","full_name":"soba-org/org-repo","clone_url":"` + srvURL + `/gitea/soba-org/org-repo.git","owner":{"login":"soba-org"}}]`))
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	srvURL = srv.URL
+
+	g, err := NewGiteaHost(NewGiteaHostInput{
+		APIURL: srv.URL + "/gitea/api/v1/",
+		Token:  "test-token",
+	})
+	require.NoError(t, err)
+
+	userRepos, err := g.getAllUserRepos(context.Background(), "soba")
+	require.NoError(t, err)
+
+	orgRepos, err := g.getOrganizationsRepos(context.Background(), []giteaOrganization{{Name: "soba-org"}})
+	require.NoError(t, err)
+
+	repos := append(userRepos, orgRepos...)
+	require.Len(t, repos, 2)
+
+	// the port and the path the instance is served under aren't part of the domain
+	for _, repo := range repos {
+		require.Equal(t, "127.0.0.1", repo.Domain)
+	}
+}
+
+func TestFilterGiteaRepos(t *testing.T) {
+	t.Parallel()
+
+	repos := []giteaRepository{
+		{Name: "plain"},
+		{Name: "archived", Archived: true},
+		{Name: "mirror", Mirror: true},
+		{Name: "archived-mirror", Archived: true, Mirror: true},
+	}
+
+	names := func(repos []giteaRepository) []string {
+		var n []string
+		for _, r := range repos {
+			n = append(n, r.Name)
+		}
+
+		return n
+	}
+
+	require.Equal(t, []string{"plain", "archived", "mirror", "archived-mirror"}, names(filterGiteaRepos(repos, false, true)))
+	require.Equal(t, []string{"plain", "mirror"}, names(filterGiteaRepos(repos, true, true)))
+	require.Equal(t, []string{"plain", "archived"}, names(filterGiteaRepos(repos, false, false)))
+	require.Equal(t, []string{"plain"}, names(filterGiteaRepos(repos, true, false)))
+}
+
+func TestNewGiteaHostMirrorsIncludedByDefault(t *testing.T) {
+	t.Parallel()
+
+	g, err := NewGiteaHost(NewGiteaHostInput{APIURL: "https://codeberg.org/api/v1", Token: "test-token"})
+	require.NoError(t, err)
+	require.True(t, g.IncludeMirrors)
+	require.False(t, g.SkipArchived)
+
+	includeMirrors := false
+
+	g, err = NewGiteaHost(NewGiteaHostInput{APIURL: "https://codeberg.org/api/v1", Token: "test-token", IncludeMirrors: &includeMirrors, SkipArchived: true})
+	require.NoError(t, err)
+	require.False(t, g.IncludeMirrors)
+	require.True(t, g.SkipArchived)
+}
+
+func TestGiteaMissingOrganizationsSkipped(t *testing.T) {
+	t.Parallel()
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/api/v1/orgs/present", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`{"id":1,"name":"present","username":"present"}`))
+	})
+	mux.HandleFunc("/api/v1/orgs/present/repos", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`[{"name":"repo1","full_name":"present/repo1","clone_url":"https://gitea.example.com/present/repo1.git","owner":{"login":"present"}}]`))
+	})
+	mux.HandleFunc("/api/v1/orgs/", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = w.Write([]byte(`{"message":"GetOrgByName"}`))
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	capture := &captureLogger{}
+
+	g, err := NewGiteaHost(NewGiteaHostInput{
+		APIURL: srv.URL + "/api/v1",
+		Token:  "test-token",
+		Orgs:   []string{"missing", "present"},
+		Logger: capture,
+	})
+	require.NoError(t, err)
+
+	orgs, oErr := g.getOrganizations(context.Background())
+	require.NoError(t, oErr)
+	require.Len(t, orgs, 1)
+	require.Equal(t, "present", orgs[0].Name)
+
+	// an organization removed after being listed is skipped too
+	repos, rErr := g.getOrganizationsRepos(context.Background(), []giteaOrganization{{Name: "removed"}, {Name: "present"}})
+	require.NoError(t, rErr)
+	require.Len(t, repos, 1)
+	require.Equal(t, "present/repo1", repos[0].PathWithNameSpace)
+
+	logs := strings.Join(capture.lines, "\n")
+	require.Contains(t, logs, "organization missing not found, skipping")
+	require.Contains(t, logs, "organization removed not found, skipping")
+}
+
+func TestGiteaReposUpdatedAt(t *testing.T) {
+	t.Parallel()
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/api/v1/orgs/soba-org/repos", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`[{"name":"org-repo","full_name":"soba-org/org-repo","owner":{"login":"soba-org"},"updated_at":"2024-06-01T12:30:00Z"}]`))
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	g, err := NewGiteaHost(NewGiteaHostInput{
+		APIURL: srv.URL + "/api/v1",
+		Token:  "test-token",
+	})
+	require.NoError(t, err)
+
+	repos, rErr := g.getOrganizationsRepos(context.Background(), []giteaOrganization{{Name: "soba-org"}})
+	require.NoError(t, rErr)
+	require.Len(t, repos, 1)
+	require.True(t, time.Date(2024, 6, 1, 12, 30, 0, 0, time.UTC).Equal(repos[0].UpdatedAt))
+}
+
+func TestGiteaReposFork(t *testing.T) {
+	t.Parallel()
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/api/v1/orgs/soba-org/repos", func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte(`[{"id":7,"name":"org-repo","full_name":"soba-org/org-repo","owner":{"login":"soba-org"}},` +
+			`{"name":"org-fork","full_name":"soba-org/org-fork","owner":{"login":"soba-org"},"fork":true}]`))
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	g, err := NewGiteaHost(NewGiteaHostInput{
+		APIURL:    srv.URL + "/api/v1",
+		Token:     "test-token",
+		SkipForks: true,
+	})
+	require.NoError(t, err)
+	require.True(t, g.SkipForks)
+
+	repos, rErr := g.getOrganizationsRepos(context.Background(), []giteaOrganization{{Name: "soba-org"}})
+	require.NoError(t, rErr)
+	require.Len(t, repos, 2)
+	require.False(t, repos[0].IsFork)
+	require.True(t, repos[1].IsFork)
+	require.Equal(t, "7", repos[0].ID)
+}
+
+func TestGiteaLogsMaskToken(t *testing.T) {
+	t.Parallel()
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/api/v1/orgs/soba-org", func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte(`{"message":"token secret-token is invalid"}`))
+	})
+
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	capture := &captureLogger{}
+
+	g, err := NewGiteaHost(NewGiteaHostInput{
+		APIURL:   srv.URL + "/api/v1",
+		Token:    "secret-token",
+		LogLevel: 1,
+		Logger:   capture,
+	})
+	require.NoError(t, err)
+
+	_, oErr := g.getOrganization(context.Background(), "soba-org")
+	require.Error(t, oErr)
+
+	logs := strings.Join(capture.lines, "\n")
+	require.Contains(t, logs, "token ************ is invalid")
+	require.NotContains(t, logs, "secret-token")
+}
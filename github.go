@@ -2,17 +2,23 @@ package githosts
 
 import (
 	"bytes"
+	"cmp"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"os"
+	"regexp"
 	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/hashicorp/go-retryablehttp"
+	"github.com/peterhellberg/link"
 	"gitlab.com/tozd/go/errors"
 )
 
@@ -21,92 +27,336 @@ const (
 	githubEnvVarCallSize = "GITHUB_CALL_SIZE"
 	gitHubDomain         = "github.com"
 	gitHubProviderName   = "GitHub"
+	// limit the number of organizations whose repositories are listed at once
+	githubMaxConcurrentOrgRequests = 5
+	// requests rejected for exceeding a rate limit are retried after the wait requested
+	githubRateLimitRetries      = 3
+	githubRateLimitLowRemaining = 10
+	githubRateLimitMaxWait      = time.Hour
+	// number of results requested per page from the REST API
+	githubRESTPageSize = 100
 )
 
+// errGitHubFineGrainedPAT is returned when the GraphQL API rejects a fine-grained PAT, in which
+// case the repositories are listed with the REST API instead.
+var errGitHubFineGrainedPAT = errors.Base("GitHub authorisation with fine grained PAT (Personal Access Token) failed as their GraphQL endpoint currently only supports classic PATs: https://github.blog/2022-10-18-introducing-fine-grained-personal-access-tokens-for-github/#coming-next")
+
 type NewGitHubHostInput struct {
-	HTTPClient       *retryablehttp.Client
-	Caller           string
-	APIURL           string
-	DiffRemoteMethod string
-	BackupDir        string
-	Token            string
-	LimitUserOwned   bool
-	SkipUserRepos    bool
-	Orgs             []string
-	BackupsToRetain  int
-	LogLevel         int
+	HTTPClient            *retryablehttp.Client
+	RetryMax              int // defaults to 2, -1 disables retries
+	RetryWaitMinSeconds   int
+	RetryWaitMaxSeconds   int
+	Caller                string
+	APIURL                string
+	DiffRemoteMethod      string
+	BackupDir             string
+	NamespacePrefix       string
+	BundleRefSpec         string
+	BundleNameTemplate    string
+	FlatLayout            bool
+	FlatLayoutSeparator   string
+	DateDirLayout         bool
+	DetectRenames         bool
+	RefSpec               []string
+	Include               []string
+	Exclude               []string
+	RepoListFile          string
+	RepoListMode          string
+	MaxConcurrent         int
+	MaxRepos              int
+	DryRun                bool
+	FailFast              bool
+	FailOnAnyError        bool
+	PartialClone          bool
+	KeepWorkingDir        bool
+	BackupSubmodules      bool
+	VerifyAfterCreate     *bool // defaults to true
+	CompressBundles       bool
+	ArchivePerRepo        bool
+	KeepArchivedFiles     bool
+	SSHPrivateKeyPath     string
+	SSHKnownHostsPath     string
+	Token                 string
+	LimitUserOwned        bool
+	SkipUserRepos         bool
+	SkipForks             bool
+	Orgs                  []string
+	BackupsToRetain       int
+	KeepForDays           int
+	CloneRetries          int // defaults to 2, -1 disables retries
+	MinFreeDiskMB         int
+	UpdatedSince          time.Time
+	LogLevel              int
+	Logger                Logger
+	Progress              func(done, total int, repo string)
+	RemoteStore           RemoteStore
+	RepoBackupTimeout     time.Duration
+	LockTimeout           time.Duration
+	GitBinaryPath         string
+	ExtraGitConfig        []string
+	NotifyWebhookURL      string
+	ProxyURL              string
+	CACertPath            string
+	InsecureSkipTLSVerify bool
+	UseAlternates         bool
+	BackupReleases        bool
+	BackupMetadata        bool
 }
 
 func (gh *GitHubHost) getAPIURL() string {
 	return gh.APIURL
 }
 
+// Validate checks the input's settings, returning an error listing each that's missing or invalid.
+func (input NewGitHubHostInput) Validate() error {
+	return errors.Join(
+		validRequired(input.Token, "token"),
+		validGitHubAPIURL(cmp.Or(input.APIURL, githubAPIURL)),
+		validBackupDir(input.BackupDir),
+		validDiffRemoteMethodSetting(input.DiffRemoteMethod),
+		validNamespacePrefix(input.NamespacePrefix),
+		validBundleRefSpec(input.BundleRefSpec, input.RefSpec),
+		validBundleNameTemplate(input.BundleNameTemplate),
+		validFlatLayoutSeparator(input.FlatLayoutSeparator),
+		validRepoFilters(input.Include, input.Exclude),
+		validRepoList(input.RepoListFile, input.RepoListMode),
+		validMaxConcurrent(input.MaxConcurrent),
+		validMaxRepos(input.MaxRepos),
+		validRetryConfig(input.RetryMax, input.RetryWaitMinSeconds, input.RetryWaitMaxSeconds),
+		validCloneRetries(input.CloneRetries),
+		validMinFreeDiskMB(input.MinFreeDiskMB),
+		validSSHAuth(input.SSHPrivateKeyPath, input.SSHKnownHostsPath),
+		validRepoBackupTimeout(input.RepoBackupTimeout),
+		validLockTimeout(input.LockTimeout),
+		validExtraGitConfig(input.ExtraGitConfig),
+		validNotifyWebhookURL(input.NotifyWebhookURL),
+		validProxyURL(input.ProxyURL),
+		validTLSConfig(input.CACertPath, input.InsecureSkipTLSVerify),
+	)
+}
+
 func NewGitHubHost(input NewGitHubHostInput) (*GitHubHost, error) {
-	setLoggerPrefix(input.Caller)
+	if input.Logger == nil {
+		setLoggerPrefix(input.Caller)
+	}
+
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
 
 	apiURL := githubAPIURL
 	if input.APIURL != "" {
 		apiURL = input.APIURL
 	}
 
-	diffRemoteMethod, err := getDiffRemoteMethod(input.DiffRemoteMethod)
+	diffRemoteMethod, err := getDiffRemoteMethod(getLogger(input.Logger), input.DiffRemoteMethod)
 	if err != nil {
 		return nil, err
 	}
 
-	if diffRemoteMethod == "" {
-		logger.Print("using default diff remote method: " + defaultRemoteMethod)
-		diffRemoteMethod = defaultRemoteMethod
-	} else {
-		logger.Print("using diff remote method: " + diffRemoteMethod)
+	bundleRefSpec, err := getBundleRefSpec(input.BundleRefSpec)
+	if err != nil {
+		return nil, err
+	}
+
+	repoList, repoListMode, err := readRepoList(input.RepoListFile, input.RepoListMode)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := getTLSConfig(input.CACertPath, input.InsecureSkipTLSVerify)
+	if err != nil {
+		return nil, err
+	}
+
+	if input.InsecureSkipTLSVerify {
+		getLogger(input.Logger).Println("WARNING: TLS certificate verification is disabled")
 	}
 
 	httpClient := input.HTTPClient
 	if httpClient == nil {
-		httpClient = getHTTPClient()
+		httpClient = getHTTPClient(input.RetryMax, input.RetryWaitMinSeconds, input.RetryWaitMaxSeconds, input.ProxyURL, tlsConfig)
 	}
 
 	return &GitHubHost{
-		Caller:           input.Caller,
-		HttpClient:       httpClient,
-		Provider:         gitHubProviderName,
-		APIURL:           apiURL,
-		DiffRemoteMethod: diffRemoteMethod,
-		BackupDir:        input.BackupDir,
-		SkipUserRepos:    input.SkipUserRepos,
-		LimitUserOwned:   input.LimitUserOwned,
-		BackupsToRetain:  input.BackupsToRetain,
-		Token:            input.Token,
-		Orgs:             input.Orgs,
-		LogLevel:         input.LogLevel,
+		Caller:                input.Caller,
+		HttpClient:            httpClient,
+		Provider:              gitHubProviderName,
+		APIURL:                apiURL,
+		DiffRemoteMethod:      diffRemoteMethod,
+		BackupDir:             input.BackupDir,
+		NamespacePrefix:       input.NamespacePrefix,
+		BundleRefSpec:         bundleRefSpec,
+		RefSpec:               input.RefSpec,
+		refSpecPatterns:       compileRefSpec(input.RefSpec),
+		BundleNameTemplate:    input.BundleNameTemplate,
+		FlatLayout:            input.FlatLayout,
+		FlatLayoutSeparator:   input.FlatLayoutSeparator,
+		DateDirLayout:         input.DateDirLayout,
+		DetectRenames:         input.DetectRenames,
+		Include:               input.Include,
+		Exclude:               input.Exclude,
+		RepoList:              repoList,
+		RepoListMode:          repoListMode,
+		MaxConcurrent:         input.MaxConcurrent,
+		MaxRepos:              input.MaxRepos,
+		DryRun:                input.DryRun,
+		FailFast:              input.FailFast,
+		FailOnAnyError:        input.FailOnAnyError,
+		PartialClone:          input.PartialClone,
+		KeepWorkingDir:        input.KeepWorkingDir,
+		BackupSubmodules:      input.BackupSubmodules,
+		VerifyAfterCreate:     input.VerifyAfterCreate == nil || *input.VerifyAfterCreate,
+		CompressBundles:       input.CompressBundles,
+		ArchivePerRepo:        input.ArchivePerRepo,
+		KeepArchivedFiles:     input.KeepArchivedFiles,
+		SSHPrivateKeyPath:     input.SSHPrivateKeyPath,
+		SSHKnownHostsPath:     input.SSHKnownHostsPath,
+		SkipUserRepos:         input.SkipUserRepos,
+		SkipForks:             input.SkipForks,
+		LimitUserOwned:        input.LimitUserOwned,
+		BackupsToRetain:       input.BackupsToRetain,
+		KeepForDays:           input.KeepForDays,
+		CloneRetries:          input.CloneRetries,
+		MinFreeDiskMB:         input.MinFreeDiskMB,
+		UpdatedSince:          input.UpdatedSince,
+		Token:                 input.Token,
+		Orgs:                  input.Orgs,
+		LogLevel:              input.LogLevel,
+		Logger:                input.Logger,
+		Progress:              input.Progress,
+		RemoteStore:           input.RemoteStore,
+		RepoBackupTimeout:     input.RepoBackupTimeout,
+		LockTimeout:           input.LockTimeout,
+		GitBinaryPath:         input.GitBinaryPath,
+		ExtraGitConfig:        input.ExtraGitConfig,
+		NotifyWebhookURL:      input.NotifyWebhookURL,
+		ProxyURL:              input.ProxyURL,
+		CACertPath:            input.CACertPath,
+		InsecureSkipTLSVerify: input.InsecureSkipTLSVerify,
+		UseAlternates:         input.UseAlternates,
+		BackupReleases:        input.BackupReleases,
+		BackupMetadata:        input.BackupMetadata,
 	}, nil
 }
 
 type GitHubHost struct {
-	Caller           string
-	HttpClient       *retryablehttp.Client
-	Provider         string
-	APIURL           string
-	DiffRemoteMethod string
-	BackupDir        string
-	SkipUserRepos    bool
-	LimitUserOwned   bool
-	BackupsToRetain  int
-	Token            string
-	Orgs             []string
-	LogLevel         int
+	Caller                string
+	HttpClient            *retryablehttp.Client
+	Provider              string
+	APIURL                string
+	DiffRemoteMethod      string
+	BackupDir             string
+	NamespacePrefix       string
+	BundleRefSpec         string
+	RefSpec               []string
+	refSpecPatterns       []*regexp.Regexp
+	BundleNameTemplate    string
+	FlatLayout            bool
+	FlatLayoutSeparator   string
+	DateDirLayout         bool
+	DetectRenames         bool
+	Include               []string
+	Exclude               []string
+	RepoList              []string
+	RepoListMode          string
+	MaxConcurrent         int
+	MaxRepos              int
+	DryRun                bool
+	FailFast              bool
+	FailOnAnyError        bool
+	PartialClone          bool
+	KeepWorkingDir        bool
+	BackupSubmodules      bool
+	VerifyAfterCreate     bool
+	CompressBundles       bool
+	ArchivePerRepo        bool
+	KeepArchivedFiles     bool
+	SSHPrivateKeyPath     string
+	SSHKnownHostsPath     string
+	SkipUserRepos         bool
+	SkipForks             bool
+	LimitUserOwned        bool
+	BackupsToRetain       int
+	KeepForDays           int
+	CloneRetries          int
+	MinFreeDiskMB         int
+	UpdatedSince          time.Time
+	Token                 string
+	Orgs                  []string
+	LogLevel              int
+	Logger                Logger
+	Progress              func(done, total int, repo string)
+	RemoteStore           RemoteStore
+	RepoBackupTimeout     time.Duration
+	LockTimeout           time.Duration
+	GitBinaryPath         string
+	ExtraGitConfig        []string
+	NotifyWebhookURL      string
+	ProxyURL              string
+	CACertPath            string
+	InsecureSkipTLSVerify bool
+	UseAlternates         bool
+	BackupReleases        bool
+	BackupMetadata        bool
 }
 
 type edge struct {
 	Node struct {
+		DatabaseID    int64 `json:"databaseId"`
 		Name          string
 		NameWithOwner string
 		URL           string `json:"Url"`
 		SSHURL        string `json:"sshUrl"`
+		IsFork        bool   `json:"isFork"`
+		Parent        *struct {
+			NameWithOwner string `json:"nameWithOwner"`
+		} `json:"parent"`
+		PushedAt         time.Time `json:"pushedAt"`
+		Description      string    `json:"description"`
+		Visibility       string    `json:"visibility"`
+		DefaultBranchRef *struct {
+			Name string `json:"name"`
+		} `json:"defaultBranchRef"`
+		RepositoryTopics struct {
+			Nodes []struct {
+				Topic struct {
+					Name string `json:"name"`
+				} `json:"topic"`
+			} `json:"nodes"`
+		} `json:"repositoryTopics"`
 	}
 	Cursor string
 }
 
+// defaultBranch returns the name of the repository's default branch, or empty if it has none.
+func (e edge) defaultBranch() string {
+	if e.Node.DefaultBranchRef == nil {
+		return ""
+	}
+
+	return e.Node.DefaultBranchRef.Name
+}
+
+// topics returns the names of the repository's topics.
+func (e edge) topics() []string {
+	var topics []string
+
+	for _, node := range e.Node.RepositoryTopics.Nodes {
+		topics = append(topics, node.Topic.Name)
+	}
+
+	return topics
+}
+
+func (e edge) forkParent() string {
+	if !e.Node.IsFork || e.Node.Parent == nil {
+		return ""
+	}
+
+	return e.Node.Parent.NameWithOwner
+}
+
 type githubQueryNamesResponse struct {
 	Data struct {
 		Viewer struct {
@@ -170,52 +420,68 @@ type graphQLRequest struct {
 	Variables string `json:"variables"`
 }
 
-func (gh *GitHubHost) makeGithubRequest(payload string) (string, errors.E) {
-	contentReader := bytes.NewReader([]byte(payload))
-
-	ctx, cancel := context.WithTimeout(context.Background(), defaultHttpRequestTimeout)
-	defer cancel()
-
-	req, newReqErr := retryablehttp.NewRequestWithContext(ctx, http.MethodPost, "https://api.github.com/graphql", contentReader)
+func validGitHubAPIURL(apiURL string) error {
+	u, err := url.Parse(apiURL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return errors.Errorf("invalid GitHub API URL: %s", apiURL)
+	}
 
-	if newReqErr != nil {
-		logger.Println(newReqErr)
+	return nil
+}
 
-		return "", errors.Wrap(newReqErr, "failed to create request")
+// githubGraphQLURL returns the GraphQL endpoint of the API. GitHub Enterprise Server serves it
+// at /api/graphql, alongside the REST API at /api/v3, e.g. https://ghe.example.com/api/graphql.
+func githubGraphQLURL(apiURL string) string {
+	if apiURL == "" {
+		return githubAPIURL
 	}
 
-	req.Header.Set("Authorization", "bearer "+gh.Token)
-	req.Header.Set("Content-Type", contentTypeApplicationJSON)
-	req.Header.Set("Accept", contentTypeApplicationJSON)
+	apiURL = strings.TrimSuffix(apiURL, "/")
 
-	resp, reqErr := gh.HttpClient.Do(req)
-	if reqErr != nil {
-		logger.Print(reqErr)
+	switch {
+	case strings.HasSuffix(apiURL, "/graphql"):
+		return apiURL
+	case strings.HasSuffix(apiURL, "/api/v3"):
+		return strings.TrimSuffix(apiURL, "/v3") + "/graphql"
+	case strings.HasSuffix(apiURL, "/api"):
+		return apiURL + "/graphql"
+	}
 
-		return "", errors.Wrap(reqErr, "failed to make request")
+	if u, err := url.Parse(apiURL); err == nil && u.Host == "api.github.com" {
+		return apiURL + "/graphql"
 	}
 
-	bodyB, err := io.ReadAll(resp.Body)
-	if err != nil {
-		logger.Print(err)
+	return apiURL + "/api/graphql"
+}
 
-		return "", errors.Wrap(err, "failed to read response body")
+// githubRESTURL returns the base URL of the REST API. GitHub Enterprise Server serves it at
+// /api/v3, e.g. https://ghe.example.com/api/v3.
+func githubRESTURL(apiURL string) string {
+	apiURL = strings.TrimSuffix(githubGraphQLURL(apiURL), "/graphql")
+
+	if strings.HasSuffix(apiURL, "/api") {
+		return apiURL + "/v3"
 	}
 
-	defer resp.Body.Close()
+	return apiURL
+}
 
-	bodyStr := string(bytes.ReplaceAll(bodyB, []byte("\r"), []byte("\r\n")))
+func (gh *GitHubHost) makeGithubRequest(ctx context.Context, payload string) (string, errors.E) {
+	resp, bodyStr, err := gh.requestGithub(ctx, http.MethodPost, githubGraphQLURL(gh.APIURL), payload)
+	if err != nil {
+		return "", err
+	}
 
 	// check response for errors
 	switch resp.StatusCode {
 	case http.StatusUnauthorized:
 		if strings.Contains(bodyStr, "Personal access tokens with fine grained access do not support the GraphQL API") {
-			logger.Println("GitHub authorisation with fine grained PAT (Personal Access Token) failed as their GraphQL endpoint currently only supports classic PATs: https://github.blog/2022-10-18-introducing-fine-grained-personal-access-tokens-for-github/#coming-next")
+			gh.logger().Println(errGitHubFineGrainedPAT.Error())
 
-			return "", errors.New("GitHub authorisation with fine grained PAT (Personal Access Token) failed as their GraphQL endpoint currently only supports classic PATs: https://github.blog/2022-10-18-introducing-fine-grained-personal-access-tokens-for-github/#coming-next")
+			return "", errors.WithStack(errGitHubFineGrainedPAT)
 		}
 
-		logger.Printf("GitHub authorisation failed: %s", bodyStr)
+		gh.logger().Printf("GitHub authorisation failed: %s", bodyStr)
 
 		return "", errors.Errorf("GitHub authorisation failed: %s", bodyStr)
 	case http.StatusOK:
@@ -227,9 +493,157 @@ func (gh *GitHubHost) makeGithubRequest(payload string) (string, errors.E) {
 	return bodyStr, nil
 }
 
+// makeGithubRESTRequest makes a GET request to the REST API and returns the response body with
+// the URL of the next page of results, if any.
+func (gh *GitHubHost) makeGithubRESTRequest(ctx context.Context, reqURL string) (string, string, errors.E) {
+	resp, bodyStr, err := gh.requestGithub(ctx, http.MethodGet, reqURL, "")
+	if err != nil {
+		return "", "", err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusUnauthorized, http.StatusForbidden:
+		gh.logger().Printf("GitHub authorisation failed: %s", bodyStr)
+
+		return "", "", errors.Errorf("GitHub authorisation failed: %s", bodyStr)
+	default:
+		return "", "", errors.Errorf("GitHub request failed: %s: %s", resp.Status, bodyStr)
+	}
+
+	var next string
+
+	for _, l := range link.ParseResponse(resp) {
+		if l.Rel == txtNext {
+			next = l.URI
+		}
+	}
+
+	return bodyStr, next, nil
+}
+
+// requestGithub makes a request to the API, retrying requests rejected for exceeding a rate limit,
+// and returns the response with its body.
+func (gh *GitHubHost) requestGithub(ctx context.Context, method, reqURL, payload string) (*http.Response, string, errors.E) {
+	for attempt := 0; ; attempt++ {
+		resp, bodyStr, err := gh.doGithubRequest(ctx, method, reqURL, payload)
+		if err != nil {
+			return nil, "", err
+		}
+
+		wait := githubRateLimitWait(resp, time.Now())
+
+		if isGitHubRateLimited(resp) && attempt < githubRateLimitRetries {
+			gh.logger().Printf("GitHub rate limit reached, retrying in %s", wait)
+
+			if sErr := sleepWithContext(ctx, wait); sErr != nil {
+				return nil, "", sErr
+			}
+
+			continue
+		}
+
+		// the next request would be limited, so wait for the limit to reset first
+		if resp.StatusCode == http.StatusOK && wait > 0 {
+			gh.logger().Printf("GitHub rate limit almost reached, waiting %s for it to reset", wait)
+
+			if sErr := sleepWithContext(ctx, wait); sErr != nil {
+				return nil, "", sErr
+			}
+		}
+
+		return resp, bodyStr, nil
+	}
+}
+
+// doGithubRequest makes a single request to the API and returns the response with its body.
+func (gh *GitHubHost) doGithubRequest(ctx context.Context, method, reqURL, payload string) (*http.Response, string, errors.E) {
+	var contentReader io.Reader
+	if payload != "" {
+		contentReader = bytes.NewReader([]byte(payload))
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultHttpRequestTimeout)
+	defer cancel()
+
+	req, newReqErr := retryablehttp.NewRequestWithContext(ctx, method, reqURL, contentReader)
+
+	if newReqErr != nil {
+		gh.logger().Println(newReqErr)
+
+		return nil, "", errors.Wrap(newReqErr, "failed to create request")
+	}
+
+	req.Header.Set("Authorization", "bearer "+gh.Token)
+	req.Header.Set("Content-Type", contentTypeApplicationJSON)
+	req.Header.Set("Accept", contentTypeApplicationJSON)
+
+	resp, reqErr := gh.HttpClient.Do(req)
+	if reqErr != nil {
+		gh.logger().Println(reqErr)
+
+		return nil, "", errors.Wrap(reqErr, "failed to make request")
+	}
+
+	defer resp.Body.Close()
+
+	bodyB, err := io.ReadAll(resp.Body)
+	if err != nil {
+		gh.logger().Println(err)
+
+		return nil, "", errors.Wrap(err, "failed to read response body")
+	}
+
+	return resp, string(bytes.ReplaceAll(bodyB, []byte("\r"), []byte("\r\n"))), nil
+}
+
+// isGitHubRateLimited returns whether the request was rejected for exceeding a rate limit, rather
+// than for lacking permission.
+func isGitHubRateLimited(resp *http.Response) bool {
+	if resp.StatusCode != http.StatusForbidden && resp.StatusCode != http.StatusTooManyRequests {
+		return false
+	}
+
+	return resp.Header.Get("Retry-After") != "" || resp.Header.Get("X-RateLimit-Remaining") == "0"
+}
+
+// githubRateLimitWait returns how long to wait before making another request. Retry-After is
+// returned when exceeding a secondary rate limit, and otherwise the wait is until the primary
+// rate limit resets if few requests remain.
+func githubRateLimitWait(resp *http.Response, now time.Time) time.Duration {
+	if wait, ok := retryAfter(resp, now); ok {
+		return min(wait, githubRateLimitMaxWait)
+	}
+
+	remaining, err := strconv.Atoi(resp.Header.Get("X-RateLimit-Remaining"))
+	if err != nil || remaining > githubRateLimitLowRemaining {
+		return 0
+	}
+
+	reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return min(max(time.Unix(reset, 0).Sub(now), 0), githubRateLimitMaxWait)
+}
+
+// sleepWithContext waits for the duration, returning early with an error if the context ends.
+func sleepWithContext(ctx context.Context, d time.Duration) errors.E {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "wait cancelled")
+	case <-timer.C:
+		return nil
+	}
+}
+
 // describeGithubUserRepos returns a list of repositories owned by authenticated user.
-func (gh *GitHubHost) describeGithubUserRepos() ([]repository, errors.E) {
-	logger.Println("listing GitHub user's owned repositories")
+func (gh *GitHubHost) describeGithubUserRepos(ctx context.Context) ([]repository, errors.E) {
+	gh.logger().Println("listing GitHub user's owned repositories")
 
 	gcs := gitHubCallSize
 
@@ -245,31 +659,40 @@ func (gh *GitHubHost) describeGithubUserRepos() ([]repository, errors.E) {
 	var reqBody string
 
 	if gh.LimitUserOwned {
-		reqBody = "{\"query\": \"query { viewer { repositories(first:" + strconv.Itoa(gcs) + ", affiliations: OWNER, ownerAffiliations: OWNER) { edges { node { name nameWithOwner url sshUrl } cursor } pageInfo { endCursor hasNextPage }} } }\""
+		reqBody = "{\"query\": \"query { viewer { repositories(first:" + strconv.Itoa(gcs) + ", affiliations: OWNER, ownerAffiliations: OWNER) { edges { node { name nameWithOwner url sshUrl databaseId isFork parent { nameWithOwner } pushedAt description visibility defaultBranchRef { name } repositoryTopics(first:100) { nodes { topic { name } } } } cursor } pageInfo { endCursor hasNextPage }} } }\""
 	} else {
-		reqBody = "{\"query\": \"query { viewer { repositories(first:" + strconv.Itoa(gcs) + ") { edges { node { name nameWithOwner url sshUrl } cursor } pageInfo { endCursor hasNextPage }} } }\""
+		reqBody = "{\"query\": \"query { viewer { repositories(first:" + strconv.Itoa(gcs) + ") { edges { node { name nameWithOwner url sshUrl databaseId isFork parent { nameWithOwner } pushedAt description visibility defaultBranchRef { name } repositoryTopics(first:100) { nodes { topic { name } } } } cursor } pageInfo { endCursor hasNextPage }} } }\""
 	}
 
 	for {
-		bodyStr, err := gh.makeGithubRequest(reqBody)
+		bodyStr, err := gh.makeGithubRequest(ctx, reqBody)
 		if err != nil {
-			return nil, errors.Wrap(err, "GitHub request failed")
+			return nil, errors.WithMessage(err, "GitHub request failed")
 		}
 
 		var respObj githubQueryNamesResponse
 		if uErr := json.Unmarshal([]byte(bodyStr), &respObj); uErr != nil {
-			logger.Print(uErr)
+			gh.logger().Println(uErr)
 
 			return nil, errors.Wrap(uErr, "failed to unmarshal response")
 		}
 
 		for _, repo := range respObj.Data.Viewer.Repositories.Edges {
 			repos = append(repos, repository{
+				ID:                providerRepoID(repo.Node.DatabaseID),
 				Name:              repo.Node.Name,
 				SSHUrl:            repo.Node.SSHURL,
 				HTTPSUrl:          repo.Node.URL,
+				Owner:             ownerFromPath(repo.Node.NameWithOwner),
 				PathWithNameSpace: repo.Node.NameWithOwner,
 				Domain:            gitHubDomain,
+				IsFork:            repo.Node.IsFork,
+				ForkParent:        repo.forkParent(),
+				UpdatedAt:         repo.Node.PushedAt,
+				Description:       repo.Node.Description,
+				Topics:            repo.topics(),
+				DefaultBranch:     repo.defaultBranch(),
+				Visibility:        strings.ToLower(repo.Node.Visibility),
 			})
 		}
 
@@ -277,9 +700,9 @@ func (gh *GitHubHost) describeGithubUserRepos() ([]repository, errors.E) {
 			break
 		} else {
 			if gh.LimitUserOwned {
-				reqBody = "{\"query\": \"query($first:Int $after:String){ viewer { repositories(first:$first after:$after, affiliations: OWNER, ownerAffiliations: OWNER) { edges { node { name nameWithOwner url sshUrl } cursor } pageInfo { endCursor hasNextPage }} } }\", \"variables\":{\"first\":" + strconv.Itoa(gcs) + ",\"after\":\"" + respObj.Data.Viewer.Repositories.PageInfo.EndCursor + "\"} }"
+				reqBody = "{\"query\": \"query($first:Int $after:String){ viewer { repositories(first:$first after:$after, affiliations: OWNER, ownerAffiliations: OWNER) { edges { node { name nameWithOwner url sshUrl databaseId isFork parent { nameWithOwner } pushedAt description visibility defaultBranchRef { name } repositoryTopics(first:100) { nodes { topic { name } } } } cursor } pageInfo { endCursor hasNextPage }} } }\", \"variables\":{\"first\":" + strconv.Itoa(gcs) + ",\"after\":\"" + respObj.Data.Viewer.Repositories.PageInfo.EndCursor + "\"} }"
 			} else {
-				reqBody = "{\"query\": \"query($first:Int $after:String){ viewer { repositories(first:$first after:$after) { edges { node { name nameWithOwner url sshUrl } cursor } pageInfo { endCursor hasNextPage }} } }\", \"variables\":{\"first\":" + strconv.Itoa(gcs) + ",\"after\":\"" + respObj.Data.Viewer.Repositories.PageInfo.EndCursor + "\"} }"
+				reqBody = "{\"query\": \"query($first:Int $after:String){ viewer { repositories(first:$first after:$after) { edges { node { name nameWithOwner url sshUrl databaseId isFork parent { nameWithOwner } pushedAt description visibility defaultBranchRef { name } repositoryTopics(first:100) { nodes { topic { name } } } } cursor } pageInfo { endCursor hasNextPage }} } }\", \"variables\":{\"first\":" + strconv.Itoa(gcs) + ",\"after\":\"" + respObj.Data.Viewer.Repositories.PageInfo.EndCursor + "\"} }"
 			}
 		}
 	}
@@ -287,30 +710,30 @@ func (gh *GitHubHost) describeGithubUserRepos() ([]repository, errors.E) {
 	return repos, nil
 }
 
-func (gh *GitHubHost) describeGithubUserOrganizations() ([]githubOrganization, errors.E) {
-	logger.Println("listing GitHub user's related Organizations")
+func (gh *GitHubHost) describeGithubUserOrganizations(ctx context.Context) ([]githubOrganization, errors.E) {
+	gh.logger().Println("listing GitHub user's related Organizations")
 
 	var orgs []githubOrganization
 
 	reqBody := "{\"query\": \"{ viewer { organizations(first:100) { edges { node { name } } } } }\""
 
-	bodyStr, err := gh.makeGithubRequest(reqBody)
+	bodyStr, err := gh.makeGithubRequest(ctx, reqBody)
 	if err != nil {
-		logger.Print(err)
+		gh.logger().Println(err)
 
-		return nil, errors.Wrap(err, "GitHub request failed")
+		return nil, errors.WithMessage(err, "GitHub request failed")
 	}
 
 	var respObj githubQueryOrgsResponse
 	if uErr := json.Unmarshal([]byte(bodyStr), &respObj); uErr != nil {
-		logger.Print(uErr)
+		gh.logger().Println(uErr)
 
 		return nil, errors.Wrap(uErr, "failed to unmarshal response")
 	}
 
 	if len(respObj.Errors) > 0 {
 		for _, queryError := range respObj.Errors {
-			logger.Printf("failed to retrieve organizations user's a member of: %s", queryError.Message)
+			gh.logger().Printf("failed to retrieve organizations user's a member of: %s", queryError.Message)
 		}
 
 		return nil, errors.New("failed to retrieve organizations user's a member of")
@@ -329,10 +752,10 @@ type githubOrganization struct {
 	Name string `json:"name"`
 }
 
-func createGithubRequestPayload(body string) (string, errors.E) {
+func createGithubRequestPayload(logger Logger, body string) (string, errors.E) {
 	gqlMarshalled, err := json.Marshal(graphQLRequest{Query: body})
 	if err != nil {
-		logger.Print(err)
+		logger.Println(err)
 
 		return "", errors.Wrap(err, "failed to marshal request")
 	}
@@ -340,8 +763,10 @@ func createGithubRequestPayload(body string) (string, errors.E) {
 	return string(gqlMarshalled), nil
 }
 
-func (gh *GitHubHost) describeGithubOrgRepos(orgName string) ([]repository, errors.E) {
-	logger.Printf("listing GitHub organization %s's repositories", orgName)
+// describeGithubOrgRepos returns the organization's repositories. Those listed before a failure
+// are returned with it.
+func (gh *GitHubHost) describeGithubOrgRepos(ctx context.Context, orgName string) ([]repository, errors.E) {
+	gh.logger().Printf("listing GitHub organization %s's repositories", orgName)
 
 	gcs := gitHubCallSize
 
@@ -354,91 +779,112 @@ func (gh *GitHubHost) describeGithubOrgRepos(orgName string) ([]repository, erro
 
 	var repos []repository
 
-	reqBody := "query { organization(login: \"" + orgName + "\") { repositories(first:" + strconv.Itoa(gcs) + ") { edges { node { name nameWithOwner url sshUrl } cursor } pageInfo { endCursor hasNextPage }}}}"
+	reqBody := "query { organization(login: \"" + orgName + "\") { repositories(first:" + strconv.Itoa(gcs) + ") { edges { node { name nameWithOwner url sshUrl databaseId isFork parent { nameWithOwner } pushedAt description visibility defaultBranchRef { name } repositoryTopics(first:100) { nodes { topic { name } } } } cursor } pageInfo { endCursor hasNextPage }}}}"
 
 	for {
-		payload, err := createGithubRequestPayload(reqBody)
+		payload, err := createGithubRequestPayload(gh.logger(), reqBody)
 		if err != nil {
-			logger.Print(err)
+			gh.logger().Println(err)
 
-			return nil, errors.Wrap(err, "failed to create request payload")
+			return repos, errors.Wrap(err, "failed to create request payload")
 		}
 
-		bodyStr, err := gh.makeGithubRequest(payload)
+		bodyStr, err := gh.makeGithubRequest(ctx, payload)
 		if err != nil {
-			logger.Print(err)
+			gh.logger().Println(err)
 
-			return nil, nil
+			return repos, errors.WithMessage(err, "GitHub request failed")
 		}
 
 		var respObj githubQueryOrgResponse
 
-		if uErr := json.Unmarshal([]byte(bodyStr), &respObj); err != nil {
-			logger.Print(err)
+		if uErr := json.Unmarshal([]byte(bodyStr), &respObj); uErr != nil {
+			gh.logger().Println(uErr)
 
-			return nil, errors.Wrap(uErr, "failed to unmarshal response")
+			return repos, errors.Wrap(uErr, "failed to unmarshal response")
 		}
 
 		if respObj.Errors != nil {
 			for _, gqlErr := range respObj.Errors {
 				if gqlErr.Type == "NOT_FOUND" {
-					logger.Printf("organization %s not found", orgName)
+					gh.logger().Printf("organization %s not found", orgName)
 
 					return nil, errors.Errorf("organization %s not found", orgName)
 				} else {
-					logger.Printf("unexpected error: type: %s message: %s", gqlErr.Type, gqlErr.Message)
+					gh.logger().Printf("unexpected error: type: %s message: %s", gqlErr.Type, gqlErr.Message)
 
-					return nil, errors.Errorf("unexpected error: type: %s message: %s", gqlErr.Type, gqlErr.Message)
+					return repos, errors.Errorf("unexpected error: type: %s message: %s", gqlErr.Type, gqlErr.Message)
 				}
 			}
 		}
 
 		for _, repo := range respObj.Data.Organization.Repositories.Edges {
 			repos = append(repos, repository{
+				ID:                providerRepoID(repo.Node.DatabaseID),
 				Name:              repo.Node.Name,
 				SSHUrl:            repo.Node.SSHURL,
 				HTTPSUrl:          repo.Node.URL,
+				Owner:             ownerFromPath(repo.Node.NameWithOwner),
 				PathWithNameSpace: repo.Node.NameWithOwner,
 				Domain:            gitHubDomain,
+				IsFork:            repo.Node.IsFork,
+				ForkParent:        repo.forkParent(),
+				UpdatedAt:         repo.Node.PushedAt,
+				Description:       repo.Node.Description,
+				Topics:            repo.topics(),
+				DefaultBranch:     repo.defaultBranch(),
+				Visibility:        strings.ToLower(repo.Node.Visibility),
 			})
 		}
 
 		if !respObj.Data.Organization.Repositories.PageInfo.HasNextPage {
 			break
 		} else {
-			reqBody = "query { organization(login: \"" + orgName + "\") { repositories(first:" + strconv.Itoa(gcs) + " after: \"" + respObj.Data.Organization.Repositories.PageInfo.EndCursor + "\") { edges { node { name nameWithOwner url sshUrl } cursor } pageInfo { endCursor hasNextPage }}}}"
+			reqBody = "query { organization(login: \"" + orgName + "\") { repositories(first:" + strconv.Itoa(gcs) + " after: \"" + respObj.Data.Organization.Repositories.PageInfo.EndCursor + "\") { edges { node { name nameWithOwner url sshUrl databaseId isFork parent { nameWithOwner } pushedAt description visibility defaultBranchRef { name } repositoryTopics(first:100) { nodes { topic { name } } } } cursor } pageInfo { endCursor hasNextPage }}}}"
 		}
 	}
 
 	return repos, nil
 }
 
-func (gh *GitHubHost) describeRepos() (describeReposOutput, errors.E) {
+func (gh *GitHubHost) describeRepos(ctx context.Context) (describeReposOutput, errors.E) {
+	out, err := gh.describeReposGraphQL(ctx)
+	if errors.Is(err, errGitHubFineGrainedPAT) {
+		gh.logger().Println("listing GitHub repositories with the REST API as the GraphQL API doesn't support fine grained PATs")
+
+		return gh.describeReposREST(ctx)
+	}
+
+	return out, err
+}
+
+// describeReposGraphQL returns the repositories to back up, listed with the GraphQL API.
+func (gh *GitHubHost) describeReposGraphQL(ctx context.Context) (describeReposOutput, errors.E) {
 	var repos []repository
 
 	if !gh.SkipUserRepos {
 		// get authenticated user's owned repos
 		var err errors.E
 
-		repos, err = gh.describeGithubUserRepos()
+		repos, err = gh.describeGithubUserRepos(ctx)
 		if err != nil {
-			logger.Print("failed to get GitHub user repos")
+			gh.logger().Println("failed to get GitHub user repos")
 
 			return describeReposOutput{}, err
 		}
 	}
 
 	// set orgs repos to retrieve to those specified when client constructed
-	orgs := gh.Orgs
+	orgs := slices.Clone(gh.Orgs)
 
 	// if we get a wildcard, get all orgs user belongs to
-	if slices.Contains(gh.Orgs, "*") {
+	if slices.Contains(orgs, "*") {
 		// delete the wildcard, leaving any existing specified orgs that may have been passed in
 		orgs = remove(orgs, "*")
 		// get a list of orgs the authenticated user belongs to
-		githubOrgs, err := gh.describeGithubUserOrganizations()
+		githubOrgs, err := gh.describeGithubUserOrganizations(ctx)
 		if err != nil {
-			logger.Print("failed to get user's GitHub organizations")
+			gh.logger().Println("failed to get user's GitHub organizations")
 
 			return describeReposOutput{}, err
 		}
@@ -449,15 +895,12 @@ func (gh *GitHubHost) describeRepos() (describeReposOutput, errors.E) {
 	}
 
 	// append repos belonging to any orgs specified
-	for _, org := range orgs {
-		dRepos, err := gh.describeGithubOrgRepos(org)
-		if err != nil {
-			logger.Printf("failed to get GitHub organization %s repos", org)
+	orgsRepos, err := gh.describeGithubOrgsRepos(ctx, orgs, gh.describeGithubOrgRepos)
 
-			return describeReposOutput{}, errors.Wrapf(err, "failed to get GitHub organization %s repos", org)
-		}
+	repos = append(repos, orgsRepos...)
 
-		repos = append(repos, dRepos...)
+	if err != nil {
+		return describeReposOutput{Repos: removeDuplicates(repos)}, err
 	}
 
 	// remove any duplicate repos
@@ -469,6 +912,268 @@ func (gh *GitHubHost) describeRepos() (describeReposOutput, errors.E) {
 	}, nil
 }
 
+// describeGithubOrgsRepos returns the repositories of the specified organizations, fetching them
+// concurrently with describeOrg. The results are returned in the order the organizations are specified.
+func (gh *GitHubHost) describeGithubOrgsRepos(ctx context.Context, orgs []string, describeOrg func(context.Context, string) ([]repository, errors.E)) ([]repository, errors.E) {
+	orgsRepos := make([][]repository, len(orgs))
+	orgsErrs := make([]errors.E, len(orgs))
+
+	sem := make(chan struct{}, githubMaxConcurrentOrgRequests)
+
+	var wg sync.WaitGroup
+
+	for x, org := range orgs {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			sem <- struct{}{}
+			defer func() { <-sem }()
+
+			orgsRepos[x], orgsErrs[x] = describeOrg(ctx, org)
+		}()
+	}
+
+	wg.Wait()
+
+	var repos []repository
+
+	for x, org := range orgs {
+		// those listed before a failure are returned with it
+		repos = append(repos, orgsRepos[x]...)
+
+		if orgsErrs[x] != nil {
+			gh.logger().Printf("failed to get GitHub organization %s repos", org)
+
+			return repos, errors.WithMessagef(orgsErrs[x], "failed to get GitHub organization %s repos", org)
+		}
+	}
+
+	return repos, nil
+}
+
+// githubRESTRepo is a repository returned by the REST API.
+type githubRESTRepo struct {
+	ID       int64     `json:"id"`
+	Name     string    `json:"name"`
+	FullName string    `json:"full_name"`
+	HTMLURL  string    `json:"html_url"`
+	SSHURL   string    `json:"ssh_url"`
+	Fork     bool      `json:"fork"`
+	PushedAt time.Time `json:"pushed_at"`
+	// the repository's metadata, kept when BackupMetadata is set
+	Description   string   `json:"description"`
+	Topics        []string `json:"topics"`
+	DefaultBranch string   `json:"default_branch"`
+	Visibility    string   `json:"visibility"`
+}
+
+// describeReposREST returns the repositories to back up, listed with the REST API. Unlike the
+// GraphQL API, the REST API accepts fine-grained PATs.
+func (gh *GitHubHost) describeReposREST(ctx context.Context) (describeReposOutput, errors.E) {
+	var repos []repository
+
+	if !gh.SkipUserRepos {
+		var err errors.E
+
+		repos, err = gh.describeGithubUserReposREST(ctx)
+		if err != nil {
+			gh.logger().Println("failed to get GitHub user repos")
+
+			return describeReposOutput{}, err
+		}
+	}
+
+	orgs := slices.Clone(gh.Orgs)
+
+	if slices.Contains(orgs, "*") {
+		orgs = remove(orgs, "*")
+
+		githubOrgs, err := gh.describeGithubUserOrganizationsREST(ctx)
+		if err != nil {
+			gh.logger().Println("failed to get user's GitHub organizations")
+
+			return describeReposOutput{}, err
+		}
+
+		for _, gho := range githubOrgs {
+			orgs = append(orgs, gho.Name)
+		}
+	}
+
+	orgsRepos, err := gh.describeGithubOrgsRepos(ctx, orgs, gh.describeGithubOrgReposREST)
+
+	repos = append(repos, orgsRepos...)
+
+	if err != nil {
+		return describeReposOutput{Repos: removeDuplicates(repos)}, err
+	}
+
+	return describeReposOutput{
+		Repos: removeDuplicates(repos),
+	}, nil
+}
+
+// describeGithubUserReposREST returns the repositories the authenticated user has access to, or
+// only those they own if LimitUserOwned is set.
+func (gh *GitHubHost) describeGithubUserReposREST(ctx context.Context) ([]repository, errors.E) {
+	gh.logger().Println("listing GitHub user's owned repositories")
+
+	query := url.Values{}
+	query.Set("per_page", strconv.Itoa(githubRESTPageSize))
+
+	if gh.LimitUserOwned {
+		query.Set("affiliation", "owner")
+	}
+
+	return gh.getGithubReposREST(ctx, githubRESTURL(gh.APIURL)+"/user/repos?"+query.Encode())
+}
+
+// describeGithubOrgReposREST returns the repositories of the organization.
+func (gh *GitHubHost) describeGithubOrgReposREST(ctx context.Context, orgName string) ([]repository, errors.E) {
+	gh.logger().Printf("listing GitHub organization %s's repositories", orgName)
+
+	return gh.getGithubReposREST(ctx, githubRESTURL(gh.APIURL)+"/orgs/"+url.PathEscape(orgName)+"/repos?per_page="+strconv.Itoa(githubRESTPageSize))
+}
+
+// getGithubReposREST returns the repositories listed from the URL and any subsequent pages. Those
+// listed before a failure are returned with it.
+func (gh *GitHubHost) getGithubReposREST(ctx context.Context, reqURL string) ([]repository, errors.E) {
+	var repos []repository
+
+	for reqURL != "" {
+		bodyStr, next, err := gh.makeGithubRESTRequest(ctx, reqURL)
+		if err != nil {
+			return repos, errors.WithMessage(err, "GitHub request failed")
+		}
+
+		var respObj []githubRESTRepo
+		if uErr := json.Unmarshal([]byte(bodyStr), &respObj); uErr != nil {
+			gh.logger().Println(uErr)
+
+			return repos, errors.Wrap(uErr, "failed to unmarshal response")
+		}
+
+		for _, repo := range respObj {
+			repos = append(repos, repository{
+				ID:                providerRepoID(repo.ID),
+				Name:              repo.Name,
+				SSHUrl:            repo.SSHURL,
+				HTTPSUrl:          repo.HTMLURL,
+				Owner:             ownerFromPath(repo.FullName),
+				PathWithNameSpace: repo.FullName,
+				Domain:            gitHubDomain,
+				IsFork:            repo.Fork,
+				UpdatedAt:         repo.PushedAt,
+				Description:       repo.Description,
+				Topics:            repo.Topics,
+				DefaultBranch:     repo.DefaultBranch,
+				Visibility:        repo.Visibility,
+			})
+		}
+
+		reqURL = next
+	}
+
+	return repos, nil
+}
+
+// githubRelease is a release as returned by the REST API.
+type githubRelease struct {
+	TagName string `json:"tag_name"`
+	Assets  []struct {
+		Name string `json:"name"`
+		URL  string `json:"url"`
+		Size int64  `json:"size"`
+	} `json:"assets"`
+}
+
+// listReleases returns the releases of the repository with their assets.
+func (gh *GitHubHost) listReleases(ctx context.Context, repo repository) ([]release, errors.E) {
+	var releases []release
+
+	reqURL := githubRESTURL(gh.APIURL) + "/repos/" + repo.PathWithNameSpace + "/releases?per_page=" + strconv.Itoa(githubRESTPageSize)
+
+	for reqURL != "" {
+		bodyStr, next, err := gh.makeGithubRESTRequest(ctx, reqURL)
+		if err != nil {
+			return nil, errors.WithMessage(err, "failed to list releases")
+		}
+
+		var respObj []githubRelease
+		if uErr := json.Unmarshal([]byte(bodyStr), &respObj); uErr != nil {
+			return nil, errors.Wrap(uErr, "failed to unmarshal response")
+		}
+
+		for _, r := range respObj {
+			rel := release{Tag: r.TagName}
+
+			for _, asset := range r.Assets {
+				rel.Assets = append(rel.Assets, releaseAsset{Name: asset.Name, URL: asset.URL, Size: asset.Size})
+			}
+
+			releases = append(releases, rel)
+		}
+
+		reqURL = next
+	}
+
+	return releases, nil
+}
+
+// downloadAsset downloads the asset through the API, which redirects to where it's stored.
+func (gh *GitHubHost) downloadAsset(ctx context.Context, asset releaseAsset, w io.Writer) errors.E {
+	return downloadURL(ctx, gh.HttpClient, asset.URL, http.Header{
+		"Authorization": {"bearer " + gh.Token},
+		"Accept":        {"application/octet-stream"},
+	}, w)
+}
+
+// releaseSource returns the host as the source of its repositories' releases, if they're backed up.
+func (gh *GitHubHost) releaseSource() releaseSource {
+	if !gh.BackupReleases {
+		return nil
+	}
+
+	return gh
+}
+
+// describeGithubUserOrganizationsREST returns the organizations the authenticated user belongs to.
+func (gh *GitHubHost) describeGithubUserOrganizationsREST(ctx context.Context) ([]githubOrganization, errors.E) {
+	gh.logger().Println("listing GitHub user's related Organizations")
+
+	var orgs []githubOrganization
+
+	reqURL := githubRESTURL(gh.APIURL) + "/user/orgs?per_page=" + strconv.Itoa(githubRESTPageSize)
+
+	for reqURL != "" {
+		bodyStr, next, err := gh.makeGithubRESTRequest(ctx, reqURL)
+		if err != nil {
+			return nil, errors.WithMessage(err, "GitHub request failed")
+		}
+
+		var respObj []struct {
+			Login string `json:"login"`
+		}
+		if uErr := json.Unmarshal([]byte(bodyStr), &respObj); uErr != nil {
+			gh.logger().Println(uErr)
+
+			return nil, errors.Wrap(uErr, "failed to unmarshal response")
+		}
+
+		for _, org := range respObj {
+			orgs = append(orgs, githubOrganization{
+				Name: org.Login,
+			})
+		}
+
+		reqURL = next
+	}
+
+	return orgs, nil
+}
+
 func removeDuplicates(repos []repository) []repository {
 	var uniqueRepos []repository
 
@@ -485,31 +1190,90 @@ func removeDuplicates(repos []repository) []repository {
 	return uniqueRepos
 }
 
-func gitHubWorker(logLevel int, token, backupDIR, diffRemoteMethod string, backupsToKeep int, jobs <-chan repository, results chan<- RepoBackupResults) {
-	for repo := range jobs {
-		firstPos := strings.Index(repo.HTTPSUrl, "//")
-		repo.URLWithToken = fmt.Sprintf("%s%s@%s", repo.HTTPSUrl[:firstPos+2], stripTrailing(token, "\n"), repo.HTTPSUrl[firstPos+2:])
-		err := processBackup(logLevel, repo, backupDIR, backupsToKeep, diffRemoteMethod)
+// backupInput returns the settings each of the host's repositories is backed up with.
+func (gh *GitHubHost) backupInput() processBackupInput {
+	return processBackupInput{
+		LogLevel:            gh.LogLevel,
+		Logger:              gh.logger(),
+		RemoteStore:         gh.RemoteStore,
+		StoreKeyPrefix:      gh.NamespacePrefix,
+		RepoBackupTimeout:   gh.RepoBackupTimeout,
+		Git:                 gitOptions{BinaryPath: gh.GitBinaryPath, ExtraConfig: gh.ExtraGitConfig, ProxyURL: gh.ProxyURL, CACertPath: gh.CACertPath, InsecureSkipTLSVerify: gh.InsecureSkipTLSVerify},
+		BackupDIR:           backupRoot(gh.BackupDir, gh.NamespacePrefix),
+		BackupsToKeep:       gh.BackupsToRetain,
+		KeepForDays:         gh.KeepForDays,
+		CloneRetries:        gh.CloneRetries,
+		MinFreeDiskMB:       gh.MinFreeDiskMB,
+		DiffRemoteMethod:    gh.diffRemoteMethod(),
+		BundleRefSpec:       gh.BundleRefSpec,
+		RefSpec:             gh.refSpecPatterns,
+		BundleNameTemplate:  gh.BundleNameTemplate,
+		FlatLayout:          gh.FlatLayout,
+		FlatLayoutSeparator: gh.FlatLayoutSeparator,
+		DateDir:             backupDateDir(gh.DateDirLayout),
+		DetectRenames:       gh.DetectRenames,
+		UseAlternates:       gh.UseAlternates,
+		DryRun:              gh.DryRun,
+		PartialClone:        gh.PartialClone,
+		KeepWorkingDir:      gh.KeepWorkingDir,
+		SkipVerify:          !gh.VerifyAfterCreate,
+		CompressBundles:     gh.CompressBundles,
+		ArchivePerRepo:      gh.ArchivePerRepo,
+		KeepArchivedFiles:   gh.KeepArchivedFiles,
+		SSHPrivateKeyPath:   gh.SSHPrivateKeyPath,
+		SSHKnownHostsPath:   gh.SSHKnownHostsPath,
+		Releases:            gh.releaseSource(),
+		BackupMetadata:      gh.BackupMetadata,
+	}
+}
 
-		backupResult := RepoBackupResults{
-			Repo: repo.PathWithNameSpace,
-		}
+// setupRepo adds the token to the repository's URL so it can be cloned.
+func (gh *GitHubHost) setupRepo(repo repository) repository {
+	firstPos := strings.Index(repo.HTTPSUrl, "//")
+	repo.URLWithToken = fmt.Sprintf("%s%s@%s", repo.HTTPSUrl[:firstPos+2], stripTrailing(gh.Token, "\n"), repo.HTTPSUrl[firstPos+2:])
 
-		status := statusOk
-		if err != nil {
-			status = statusFailed
-			backupResult.Error = err
-		}
+	return repo
+}
 
-		backupResult.Status = status
+func (gh *GitHubHost) Backup() ProviderBackupResult {
+	return gh.BackupWithContext(context.Background())
+}
 
-		results <- backupResult
+// BackupWithContext backs up the host's repositories. Any not yet backed up when the context is
+// cancelled are reported as failed.
+func (gh *GitHubHost) BackupWithContext(ctx context.Context) ProviderBackupResult {
+	release, err := acquireBackupLocks(ctx, []GitProvider{gh})
+	if err != nil {
+		return ProviderBackupResult{Error: err}
 	}
+
+	defer release()
+
+	return gh.backupWithCloneTokens(ctx, nil)
 }
 
-func (gh *GitHubHost) Backup() ProviderBackupResult {
+// backupLock returns the directory locked while the host is backed up, and how long to wait for it.
+func (gh *GitHubHost) backupLock() (string, time.Duration) {
+	return gh.BackupDir, gh.LockTimeout
+}
+
+// backupWithCloneTokens backs up the host's repositories, each holding a token from cloneTokens, if
+// specified, while being backed up.
+func (gh *GitHubHost) backupWithCloneTokens(ctx context.Context, cloneTokens chan struct{}) ProviderBackupResult {
+	in := gh.backupInput()
+
+	result := gh.backup(ctx, in, cloneTokens)
+
+	updateBackupIndexes(gh.logger(), in, result.BackupResults)
+
+	notifyWebhook(ctx, gh.logger(), gh.HttpClient, gh.NotifyWebhookURL, gitHubProviderName, result)
+
+	return result
+}
+
+func (gh *GitHubHost) backup(ctx context.Context, in processBackupInput, cloneTokens chan struct{}) ProviderBackupResult {
 	if gh.BackupDir == "" {
-		logger.Printf("backup skipped as backup directory not specified")
+		gh.logger().Printf("backup skipped as backup directory not specified")
 
 		return ProviderBackupResult{
 			BackupResults: nil,
@@ -517,9 +1281,7 @@ func (gh *GitHubHost) Backup() ProviderBackupResult {
 		}
 	}
 
-	maxConcurrent := 10
-
-	repoDesc, err := gh.describeRepos()
+	repoDesc, err := gh.describeRepos(ctx)
 	if err != nil {
 		return ProviderBackupResult{
 			BackupResults: nil,
@@ -527,50 +1289,38 @@ func (gh *GitHubHost) Backup() ProviderBackupResult {
 		}
 	}
 
-	jobs := make(chan repository, len(repoDesc.Repos))
-	results := make(chan RepoBackupResults, maxConcurrent)
-
-	for w := 1; w <= maxConcurrent; w++ {
-		go gitHubWorker(gh.LogLevel, gh.Token, gh.BackupDir, gh.DiffRemoteMethod, gh.BackupsToRetain, jobs, results)
-	}
-
-	for x := range repoDesc.Repos {
-		repo := repoDesc.Repos[x]
-		jobs <- repo
-	}
-
-	close(jobs)
+	repoDesc.Repos = filterRepos(gh.logger(), repoDesc.Repos, gh.Include, gh.Exclude)
+	repoDesc.Repos = filterRepoList(gh.logger(), repoDesc.Repos, gh.RepoList, gh.RepoListMode)
 
-	var providerBackupResults ProviderBackupResult
-
-	for a := 1; a <= len(repoDesc.Repos); a++ {
-		res := <-results
-		if res.Error != nil {
-			logger.Printf("backup failed: %+v\n", errors.Unwrap(res.Error))
-		}
-
-		providerBackupResults.BackupResults = append(providerBackupResults.BackupResults, res)
+	if mErr := checkMaxRepos(gh.logger(), gitHubProviderName, len(repoDesc.Repos), gh.MaxRepos); mErr != nil {
+		return ProviderBackupResult{Error: mErr}
 	}
 
-	return providerBackupResults
+	repos, skipped := filterSkippedRepos(gh.logger(), repoDesc.Repos, gh.DryRun, skipReasonFork, func(repo repository) bool {
+		return gh.SkipForks && repo.IsFork
+	})
+
+	repos, notUpdatedResults := filterSkippedRepos(gh.logger(), repos, gh.DryRun, skipReasonNotUpdated, notUpdatedSince(gh.UpdatedSince))
+	skipped = append(skipped, notUpdatedResults...)
+
+	return runBackups(ctx, gitHubProviderName, in, gh.setupRepo, repos, cloneTokens, backupRunOptions{
+		MaxConcurrent:    getMaxConcurrent(gh.MaxConcurrent, defaultMaxConcurrentGitHub),
+		FailFast:         gh.FailFast,
+		FailOnAnyError:   gh.FailOnAnyError,
+		UseAlternates:    gh.UseAlternates,
+		BackupSubmodules: gh.BackupSubmodules,
+		DetectRenames:    gh.DetectRenames,
+		Progress:         gh.Progress,
+		Skipped:          skipped,
+	})
 }
 
 // return normalised method.
 func (gh *GitHubHost) diffRemoteMethod() string {
-	switch strings.ToLower(gh.DiffRemoteMethod) {
-	case refsMethod:
-		return refsMethod
-	case cloneMethod:
-		return cloneMethod
-	case "":
-		logger.Printf("diff remote method not specified. defaulting to: %s", cloneMethod)
-
-		// default to bundle as safest
-		return cloneMethod
-	default:
-		logger.Printf("unexpected diff remote method: %s", gh.DiffRemoteMethod)
+	return normaliseDiffRemoteMethod(gh.logger(), gh.DiffRemoteMethod)
+}
 
-		// default to bundle as safest
-		return cloneMethod
-	}
+// logger returns the configured logger, or the package's default if none was specified.
+func (gh *GitHubHost) logger() Logger {
+	return getLogger(gh.Logger)
 }
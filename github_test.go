@@ -1,21 +1,26 @@
 package githosts
 
 import (
-	"bytes"
+	"context"
+	"io"
 	"log"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
 	"github.com/stretchr/testify/require"
 )
 
-var buf bytes.Buffer
-
 const (
 	envGithubToken            = "GITHUB_TOKEN" //nolint:gosec
 	msgSkipGitHubTokenMissing = "Skipping GitHub test as " + envGithubToken + " is missing"
@@ -80,9 +85,7 @@ func TestDescribeGithubOrgRepos(t *testing.T) {
 		t.Skip(msgSkipGitHubTokenMissing)
 	}
 
-	// need to set output to buffer in order to test output
-	logger.SetOutput(&buf)
-	defer logger.SetOutput(os.Stdout)
+	_, testLogger := newTestLogger()
 
 	resetBackups()
 
@@ -95,13 +98,14 @@ func TestDescribeGithubOrgRepos(t *testing.T) {
 	unsetEnvVars([]string{envVarGitBackupDir, envGithubToken})
 
 	gh, err := NewGitHubHost(NewGitHubHostInput{
+		Logger:           testLogger,
 		APIURL:           githubAPIURL,
 		DiffRemoteMethod: refsMethod,
 		Token:            os.Getenv(envGithubToken),
 	})
 	require.NoError(t, err)
 
-	repos, err := gh.describeGithubOrgRepos("Nudelmesse")
+	repos, err := gh.describeGithubOrgRepos(context.Background(), "Nudelmesse")
 	require.NoError(t, err)
 	require.Len(t, repos, 4)
 }
@@ -111,9 +115,7 @@ func TestSinglePublicGitHubOrgRepoBackups(t *testing.T) {
 		t.Skip(msgSkipGitHubTokenMissing)
 	}
 
-	// need to set output to buffer in order to test output
-	logger.SetOutput(&buf)
-	defer logger.SetOutput(os.Stdout)
+	buf, testLogger := newTestLogger()
 
 	resetBackups()
 
@@ -128,6 +130,7 @@ func TestSinglePublicGitHubOrgRepoBackups(t *testing.T) {
 	backupDIR := os.Getenv(envVarGitBackupDir)
 
 	ghHost, err := NewGitHubHost(NewGitHubHostInput{
+		Logger:           testLogger,
 		APIURL:           githubAPIURL,
 		DiffRemoteMethod: refsMethod,
 		BackupDir:        backupDIR,
@@ -167,8 +170,6 @@ func TestSinglePublicGitHubOrgRepoBackups(t *testing.T) {
 
 	var matches int
 
-	logger.SetOutput(os.Stdout)
-
 	for x := range logLines {
 		if reRepo0.MatchString(logLines[x]) {
 			matches++
@@ -191,11 +192,7 @@ func TestPublicGitHubOrgRepoBackups(t *testing.T) {
 		t.Skip(msgSkipGitHubTokenMissing)
 	}
 
-	// need to set output to buffer in order to test output
-	buf = bytes.Buffer{}
-	logger.SetOutput(&buf)
-
-	defer logger.SetOutput(os.Stdout)
+	buf, testLogger := newTestLogger()
 
 	resetBackups()
 
@@ -210,6 +207,7 @@ func TestPublicGitHubOrgRepoBackups(t *testing.T) {
 	backupDIR := os.Getenv(envVarGitBackupDir)
 
 	ghHost, err := NewGitHubHost(NewGitHubHostInput{
+		Logger:           testLogger,
 		APIURL:           githubAPIURL,
 		DiffRemoteMethod: refsMethod,
 		BackupDir:        backupDIR,
@@ -241,8 +239,6 @@ func TestPublicGitHubOrgRepoBackups(t *testing.T) {
 
 	var matches int
 
-	logger.SetOutput(os.Stdout)
-
 	for x := range logLines {
 		if strings.TrimSpace(logLines[x]) == "" {
 			continue
@@ -265,9 +261,7 @@ func TestDescribeGithubReposWithWildcard(t *testing.T) {
 		t.Skip(msgSkipGitHubTokenMissing)
 	}
 
-	// need to set output to buffer in order to test output
-	logger.SetOutput(&buf)
-	defer logger.SetOutput(os.Stdout)
+	_, testLogger := newTestLogger()
 
 	resetBackups()
 
@@ -280,6 +274,7 @@ func TestDescribeGithubReposWithWildcard(t *testing.T) {
 	unsetEnvVars([]string{envVarGitBackupDir, envGithubToken})
 
 	gh, err := NewGitHubHost(NewGitHubHostInput{
+		Logger:           testLogger,
 		APIURL:           githubAPIURL,
 		DiffRemoteMethod: refsMethod,
 		Token:            os.Getenv(envGithubToken),
@@ -287,7 +282,7 @@ func TestDescribeGithubReposWithWildcard(t *testing.T) {
 	})
 	require.NoError(t, err)
 
-	descReposResp, err := gh.describeRepos()
+	descReposResp, err := gh.describeRepos(context.Background())
 	require.NoError(t, err)
 
 	require.True(t, repoExists(repoExistsInput{
@@ -346,9 +341,7 @@ func TestDescribeGithubReposWithWildcardAndLimitUserOwned(t *testing.T) {
 		t.Skip(msgSkipGitHubTokenMissing)
 	}
 
-	// need to set output to buffer in order to test output
-	logger.SetOutput(&buf)
-	defer logger.SetOutput(os.Stdout)
+	_, testLogger := newTestLogger()
 
 	resetBackups()
 
@@ -361,6 +354,7 @@ func TestDescribeGithubReposWithWildcardAndLimitUserOwned(t *testing.T) {
 	unsetEnvVars([]string{envVarGitBackupDir, envGithubToken})
 
 	gh, err := NewGitHubHost(NewGitHubHostInput{
+		Logger:           testLogger,
 		APIURL:           githubAPIURL,
 		LimitUserOwned:   true,
 		DiffRemoteMethod: refsMethod,
@@ -369,7 +363,7 @@ func TestDescribeGithubReposWithWildcardAndLimitUserOwned(t *testing.T) {
 	})
 	require.NoError(t, err)
 
-	descReposResp, err := gh.describeRepos()
+	descReposResp, err := gh.describeRepos(context.Background())
 	require.NoError(t, err)
 
 	require.True(t, repoExists(repoExistsInput{
@@ -429,9 +423,7 @@ func TestDescribeGithubReposWithWildcardAndNoLimitUserOwned(t *testing.T) {
 		t.Skip(msgSkipGitHubTokenMissing)
 	}
 
-	// need to set output to buffer in order to test output
-	logger.SetOutput(&buf)
-	defer logger.SetOutput(os.Stdout)
+	_, testLogger := newTestLogger()
 
 	resetBackups()
 
@@ -444,6 +436,7 @@ func TestDescribeGithubReposWithWildcardAndNoLimitUserOwned(t *testing.T) {
 	unsetEnvVars([]string{envVarGitBackupDir, envGithubToken})
 
 	gh, err := NewGitHubHost(NewGitHubHostInput{
+		Logger:           testLogger,
 		APIURL:           githubAPIURL,
 		LimitUserOwned:   false,
 		DiffRemoteMethod: refsMethod,
@@ -452,7 +445,7 @@ func TestDescribeGithubReposWithWildcardAndNoLimitUserOwned(t *testing.T) {
 	})
 	require.NoError(t, err)
 
-	descReposResp, err := gh.describeRepos()
+	descReposResp, err := gh.describeRepos(context.Background())
 	require.NoError(t, err)
 
 	require.True(t, repoExists(repoExistsInput{
@@ -513,9 +506,7 @@ func TestDescribeGithubReposWithSkipUserRepos(t *testing.T) {
 		t.Skip(msgSkipGitHubTokenMissing)
 	}
 
-	// need to set output to buffer in order to test output
-	logger.SetOutput(&buf)
-	defer logger.SetOutput(os.Stdout)
+	_, testLogger := newTestLogger()
 
 	resetBackups()
 
@@ -528,6 +519,7 @@ func TestDescribeGithubReposWithSkipUserRepos(t *testing.T) {
 	unsetEnvVars([]string{envVarGitBackupDir, envGithubToken})
 
 	gh, err := NewGitHubHost(NewGitHubHostInput{
+		Logger:           testLogger,
 		APIURL:           githubAPIURL,
 		DiffRemoteMethod: refsMethod,
 		SkipUserRepos:    true,
@@ -536,7 +528,7 @@ func TestDescribeGithubReposWithSkipUserRepos(t *testing.T) {
 	})
 	require.NoError(t, err)
 
-	descReposResp, err := gh.describeRepos()
+	descReposResp, err := gh.describeRepos(context.Background())
 	require.NoError(t, err)
 
 	require.True(t, repoExists(repoExistsInput{
@@ -618,3 +610,421 @@ func TestDiffRemoteMethodReturnsCloneMethodWhenInputIsEmpty(t *testing.T) {
 
 	assert.Equal(t, "clone", result)
 }
+
+func TestDescribeGithubOrgsReposConcurrently(t *testing.T) {
+	t.Parallel()
+
+	loginRegex := regexp.MustCompile(`login: \\"([^\\]+)\\"`)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+
+		match := loginRegex.FindSubmatch(body)
+		if !assert.Len(t, match, 2) {
+			w.WriteHeader(http.StatusBadRequest)
+
+			return
+		}
+
+		org := string(match[1])
+		if org == "missing" {
+			_, _ = w.Write([]byte(`{"errors":[{"type":"NOT_FOUND","message":"not found"}]}`))
+
+			return
+		}
+
+		resp := `{"data":{"organization":{"repositories":{"edges":[` +
+			`{"node":{"name":"repo1","nameWithOwner":"` + org + `/repo1","url":"https://github.com/` + org + `/repo1"}},` +
+			`{"node":{"name":"repo2","nameWithOwner":"` + org + `/repo2","url":"https://github.com/` + org + `/repo2"}}` +
+			`],"pageInfo":{"hasNextPage":false}}}}}`
+
+		_, _ = w.Write([]byte(resp))
+	}))
+	defer srv.Close()
+
+	gh, err := NewGitHubHost(NewGitHubHostInput{
+		APIURL:        srv.URL,
+		Token:         "test-token",
+		SkipUserRepos: true,
+		Orgs:          []string{"org1", "org2", "org3", "org4", "org5", "org6", "org7"},
+	})
+	require.NoError(t, err)
+
+	desc, dErr := gh.describeRepos(context.Background())
+	require.NoError(t, dErr)
+	require.Len(t, desc.Repos, 14)
+
+	// results are merged in the order the organizations were specified
+	for x, org := range gh.Orgs {
+		require.Equal(t, org+"/repo1", desc.Repos[x*2].PathWithNameSpace)
+		require.Equal(t, org+"/repo2", desc.Repos[x*2+1].PathWithNameSpace)
+	}
+
+	gh.Orgs = []string{"org1", "missing", "org2"}
+	desc, dErr = gh.describeRepos(context.Background())
+	require.ErrorContains(t, dErr, "failed to get GitHub organization missing repos")
+
+	// the repositories listed before the failure are returned with it
+	require.Len(t, desc.Repos, 2)
+	require.Equal(t, "org1/repo1", desc.Repos[0].PathWithNameSpace)
+}
+
+func TestDescribeGithubOrgReposResumesAfterRateLimit(t *testing.T) {
+	t.Parallel()
+
+	var limited atomic.Bool
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		assert.NoError(t, err)
+
+		page := "1"
+
+		if strings.Contains(string(body), `after: \"cursor-1\"`) {
+			page = "2"
+
+			// the second page is rate limited once
+			if limited.CompareAndSwap(false, true) {
+				w.Header().Set("Retry-After", "1")
+				w.WriteHeader(http.StatusTooManyRequests)
+
+				return
+			}
+		}
+
+		_, _ = w.Write([]byte(`{"data":{"organization":{"repositories":{"edges":[` +
+			`{"node":{"name":"repo` + page + `","nameWithOwner":"org/repo` + page + `","url":"https://github.com/org/repo` + page + `"}}` +
+			`],"pageInfo":{"endCursor":"cursor-` + page + `","hasNextPage":` + strconv.FormatBool(page == "1") + `}}}}}`))
+	}))
+	defer srv.Close()
+
+	gh, err := NewGitHubHost(NewGitHubHostInput{
+		APIURL:        srv.URL,
+		Token:         "test-token",
+		SkipUserRepos: true,
+		Orgs:          []string{"org"},
+	})
+	require.NoError(t, err)
+
+	start := time.Now()
+
+	desc, dErr := gh.describeRepos(context.Background())
+	require.NoError(t, dErr)
+	require.True(t, limited.Load())
+	require.GreaterOrEqual(t, time.Since(start), time.Second)
+	require.Len(t, desc.Repos, 2)
+	require.Equal(t, "org/repo1", desc.Repos[0].PathWithNameSpace)
+	require.Equal(t, "org/repo2", desc.Repos[1].PathWithNameSpace)
+	require.Equal(t, "org", desc.Repos[1].Owner)
+}
+
+func TestGithubGraphQLURL(t *testing.T) {
+	t.Parallel()
+
+	for apiURL, expected := range map[string]string{
+		"":                                    githubAPIURL,
+		githubAPIURL:                          githubAPIURL,
+		"https://api.github.com":              githubAPIURL,
+		"https://ghe.example.com":             "https://ghe.example.com/api/graphql",
+		"https://ghe.example.com/":            "https://ghe.example.com/api/graphql",
+		"https://ghe.example.com/api":         "https://ghe.example.com/api/graphql",
+		"https://ghe.example.com/api/v3/":     "https://ghe.example.com/api/graphql",
+		"https://ghe.example.com/api/graphql": "https://ghe.example.com/api/graphql",
+	} {
+		require.Equal(t, expected, githubGraphQLURL(apiURL), apiURL)
+	}
+
+	for _, apiURL := range []string{"ghe.example.com", "ftp://ghe.example.com", "https://"} {
+		_, err := NewGitHubHost(NewGitHubHostInput{APIURL: apiURL, Token: "test-token"})
+		require.ErrorContains(t, err, "invalid GitHub API URL", apiURL)
+	}
+}
+
+func TestDescribeGithubUserReposEnterpriseServer(t *testing.T) {
+	t.Parallel()
+
+	var paths []string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+
+		assert.Equal(t, "bearer test-token", r.Header.Get("Authorization"))
+
+		_, _ = w.Write([]byte(`{"data":{"viewer":{"repositories":{"edges":[` +
+			`{"node":{"name":"repo1","nameWithOwner":"user/repo1","url":"https://ghe.example.com/user/repo1","sshUrl":"git@ghe.example.com:user/repo1.git","pushedAt":"2024-06-01T12:30:00Z"}}` +
+			`],"pageInfo":{"hasNextPage":false}}}}}`))
+	}))
+	defer srv.Close()
+
+	gh, err := NewGitHubHost(NewGitHubHostInput{
+		APIURL: srv.URL + "/api/v3",
+		Token:  "test-token",
+	})
+	require.NoError(t, err)
+
+	repos, dErr := gh.describeGithubUserRepos(context.Background())
+	require.NoError(t, dErr)
+	require.Equal(t, []string{"/api/graphql"}, paths)
+	require.Len(t, repos, 1)
+	require.Equal(t, "user/repo1", repos[0].PathWithNameSpace)
+	require.Equal(t, "user", repos[0].Owner)
+	require.Equal(t, "https://ghe.example.com/user/repo1", repos[0].HTTPSUrl)
+	require.True(t, time.Date(2024, 6, 1, 12, 30, 0, 0, time.UTC).Equal(repos[0].UpdatedAt))
+}
+
+func TestDescribeGithubReposForks(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/graphql":
+			_, _ = w.Write([]byte(`{"data":{"viewer":{"repositories":{"edges":[` +
+				`{"node":{"databaseId":101,"name":"repo1","nameWithOwner":"user/repo1","isFork":false}},` +
+				`{"node":{"name":"fork1","nameWithOwner":"user/fork1","isFork":true,"parent":{"nameWithOwner":"upstream/fork1"}}}` +
+				`],"pageInfo":{"hasNextPage":false}}}}}`))
+		case "/api/v3/user/repos":
+			_, _ = w.Write([]byte(`[{"id":101,"name":"repo1","full_name":"user/repo1","fork":false},{"name":"fork1","full_name":"user/fork1","fork":true}]`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	gh, err := NewGitHubHost(NewGitHubHostInput{APIURL: srv.URL, Token: "test-token", SkipForks: true})
+	require.NoError(t, err)
+	require.True(t, gh.SkipForks)
+
+	repos, dErr := gh.describeGithubUserRepos(context.Background())
+	require.NoError(t, dErr)
+	require.Len(t, repos, 2)
+	require.False(t, repos[0].IsFork)
+	require.True(t, repos[1].IsFork)
+	require.Equal(t, "upstream/fork1", repos[1].ForkParent)
+	require.Equal(t, "101", repos[0].ID)
+	require.Empty(t, repos[1].ID)
+
+	repos, dErr = gh.describeGithubUserReposREST(context.Background())
+	require.NoError(t, dErr)
+	require.Len(t, repos, 2)
+	require.False(t, repos[0].IsFork)
+	require.True(t, repos[1].IsFork)
+	require.Equal(t, "101", repos[0].ID)
+}
+
+func TestDescribeGithubReposUnauthorised(t *testing.T) {
+	t.Parallel()
+
+	body := `{"message":"Bad credentials"}`
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	gh, err := NewGitHubHost(NewGitHubHostInput{
+		APIURL:    srv.URL,
+		BackupDir: t.TempDir(),
+		Token:     "test-token",
+	})
+	require.NoError(t, err)
+
+	_, dErr := gh.describeRepos(context.Background())
+	require.ErrorContains(t, dErr, "GitHub authorisation failed: "+body)
+
+	result := gh.Backup()
+	require.Error(t, result.Error)
+	require.Empty(t, result.BackupResults)
+
+	// fine-grained tokens aren't supported by the GraphQL API
+	body = `{"message":"Personal access tokens with fine grained access do not support the GraphQL API"}`
+
+	_, mErr := gh.makeGithubRequest(context.Background(), `{"query":""}`)
+	require.ErrorIs(t, mErr, errGitHubFineGrainedPAT)
+
+	// the REST API used instead rejects the token too
+	_, dErr = gh.describeRepos(context.Background())
+	require.ErrorContains(t, dErr, "GitHub authorisation failed: "+body)
+
+	// failures listing organizations' repositories are returned rather than ignored
+	gh.SkipUserRepos = true
+	gh.Orgs = []string{"org1"}
+
+	_, dErr = gh.describeRepos(context.Background())
+	require.ErrorContains(t, dErr, "failed to get GitHub organization org1 repos")
+	require.ErrorContains(t, dErr, "GitHub authorisation failed")
+}
+
+func TestDescribeGithubReposFineGrainedPAT(t *testing.T) {
+	t.Parallel()
+
+	var srv *httptest.Server
+
+	restRepo := func(fullName string) string {
+		name := fullName[strings.Index(fullName, "/")+1:]
+
+		return `{"name":"` + name + `","full_name":"` + fullName + `","html_url":"https://github.com/` + fullName +
+			`","ssh_url":"git@github.com:` + fullName + `.git","pushed_at":"2024-06-01T12:30:00Z"}`
+	}
+
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "bearer test-token", r.Header.Get("Authorization"))
+
+		switch {
+		case r.Method == http.MethodPost && r.URL.Path == "/api/graphql":
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"message":"Personal access tokens with fine grained access do not support the GraphQL API"}`))
+		case r.URL.Path == "/api/v3/user/repos" && r.URL.Query().Get("page") == "":
+			assert.Equal(t, "100", r.URL.Query().Get("per_page"))
+			w.Header().Set("Link", `<`+srv.URL+`/api/v3/user/repos?per_page=100&page=2>; rel="next"`)
+			_, _ = w.Write([]byte(`[` + restRepo("user/repo1") + `,` + restRepo("org1/repo1") + `]`))
+		case r.URL.Path == "/api/v3/user/repos":
+			assert.Equal(t, "2", r.URL.Query().Get("page"))
+			_, _ = w.Write([]byte(`[` + restRepo("user/repo2") + `]`))
+		case r.URL.Path == "/api/v3/user/orgs":
+			_, _ = w.Write([]byte(`[{"login":"org2"}]`))
+		case r.URL.Path == "/api/v3/orgs/org1/repos":
+			_, _ = w.Write([]byte(`[` + restRepo("org1/repo1") + `,` + restRepo("org1/repo2") + `]`))
+		case r.URL.Path == "/api/v3/orgs/org2/repos":
+			_, _ = w.Write([]byte(`[` + restRepo("org2/repo1") + `]`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	gh, err := NewGitHubHost(NewGitHubHostInput{
+		APIURL: srv.URL,
+		Token:  "test-token",
+		Orgs:   []string{"org1", "*"},
+	})
+	require.NoError(t, err)
+
+	desc, dErr := gh.describeRepos(context.Background())
+	require.NoError(t, dErr)
+
+	var paths []string
+	for _, repo := range desc.Repos {
+		paths = append(paths, repo.PathWithNameSpace)
+	}
+
+	require.Equal(t, []string{"user/repo1", "org1/repo1", "user/repo2", "org1/repo2", "org2/repo1"}, paths)
+	require.Equal(t, repository{
+		Name:              "repo1",
+		Owner:             "user",
+		SSHUrl:            "git@github.com:user/repo1.git",
+		HTTPSUrl:          "https://github.com/user/repo1",
+		PathWithNameSpace: "user/repo1",
+		Domain:            gitHubDomain,
+		UpdatedAt:         time.Date(2024, 6, 1, 12, 30, 0, 0, time.UTC),
+	}, desc.Repos[0])
+
+	// the wildcard is left in place for subsequent backups
+	require.Equal(t, []string{"org1", "*"}, gh.Orgs)
+
+	gh.SkipUserRepos = true
+	gh.Orgs = []string{"*"}
+
+	desc, dErr = gh.describeRepos(context.Background())
+	require.NoError(t, dErr)
+	require.Len(t, desc.Repos, 1)
+	require.Equal(t, "org2/repo1", desc.Repos[0].PathWithNameSpace)
+	require.Equal(t, []string{"*"}, gh.Orgs)
+}
+
+func TestGithubRESTURL(t *testing.T) {
+	t.Parallel()
+
+	for apiURL, expected := range map[string]string{
+		"":                                    "https://api.github.com",
+		githubAPIURL:                          "https://api.github.com",
+		"https://api.github.com":              "https://api.github.com",
+		"https://ghe.example.com":             "https://ghe.example.com/api/v3",
+		"https://ghe.example.com/api":         "https://ghe.example.com/api/v3",
+		"https://ghe.example.com/api/v3/":     "https://ghe.example.com/api/v3",
+		"https://ghe.example.com/api/graphql": "https://ghe.example.com/api/v3",
+	} {
+		require.Equal(t, expected, githubRESTURL(apiURL), apiURL)
+	}
+}
+
+func TestMakeGithubRequestWaitsForRateLimit(t *testing.T) {
+	t.Parallel()
+
+	var (
+		mu       sync.Mutex
+		requests []time.Time
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		mu.Lock()
+		requests = append(requests, time.Now())
+		first := len(requests) == 1
+		mu.Unlock()
+
+		// secondary rate limits are rejected with a forbidden status
+		if first {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte(`{"message":"You have exceeded a secondary rate limit."}`))
+
+			return
+		}
+
+		_, _ = w.Write([]byte(`{"data":{}}`))
+	}))
+	defer srv.Close()
+
+	gh, err := NewGitHubHost(NewGitHubHostInput{
+		APIURL: srv.URL,
+		Token:  "test-token",
+	})
+	require.NoError(t, err)
+
+	body, rErr := gh.makeGithubRequest(context.Background(), `{"query":""}`)
+	require.NoError(t, rErr)
+	require.Equal(t, `{"data":{}}`, body)
+
+	require.Len(t, requests, 2)
+	require.InDelta(t, time.Second, requests[1].Sub(requests[0]), float64(500*time.Millisecond))
+}
+
+func TestGithubRateLimitWait(t *testing.T) {
+	t.Parallel()
+
+	now := time.Unix(1700000000, 0)
+
+	response := func(status int, headers map[string]string) *http.Response {
+		resp := &http.Response{StatusCode: status, Header: http.Header{}}
+		for k, v := range headers {
+			resp.Header.Set(k, v)
+		}
+
+		return resp
+	}
+
+	resp := response(http.StatusForbidden, map[string]string{"Retry-After": "30"})
+	require.True(t, isGitHubRateLimited(resp))
+	require.Equal(t, 30*time.Second, githubRateLimitWait(resp, now))
+
+	// the primary limit has been exceeded until it resets
+	resp = response(http.StatusForbidden, map[string]string{"X-RateLimit-Remaining": "0", "X-RateLimit-Reset": "1700000120"})
+	require.True(t, isGitHubRateLimited(resp))
+	require.Equal(t, 2*time.Minute, githubRateLimitWait(resp, now))
+
+	// few requests remain so the next waits for the reset
+	resp = response(http.StatusOK, map[string]string{"X-RateLimit-Remaining": "5", "X-RateLimit-Reset": "1700000060"})
+	require.False(t, isGitHubRateLimited(resp))
+	require.Equal(t, time.Minute, githubRateLimitWait(resp, now))
+
+	resp = response(http.StatusOK, map[string]string{"X-RateLimit-Remaining": "4000", "X-RateLimit-Reset": "1700000060"})
+	require.Zero(t, githubRateLimitWait(resp, now))
+
+	// a forbidden response without rate limit headers lacks permission
+	require.False(t, isGitHubRateLimited(response(http.StatusForbidden, nil)))
+
+	// waits are capped
+	resp = response(http.StatusTooManyRequests, map[string]string{"Retry-After": "86400"})
+	require.Equal(t, githubRateLimitMaxWait, githubRateLimitWait(resp, now))
+}
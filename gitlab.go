@@ -8,10 +8,12 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"regexp"
 	"slices"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"gitlab.com/tozd/go/errors"
 
@@ -23,6 +25,10 @@ const (
 	// GitLabDefaultMinimumProjectAccessLevel https://docs.gitlab.com/ee/user/permissions.html#roles
 	GitLabDefaultMinimumProjectAccessLevel = 20
 	gitLabDomain                           = "gitlab.com"
+	gitLabProviderName                     = "GitLab"
+	gitlabRateLimitRetries                 = 3
+	gitlabRateLimitDefaultWait             = time.Minute
+	gitlabRateLimitMaxWait                 = time.Hour
 )
 
 type gitlabUser struct {
@@ -36,14 +42,61 @@ type GitLabHost struct {
 	APIURL                string
 	DiffRemoteMethod      string
 	BackupDir             string
+	NamespacePrefix       string
+	BundleRefSpec         string
+	RefSpec               []string
+	refSpecPatterns       []*regexp.Regexp
+	BundleNameTemplate    string
+	FlatLayout            bool
+	FlatLayoutSeparator   string
+	DateDirLayout         bool
+	DetectRenames         bool
+	Include               []string
+	Exclude               []string
+	RepoList              []string
+	RepoListMode          string
+	MaxConcurrent         int
+	MaxRepos              int
+	PageDelayMs           int
+	DryRun                bool
+	FailFast              bool
+	FailOnAnyError        bool
+	PartialClone          bool
+	KeepWorkingDir        bool
+	BackupSubmodules      bool
+	VerifyAfterCreate     bool
+	CompressBundles       bool
+	ArchivePerRepo        bool
+	KeepArchivedFiles     bool
+	SSHPrivateKeyPath     string
+	SSHKnownHostsPath     string
 	BackupsToRetain       int
+	KeepForDays           int
+	CloneRetries          int
+	MinFreeDiskMB         int
+	UpdatedSince          time.Time
+	SkipEmptyProjects     bool
 	ProjectMinAccessLevel int
+	Groups                []string
 	Token                 string
 	User                  gitlabUser
 	LogLevel              int
+	Logger                Logger
+	Progress              func(done, total int, repo string)
+	RemoteStore           RemoteStore
+	RepoBackupTimeout     time.Duration
+	LockTimeout           time.Duration
+	GitBinaryPath         string
+	ExtraGitConfig        []string
+	NotifyWebhookURL      string
+	ProxyURL              string
+	CACertPath            string
+	InsecureSkipTLSVerify bool
+	UseAlternates         bool
+	BackupReleases        bool
 }
 
-func (gl *GitLabHost) getAuthenticatedGitLabUser() (gitlabUser, errors.E) {
+func (gl *GitLabHost) getAuthenticatedGitLabUser(ctx context.Context) (gitlabUser, errors.E) {
 	gitlabToken := strings.TrimSpace(gl.Token)
 	if gitlabToken == "" {
 		return gitlabUser{}, errors.New("GitLab token not provided")
@@ -58,7 +111,7 @@ func (gl *GitLabHost) getAuthenticatedGitLabUser() (gitlabUser, errors.E) {
 
 	getUserIDURL := gl.APIURL + "/user"
 
-	ctx, cancel := context.WithTimeout(context.Background(), defaultHttpRequestTimeout)
+	ctx, cancel := context.WithTimeout(ctx, defaultHttpRequestTimeout)
 	defer cancel()
 
 	var req *retryablehttp.Request
@@ -81,9 +134,7 @@ func (gl *GitLabHost) getAuthenticatedGitLabUser() (gitlabUser, errors.E) {
 
 	bodyB, err := io.ReadAll(resp.Body)
 	if err != nil {
-		return gitlabUser{
-			UserName: "",
-		}, nil
+		return gitlabUser{}, errors.Errorf("failed to read response body: %s", err)
 	}
 
 	bodyStr := string(bytes.ReplaceAll(bodyB, []byte("\r"), []byte("\r\n")))
@@ -93,16 +144,20 @@ func (gl *GitLabHost) getAuthenticatedGitLabUser() (gitlabUser, errors.E) {
 	switch resp.StatusCode {
 	case http.StatusOK:
 		if gl.LogLevel > 0 {
-			logger.Println("authentication successful")
+			gl.logger().Println("authentication successful")
 		}
 	case http.StatusForbidden:
-		logger.Println("failed to authenticate (HTTP 403)")
+		gl.logger().Println("failed to authenticate (HTTP 403)")
+
+		return gitlabUser{}, errors.New("failed to authenticate (HTTP 403)")
 	case http.StatusUnauthorized:
-		logger.Println("failed to authenticate due to invalid credentials (HTTP 401)")
+		gl.logger().Println("failed to authenticate due to invalid credentials (HTTP 401)")
+
+		return gitlabUser{}, errors.New("failed to authenticate due to invalid credentials (HTTP 401)")
 	default:
-		logger.Printf("failed to authenticate due to unexpected response: %d (%s)", resp.StatusCode, resp.Status)
+		gl.logger().Printf("failed to authenticate due to unexpected response: %d (%s)", resp.StatusCode, resp.Status)
 
-		return gitlabUser{}, nil
+		return gitlabUser{}, errors.Errorf("failed to authenticate due to unexpected response: %d (%s)", resp.StatusCode, resp.Status)
 	}
 
 	var user gitlabUser
@@ -121,11 +176,20 @@ type gitLabOwner struct {
 }
 
 type gitLabProject struct {
+	ID                int64       `json:"id"`
 	Path              string      `json:"path"`
 	PathWithNameSpace string      `json:"path_with_namespace"`
 	HTTPSURL          string      `json:"http_url_to_repo"`
 	SSHURL            string      `json:"ssh_url_to_repo"`
 	Owner             gitLabOwner `json:"owner"`
+	ForkedFromProject *struct {
+		PathWithNameSpace string `json:"path_with_namespace"`
+	} `json:"forked_from_project"`
+	LastActivityAt time.Time `json:"last_activity_at"`
+	// Statistics are only listed when requested, and to users with at least reporter access
+	Statistics *struct {
+		RepositorySize int64 `json:"repository_size"`
+	} `json:"statistics"`
 }
 type gitLabGetProjectsResponse []gitLabProject
 
@@ -136,7 +200,9 @@ var validAccessLevels = map[int]string{
 	50: "Owner",
 }
 
-func (gl *GitLabHost) getAllProjectRepositories(client http.Client) ([]repository, errors.E) {
+// setProjectMinAccessLevel sets the minimum access level of the projects, and groups, to list to
+// the default if not specified or invalid.
+func (gl *GitLabHost) setProjectMinAccessLevel() {
 	var sortedLevels []int
 	for k := range validAccessLevels {
 		sortedLevels = append(sortedLevels, k)
@@ -150,33 +216,37 @@ func (gl *GitLabHost) getAllProjectRepositories(client http.Client) ([]repositor
 		validMinimumProjectAccessLevels = append(validMinimumProjectAccessLevels, fmt.Sprintf("%s (%d)", validAccessLevels[level], level))
 	}
 
-	logger.Printf("retrieving all projects for user %s (%d):", gl.User.UserName, gl.User.ID)
-
-	if strings.TrimSpace(gl.APIURL) == "" {
-		gl.APIURL = gitlabAPIURL
-	}
-
-	getProjectsURL := gl.APIURL + "/projects"
-
 	if gl.ProjectMinAccessLevel == 0 {
 		gl.ProjectMinAccessLevel = GitLabDefaultMinimumProjectAccessLevel
 	}
 
 	if !slices.Contains(sortedLevels, gl.ProjectMinAccessLevel) {
-		logger.Printf("project minimum access level must be one of %s so using default %d",
+		gl.logger().Printf("project minimum access level must be one of %s so using default %d",
 			strings.Join(validMinimumProjectAccessLevels, ", "), GitLabDefaultMinimumProjectAccessLevel)
 
 		gl.ProjectMinAccessLevel = GitLabDefaultMinimumProjectAccessLevel
 	}
 
-	logger.Printf("project minimum access level set to %s (%d)",
+	gl.logger().Printf("project minimum access level set to %s (%d)",
 		validAccessLevels[gl.ProjectMinAccessLevel],
 		gl.ProjectMinAccessLevel)
+}
+
+func (gl *GitLabHost) getAllProjectRepositories(ctx context.Context, client http.Client) ([]repository, errors.E) {
+	gl.logger().Printf("retrieving all projects for user %s (%d):", gl.User.UserName, gl.User.ID)
+
+	if strings.TrimSpace(gl.APIURL) == "" {
+		gl.APIURL = gitlabAPIURL
+	}
+
+	getProjectsURL := gl.APIURL + "/projects"
+
+	gl.setProjectMinAccessLevel()
 
 	// Initial request
 	u, err := url.Parse(getProjectsURL)
 	if err != nil {
-		logger.Print(err)
+		gl.logger().Println(err)
 
 		return []repository{}, errors.Wrap(err, "failed to parse url")
 	}
@@ -185,12 +255,121 @@ func (gl *GitLabHost) getAllProjectRepositories(client http.Client) ([]repositor
 	// set initial max per page
 	q.Set("per_page", strconv.Itoa(gitlabProjectsPerPageDefault))
 	q.Set("min_access_level", strconv.Itoa(gl.ProjectMinAccessLevel))
+	gl.setStatisticsQuery(q)
 	u.RawQuery = q.Encode()
 
-	var body []byte
+	return gl.getProjects(ctx, client, u.String())
+}
+
+type gitLabGroup struct {
+	ID       int64  `json:"id"`
+	FullPath string `json:"full_path"`
+}
+
+// getAllGroups returns the full paths of every top-level group that the user has at least the
+// minimum access level to. Subgroups aren't listed as their projects are listed with their groups'.
+func (gl *GitLabHost) getAllGroups(ctx context.Context, client http.Client) ([]string, errors.E) {
+	gl.logger().Println("retrieving all groups")
+
+	if strings.TrimSpace(gl.APIURL) == "" {
+		gl.APIURL = gitlabAPIURL
+	}
+
+	gl.setProjectMinAccessLevel()
+
+	u, err := url.Parse(gl.APIURL + "/groups")
+	if err != nil {
+		gl.logger().Println(err)
+
+		return nil, errors.Wrap(err, "failed to parse url")
+	}
+
+	q := u.Query()
+	q.Set("per_page", strconv.Itoa(gitlabProjectsPerPageDefault))
+	q.Set("min_access_level", strconv.Itoa(gl.ProjectMinAccessLevel))
+	q.Set("top_level_only", "true")
+	u.RawQuery = q.Encode()
 
 	reqUrl := u.String()
 
+	var groups []string
+
+	for {
+		resp, body, rErr := makeGitLabRequest(ctx, &client, reqUrl, gl.Token)
+		if rErr != nil {
+			gl.logger().Println(rErr)
+
+			return groups, rErr
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			gl.logger().Printf("failed to get groups due to unexpected response: %d (%s)", resp.StatusCode, resp.Status)
+
+			return groups, errors.Errorf("failed to get groups due to unexpected response: %d (%s)", resp.StatusCode, resp.Status)
+		}
+
+		var respObj []gitLabGroup
+
+		if uErr := json.Unmarshal(body, &respObj); uErr != nil {
+			gl.logger().Println(uErr)
+
+			return groups, errors.Errorf("failed to unmarshall gitlab json response: %s", uErr.Error())
+		}
+
+		for _, group := range respObj {
+			groups = append(groups, group.FullPath)
+		}
+
+		reqUrl = ""
+
+		for _, l := range link.ParseResponse(resp) {
+			if l.Rel == txtNext {
+				reqUrl = l.URI
+			}
+		}
+
+		if reqUrl == "" {
+			break
+		}
+
+		if sErr := sleepWithContext(ctx, time.Duration(gl.PageDelayMs)*time.Millisecond); sErr != nil {
+			return nil, sErr
+		}
+	}
+
+	return groups, nil
+}
+
+// getGroupProjects returns the projects of the group, including those of its subgroups.
+func (gl *GitLabHost) getGroupProjects(ctx context.Context, client http.Client, groupID string) ([]repository, errors.E) {
+	gl.logger().Printf("retrieving all projects for group %s", groupID)
+
+	if strings.TrimSpace(gl.APIURL) == "" {
+		gl.APIURL = gitlabAPIURL
+	}
+
+	// group paths containing slashes must be encoded
+	u, err := url.Parse(gl.APIURL + "/groups/" + url.PathEscape(groupID) + "/projects")
+	if err != nil {
+		gl.logger().Println(err)
+
+		return []repository{}, errors.Wrap(err, "failed to parse url")
+	}
+
+	q := u.Query()
+	q.Set("per_page", strconv.Itoa(gitlabProjectsPerPageDefault))
+	q.Set("include_subgroups", "true")
+	gl.setStatisticsQuery(q)
+	u.RawQuery = q.Encode()
+
+	return gl.getProjects(ctx, client, u.String())
+}
+
+// getProjects returns the projects from every page of results, starting at reqUrl. Those listed
+// before a failure are returned with it.
+func (gl *GitLabHost) getProjects(ctx context.Context, client http.Client, reqUrl string) ([]repository, errors.E) {
+	var body []byte
+
 	var repos []repository
 
 	for {
@@ -198,50 +377,60 @@ func (gl *GitLabHost) getAllProjectRepositories(client http.Client) ([]repositor
 
 		var rErr errors.E
 
-		resp, body, rErr = makeGitLabRequest(&client, reqUrl, gl.Token)
+		resp, body, rErr = makeGitLabRequest(ctx, &client, reqUrl, gl.Token)
 		if rErr != nil {
-			logger.Print(rErr)
+			gl.logger().Println(rErr)
 
-			return []repository{}, rErr
+			return repos, rErr
 		}
 
 		if gl.LogLevel > 0 {
-			logger.Println(string(body))
+			gl.logger().Println(string(body))
 		}
 
 		switch resp.StatusCode {
 		case http.StatusOK:
 			if gl.LogLevel > 0 {
-				logger.Println("projects retrieved successfully")
+				gl.logger().Println("projects retrieved successfully")
 			}
 		case http.StatusForbidden:
-			logger.Println("failed to get projects due to invalid missing permissions (HTTP 403)")
+			gl.logger().Println("failed to get projects due to invalid missing permissions (HTTP 403)")
 
-			return []repository{}, errors.New("failed to get projects due to invalid missing permissions (HTTP 403)")
+			return repos, errors.New("failed to get projects due to invalid missing permissions (HTTP 403)")
 		default:
-			logger.Printf("failed to get projects due to unexpected response: %d (%s)", resp.StatusCode, resp.Status)
+			gl.logger().Printf("failed to get projects due to unexpected response: %d (%s)", resp.StatusCode, resp.Status)
 
-			return []repository{}, errors.Errorf("failed to get projects due to unexpected response: %d (%s)", resp.StatusCode, resp.Status)
+			return repos, errors.Errorf("failed to get projects due to unexpected response: %d (%s)", resp.StatusCode, resp.Status)
 		}
 
 		var respObj gitLabGetProjectsResponse
 
-		if err = json.Unmarshal(body, &respObj); err != nil {
-			logger.Println(err)
+		if err := json.Unmarshal(body, &respObj); err != nil {
+			gl.logger().Println(err)
 
-			return []repository{}, errors.Errorf("failed to unmarshall gitlab json response: %s", err.Error())
+			return repos, errors.Errorf("failed to unmarshall gitlab json response: %s", err.Error())
 		}
 
 		for _, project := range respObj {
 			// gitlab replaces hyphens with spaces in owner names, so fix
 			owner := strings.ReplaceAll(project.Owner.Name, " ", "-")
 			repo := repository{
+				ID:                providerRepoID(project.ID),
 				Name:              project.Path,
 				Owner:             owner,
 				PathWithNameSpace: project.PathWithNameSpace,
 				HTTPSUrl:          project.HTTPSURL,
 				SSHUrl:            project.SSHURL,
 				Domain:            gitLabDomain,
+				UpdatedAt:         project.LastActivityAt,
+			}
+
+			if project.ForkedFromProject != nil {
+				repo.ForkParent = project.ForkedFromProject.PathWithNameSpace
+			}
+
+			if project.Statistics != nil && project.Statistics.RepositorySize == 0 {
+				repo.ReportedEmpty = true
 			}
 
 			repos = append(repos, repo)
@@ -260,13 +449,47 @@ func (gl *GitLabHost) getAllProjectRepositories(client http.Client) ([]repositor
 		if reqUrl == "" {
 			break
 		}
+
+		if sErr := sleepWithContext(ctx, time.Duration(gl.PageDelayMs)*time.Millisecond); sErr != nil {
+			return nil, sErr
+		}
 	}
 
 	return repos, nil
 }
 
-func makeGitLabRequest(c *http.Client, reqUrl, token string) (*http.Response, []byte, errors.E) {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultHttpRequestTimeout)
+// makeGitLabRequest makes a GET request to the API, waiting and retrying requests rejected for
+// exceeding a rate limit, so a listing resumes from the page it was on.
+func makeGitLabRequest(ctx context.Context, c *http.Client, reqUrl, token string) (*http.Response, []byte, errors.E) {
+	for attempt := 0; ; attempt++ {
+		resp, body, err := doGitLabRequest(ctx, c, reqUrl, token)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests || attempt >= gitlabRateLimitRetries {
+			return resp, body, err
+		}
+
+		if sErr := sleepWithContext(ctx, gitLabRateLimitWait(resp, time.Now())); sErr != nil {
+			return nil, nil, sErr
+		}
+	}
+}
+
+// gitLabRateLimitWait returns how long to wait before retrying a request rejected for exceeding a
+// rate limit: that requested with Retry-After, or otherwise until the limit resets.
+func gitLabRateLimitWait(resp *http.Response, now time.Time) time.Duration {
+	if wait, ok := retryAfter(resp, now); ok {
+		return min(wait, gitlabRateLimitMaxWait)
+	}
+
+	if reset, err := strconv.ParseInt(resp.Header.Get("RateLimit-Reset"), 10, 64); err == nil {
+		return min(max(time.Unix(reset, 0).Sub(now), 0), gitlabRateLimitMaxWait)
+	}
+
+	return gitlabRateLimitDefaultWait
+}
+
+// doGitLabRequest makes a single GET request to the API and returns the response with its body.
+func doGitLabRequest(ctx context.Context, c *http.Client, reqUrl, token string) (*http.Response, []byte, errors.E) {
+	ctx, cancel := context.WithTimeout(ctx, defaultHttpRequestTimeout)
 	defer cancel()
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, reqUrl, nil)
@@ -298,38 +521,133 @@ func makeGitLabRequest(c *http.Client, reqUrl, token string) (*http.Response, []
 type NewGitLabHostInput struct {
 	Caller                string
 	HTTPClient            *retryablehttp.Client
+	RetryMax              int // defaults to 2, -1 disables retries
+	RetryWaitMinSeconds   int
+	RetryWaitMaxSeconds   int
 	APIURL                string
 	DiffRemoteMethod      string
 	BackupDir             string
+	NamespacePrefix       string
+	BundleRefSpec         string
+	BundleNameTemplate    string
+	FlatLayout            bool
+	FlatLayoutSeparator   string
+	DateDirLayout         bool
+	DetectRenames         bool
+	RefSpec               []string
+	Include               []string
+	Exclude               []string
+	RepoListFile          string
+	RepoListMode          string
+	MaxConcurrent         int
+	MaxRepos              int
+	PageDelayMs           int
+	DryRun                bool
+	FailFast              bool
+	FailOnAnyError        bool
+	PartialClone          bool
+	KeepWorkingDir        bool
+	BackupSubmodules      bool
+	VerifyAfterCreate     *bool // defaults to true
+	CompressBundles       bool
+	ArchivePerRepo        bool
+	KeepArchivedFiles     bool
+	SSHPrivateKeyPath     string
+	SSHKnownHostsPath     string
 	Token                 string
 	ProjectMinAccessLevel int
+	Groups                []string // full paths or IDs of groups whose projects to back up, or "*" for all
 	BackupsToRetain       int
+	KeepForDays           int
+	CloneRetries          int // defaults to 2, -1 disables retries
+	MinFreeDiskMB         int
+	UpdatedSince          time.Time
+	SkipEmptyProjects     bool
 	LogLevel              int
+	Logger                Logger
+	Progress              func(done, total int, repo string)
+	RemoteStore           RemoteStore
+	RepoBackupTimeout     time.Duration
+	LockTimeout           time.Duration
+	GitBinaryPath         string
+	ExtraGitConfig        []string
+	NotifyWebhookURL      string
+	ProxyURL              string
+	CACertPath            string
+	InsecureSkipTLSVerify bool
+	UseAlternates         bool
+	BackupReleases        bool
+}
+
+// Validate checks the input's settings, returning an error listing each that's missing or invalid.
+func (input NewGitLabHostInput) Validate() error {
+	return errors.Join(
+		validRequired(input.Token, "token"),
+		validBackupDir(input.BackupDir),
+		validDiffRemoteMethodSetting(input.DiffRemoteMethod),
+		validNamespacePrefix(input.NamespacePrefix),
+		validBundleRefSpec(input.BundleRefSpec, input.RefSpec),
+		validBundleNameTemplate(input.BundleNameTemplate),
+		validFlatLayoutSeparator(input.FlatLayoutSeparator),
+		validRepoFilters(input.Include, input.Exclude),
+		validRepoList(input.RepoListFile, input.RepoListMode),
+		validMaxConcurrent(input.MaxConcurrent),
+		validMaxRepos(input.MaxRepos),
+		validRetryConfig(input.RetryMax, input.RetryWaitMinSeconds, input.RetryWaitMaxSeconds),
+		validCloneRetries(input.CloneRetries),
+		validMinFreeDiskMB(input.MinFreeDiskMB),
+		validPageDelay(input.PageDelayMs),
+		validSSHAuth(input.SSHPrivateKeyPath, input.SSHKnownHostsPath),
+		validRepoBackupTimeout(input.RepoBackupTimeout),
+		validLockTimeout(input.LockTimeout),
+		validExtraGitConfig(input.ExtraGitConfig),
+		validNotifyWebhookURL(input.NotifyWebhookURL),
+		validProxyURL(input.ProxyURL),
+		validTLSConfig(input.CACertPath, input.InsecureSkipTLSVerify),
+	)
 }
 
 func NewGitLabHost(input NewGitLabHostInput) (*GitLabHost, error) {
-	setLoggerPrefix(input.Caller)
+	if input.Logger == nil {
+		setLoggerPrefix(input.Caller)
+	}
+
+	if err := input.Validate(); err != nil {
+		return nil, err
+	}
 
 	apiURL := gitlabAPIURL
 	if input.APIURL != "" {
 		apiURL = input.APIURL
 	}
 
-	diffRemoteMethod, err := getDiffRemoteMethod(input.DiffRemoteMethod)
+	diffRemoteMethod, err := getDiffRemoteMethod(getLogger(input.Logger), input.DiffRemoteMethod)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get diff remote method: %w", err)
 	}
 
-	if diffRemoteMethod == "" {
-		logger.Print("using default diff remote method: " + defaultRemoteMethod)
-		diffRemoteMethod = defaultRemoteMethod
-	} else {
-		logger.Print("using diff remote method: " + diffRemoteMethod)
+	bundleRefSpec, err := getBundleRefSpec(input.BundleRefSpec)
+	if err != nil {
+		return nil, err
+	}
+
+	repoList, repoListMode, err := readRepoList(input.RepoListFile, input.RepoListMode)
+	if err != nil {
+		return nil, err
+	}
+
+	tlsConfig, err := getTLSConfig(input.CACertPath, input.InsecureSkipTLSVerify)
+	if err != nil {
+		return nil, err
+	}
+
+	if input.InsecureSkipTLSVerify {
+		getLogger(input.Logger).Println("WARNING: TLS certificate verification is disabled")
 	}
 
 	httpClient := input.HTTPClient
 	if httpClient == nil {
-		httpClient = getHTTPClient()
+		httpClient = getHTTPClient(input.RetryMax, input.RetryWaitMinSeconds, input.RetryWaitMaxSeconds, input.ProxyURL, tlsConfig)
 	}
 
 	return &GitLabHost{
@@ -338,72 +656,341 @@ func NewGitLabHost(input NewGitLabHostInput) (*GitLabHost, error) {
 		APIURL:                apiURL,
 		DiffRemoteMethod:      diffRemoteMethod,
 		BackupDir:             input.BackupDir,
+		NamespacePrefix:       input.NamespacePrefix,
+		BundleRefSpec:         bundleRefSpec,
+		RefSpec:               input.RefSpec,
+		refSpecPatterns:       compileRefSpec(input.RefSpec),
+		BundleNameTemplate:    input.BundleNameTemplate,
+		FlatLayout:            input.FlatLayout,
+		FlatLayoutSeparator:   input.FlatLayoutSeparator,
+		DateDirLayout:         input.DateDirLayout,
+		DetectRenames:         input.DetectRenames,
+		Include:               input.Include,
+		Exclude:               input.Exclude,
+		RepoList:              repoList,
+		RepoListMode:          repoListMode,
+		MaxConcurrent:         input.MaxConcurrent,
+		MaxRepos:              input.MaxRepos,
+		PageDelayMs:           input.PageDelayMs,
+		DryRun:                input.DryRun,
+		FailFast:              input.FailFast,
+		FailOnAnyError:        input.FailOnAnyError,
+		PartialClone:          input.PartialClone,
+		KeepWorkingDir:        input.KeepWorkingDir,
+		BackupSubmodules:      input.BackupSubmodules,
+		VerifyAfterCreate:     input.VerifyAfterCreate == nil || *input.VerifyAfterCreate,
+		CompressBundles:       input.CompressBundles,
+		ArchivePerRepo:        input.ArchivePerRepo,
+		KeepArchivedFiles:     input.KeepArchivedFiles,
+		SSHPrivateKeyPath:     input.SSHPrivateKeyPath,
+		SSHKnownHostsPath:     input.SSHKnownHostsPath,
 		BackupsToRetain:       input.BackupsToRetain,
+		KeepForDays:           input.KeepForDays,
+		CloneRetries:          input.CloneRetries,
+		MinFreeDiskMB:         input.MinFreeDiskMB,
+		UpdatedSince:          input.UpdatedSince,
+		SkipEmptyProjects:     input.SkipEmptyProjects,
 		Token:                 input.Token,
 		ProjectMinAccessLevel: input.ProjectMinAccessLevel,
+		Groups:                input.Groups,
 		LogLevel:              input.LogLevel,
+		Logger:                input.Logger,
+		Progress:              input.Progress,
+		RemoteStore:           input.RemoteStore,
+		RepoBackupTimeout:     input.RepoBackupTimeout,
+		LockTimeout:           input.LockTimeout,
+		GitBinaryPath:         input.GitBinaryPath,
+		ExtraGitConfig:        input.ExtraGitConfig,
+		NotifyWebhookURL:      input.NotifyWebhookURL,
+		ProxyURL:              input.ProxyURL,
+		CACertPath:            input.CACertPath,
+		InsecureSkipTLSVerify: input.InsecureSkipTLSVerify,
+		UseAlternates:         input.UseAlternates,
+		BackupReleases:        input.BackupReleases,
 	}, nil
 }
 
-func (gl *GitLabHost) describeRepos() (describeReposOutput, errors.E) {
-	logger.Println("listing repositories")
+func (gl *GitLabHost) describeRepos(ctx context.Context) (describeReposOutput, errors.E) {
+	gl.logger().Println("listing repositories")
+
+	client, err := gl.apiClient()
+	if err != nil {
+		return describeReposOutput{}, err
+	}
+
+	// the projects listed before a failure are returned with it
+	repos, err := gl.getAllProjectRepositories(ctx, *client)
+	if err != nil {
+		return describeReposOutput{Repos: repos}, err
+	}
+
+	groups := slices.Clone(gl.Groups)
+
+	// a wildcard includes every group the user has access to, in addition to any specified
+	if slices.Contains(groups, "*") {
+		groups = remove(groups, "*")
+
+		allGroups, gErr := gl.getAllGroups(ctx, *client)
+		if gErr != nil {
+			return describeReposOutput{Repos: repos}, gErr
+		}
+
+		groups = append(groups, allGroups...)
+	}
+
+	for _, group := range groups {
+		groupRepos, gErr := gl.getGroupProjects(ctx, *client, group)
+
+		repos = append(repos, groupRepos...)
+
+		if gErr != nil {
+			return describeReposOutput{Repos: removeDuplicates(repos)}, gErr
+		}
+	}
+
+	// group projects may also be accessible to the user
+	return describeReposOutput{
+		Repos: removeDuplicates(repos),
+	}, nil
+}
+
+// apiClient returns the client used to make requests to the GitLab API: that of the host's HTTP
+// client, including one specified with HTTPClient, so its transport is shared, but without retries.
+func (gl *GitLabHost) apiClient() (*http.Client, errors.E) {
+	if gl.httpClient != nil && gl.httpClient.HTTPClient != nil {
+		return gl.httpClient.HTTPClient, nil
+	}
+
+	tlsConfig, tErr := getTLSConfig(gl.CACertPath, gl.InsecureSkipTLSVerify)
+	if tErr != nil {
+		return nil, errors.Wrap(tErr, "failed to get TLS config")
+	}
 
 	tr := &http.Transport{
+		Proxy:              getProxy(gl.ProxyURL),
+		TLSClientConfig:    tlsConfig,
 		MaxIdleConns:       maxIdleConns,
 		IdleConnTimeout:    idleConnTimeout,
 		DisableCompression: true,
 	}
 
-	client := &http.Client{Transport: tr}
+	return &http.Client{Transport: tr}, nil
+}
+
+// gitLabRelease is a release as returned by the API. Its assets are the links added to it, as the
+// archives of its source are included in the bundle.
+type gitLabRelease struct {
+	TagName string `json:"tag_name"`
+	Assets  struct {
+		Links []struct {
+			Name           string `json:"name"`
+			URL            string `json:"url"`
+			DirectAssetURL string `json:"direct_asset_url"`
+		} `json:"links"`
+	} `json:"assets"`
+}
 
-	userRepos, err := gl.getAllProjectRepositories(*client)
+// listReleases returns the releases of the project with their assets.
+func (gl *GitLabHost) listReleases(ctx context.Context, repo repository) ([]release, errors.E) {
+	client, err := gl.apiClient()
 	if err != nil {
-		return describeReposOutput{}, err
+		return nil, err
 	}
 
-	return describeReposOutput{
-		Repos: userRepos,
-	}, nil
+	var releases []release
+
+	reqUrl := gl.getAPIURL() + "/projects/" + url.PathEscape(repo.PathWithNameSpace) + "/releases?per_page=100"
+
+	for reqUrl != "" {
+		resp, body, rErr := makeGitLabRequest(ctx, client, reqUrl, gl.Token)
+		if rErr != nil {
+			return nil, rErr
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			return nil, errors.Errorf("failed to list releases due to unexpected response: %d (%s)", resp.StatusCode, resp.Status)
+		}
+
+		var respObj []gitLabRelease
+		if uErr := json.Unmarshal(body, &respObj); uErr != nil {
+			return nil, errors.Errorf("failed to unmarshall gitlab json response: %s", uErr.Error())
+		}
+
+		for _, r := range respObj {
+			rel := release{Tag: r.TagName}
+
+			for _, assetLink := range r.Assets.Links {
+				assetURL := assetLink.DirectAssetURL
+				if assetURL == "" {
+					assetURL = assetLink.URL
+				}
+
+				rel.Assets = append(rel.Assets, releaseAsset{Name: assetLink.Name, URL: assetURL})
+			}
+
+			releases = append(releases, rel)
+		}
+
+		reqUrl = ""
+
+		for _, l := range link.ParseResponse(resp) {
+			if l.Rel == txtNext {
+				reqUrl = l.URI
+			}
+		}
+	}
+
+	return releases, nil
 }
 
-func (gl *GitLabHost) getAPIURL() string {
-	return gl.APIURL
+// downloadAsset downloads the asset, only sending the token if it's stored by the GitLab instance,
+// as assets may link to other sites.
+func (gl *GitLabHost) downloadAsset(ctx context.Context, asset releaseAsset, w io.Writer) errors.E {
+	header := http.Header{}
+
+	assetURL, aErr := url.Parse(asset.URL)
+	apiURL, pErr := url.Parse(gl.getAPIURL())
+
+	if aErr == nil && pErr == nil && assetURL.Host == apiURL.Host {
+		header.Set("Private-Token", gl.Token)
+	}
+
+	return downloadURL(ctx, gl.httpClient, asset.URL, header, w)
 }
 
-func gitlabWorker(logLevel int, userName, token, backupDIR, diffRemoteMethod string, backupsToKeep int, jobs <-chan repository, results chan<- RepoBackupResults) {
-	for repo := range jobs {
-		firstPos := strings.Index(repo.HTTPSUrl, "//")
-		repo.URLWithToken = repo.HTTPSUrl[:firstPos+2] + userName + ":" + stripTrailing(token, "\n") + "@" + repo.HTTPSUrl[firstPos+2:]
-		err := processBackup(logLevel, repo, backupDIR, backupsToKeep, diffRemoteMethod)
+// releaseSource returns the host as the source of its projects' releases, if they're backed up.
+func (gl *GitLabHost) releaseSource() releaseSource {
+	if !gl.BackupReleases {
+		return nil
+	}
 
-		backupResult := RepoBackupResults{
-			Repo: repo.PathWithNameSpace,
-		}
+	return gl
+}
+
+// setStatisticsQuery requests the projects' statistics with the listing, if empty projects are
+// skipped, rather than requesting those of each project in turn.
+func (gl *GitLabHost) setStatisticsQuery(q url.Values) {
+	if gl.SkipEmptyProjects {
+		q.Set("statistics", "true")
+	}
+}
+
+// isEmptyProject returns whether the project's repository is empty. Statistics are computed
+// asynchronously, so one reported as empty may have just been pushed to, and its refs are checked.
+// A project whose refs can't be listed is assumed not to be empty, so it's still backed up.
+func (gl *GitLabHost) isEmptyProject(ctx context.Context, repo repository) bool {
+	if !repo.ReportedEmpty {
+		return false
+	}
+
+	gitOpts := gitOptions{BinaryPath: gl.GitBinaryPath, ExtraConfig: gl.ExtraGitConfig, ProxyURL: gl.ProxyURL, CACertPath: gl.CACertPath, InsecureSkipTLSVerify: gl.InsecureSkipTLSVerify}
 
-		status := statusOk
-		if err != nil {
-			status = statusFailed
-			backupResult.Error = err
+	refs, err := getRemoteRefs(ctx, gitOpts, getCloneURL(gl.setupRepo(repo), gl.SSHPrivateKeyPath), gitSSHCommand(gl.SSHPrivateKeyPath, gl.SSHKnownHostsPath))
+	if err != nil {
+		if gl.LogLevel > 0 {
+			gl.logger().Printf("failed to get refs of project %s: %s", repo.PathWithNameSpace, err)
 		}
 
-		backupResult.Status = status
+		return false
+	}
+
+	return len(refs) == 0
+}
+
+func (gl *GitLabHost) getAPIURL() string {
+	return gl.APIURL
+}
 
-		results <- backupResult
+// backupInput returns the settings each of the host's repositories is backed up with.
+func (gl *GitLabHost) backupInput() processBackupInput {
+	return processBackupInput{
+		LogLevel:            gl.LogLevel,
+		Logger:              gl.logger(),
+		RemoteStore:         gl.RemoteStore,
+		StoreKeyPrefix:      gl.NamespacePrefix,
+		RepoBackupTimeout:   gl.RepoBackupTimeout,
+		Git:                 gitOptions{BinaryPath: gl.GitBinaryPath, ExtraConfig: gl.ExtraGitConfig, ProxyURL: gl.ProxyURL, CACertPath: gl.CACertPath, InsecureSkipTLSVerify: gl.InsecureSkipTLSVerify},
+		BackupDIR:           backupRoot(gl.BackupDir, gl.NamespacePrefix),
+		BackupsToKeep:       gl.BackupsToRetain,
+		KeepForDays:         gl.KeepForDays,
+		CloneRetries:        gl.CloneRetries,
+		MinFreeDiskMB:       gl.MinFreeDiskMB,
+		DiffRemoteMethod:    gl.diffRemoteMethod(),
+		BundleRefSpec:       gl.BundleRefSpec,
+		RefSpec:             gl.refSpecPatterns,
+		BundleNameTemplate:  gl.BundleNameTemplate,
+		FlatLayout:          gl.FlatLayout,
+		FlatLayoutSeparator: gl.FlatLayoutSeparator,
+		DateDir:             backupDateDir(gl.DateDirLayout),
+		DetectRenames:       gl.DetectRenames,
+		UseAlternates:       gl.UseAlternates,
+		DryRun:              gl.DryRun,
+		PartialClone:        gl.PartialClone,
+		KeepWorkingDir:      gl.KeepWorkingDir,
+		SkipVerify:          !gl.VerifyAfterCreate,
+		CompressBundles:     gl.CompressBundles,
+		ArchivePerRepo:      gl.ArchivePerRepo,
+		KeepArchivedFiles:   gl.KeepArchivedFiles,
+		SSHPrivateKeyPath:   gl.SSHPrivateKeyPath,
+		SSHKnownHostsPath:   gl.SSHKnownHostsPath,
+		Releases:            gl.releaseSource(),
 	}
 }
 
+// setupRepo adds the authenticated user and token to the repository's URL so it can be cloned.
+func (gl *GitLabHost) setupRepo(repo repository) repository {
+	firstPos := strings.Index(repo.HTTPSUrl, "//")
+	repo.URLWithToken = repo.HTTPSUrl[:firstPos+2] + gl.User.UserName + ":" + stripTrailing(gl.Token, "\n") + "@" + repo.HTTPSUrl[firstPos+2:]
+
+	return repo
+}
+
 func (gl *GitLabHost) Backup() ProviderBackupResult {
+	return gl.BackupWithContext(context.Background())
+}
+
+// BackupWithContext backs up the host's repositories. Any not yet backed up when the context is
+// cancelled are reported as failed.
+func (gl *GitLabHost) BackupWithContext(ctx context.Context) ProviderBackupResult {
+	release, err := acquireBackupLocks(ctx, []GitProvider{gl})
+	if err != nil {
+		return ProviderBackupResult{Error: err}
+	}
+
+	defer release()
+
+	return gl.backupWithCloneTokens(ctx, nil)
+}
+
+// backupLock returns the directory locked while the host is backed up, and how long to wait for it.
+func (gl *GitLabHost) backupLock() (string, time.Duration) {
+	return gl.BackupDir, gl.LockTimeout
+}
+
+// backupWithCloneTokens backs up the host's repositories, each holding a token from cloneTokens, if
+// specified, while being backed up.
+func (gl *GitLabHost) backupWithCloneTokens(ctx context.Context, cloneTokens chan struct{}) ProviderBackupResult {
+	in := gl.backupInput()
+
+	result := gl.backup(ctx, in, cloneTokens)
+
+	updateBackupIndexes(gl.logger(), in, result.BackupResults)
+
+	notifyWebhook(ctx, gl.logger(), gl.httpClient, gl.NotifyWebhookURL, gitLabProviderName, result)
+
+	return result
+}
+
+func (gl *GitLabHost) backup(ctx context.Context, in processBackupInput, cloneTokens chan struct{}) ProviderBackupResult {
 	if gl.BackupDir == "" {
-		logger.Printf("backup skipped as backup directory not specified")
+		gl.logger().Printf("backup skipped as backup directory not specified")
 
 		return ProviderBackupResult{}
 	}
 
-	maxConcurrent := 5
-
 	var err errors.E
 
-	gl.User, err = gl.getAuthenticatedGitLabUser()
+	gl.User, err = gl.getAuthenticatedGitLabUser(ctx)
 	if err != nil {
 		return ProviderBackupResult{
 			BackupResults: nil,
@@ -412,56 +999,51 @@ func (gl *GitLabHost) Backup() ProviderBackupResult {
 	}
 
 	if gl.User.ID == 0 {
-		// skip backup if user is not authenticated
-		return ProviderBackupResult{}
+		return ProviderBackupResult{
+			Error: errors.New("failed to determine authenticated GitLab user"),
+		}
 	}
 
-	repoDesc, err := gl.describeRepos()
+	repoDesc, err := gl.describeRepos(ctx)
 	if err != nil {
 		return ProviderBackupResult{
 			Error: errors.Wrap(err, "failed to describe repos"),
 		}
 	}
 
-	jobs := make(chan repository, len(repoDesc.Repos))
-	results := make(chan RepoBackupResults, maxConcurrent)
-
-	for w := 1; w <= maxConcurrent; w++ {
-		go gitlabWorker(gl.LogLevel, gl.User.UserName, gl.Token, gl.BackupDir, gl.diffRemoteMethod(), gl.BackupsToRetain, jobs, results)
-	}
-
-	var providerBackupResults ProviderBackupResult
-
-	for x := range repoDesc.Repos {
-		repo := repoDesc.Repos[x]
-		jobs <- repo
-	}
-
-	close(jobs)
-
-	for a := 1; a <= len(repoDesc.Repos); a++ {
-		res := <-results
-		if res.Error != nil {
-			logger.Printf("backup failed: %+v\n", res.Error)
-		}
+	repoDesc.Repos = filterRepos(gl.logger(), repoDesc.Repos, gl.Include, gl.Exclude)
+	repoDesc.Repos = filterRepoList(gl.logger(), repoDesc.Repos, gl.RepoList, gl.RepoListMode)
 
-		providerBackupResults.BackupResults = append(providerBackupResults.BackupResults, res)
+	if mErr := checkMaxRepos(gl.logger(), gitLabProviderName, len(repoDesc.Repos), gl.MaxRepos); mErr != nil {
+		return ProviderBackupResult{Error: mErr}
 	}
 
-	return providerBackupResults
+	repos, skipped := filterSkippedRepos(gl.logger(), repoDesc.Repos, gl.DryRun, skipReasonNotUpdated, notUpdatedSince(gl.UpdatedSince))
+
+	repos, emptyResults := filterSkippedRepos(gl.logger(), repos, gl.DryRun, skipReasonEmptyRepo, func(repo repository) bool {
+		return gl.SkipEmptyProjects && gl.isEmptyProject(ctx, repo)
+	})
+	skipped = append(skipped, emptyResults...)
+
+	return runBackups(ctx, gitLabProviderName, in, gl.setupRepo, repos, cloneTokens, backupRunOptions{
+		MaxConcurrent:    getMaxConcurrent(gl.MaxConcurrent, defaultMaxConcurrentGitLab),
+		FailFast:         gl.FailFast,
+		FailOnAnyError:   gl.FailOnAnyError,
+		UseAlternates:    gl.UseAlternates,
+		BackupSubmodules: gl.BackupSubmodules,
+		DetectRenames:    gl.DetectRenames,
+		Progress:         gl.Progress,
+		Skipped:          skipped,
+	})
 }
 
 // return normalised method.
 func (gl *GitLabHost) diffRemoteMethod() string {
-	switch strings.ToLower(gl.DiffRemoteMethod) {
-	case refsMethod:
-		return refsMethod
-	case cloneMethod:
-		return cloneMethod
-	default:
-		logger.Printf("unexpected diff remote method: %s", gl.DiffRemoteMethod)
+	return normaliseDiffRemoteMethod(gl.logger(), gl.DiffRemoteMethod)
+}
 
-		// default to bundle as safest
-		return cloneMethod
-	}
+// logger returns the configured logger, or the package's default if none was specified, masking
+// the token in any lines logged.
+func (gl *GitLabHost) logger() Logger {
+	return newMaskingLogger(getLogger(gl.Logger), gl.Token, strings.TrimSpace(gl.Token))
 }
@@ -3,11 +3,20 @@ package githosts
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"io"
+	"log"
 	"net/http"
+	"net/url"
 	"os"
-	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
@@ -17,6 +26,8 @@ import (
 
 const (
 	backupDirMode = 0o755
+	// maskingLoggerCallDepth skips the masking logger's frames to report the caller's file and line
+	maskingLoggerCallDepth = 3
 )
 
 func createDirIfAbsent(path string) error {
@@ -50,48 +61,60 @@ func stripTrailing(input string, toStrip string) string {
 	return input
 }
 
-func isEmpty(clonedRepoPath string) (bool, errors.E) {
-	remoteHeadsCmd := exec.Command("git", "count-objects", "-v")
-	remoteHeadsCmd.Dir = clonedRepoPath
+// getLocalRefs returns the refs of the repository at repoPath.
+func getLocalRefs(ctx context.Context, gitOpts gitOptions, repoPath string) (gitRefs, errors.E) {
+	forEachRefCmd := gitCommand(ctx, gitOpts, "", "for-each-ref", "--format=%(objectname) %(refname)")
+	forEachRefCmd.Dir = repoPath
 
-	out, err := remoteHeadsCmd.CombinedOutput()
+	out, err := forEachRefCmd.CombinedOutput()
 	if err != nil {
-		return true, errors.Wrapf(err, "failed to count objects in %s", clonedRepoPath)
+		return nil, errors.Wrapf(err, "failed to list refs in %s", repoPath)
 	}
 
-	cmdOutput := strings.Split(string(out), "\n")
+	refs, err := generateMapFromRefsCmdOutput(out)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to parse refs in %s", repoPath)
+	}
 
-	var looseObjects bool
+	return refs, nil
+}
 
-	var inPackObjects bool
+// getRefSpecRefs returns the refs of the cloned repository that match the ref spec patterns, in
+// order, or none if it has no such refs.
+func getRefSpecRefs(ctx context.Context, gitOpts gitOptions, clonedRepoPath string, refSpec []*regexp.Regexp) ([]string, errors.E) {
+	refs, err := getLocalRefs(ctx, gitOpts, clonedRepoPath)
+	if err != nil {
+		return nil, err
+	}
 
-	var matchingLinesFound int
+	var matched []string
 
-	for _, line := range cmdOutput {
-		fields := strings.Fields(line)
-		if len(fields) >= 2 {
-			switch fields[0] {
-			case "count:":
-				matchingLinesFound++
+	for ref := range filterRefsByRefSpec(refs, refSpec) {
+		matched = append(matched, ref)
+	}
 
-				looseObjects = fields[1] != "0"
-			case "in-pack:":
-				matchingLinesFound++
+	slices.Sort(matched)
 
-				inPackObjects = fields[1] != "0"
-			}
-		}
-	}
+	return matched, nil
+}
+
+// isEmpty returns whether the cloned repository has no refs that would be included in a bundle.
+func isEmpty(ctx context.Context, gitOpts gitOptions, clonedRepoPath, bundleRefSpec string) (bool, errors.E) {
+	args := []string{"for-each-ref", "--count=1", "--format=%(refname)"}
 
-	if matchingLinesFound != 2 {
-		return false, errors.Errorf("failed to get object counts from %s", clonedRepoPath)
+	for _, arg := range bundleRefSpecArgs(bundleRefSpec) {
+		args = append(args, bundleRefSpecPrefixes[arg])
 	}
 
-	if !looseObjects && !inPackObjects {
-		return true, nil
+	forEachRefCmd := gitCommand(ctx, gitOpts, "", args...)
+	forEachRefCmd.Dir = clonedRepoPath
+
+	out, err := forEachRefCmd.CombinedOutput()
+	if err != nil {
+		return true, errors.Wrapf(err, "failed to list refs in %s", clonedRepoPath)
 	}
 
-	return false, nil
+	return strings.TrimSpace(string(out)) == "", nil
 }
 
 func getResponseBody(resp *http.Response) ([]byte, error) {
@@ -118,12 +141,48 @@ func getResponseBody(resp *http.Response) ([]byte, error) {
 
 func maskSecrets(content string, secret []string) string {
 	for _, s := range secret {
+		if s == "" {
+			continue
+		}
+
 		content = strings.ReplaceAll(content, s, strings.Repeat("*", len(s)))
 	}
 
 	return content
 }
 
+// maskingLogger masks secrets, such as API tokens, in the lines logged with it.
+type maskingLogger struct {
+	logger  Logger
+	secrets []string
+}
+
+// newMaskingLogger returns a logger that masks the secrets in lines before passing them to l.
+func newMaskingLogger(l Logger, secrets ...string) Logger {
+	return maskingLogger{logger: l, secrets: secrets}
+}
+
+func (m maskingLogger) Printf(format string, v ...any) {
+	m.output(fmt.Sprintf(format, v...))
+}
+
+func (m maskingLogger) Println(v ...any) {
+	m.output(strings.TrimSuffix(fmt.Sprintln(v...), "\n"))
+}
+
+func (m maskingLogger) output(line string) {
+	line = maskSecrets(line, m.secrets)
+
+	// the standard logger reports the caller of Printf or Println rather than this logger
+	if l, ok := m.logger.(*log.Logger); ok {
+		_ = l.Output(maskingLoggerCallDepth, line)
+
+		return
+	}
+
+	m.logger.Println(line)
+}
+
 type httpRequestInput struct {
 	client            *retryablehttp.Client
 	url               string
@@ -170,16 +229,501 @@ func httpRequest(in httpRequestInput) ([]byte, http.Header, int, error) {
 	return body, resp.Header, resp.StatusCode, err
 }
 
-func getDiffRemoteMethod(input string) (string, error) {
-	if input == "" {
-		return input, nil
+// getDiffRemoteMethod returns the normalised diff remote method to use when constructing a host.
+// An empty input results in the default method and an invalid one in an error.
+func getDiffRemoteMethod(logger Logger, input string) (string, error) {
+	method := strings.ToLower(strings.TrimSpace(input))
+
+	if method == "" {
+		logger.Printf("%s: %s", sUsingDefaultDiffRemoteMethod, defaultRemoteMethod)
+
+		return defaultRemoteMethod, nil
+	}
+
+	if err := validDiffRemoteMethod(method); err != nil {
+		return "", err
+	}
+
+	logger.Printf("%s: %s", sUsingDiffRemoteMethod, method)
+
+	return method, nil
+}
+
+// bundleRefSpecPrefixes maps the supported ref selection arguments to the refs they include.
+var bundleRefSpecPrefixes = map[string]string{
+	"--all":      "refs/",
+	"--branches": "refs/heads/",
+	"--tags":     "refs/tags/",
+	"--remotes":  "refs/remotes/",
+}
+
+// getBundleRefSpec returns the normalised ref selection to use when creating bundles.
+// An empty input results in the default selection and an invalid one in an error.
+func getBundleRefSpec(input string) (string, error) {
+	args := strings.Fields(input)
+	if len(args) == 0 {
+		return defaultBundleRefSpec, nil
+	}
+
+	for _, arg := range args {
+		if _, ok := bundleRefSpecPrefixes[arg]; !ok {
+			return "", errors.Errorf("invalid bundle ref spec argument: %s", arg)
+		}
+	}
+
+	return strings.Join(args, " "), nil
+}
+
+// validRepoFilters checks the include and exclude patterns are valid path.Match patterns.
+func validRepoFilters(include, exclude []string) error {
+	for _, pattern := range slices.Concat(include, exclude) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.Errorf("invalid repository filter pattern: %s", pattern)
+		}
+	}
+
+	return nil
+}
+
+// filterRepos returns the repositories whose PathWithNameSpace matches an include pattern, or all if none
+// are specified, and no exclude pattern. Exclusions take precedence over inclusions.
+func filterRepos(logger Logger, repos []repository, include, exclude []string) []repository {
+	if len(include) == 0 && len(exclude) == 0 {
+		return repos
+	}
+
+	var filtered []repository
+
+	for _, repo := range repos {
+		if len(include) > 0 && !matchesAnyPattern(repo.PathWithNameSpace, include) {
+			continue
+		}
+
+		if matchesAnyPattern(repo.PathWithNameSpace, exclude) {
+			logger.Printf("excluding repository %s", repo.PathWithNameSpace)
+
+			continue
+		}
+
+		filtered = append(filtered, repo)
+	}
+
+	return filtered
+}
+
+// filterSkippedRepos returns the repositories that aren't to be skipped, along with the results of
+// those that are, skipped for the reason specified.
+func filterSkippedRepos(logger Logger, repos []repository, dryRun bool, reason string, skip func(repository) bool) ([]repository, []RepoBackupResults) {
+	var (
+		kept    []repository
+		skipped []RepoBackupResults
+	)
+
+	for _, repo := range repos {
+		if !skip(repo) {
+			kept = append(kept, repo)
+
+			continue
+		}
+
+		logger.Printf("skipping %s: %s", repo.PathWithNameSpace, reason)
+
+		status := statusOk
+		if dryRun {
+			status = statusWouldSkip
+		}
+
+		skipped = append(skipped, RepoBackupResults{
+			Repo:       repo.PathWithNameSpace,
+			Domain:     repo.Domain,
+			Status:     status,
+			Skipped:    true,
+			SkipReason: reason,
+		})
+	}
+
+	return kept, skipped
+}
+
+// notUpdatedSince returns whether a repository wasn't updated since the time specified. None are
+// if it's zero, nor are those without an update time.
+func notUpdatedSince(since time.Time) func(repository) bool {
+	return func(repo repository) bool {
+		return !since.IsZero() && !repo.UpdatedAt.IsZero() && repo.UpdatedAt.Before(since)
+	}
+}
+
+const (
+	repoListModeAllow = "allow"
+	repoListModeDeny  = "deny"
+)
+
+// readRepoList returns the repository patterns listed in the file, one per line with blank lines and
+// those starting with # ignored, along with the normalised mode: allow, the default, backs up only the
+// repositories matching a pattern and deny those matching none. No file results in no list.
+func readRepoList(file, mode string) ([]string, string, error) {
+	if file == "" {
+		return nil, "", nil
+	}
+
+	mode = strings.ToLower(strings.TrimSpace(mode))
+
+	switch mode {
+	case "":
+		mode = repoListModeAllow
+	case repoListModeAllow, repoListModeDeny:
+	default:
+		return nil, "", errors.Errorf("invalid repository list mode: %s", mode)
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, "", errors.Errorf("failed to read repository list file: %s", err)
+	}
+
+	var patterns []string
+
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		if _, err = path.Match(line, ""); err != nil {
+			return nil, "", errors.Errorf("invalid pattern in repository list file: %s: %s", file, line)
+		}
+
+		patterns = append(patterns, line)
+	}
+
+	return patterns, mode, nil
+}
+
+// filterRepoList returns the repositories allowed by the repository list. All are returned if there's
+// no list, i.e. the mode is empty.
+func filterRepoList(logger Logger, repos []repository, patterns []string, mode string) []repository {
+	if mode == "" {
+		return repos
+	}
+
+	var filtered []repository
+
+	for _, repo := range repos {
+		if matchesAnyPattern(repo.PathWithNameSpace, patterns) != (mode == repoListModeAllow) {
+			logger.Printf("excluding repository %s by repository list", repo.PathWithNameSpace)
+
+			continue
+		}
+
+		filtered = append(filtered, repo)
+	}
+
+	return filtered
+}
+
+func matchesAnyPattern(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// errTooManyRepos is returned when a host has more repositories to back up than its maximum.
+var errTooManyRepos = errors.Base("too many repositories")
+
+// checkMaxRepos returns an error refusing to back up the host's repositories if there are more
+// than the maximum, e.g. as a filter matched far more than intended. Zero is unlimited.
+func checkMaxRepos(logger Logger, provider string, count, maxRepos int) errors.E {
+	logger.Printf("found %d %s repositories to back up", count, provider)
+
+	if maxRepos == 0 || count <= maxRepos {
+		return nil
+	}
+
+	return errors.Errorf("%w: found %d %s repositories, more than the maximum of %d", errTooManyRepos, count, provider, maxRepos)
+}
+
+func validMaxRepos(maxRepos int) error {
+	if maxRepos < 0 {
+		return errors.Errorf("invalid max repos: %d", maxRepos)
 	}
 
-	if err := validDiffRemoteMethod(input); err != nil {
-		return input, err
+	return nil
+}
+
+func validMaxConcurrent(maxConcurrent int) error {
+	if maxConcurrent < 0 {
+		return errors.Errorf("invalid max concurrent: %d", maxConcurrent)
+	}
+
+	return nil
+}
+
+// validRetryConfig checks the retry settings are not negative and, once defaults are applied, the
+// minimum wait between retries doesn't exceed the maximum.
+func validRetryConfig(retryMax, retryWaitMinSeconds, retryWaitMaxSeconds int) error {
+	if retryMax < disableRetries {
+		return errors.Errorf("invalid retry max: %d", retryMax)
+	}
+
+	if retryWaitMinSeconds < 0 {
+		return errors.Errorf("invalid retry wait min seconds: %d", retryWaitMinSeconds)
+	}
+
+	if retryWaitMaxSeconds < 0 {
+		return errors.Errorf("invalid retry wait max seconds: %d", retryWaitMaxSeconds)
+	}
+
+	waitMin := getRetrySetting(retryWaitMinSeconds, defaultRetryWaitMinSeconds)
+	waitMax := getRetrySetting(retryWaitMaxSeconds, defaultRetryWaitMaxSeconds)
+
+	if waitMin > waitMax {
+		return errors.Errorf("retry wait min seconds (%d) exceeds retry wait max seconds (%d)", waitMin, waitMax)
+	}
+
+	return nil
+}
+
+// validBundleNameTemplate checks the bundle name template, if specified, names bundles so that
+// their timestamps can be found, which requires the timestamp to be followed by the extension.
+func validBundleNameTemplate(bundleNameTemplate string) error {
+	if bundleNameTemplate == "" {
+		return nil
+	}
+
+	created := time.Date(2020, time.April, 1, 11, 11, 11, 0, time.UTC)
+
+	name, err := bundleFileName(bundleNameTemplate, "owner", "repo", created)
+	if err != nil {
+		return err
+	}
+
+	if ts, ok := generationTimeStamp(name); !strings.HasSuffix(name, bundleExtension) || !ok || !ts.Equal(created) {
+		return errors.Errorf("invalid bundle name template: %s: names must include {{.Timestamp}} and end with %s", bundleNameTemplate, bundleExtension)
+	}
+
+	return nil
+}
+
+// validFlatLayoutSeparator checks the separator, if specified, keeps the flat layout's directories
+// directly within the backup directory.
+func validFlatLayoutSeparator(separator string) error {
+	if strings.ContainsAny(separator, `/\`) {
+		return errors.Errorf("invalid flat layout separator: %s", separator)
+	}
+
+	return nil
+}
+
+// validCloneRetries checks the number of times to retry clones isn't negative.
+func validCloneRetries(cloneRetries int) error {
+	if cloneRetries < disableRetries {
+		return errors.Errorf("invalid clone retries: %d", cloneRetries)
+	}
+
+	return nil
+}
+
+// retryAfter returns the wait requested by the response's Retry-After header, given either in
+// seconds or as an HTTP date, and whether it requested one.
+func retryAfter(resp *http.Response, now time.Time) (time.Duration, bool) {
+	value := resp.Header.Get("Retry-After")
+	if value == "" {
+		return 0, false
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+
+	if at, err := http.ParseTime(value); err == nil {
+		return max(at.Sub(now), 0), true
+	}
+
+	return 0, false
+}
+
+// validMinFreeDiskMB checks the free disk space required isn't negative.
+func validMinFreeDiskMB(minFreeDiskMB int) error {
+	if minFreeDiskMB < 0 {
+		return errors.Errorf("invalid minimum free disk space: %d", minFreeDiskMB)
+	}
+
+	return nil
+}
+
+// validPageDelay checks the delay between requests for pages of a listing isn't negative.
+func validPageDelay(pageDelayMs int) error {
+	if pageDelayMs < 0 {
+		return errors.Errorf("invalid page delay: %d", pageDelayMs)
+	}
+
+	return nil
+}
+
+// validSSHAuth checks the SSH private key, and known hosts file if specified, exist. A known hosts
+// file is only used with a key.
+func validSSHAuth(sshPrivateKeyPath, sshKnownHostsPath string) error {
+	if sshPrivateKeyPath == "" {
+		if sshKnownHostsPath != "" {
+			return errors.New("SSH known hosts path specified without an SSH private key path")
+		}
+
+		return nil
+	}
+
+	if _, err := os.Stat(sshPrivateKeyPath); err != nil {
+		return errors.Errorf("invalid SSH private key path: %s", err)
+	}
+
+	if sshKnownHostsPath != "" {
+		if _, err := os.Stat(sshKnownHostsPath); err != nil {
+			return errors.Errorf("invalid SSH known hosts path: %s", err)
+		}
+	}
+
+	return nil
+}
+
+func validRepoBackupTimeout(timeout time.Duration) error {
+	if timeout < 0 {
+		return errors.Errorf("invalid repository backup timeout: %s", timeout)
+	}
+
+	return nil
+}
+
+// validExtraGitConfig checks each entry of extra git configuration is of the form key=value.
+func validExtraGitConfig(extraGitConfig []string) error {
+	for _, config := range extraGitConfig {
+		key, _, found := strings.Cut(config, "=")
+		if !found || strings.TrimSpace(key) == "" {
+			return errors.Errorf("invalid extra git config '%s': expected key=value", config)
+		}
+	}
+
+	return nil
+}
+
+// validProxyURL checks the proxy, if specified, is an absolute URL of a supported scheme. The URL
+// isn't included in the error as it may contain credentials.
+func validProxyURL(proxyURL string) error {
+	if proxyURL == "" {
+		return nil
+	}
+
+	u, err := url.Parse(proxyURL)
+	if err != nil || u.Host == "" || !slices.Contains([]string{"http", "https", "socks5"}, u.Scheme) {
+		return errors.New("invalid proxy URL")
+	}
+
+	return nil
+}
+
+// getTLSConfig returns the TLS configuration of connections to the provider's API, or nil to use the
+// default. The CA certificate, if specified, is trusted in addition to those of the system so that
+// instances using an internal CA are verified.
+func getTLSConfig(caCertPath string, insecureSkipTLSVerify bool) (*tls.Config, error) {
+	if caCertPath == "" && !insecureSkipTLSVerify {
+		return nil, nil
+	}
+
+	//nolint:gosec // skipping verification is explicitly requested
+	tlsConfig := &tls.Config{InsecureSkipVerify: insecureSkipTLSVerify}
+
+	if caCertPath == "" {
+		return tlsConfig, nil
 	}
 
-	return input, nil
+	pem, err := os.ReadFile(caCertPath)
+	if err != nil {
+		return nil, errors.Errorf("failed to read CA certificate: %s", err)
+	}
+
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.Errorf("no certificates found in CA certificate: %s", caCertPath)
+	}
+
+	tlsConfig.RootCAs = pool
+
+	return tlsConfig, nil
+}
+
+// getRepoBackupTimeout returns the time allowed to back up a repository, using the default if not specified.
+func getRepoBackupTimeout(timeout time.Duration) time.Duration {
+	if timeout > 0 {
+		return timeout
+	}
+
+	return defaultRepoBackupTimeout
+}
+
+// getRetrySetting returns the retry setting, using the default if not specified.
+func getRetrySetting(setting, defaultSetting int) int {
+	if setting > 0 {
+		return setting
+	}
+
+	return defaultSetting
+}
+
+// getRetryCount returns the number of times to retry, using the default if not specified, or none
+// if retries are disabled.
+func getRetryCount(setting, defaultSetting int) int {
+	if setting == disableRetries {
+		return 0
+	}
+
+	return getRetrySetting(setting, defaultSetting)
+}
+
+// getMaxConcurrent returns the number of workers to back up repositories with, using the
+// provider's default if not specified.
+func getMaxConcurrent(maxConcurrent, defaultMaxConcurrent int) int {
+	if maxConcurrent > 0 {
+		return maxConcurrent
+	}
+
+	return defaultMaxConcurrent
+}
+
+// validNamespacePrefix checks the prefix is a relative path that remains within the backup directory.
+func validNamespacePrefix(prefix string) error {
+	if prefix == "" {
+		return nil
+	}
+
+	if !filepath.IsLocal(prefix) {
+		return errors.Errorf("invalid namespace prefix: %s", prefix)
+	}
+
+	return nil
+}
+
+// normaliseDiffRemoteMethod returns the diff remote method to use at backup time, falling back to
+// the default for hosts that were not created with a valid method.
+func normaliseDiffRemoteMethod(logger Logger, method string) string {
+	switch strings.ToLower(method) {
+	case refsMethod:
+		return refsMethod
+	case cloneMethod:
+		return cloneMethod
+	case "":
+		return defaultRemoteMethod
+	default:
+		logger.Printf("unexpected diff remote method: %s", method)
+
+		// default to bundle as safest
+		return defaultRemoteMethod
+	}
 }
 
 func remove(s []string, r string) []string {
@@ -191,3 +735,14 @@ func remove(s []string, r string) []string {
 
 	return s
 }
+
+// ownerFromPath returns the owner of the repository with the path specified, e.g. owner of
+// owner/repo, or an empty string if the path has no namespace.
+func ownerFromPath(pathWithNameSpace string) string {
+	owner, _, found := strings.Cut(pathWithNameSpace, "/")
+	if !found {
+		return ""
+	}
+
+	return owner
+}
@@ -0,0 +1,192 @@
+package githosts
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	// backupIndexFileName is the file in each domain's backup directory indexing its latest bundles
+	backupIndexFileName = ".index.json"
+	backupIndexFileMode = 0o644
+)
+
+// backupIndexMu serialises updates of the indexes, as hosts backing up the same domain may finish together.
+var backupIndexMu sync.Mutex
+
+// backupIndex lists the latest bundle of each repository backed up from a domain, so the backups
+// can be verified without walking the backup directory.
+type backupIndex struct {
+	Updated string             `json:"updated"`
+	Repos   []backupIndexEntry `json:"repos"`
+}
+
+type backupIndexEntry struct {
+	Repo      string `json:"repo"`
+	Bundle    string `json:"bundle"`
+	SHA256    string `json:"sha256"`
+	Timestamp string `json:"timestamp"`
+}
+
+// backupIndexPath returns the path of the index of the domain's backups. With the flat layout,
+// where the domain has no directory, it's named as the domain's backups are.
+func backupIndexPath(backupDIR, domain string, flatLayout bool, flatLayoutSeparator string) string {
+	if !flatLayout {
+		return filepath.Join(backupDIR, domain, backupIndexFileName)
+	}
+
+	if flatLayoutSeparator == "" {
+		flatLayoutSeparator = defaultFlatLayoutSeparator
+	}
+
+	return filepath.Join(backupDIR, domain+flatLayoutSeparator+backupIndexFileName)
+}
+
+// updateBackupIndexes updates the index of each domain with the latest bundles of the repositories
+// backed up, whether or not a new bundle was kept. The entries of those that weren't, such as
+// failed backups, and of repositories not included in the backup are left as they were. When
+// grouping backups by date, the indexes are those of the date directory backed up to, so in must
+// be the settings the backups were made with, as a run may finish on a later date than it started.
+func updateBackupIndexes(logger Logger, in processBackupInput, results []RepoBackupResults) {
+	entries := map[string][]backupIndexEntry{}
+
+	for _, res := range results {
+		if res.Status != statusOk {
+			continue
+		}
+
+		backupPath := repoBackupPath(datedBackupDIR(in.BackupDIR, in.DateDir), repository{Domain: res.Domain, PathWithNameSpace: res.Repo}, in.FlatLayout, in.FlatLayoutSeparator)
+
+		// e.g. an empty repository, or one whose bundles are archived
+		bundlePath, err := getLatestBundlePath(backupPath)
+		if err != nil {
+			continue
+		}
+
+		entry, eErr := newBackupIndexEntry(res.Repo, bundlePath)
+		if eErr != nil {
+			logger.Printf("failed to index backup of %s repo '%s': %s", res.Domain, res.Repo, eErr)
+
+			continue
+		}
+
+		entries[res.Domain] = append(entries[res.Domain], entry)
+	}
+
+	backupIndexMu.Lock()
+	defer backupIndexMu.Unlock()
+
+	for domain, domainEntries := range entries {
+		if err := updateBackupIndex(backupIndexPath(datedBackupDIR(in.BackupDIR, in.DateDir), domain, in.FlatLayout, in.FlatLayoutSeparator), domainEntries); err != nil {
+			logger.Printf("failed to update %s backup index: %s", domain, err)
+		}
+	}
+}
+
+// newBackupIndexEntry returns the index entry of the repository's latest bundle.
+func newBackupIndexEntry(repo, bundlePath string) (backupIndexEntry, errors.E) {
+	hash, err := getSHA2Hash(bundlePath)
+	if err != nil {
+		return backupIndexEntry{}, errors.Errorf("failed to get bundle hash: %s", err)
+	}
+
+	entry := backupIndexEntry{
+		Repo:   repo,
+		Bundle: filepath.Base(bundlePath),
+		SHA256: hex.EncodeToString(hash),
+	}
+
+	if created, tsErr := timeStampFromBundleName(entry.Bundle); tsErr == nil {
+		entry.Timestamp = created.Format(timeStampFormat)
+	}
+
+	return entry, nil
+}
+
+// updateBackupIndex merges the entries into the index at indexPath, replacing any of the same
+// repositories. The index is replaced in one step so it's never read partially written.
+func updateBackupIndex(indexPath string, entries []backupIndexEntry) errors.E {
+	index, err := readBackupIndex(indexPath)
+	if err != nil {
+		return err
+	}
+
+	merged := map[string]backupIndexEntry{}
+
+	for _, entry := range index.Repos {
+		merged[entry.Repo] = entry
+	}
+
+	for _, entry := range entries {
+		merged[entry.Repo] = entry
+	}
+
+	index.Updated = getTimestamp()
+	index.Repos = make([]backupIndexEntry, 0, len(merged))
+
+	for _, entry := range merged {
+		index.Repos = append(index.Repos, entry)
+	}
+
+	sort.Slice(index.Repos, func(i, j int) bool {
+		return index.Repos[i].Repo < index.Repos[j].Repo
+	})
+
+	data, mErr := json.MarshalIndent(index, "", "  ")
+	if mErr != nil {
+		return errors.Errorf("failed to marshal backup index: %s", mErr)
+	}
+
+	tmp, cErr := os.CreateTemp(filepath.Dir(indexPath), filepath.Base(indexPath)+".*")
+	if cErr != nil {
+		return errors.Errorf("failed to create backup index: %s", cErr)
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, wErr := tmp.Write(data); wErr != nil {
+		_ = tmp.Close()
+
+		return errors.Errorf("failed to write backup index: %s", wErr)
+	}
+
+	if cErr = tmp.Close(); cErr != nil {
+		return errors.Errorf("failed to write backup index: %s", cErr)
+	}
+
+	if cErr = os.Chmod(tmp.Name(), backupIndexFileMode); cErr != nil {
+		return errors.Errorf("failed to set backup index mode: %s", cErr)
+	}
+
+	if rErr := os.Rename(tmp.Name(), indexPath); rErr != nil {
+		return errors.Errorf("failed to write backup index: %s", rErr)
+	}
+
+	return nil
+}
+
+// readBackupIndex returns the index at indexPath, or an empty index if there isn't one yet.
+func readBackupIndex(indexPath string) (backupIndex, errors.E) {
+	var index backupIndex
+
+	data, err := os.ReadFile(indexPath)
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+
+	if err != nil {
+		return index, errors.Errorf("failed to read backup index: %s", err)
+	}
+
+	if err = json.Unmarshal(data, &index); err != nil {
+		return index, errors.Errorf("failed to unmarshal backup index: %s: %s", indexPath, err)
+	}
+
+	return index, nil
+}
@@ -0,0 +1,108 @@
+package githosts
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBackupIndexAccumulatesEntries(t *testing.T) {
+	t.Parallel()
+
+	repoOne := setupTestRepo(t)
+	repoTwo := setupTestRepo(t)
+	backupDir := t.TempDir()
+
+	backup := func(urls ...string) ProviderBackupResult {
+		host, err := NewGenericHost(NewGenericHostInput{BackupDir: backupDir, URLs: urls})
+		require.NoError(t, err)
+
+		return host.Backup()
+	}
+
+	indexed := func() map[string]backupIndexEntry {
+		index, err := readBackupIndex(backupIndexPath(backupDir, genericLocalDomain, false, ""))
+		require.NoError(t, err)
+
+		entries := map[string]backupIndexEntry{}
+		for _, entry := range index.Repos {
+			entries[entry.Repo] = entry
+		}
+
+		return entries
+	}
+
+	result := backup("file://"+repoOne, "file://"+repoTwo)
+	require.Len(t, result.BackupResults, 2)
+
+	first := indexed()
+	require.Len(t, first, 2)
+
+	for _, res := range result.BackupResults {
+		entry := first[res.Repo]
+
+		bundlePath, err := getLatestBundlePath(repoBackupPath(backupDir, repository{Domain: res.Domain, PathWithNameSpace: res.Repo}, false, ""))
+		require.NoError(t, err)
+		require.Equal(t, filepath.Base(bundlePath), entry.Bundle)
+		require.NotEmpty(t, entry.Timestamp)
+
+		expected, err := newBackupIndexEntry(res.Repo, bundlePath)
+		require.NoError(t, err)
+		require.Equal(t, expected.SHA256, entry.SHA256)
+	}
+
+	// the second backup updates one repository, fails to back up another, and leaves out the third
+	require.NoError(t, os.WriteFile(filepath.Join(repoOne, "second.txt"), []byte("second"), 0o600))
+	runGitCmd(t, repoOne, "add", "second.txt")
+	runGitCmd(t, repoOne, "commit", "-m", "second commit")
+
+	result = backup("file://"+repoOne, "file://"+filepath.Join(t.TempDir(), "missing"))
+	require.Len(t, result.BackupResults, 2)
+
+	second := indexed()
+	require.Len(t, second, 2)
+
+	for _, res := range result.BackupResults {
+		if res.Status == statusOk {
+			require.NotEqual(t, first[res.Repo].SHA256, second[res.Repo].SHA256)
+
+			continue
+		}
+
+		require.NotContains(t, second, res.Repo)
+	}
+
+	// the entry of the repository left out is kept as it was
+	repoTwoPath := strings.Trim(repoTwo, "/")
+	require.Contains(t, second, repoTwoPath)
+	require.Equal(t, first[repoTwoPath], second[repoTwoPath])
+}
+
+func TestBackupIndexDateDirOfRun(t *testing.T) {
+	t.Parallel()
+
+	repoDir := setupTestRepo(t)
+	backupDir := t.TempDir()
+
+	host, err := NewGenericHost(NewGenericHostInput{BackupDir: backupDir, URLs: []string{"file://" + repoDir}, DateDirLayout: true})
+	require.NoError(t, err)
+
+	// the run started on an earlier date than it finishes, so its bundles are in that date's directory
+	in := host.backupInput()
+	in.DateDir = "2024-01-01"
+
+	result := host.backup(context.Background(), in, nil)
+	require.Len(t, result.BackupResults, 1)
+	require.Equal(t, statusOk, result.BackupResults[0].Status)
+
+	updateBackupIndexes(logger, in, result.BackupResults)
+
+	index, iErr := readBackupIndex(backupIndexPath(filepath.Join(backupDir, "2024-01-01"), genericLocalDomain, false, ""))
+	require.NoError(t, iErr)
+	require.Len(t, index.Repos, 1)
+	require.Equal(t, strings.Trim(repoDir, "/"), index.Repos[0].Repo)
+}
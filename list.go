@@ -0,0 +1,148 @@
+package githosts
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// RepoBackupInfo summarises the backups of a repository.
+type RepoBackupInfo struct {
+	Repo              string    `json:"repo"`   // path of the repository's backups relative to the backup directory, or its date directories
+	Domain            string    `json:"domain"` // domain of the provider the repository was backed up from
+	Bundles           int       `json:"bundles"`
+	LatestBackup      time.Time `json:"latest_backup"`
+	LatestBundleBytes int64     `json:"latest_bundle_bytes"`
+}
+
+// ListBackups returns a summary of the backups of each repository in the backup directory. The
+// backups of hosts with a namespace prefix are listed by passing the prefixed directory. Those kept
+// with the flat layout, in directories directly under the backup directory, are named with their
+// domain followed by the separator, defaulting to __. When grouped by date, the backups of a
+// repository in every date directory are summarised together.
+func ListBackups(backupDir, flatLayoutSeparator string) ([]RepoBackupInfo, error) {
+	if backupDir == "" {
+		return nil, errors.New("backup directory not specified")
+	}
+
+	var infos []RepoBackupInfo
+
+	// the position in infos of each repository's summary, as its backups may be in several date directories
+	listed := map[string]int{}
+
+	err := filepath.WalkDir(backupDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.IsDir() {
+			return nil
+		}
+
+		// working clones are not backups
+		if d.Name() == workingDIRName {
+			return filepath.SkipDir
+		}
+
+		files, err := listBundleFiles(path)
+		if err != nil {
+			return err
+		}
+
+		if len(files) == 0 {
+			return nil
+		}
+
+		repoPath, err := filepath.Rel(backupDir, path)
+		if err != nil {
+			return err
+		}
+
+		repoPath = filepath.ToSlash(repoPath)
+
+		if dateDir, datedPath, found := strings.Cut(repoPath, "/"); found && isDateDirName(dateDir) {
+			repoPath = datedPath
+		}
+
+		x, ok := listed[repoPath]
+		if !ok {
+			x = len(infos)
+			listed[repoPath] = x
+
+			infos = append(infos, RepoBackupInfo{
+				Repo:   repoPath,
+				Domain: backupDomain(repoPath, flatLayoutSeparator),
+			})
+		}
+
+		info := &infos[x]
+		info.Bundles += len(files)
+
+		for _, f := range files {
+			if f.created.After(info.LatestBackup) {
+				info.LatestBackup = f.created
+				info.LatestBundleBytes = f.info.Size()
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return infos, errors.Errorf("failed to walk backup directory: %s", err)
+	}
+
+	return infos, nil
+}
+
+// backupDomain returns the domain of the backups at repoPath, relative to the backup directory.
+func backupDomain(repoPath, flatLayoutSeparator string) string {
+	domain, _, nested := strings.Cut(repoPath, "/")
+	if nested {
+		return domain
+	}
+
+	if flatLayoutSeparator == "" {
+		flatLayoutSeparator = defaultFlatLayoutSeparator
+	}
+
+	domain, _, _ = strings.Cut(repoPath, flatLayoutSeparator)
+
+	return domain
+}
+
+// listBundleFiles returns the bundles in backupPath. Unlike getBundleFiles, those whose names
+// can't be parsed are skipped, so one doesn't prevent the others being listed.
+func listBundleFiles(backupPath string) (bundleFiles, error) {
+	entries, err := os.ReadDir(backupPath)
+	if err != nil {
+		return nil, err
+	}
+
+	var files bundleFiles
+
+	for _, entry := range entries {
+		if !isBundleFileName(entry.Name()) {
+			continue
+		}
+
+		created, tsErr := timeStampFromBundleName(entry.Name())
+		if tsErr != nil {
+			logger.Printf("skipping bundle with unexpected name: %s: %s", filepath.Join(backupPath, entry.Name()), tsErr)
+
+			continue
+		}
+
+		info, iErr := entry.Info()
+		if iErr != nil {
+			return nil, iErr
+		}
+
+		files = append(files, bundleFile{info: info, created: created})
+	}
+
+	return files, nil
+}
@@ -0,0 +1,82 @@
+package githosts
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListBackups(t *testing.T) {
+	t.Parallel()
+
+	backupDir := t.TempDir()
+
+	writeFile := func(path string, size int) {
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, make([]byte, size), 0o600))
+	}
+
+	writeFile(filepath.Join(backupDir, gitHubDomain, "owner", "one", "one.20200101111111.bundle"), 10)
+	writeFile(filepath.Join(backupDir, gitHubDomain, "owner", "one", "one.20200101111111.manifest"), 1)
+	writeFile(filepath.Join(backupDir, gitHubDomain, "owner", "one", "one.20200301111111.bundle"), 30)
+	writeFile(filepath.Join(backupDir, gitHubDomain, "owner", "one", "one.20200201111111.bundle"), 20)
+	writeFile(filepath.Join(backupDir, gitLabDomain, "group", "sub", "two", "two.20210101111111.bundle"), 5)
+
+	// invalid bundles, working clones, and directories without bundles aren't listed
+	writeFile(filepath.Join(backupDir, gitHubDomain, "owner", "one", "one.20200401111111.bundle.invalid"), 40)
+	writeFile(filepath.Join(backupDir, workingDIRName, gitHubDomain, "owner", "one", "one.20200501111111.bundle"), 50)
+	require.NoError(t, os.MkdirAll(filepath.Join(backupDir, gitHubDomain, "owner", "empty"), 0o755))
+
+	// nor are those whose names can't be parsed, without preventing the others being listed
+	writeFile(filepath.Join(backupDir, gitHubDomain, "owner", "one", "one.2020.bundle"), 60)
+
+	infos, err := ListBackups(backupDir, "")
+	require.NoError(t, err)
+
+	require.Equal(t, []RepoBackupInfo{
+		{
+			Repo:              gitHubDomain + "/owner/one",
+			Domain:            gitHubDomain,
+			Bundles:           3,
+			LatestBackup:      time.Date(2020, 3, 1, 11, 11, 11, 0, time.UTC),
+			LatestBundleBytes: 30,
+		},
+		{
+			Repo:              gitLabDomain + "/group/sub/two",
+			Domain:            gitLabDomain,
+			Bundles:           1,
+			LatestBackup:      time.Date(2021, 1, 1, 11, 11, 11, 0, time.UTC),
+			LatestBundleBytes: 5,
+		},
+	}, infos)
+
+	_, err = ListBackups("", "")
+	require.Error(t, err)
+
+	_, err = ListBackups(filepath.Join(t.TempDir(), "missing"), "")
+	require.Error(t, err)
+}
+
+func TestListBackupsFlatLayout(t *testing.T) {
+	t.Parallel()
+
+	backupDir := t.TempDir()
+
+	for _, dir := range []string{"github.com__owner__one", "gitlab.com--group--two"} {
+		require.NoError(t, os.MkdirAll(filepath.Join(backupDir, dir), 0o755))
+		require.NoError(t, os.WriteFile(filepath.Join(backupDir, dir, "repo.20200101111111.bundle"), nil, 0o600))
+	}
+
+	infos, err := ListBackups(backupDir, "")
+	require.NoError(t, err)
+	require.Len(t, infos, 2)
+	require.Equal(t, gitHubDomain, infos[0].Domain)
+	require.Equal(t, "github.com__owner__one", infos[0].Repo)
+
+	infos, err = ListBackups(backupDir, "--")
+	require.NoError(t, err)
+	require.Equal(t, gitLabDomain, infos[1].Domain)
+}
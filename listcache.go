@@ -0,0 +1,137 @@
+package githosts
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/hashicorp/go-retryablehttp"
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	listCacheExtension = ".json"
+	listCacheFileMode  = 0o600
+)
+
+// listCacheEntry is a listing response kept so that it can be reused when the provider reports it
+// hasn't changed since.
+type listCacheEntry struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	Link         string `json:"link,omitempty"` // the pagination links of the response
+	Body         []byte `json:"body"`
+}
+
+// listCachePath returns the path of the cache file of the request URL.
+func listCachePath(cacheDir, reqURL string) string {
+	hash := sha256.Sum256([]byte(reqURL))
+
+	return filepath.Join(cacheDir, hex.EncodeToString(hash[:])+listCacheExtension)
+}
+
+func readListCache(cacheDir, reqURL string) (listCacheEntry, bool) {
+	var entry listCacheEntry
+
+	data, err := os.ReadFile(listCachePath(cacheDir, reqURL))
+	if err != nil {
+		return entry, false
+	}
+
+	if err = json.Unmarshal(data, &entry); err != nil || entry.URL != reqURL {
+		return entry, false
+	}
+
+	return entry, true
+}
+
+func writeListCache(cacheDir string, entry listCacheEntry) errors.E {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Errorf("failed to marshal list cache: %s", err)
+	}
+
+	if err = createDirIfAbsent(cacheDir); err != nil {
+		return errors.Errorf("failed to create list cache directory: %s: %s", cacheDir, err)
+	}
+
+	if err = os.WriteFile(listCachePath(cacheDir, entry.URL), data, listCacheFileMode); err != nil {
+		return errors.Errorf("failed to write list cache: %s", err)
+	}
+
+	return nil
+}
+
+// setListCacheHeaders makes the request conditional on the response having changed since it was
+// cached, if caching is enabled with a cache directory.
+func setListCacheHeaders(cacheDir, reqURL string, req *retryablehttp.Request) {
+	if cacheDir == "" {
+		return
+	}
+
+	entry, ok := readListCache(cacheDir, reqURL)
+	if !ok {
+		return
+	}
+
+	if entry.ETag != "" {
+		req.Header.Set("If-None-Match", entry.ETag)
+	}
+
+	if entry.LastModified != "" {
+		req.Header.Set("If-Modified-Since", entry.LastModified)
+	}
+}
+
+// useListCache returns the cached response in place of a Not Modified response, and caches
+// successful responses that can be checked for changes. Other responses are returned as they are.
+func useListCache(logger Logger, cacheDir, reqURL string, resp *http.Response, body []byte) (*http.Response, []byte) {
+	if cacheDir == "" {
+		return resp, body
+	}
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		entry, ok := readListCache(cacheDir, reqURL)
+		if !ok {
+			return resp, body
+		}
+
+		logger.Printf("reusing cached response of %s as not modified", reqURL)
+
+		cached := *resp
+		cached.StatusCode = http.StatusOK
+		cached.Status = fmt.Sprintf("%d %s", http.StatusOK, http.StatusText(http.StatusOK))
+		cached.Header = resp.Header.Clone()
+		cached.Header.Del("Link")
+
+		if entry.Link != "" {
+			cached.Header.Set("Link", entry.Link)
+		}
+
+		return &cached, entry.Body
+	case http.StatusOK:
+		entry := listCacheEntry{
+			URL:          reqURL,
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+			Link:         resp.Header.Get("Link"),
+			Body:         body,
+		}
+
+		if entry.ETag == "" && entry.LastModified == "" {
+			return resp, body
+		}
+
+		if err := writeListCache(cacheDir, entry); err != nil {
+			logger.Printf("failed to cache response of %s: %s", reqURL, err)
+		}
+	}
+
+	return resp, body
+}
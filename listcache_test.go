@@ -0,0 +1,157 @@
+package githosts
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// newListCacheServer returns a server responding with the pages, each with an ETag, or with Not
+// Modified if the request has the page's ETag. It returns the statuses of the responses sent.
+func newListCacheServer(t *testing.T, pages func(srvURL string) map[string]string, link func(srvURL, page string) string) (*httptest.Server, func() []int) {
+	t.Helper()
+
+	var (
+		mu       sync.Mutex
+		statuses []int
+		srv      *httptest.Server
+	)
+
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page := r.URL.Query().Get("page")
+
+		body, ok := pages(srv.URL)[page]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+
+			return
+		}
+
+		etag := `"page-` + page + `"`
+
+		status := http.StatusOK
+		if r.Header.Get("If-None-Match") == etag {
+			status = http.StatusNotModified
+		}
+
+		mu.Lock()
+		statuses = append(statuses, status)
+		mu.Unlock()
+
+		w.Header().Set("ETag", etag)
+
+		if status == http.StatusNotModified {
+			w.WriteHeader(status)
+
+			return
+		}
+
+		if l := link(srv.URL, page); l != "" {
+			w.Header().Set("Link", l)
+		}
+
+		_, _ = w.Write([]byte(body))
+	}))
+
+	t.Cleanup(srv.Close)
+
+	return srv, func() []int {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return statuses
+	}
+}
+
+func TestGiteaListCache(t *testing.T) {
+	t.Parallel()
+
+	srv, statuses := newListCacheServer(t, func(string) map[string]string {
+		return map[string]string{
+			"":  `[{"name":"repo1","full_name":"soba-org/repo1","owner":{"login":"soba-org"}}]`,
+			"2": `[{"name":"repo2","full_name":"soba-org/repo2","owner":{"login":"soba-org"}}]`,
+		}
+	}, func(srvURL, page string) string {
+		if page == "" {
+			return `<` + srvURL + `/api/v1/orgs/soba-org/repos?page=2>; rel="next"`
+		}
+
+		return ""
+	})
+
+	g, err := NewGiteaHost(NewGiteaHostInput{
+		APIURL:       srv.URL + "/api/v1",
+		Token:        "test-token",
+		ListCacheDir: t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	names := func() []string {
+		repos, rErr := g.getOrganizationRepos(context.Background(), "soba-org")
+		require.NoError(t, rErr)
+
+		var n []string
+		for _, repo := range repos {
+			n = append(n, repo.FullName)
+		}
+
+		return n
+	}
+
+	require.Equal(t, []string{"soba-org/repo1", "soba-org/repo2"}, names())
+	require.Equal(t, []int{http.StatusOK, http.StatusOK}, statuses())
+
+	// the unchanged pages, and their pagination, are reused from the cache
+	require.Equal(t, []string{"soba-org/repo1", "soba-org/repo2"}, names())
+	require.Equal(t, []int{http.StatusOK, http.StatusOK, http.StatusNotModified, http.StatusNotModified}, statuses())
+
+	// nothing is cached without a cache directory
+	g.ListCacheDir = ""
+
+	require.Equal(t, []string{"soba-org/repo1", "soba-org/repo2"}, names())
+	require.Equal(t, []int{http.StatusOK, http.StatusOK}, statuses()[4:])
+}
+
+func TestBitbucketListCache(t *testing.T) {
+	t.Parallel()
+
+	srv, statuses := newListCacheServer(t, func(srvURL string) map[string]string {
+		return map[string]string{
+			"":  bitbucketTestRepos(srvURL+"/repositories/ws-one?page=2", "ws-one/repo-one", "ONE"),
+			"2": bitbucketTestRepos("", "ws-one/repo-two", "ONE"),
+		}
+	}, func(string, string) string { return "" })
+
+	_, testLogger := newTestLogger()
+
+	bb, err := NewBitBucketHost(NewBitBucketHostInput{
+		APIURL:       srv.URL,
+		User:         "user",
+		Key:          "key",
+		Secret:       "secret",
+		Logger:       testLogger,
+		Workspaces:   []string{"ws-one"},
+		ListCacheDir: t.TempDir(),
+	})
+	require.NoError(t, err)
+
+	paths := func() []string {
+		desc, lErr := bb.listRepos(context.Background(), "test-token")
+		require.NoError(t, lErr)
+
+		var p []string
+		for _, repo := range desc.Repos {
+			p = append(p, repo.PathWithNameSpace)
+		}
+
+		return p
+	}
+
+	require.Equal(t, []string{"ws-one/repo-one", "ws-one/repo-two"}, paths())
+	require.Equal(t, []string{"ws-one/repo-one", "ws-one/repo-two"}, paths())
+	require.Equal(t, []int{http.StatusOK, http.StatusOK, http.StatusNotModified, http.StatusNotModified}, statuses())
+}
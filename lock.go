@@ -0,0 +1,113 @@
+package githosts
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	// lockFileName is the file in the backup directory held while it's being backed up to
+	lockFileName = ".githosts.lock"
+	// lockRetryInterval is how often a held lock is retried while waiting for it
+	lockRetryInterval = 100 * time.Millisecond
+)
+
+var errBackupInProgress = errors.Base("another backup is in progress")
+
+// acquireBackupLock creates the lock file in backupDIR, so overlapping backups to the same
+// directory don't clobber each other's working directories, and returns the function that
+// releases it. If the lock is held, it's retried until the timeout passes. A lock left by a backup
+// that didn't finish must be removed by hand.
+func acquireBackupLock(ctx context.Context, backupDIR string, timeout time.Duration) (func(), errors.E) {
+	if err := createDirIfAbsent(backupDIR); err != nil {
+		return nil, errors.Errorf("failed to create backup directory: %s", err)
+	}
+
+	lockPath := filepath.Join(backupDIR, lockFileName)
+	deadline := time.Now().Add(timeout)
+
+	for {
+		file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, manifestFileMode)
+		if err == nil {
+			// the holder is recorded to help identify a lock left behind
+			_, _ = fmt.Fprintf(file, "pid %d started %s\n", os.Getpid(), time.Now().Format(time.RFC3339))
+			_ = file.Close()
+
+			return func() {
+				_ = os.Remove(lockPath)
+			}, nil
+		}
+
+		if !os.IsExist(err) {
+			return nil, errors.Errorf("failed to create lock file: %s", err)
+		}
+
+		if !time.Now().Before(deadline) {
+			return nil, errors.Errorf("%w: %s is locked", errBackupInProgress, lockPath)
+		}
+
+		if sErr := sleepWithContext(ctx, min(lockRetryInterval, time.Until(deadline))); sErr != nil {
+			return nil, errors.Errorf("%w: %s is locked", errBackupInProgress, lockPath)
+		}
+	}
+}
+
+// acquireBackupLocks acquires the locks of the hosts' backup directories, each once however many
+// hosts back up to it, waiting for each up to the longest of their hosts' timeouts. It returns the
+// function that releases them.
+func acquireBackupLocks(ctx context.Context, hosts []GitProvider) (func(), errors.E) {
+	timeouts := map[string]time.Duration{}
+
+	for _, host := range hosts {
+		dir, timeout := host.backupLock()
+		if dir == "" {
+			continue
+		}
+
+		dir = filepath.Clean(dir)
+		timeouts[dir] = max(timeouts[dir], timeout)
+	}
+
+	dirs := make([]string, 0, len(timeouts))
+	for dir := range timeouts {
+		dirs = append(dirs, dir)
+	}
+
+	// the locks are acquired in the same order by every run, so overlapping runs can't deadlock
+	sort.Strings(dirs)
+
+	var releases []func()
+
+	release := func() {
+		for _, r := range releases {
+			r()
+		}
+	}
+
+	for _, dir := range dirs {
+		r, err := acquireBackupLock(ctx, dir, timeouts[dir])
+		if err != nil {
+			release()
+
+			return nil, err
+		}
+
+		releases = append(releases, r)
+	}
+
+	return release, nil
+}
+
+func validLockTimeout(timeout time.Duration) error {
+	if timeout < 0 {
+		return errors.Errorf("invalid lock timeout: %s", timeout)
+	}
+
+	return nil
+}
@@ -0,0 +1,112 @@
+package githosts
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/tozd/go/errors"
+)
+
+func TestAcquireBackupLock(t *testing.T) {
+	t.Parallel()
+
+	backupDir := filepath.Join(t.TempDir(), "backups")
+
+	release1, err := acquireBackupLock(context.Background(), backupDir, 0)
+	require.NoError(t, err)
+	require.FileExists(t, filepath.Join(backupDir, lockFileName))
+
+	// a held lock fails fast without a timeout
+	_, err = acquireBackupLock(context.Background(), backupDir, 0)
+	require.True(t, errors.Is(err, errBackupInProgress))
+
+	// a held lock is waited for until released
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		release1()
+	}()
+
+	start := time.Now()
+
+	release2, err := acquireBackupLock(context.Background(), backupDir, time.Minute)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, time.Since(start), 200*time.Millisecond)
+
+	// waiting ends with the context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = acquireBackupLock(ctx, backupDir, time.Minute)
+	require.True(t, errors.Is(err, errBackupInProgress))
+
+	release2()
+	require.NoFileExists(t, filepath.Join(backupDir, lockFileName))
+}
+
+func TestBackupFailsWhileLocked(t *testing.T) {
+	t.Parallel()
+
+	repoDir := setupTestRepo(t)
+	backupDir := t.TempDir()
+
+	second, err := NewGenericHost(NewGenericHostInput{
+		BackupDir: backupDir,
+		URLs:      []string{"file://" + repoDir},
+	})
+	require.NoError(t, err)
+
+	var secondResult ProviderBackupResult
+
+	// the second backup is run while the first holds the lock
+	first, err := NewGenericHost(NewGenericHostInput{
+		BackupDir: backupDir,
+		URLs:      []string{"file://" + repoDir},
+		Progress: func(int, int, string) {
+			start := time.Now()
+			secondResult = second.Backup()
+			require.Less(t, time.Since(start), 5*time.Second)
+		},
+	})
+	require.NoError(t, err)
+
+	result := first.Backup()
+	require.NoError(t, result.Error)
+	require.Equal(t, statusOk, result.BackupResults[0].Status)
+
+	require.True(t, errors.Is(secondResult.Error, errBackupInProgress))
+	require.Empty(t, secondResult.BackupResults)
+
+	// the lock is released once the first backup completes
+	require.NoFileExists(t, filepath.Join(backupDir, lockFileName))
+	require.NoError(t, second.Backup().Error)
+
+	// hosts backed up together to the same directory share its lock
+	results := BackupAll([]GitProvider{first, second}, 0)
+	require.Len(t, results, 2)
+
+	for _, r := range results {
+		require.NoError(t, r.Error)
+	}
+}
+
+func TestBackupSingleRepoFailsWhileLocked(t *testing.T) {
+	t.Parallel()
+
+	repoDir := setupTestRepo(t)
+	backupDir := t.TempDir()
+
+	release, err := acquireBackupLock(context.Background(), backupDir, 0)
+	require.NoError(t, err)
+
+	result := BackupSingleRepo(SingleRepoInput{CloneURL: "file://" + repoDir, BackupDir: backupDir})
+	require.Equal(t, statusFailed, result.Status)
+	require.True(t, errors.Is(result.Error, errBackupInProgress))
+
+	release()
+
+	result = BackupSingleRepo(SingleRepoInput{CloneURL: "file://" + repoDir, BackupDir: backupDir})
+	require.NoError(t, result.Error)
+}
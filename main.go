@@ -7,19 +7,39 @@ import (
 )
 
 const (
-	workingDIRName               = ".working"
-	maxIdleConns                 = 10
-	idleConnTimeout              = 30 * time.Second
-	defaultHttpRequestTimeout    = 30 * time.Second
-	defaultHttpClientTimeout     = 10 * time.Second
-	timeStampFormat              = "20060102150405"
-	bitbucketAPIURL              = "https://api.bitbucket.org/2.0"
-	githubAPIURL                 = "https://api.github.com/graphql"
-	gitlabAPIURL                 = "https://gitlab.com/api/v4"
-	gitlabProjectsPerPageDefault = 20
-	contentTypeApplicationJSON   = "application/json; charset=utf-8"
+	workingDIRName                = ".working"
+	maxIdleConns                  = 10
+	idleConnTimeout               = 30 * time.Second
+	defaultHttpRequestTimeout     = 30 * time.Second
+	defaultHttpClientTimeout      = 10 * time.Second
+	timeStampFormat               = "20060102150405"
+	bitbucketAPIURL               = "https://api.bitbucket.org/2.0"
+	githubAPIURL                  = "https://api.github.com/graphql"
+	gitlabAPIURL                  = "https://gitlab.com/api/v4"
+	gitlabProjectsPerPageDefault  = 20
+	contentTypeApplicationJSON    = "application/json; charset=utf-8"
+	defaultMaxConcurrentAzure     = 10
+	defaultMaxConcurrentBitbucket = 5
+	defaultMaxConcurrentGeneric   = 5
+	defaultMaxConcurrentGitea     = 5
+	defaultMaxConcurrentGitHub    = 10
+	defaultMaxConcurrentGitLab    = 5
+	defaultRetryMax               = 2
+	defaultCloneRetries           = 2
+	defaultRetryWaitMinSeconds    = 60
+	defaultRetryWaitMaxSeconds    = 120
+	defaultRepoBackupTimeout      = 60 * time.Minute
+	defaultFlatLayoutSeparator    = "__"
+	// disableRetries, set as a retry count, disables the retries otherwise made by default
+	disableRetries = -1
 )
 
+// Logger is the interface that output is logged through. It's satisfied by *log.Logger.
+type Logger interface {
+	Printf(format string, v ...any)
+	Println(v ...any)
+}
+
 var logger *log.Logger
 
 func init() {
@@ -28,3 +48,12 @@ func init() {
 		logger = log.New(os.Stdout, logEntryPrefix, log.Lshortfile|log.LstdFlags)
 	}
 }
+
+// getLogger returns the logger, or the package's default if not specified.
+func getLogger(l Logger) Logger {
+	if l == nil {
+		return logger
+	}
+
+	return l
+}
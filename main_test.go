@@ -1,6 +1,7 @@
 package githosts
 
 import (
+	"bytes"
 	"log"
 	"os"
 	"slices"
@@ -39,6 +40,14 @@ func preflight() {
 	}
 }
 
+// newTestLogger returns a logger for a single test, along with the buffer it writes to, so that
+// tests can check the output without sharing the package's logger.
+func newTestLogger() (*bytes.Buffer, Logger) {
+	var buf bytes.Buffer
+
+	return &buf, log.New(&buf, logEntryPrefix, log.Lshortfile|log.LstdFlags)
+}
+
 func resetGlobals() {
 	// reset global var
 	numUserDefinedProviders = 0
@@ -70,8 +79,25 @@ func unsetEnvVars(exceptionList []string) {
 	}
 }
 
+// dirContents returns the entries in path, excluding the files accompanying bundles, such as
+// manifests and checksums.
 func dirContents(path string) ([]os.DirEntry, error) {
-	return os.ReadDir(path)
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var contents []os.DirEntry
+
+	for _, entry := range entries {
+		if !slices.ContainsFunc(sidecarExtensions, func(ext string) bool {
+			return strings.HasSuffix(entry.Name(), ext)
+		}) {
+			contents = append(contents, entry)
+		}
+	}
+
+	return contents, nil
 }
 
 func resetBackups() {
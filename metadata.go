@@ -0,0 +1,61 @@
+package githosts
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// repoMetadataFileName is the file in the repository's backup path its metadata is written to.
+const repoMetadataFileName = "metadata.json"
+
+// RepoMetadata describes a repository beyond its code, as returned by the provider when it was
+// last backed up.
+type RepoMetadata struct {
+	Repo          string   `json:"repo"`
+	Description   string   `json:"description"`
+	Topics        []string `json:"topics"`
+	DefaultBranch string   `json:"default_branch,omitempty"`
+	Visibility    string   `json:"visibility,omitempty"`
+}
+
+// writeRepoMetadata writes the repository's metadata to its backup path, replacing that of the
+// previous backup.
+func writeRepoMetadata(backupPath string, repo repository) errors.E {
+	metadata := RepoMetadata{
+		Repo:          repo.PathWithNameSpace,
+		Description:   repo.Description,
+		Topics:        repo.Topics,
+		DefaultBranch: repo.DefaultBranch,
+		Visibility:    repo.Visibility,
+	}
+
+	// an empty list, rather than null, is recorded for a repository without topics
+	if metadata.Topics == nil {
+		metadata.Topics = []string{}
+	}
+
+	data, err := json.MarshalIndent(metadata, "", "  ")
+	if err != nil {
+		return errors.Errorf("failed to marshal repository metadata: %s", err)
+	}
+
+	if err = createDirIfAbsent(backupPath); err != nil {
+		return errors.Errorf("failed to create backup directory: %s: %s", backupPath, err)
+	}
+
+	metadataPath := filepath.Join(backupPath, repoMetadataFileName)
+
+	// the previous metadata is kept if the new can't be written in full
+	if err = os.WriteFile(metadataPath+partialExtension, data, manifestFileMode); err != nil {
+		return errors.Errorf("failed to write repository metadata: %s", err)
+	}
+
+	if err = os.Rename(metadataPath+partialExtension, metadataPath); err != nil {
+		return errors.Errorf("failed to write repository metadata: %s", err)
+	}
+
+	return nil
+}
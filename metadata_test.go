@@ -0,0 +1,86 @@
+package githosts
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGitHubBackupMetadata(t *testing.T) {
+	t.Parallel()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/graphql":
+			_, _ = w.Write([]byte(`{"data":{"viewer":{"repositories":{"edges":[` +
+				`{"node":{"name":"repo","nameWithOwner":"owner/repo","description":"A repository","visibility":"PRIVATE",` +
+				`"defaultBranchRef":{"name":"main"},"repositoryTopics":{"nodes":[{"topic":{"name":"go"}},{"topic":{"name":"backup"}}]}}},` +
+				`{"node":{"name":"empty","nameWithOwner":"owner/empty","visibility":"PUBLIC","defaultBranchRef":null,"repositoryTopics":{"nodes":[]}}}` +
+				`],"pageInfo":{"hasNextPage":false}}}}}`))
+		case "/api/v3/user/repos":
+			_, _ = w.Write([]byte(`[{"name":"repo","full_name":"owner/repo","description":"A repository",` +
+				`"topics":["go","backup"],"default_branch":"main","visibility":"private"}]`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	gh, err := NewGitHubHost(NewGitHubHostInput{APIURL: srv.URL, Token: "test-token", BackupMetadata: true})
+	require.NoError(t, err)
+
+	repos, dErr := gh.describeGithubUserRepos(context.Background())
+	require.NoError(t, dErr)
+	require.Len(t, repos, 2)
+	require.Empty(t, repos[1].Topics)
+	require.Empty(t, repos[1].DefaultBranch)
+
+	// the REST API returns the same metadata
+	restRepos, dErr := gh.describeGithubUserReposREST(context.Background())
+	require.NoError(t, dErr)
+	require.Len(t, restRepos, 1)
+	require.Equal(t, repos[0].Topics, restRepos[0].Topics)
+	require.Equal(t, repos[0].DefaultBranch, restRepos[0].DefaultBranch)
+	require.Equal(t, repos[0].Visibility, restRepos[0].Visibility)
+
+	// the metadata is written alongside the bundles
+	repo := repos[0]
+	repo.Domain = "local"
+	repo.HTTPSUrl = "file://" + setupTestRepo(t)
+
+	in := gh.backupInput()
+	in.BackupDIR = t.TempDir()
+	in.Repo = repo
+
+	result := backupRepository(context.Background(), gitHubProviderName, in)
+	require.NoError(t, result.Error)
+
+	backupPath := filepath.Join(in.BackupDIR, "local", "owner", "repo")
+
+	data, rErr := os.ReadFile(filepath.Join(backupPath, repoMetadataFileName))
+	require.NoError(t, rErr)
+
+	var metadata RepoMetadata
+	require.NoError(t, json.Unmarshal(data, &metadata))
+	require.Equal(t, RepoMetadata{
+		Repo:          "owner/repo",
+		Description:   "A repository",
+		Topics:        []string{"go", "backup"},
+		DefaultBranch: "main",
+		Visibility:    "private",
+	}, metadata)
+
+	// the metadata isn't mistaken for a backup
+	results, vErr := VerifyBackup(in.BackupDIR)
+	require.NoError(t, vErr)
+	require.Len(t, results, 1)
+
+	gh.BackupMetadata = false
+	require.False(t, gh.backupInput().BackupMetadata)
+}
@@ -0,0 +1,111 @@
+package githosts
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	// metricsFileMode allows the metrics to be read by a collector running as another user
+	metricsFileMode = 0o644
+	msPerSecond     = 1000
+)
+
+// labelValueEscaper escapes label values as required by the Prometheus text format.
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// WriteMetricsFile writes metrics describing the backup results to the file at path, in the
+// Prometheus text format read by the node exporter's textfile collector. The file is replaced
+// in one step so that the collector never reads a partially written file.
+func WriteMetricsFile(path string, results []ProviderBackupResult) error {
+	if path == "" {
+		return errors.New("metrics file not specified")
+	}
+
+	dir := filepath.Dir(path)
+
+	if err := createDirIfAbsent(dir); err != nil {
+		return errors.Errorf("failed to create metrics directory: %s: %s", dir, err)
+	}
+
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(path)+".*")
+	if err != nil {
+		return errors.Errorf("failed to create metrics file: %s", err)
+	}
+
+	defer os.Remove(tmp.Name())
+
+	if _, err = tmp.WriteString(formatMetrics(results, time.Now())); err != nil {
+		_ = tmp.Close()
+
+		return errors.Errorf("failed to write metrics file: %s", err)
+	}
+
+	if err = tmp.Close(); err != nil {
+		return errors.Errorf("failed to write metrics file: %s", err)
+	}
+
+	if err = os.Chmod(tmp.Name(), metricsFileMode); err != nil {
+		return errors.Errorf("failed to set metrics file mode: %s", err)
+	}
+
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return errors.Errorf("failed to write metrics file: %s", err)
+	}
+
+	return nil
+}
+
+// formatMetrics returns the metrics of the backup results, completed at the time specified.
+func formatMetrics(results []ProviderBackupResult, completed time.Time) string {
+	var total, failed int
+
+	var durations, sizes strings.Builder
+
+	for _, providerResult := range results {
+		for _, res := range providerResult.BackupResults {
+			total++
+
+			if res.Status == statusFailed {
+				failed++
+			}
+
+			// repositories in a dry run aren't backed up so have no duration or size
+			if res.Status != statusOk && res.Status != statusFailed {
+				continue
+			}
+
+			labels := fmt.Sprintf(`{domain="%s",path="%s"}`, labelValueEscaper.Replace(res.Domain), labelValueEscaper.Replace(res.Repo))
+
+			durations.WriteString("githosts_repo_backup_duration_seconds" + labels + " " +
+				strconv.FormatFloat(float64(res.DurationMs)/msPerSecond, 'f', -1, 64) + "\n")
+			sizes.WriteString("githosts_repo_bundle_bytes" + labels + " " + strconv.FormatInt(res.BundleBytes, 10) + "\n")
+		}
+	}
+
+	var b strings.Builder
+
+	b.WriteString("# HELP githosts_repos_total Number of repositories backed up.\n")
+	b.WriteString("# TYPE githosts_repos_total gauge\n")
+	b.WriteString("githosts_repos_total " + strconv.Itoa(total) + "\n")
+	b.WriteString("# HELP githosts_repos_failed Number of repositories that failed to back up.\n")
+	b.WriteString("# TYPE githosts_repos_failed gauge\n")
+	b.WriteString("githosts_repos_failed " + strconv.Itoa(failed) + "\n")
+	b.WriteString("# HELP githosts_repo_backup_duration_seconds Time taken to back up the repository.\n")
+	b.WriteString("# TYPE githosts_repo_backup_duration_seconds gauge\n")
+	b.WriteString(durations.String())
+	b.WriteString("# HELP githosts_repo_bundle_bytes Size of the repository's latest bundle.\n")
+	b.WriteString("# TYPE githosts_repo_bundle_bytes gauge\n")
+	b.WriteString(sizes.String())
+	b.WriteString("# HELP githosts_last_backup_timestamp Time the backup completed, in seconds since the epoch.\n")
+	b.WriteString("# TYPE githosts_last_backup_timestamp gauge\n")
+	b.WriteString("githosts_last_backup_timestamp " + strconv.FormatInt(completed.Unix(), 10) + "\n")
+
+	return b.String()
+}
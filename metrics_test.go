@@ -0,0 +1,93 @@
+package githosts
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"gitlab.com/tozd/go/errors"
+)
+
+// parseMetrics returns the value of each sample in the metrics, keyed by its name and labels.
+func parseMetrics(t *testing.T, metrics string) map[string]string {
+	t.Helper()
+
+	samples := map[string]string{}
+
+	for _, line := range strings.Split(strings.TrimSpace(metrics), "\n") {
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		idx := strings.LastIndex(line, " ")
+		require.Positive(t, idx, line)
+
+		_, err := strconv.ParseFloat(line[idx+1:], 64)
+		require.NoError(t, err, line)
+
+		samples[line[:idx]] = line[idx+1:]
+	}
+
+	return samples
+}
+
+func TestWriteMetricsFile(t *testing.T) {
+	t.Parallel()
+
+	results := []ProviderBackupResult{
+		{
+			BackupResults: []RepoBackupResults{
+				{Repo: "owner/one", Domain: gitHubDomain, Status: statusOk, Updated: true, BundleBytes: 2048, DurationMs: 1500},
+				{Repo: `owner/"quoted"\repo`, Domain: gitHubDomain, Status: statusFailed, Error: errors.New("cloning failed"), DurationMs: 250},
+			},
+		},
+		{
+			BackupResults: []RepoBackupResults{
+				{Repo: "group/two", Domain: gitLabDomain, Status: statusOk, Skipped: true, BundleBytes: 512, DurationMs: 100},
+			},
+		},
+	}
+
+	path := filepath.Join(t.TempDir(), "collector", "githosts.prom")
+
+	before := time.Now().Unix()
+
+	require.NoError(t, WriteMetricsFile(path, results))
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+
+	metrics := string(data)
+	require.Contains(t, metrics, "# TYPE githosts_repos_total gauge\n")
+	require.Contains(t, metrics, "# TYPE githosts_repo_backup_duration_seconds gauge\n")
+
+	samples := parseMetrics(t, metrics)
+
+	lastBackup, err := strconv.ParseInt(samples["githosts_last_backup_timestamp"], 10, 64)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, lastBackup, before)
+
+	delete(samples, "githosts_last_backup_timestamp")
+
+	require.Equal(t, map[string]string{
+		"githosts_repos_total":  "3",
+		"githosts_repos_failed": "1",
+		`githosts_repo_backup_duration_seconds{domain="github.com",path="owner/one"}`:              "1.5",
+		`githosts_repo_backup_duration_seconds{domain="github.com",path="owner/\"quoted\"\\repo"}`: "0.25",
+		`githosts_repo_backup_duration_seconds{domain="gitlab.com",path="group/two"}`:              "0.1",
+		`githosts_repo_bundle_bytes{domain="github.com",path="owner/one"}`:                         "2048",
+		`githosts_repo_bundle_bytes{domain="github.com",path="owner/\"quoted\"\\repo"}`:            "0",
+		`githosts_repo_bundle_bytes{domain="gitlab.com",path="group/two"}`:                         "512",
+	}, samples)
+
+	// only the metrics file remains
+	entries, err := os.ReadDir(filepath.Dir(path))
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+
+	require.ErrorContains(t, WriteMetricsFile("", results), "metrics file not specified")
+}
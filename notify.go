@@ -0,0 +1,109 @@
+package githosts
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+
+	"github.com/hashicorp/go-retryablehttp"
+	"gitlab.com/tozd/go/errors"
+)
+
+// BackupNotification is the summary of a provider's backup posted to the notification webhook.
+// It contains repository paths only so that credentials in clone URLs can't be included.
+type BackupNotification struct {
+	Provider    string   `json:"provider"`
+	TotalRepos  int      `json:"total_repos"`
+	Succeeded   int      `json:"succeeded"`
+	Failed      int      `json:"failed"`
+	FailedRepos []string `json:"failed_repos"`
+	Error       string   `json:"error,omitempty"` // error preventing the provider's repositories from being backed up
+}
+
+func validNotifyWebhookURL(webhookURL string) error {
+	if webhookURL == "" {
+		return nil
+	}
+
+	u, err := url.Parse(webhookURL)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return errors.New("invalid notification webhook URL")
+	}
+
+	return nil
+}
+
+func newBackupNotification(provider string, result ProviderBackupResult) BackupNotification {
+	notification := BackupNotification{
+		Provider:    provider,
+		TotalRepos:  len(result.BackupResults),
+		FailedRepos: []string{},
+	}
+
+	for _, res := range result.BackupResults {
+		if res.Status == statusFailed {
+			notification.Failed++
+			notification.FailedRepos = append(notification.FailedRepos, res.Repo)
+
+			continue
+		}
+
+		notification.Succeeded++
+	}
+
+	if result.Error != nil {
+		notification.Error = maskURLSecrets(result.Error.Error())
+	}
+
+	return notification
+}
+
+// notifyWebhook posts a summary of the backup result to the webhook, if specified. Failures are
+// logged only, as the backup itself is unaffected.
+func notifyWebhook(ctx context.Context, logger Logger, client *retryablehttp.Client, webhookURL, provider string, result ProviderBackupResult) {
+	if webhookURL == "" {
+		return
+	}
+
+	if client == nil {
+		client = getHTTPClient(0, 0, 0, "", nil)
+	}
+
+	body, err := json.Marshal(newBackupNotification(provider, result))
+	if err != nil {
+		logger.Printf("failed to marshal backup notification: %s", err)
+
+		return
+	}
+
+	// the notification is still sent if the backup was cancelled
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), defaultHttpRequestTimeout)
+	defer cancel()
+
+	req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodPost, webhookURL, bytes.NewReader(body))
+	if err != nil {
+		// webhook URLs commonly embed a token
+		logger.Printf("failed to create backup notification request: %s", maskSecrets(err.Error(), []string{webhookURL}))
+
+		return
+	}
+
+	req.Header.Set("Content-Type", contentTypeApplicationJSON)
+
+	resp, err := client.Do(req)
+	if err != nil {
+		logger.Printf("failed to send backup notification: %s", maskSecrets(err.Error(), []string{webhookURL}))
+
+		return
+	}
+
+	_, _ = io.Copy(io.Discard, resp.Body)
+	_ = resp.Body.Close()
+
+	if resp.StatusCode < http.StatusOK || resp.StatusCode >= http.StatusMultipleChoices {
+		logger.Printf("backup notification rejected: %s", resp.Status)
+	}
+}
@@ -0,0 +1,104 @@
+package githosts
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// sidecarExtensions are the extensions of the files accompanying a bundle.
+var sidecarExtensions = []string{manifestExtension, bundleExtension + checksumExtension, compressedBundleExtension + checksumExtension}
+
+// CleanOrphans removes the manifests and checksums in the backup directory whose bundle no longer
+// exists, e.g. as it was pruned or renamed as invalid, and returns their paths. It shouldn't be run
+// during a backup, as a new bundle's manifest is moved into place before the bundle itself.
+func CleanOrphans(backupDir string) ([]string, error) {
+	if backupDir == "" {
+		return nil, errors.New("backup directory not specified")
+	}
+
+	var removed []string
+
+	err := filepath.WalkDir(backupDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.IsDir() {
+			return nil
+		}
+
+		// working clones and release assets are not backups
+		if d.Name() == workingDIRName || isReleasesDir(path, d) {
+			return filepath.SkipDir
+		}
+
+		orphans, err := getOrphans(path)
+		if err != nil {
+			return err
+		}
+
+		for _, orphan := range orphans {
+			if err = os.Remove(orphan); err != nil {
+				return err
+			}
+
+			removed = append(removed, orphan)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return removed, errors.Errorf("failed to clean orphaned files: %s", err)
+	}
+
+	return removed, nil
+}
+
+// getOrphans returns the paths of the files in backupPath accompanying a bundle that doesn't exist.
+func getOrphans(backupPath string) ([]string, error) {
+	entries, err := os.ReadDir(backupPath)
+	if err != nil {
+		return nil, err
+	}
+
+	bundles := make(map[time.Time]bool)
+
+	var sidecars []string
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+
+		if isBundleFileName(entry.Name()) {
+			if ts, ok := generationTimeStamp(entry.Name()); ok {
+				bundles[ts] = true
+			}
+
+			continue
+		}
+
+		for _, ext := range sidecarExtensions {
+			if strings.HasSuffix(entry.Name(), ext) {
+				sidecars = append(sidecars, entry.Name())
+
+				break
+			}
+		}
+	}
+
+	var orphans []string
+
+	for _, name := range sidecars {
+		if ts, ok := generationTimeStamp(name); ok && !bundles[ts] {
+			orphans = append(orphans, filepath.Join(backupPath, name))
+		}
+	}
+
+	return orphans, nil
+}
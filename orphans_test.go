@@ -0,0 +1,68 @@
+package githosts
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCleanOrphans(t *testing.T) {
+	t.Parallel()
+
+	backupDir := t.TempDir()
+
+	writeFile := func(path string) string {
+		require.NoError(t, os.MkdirAll(filepath.Dir(path), 0o755))
+		require.NoError(t, os.WriteFile(path, []byte("content"), 0o600))
+
+		return path
+	}
+
+	repoPath := filepath.Join(backupDir, gitHubDomain, "owner", "repo")
+
+	kept := []string{
+		// a complete backup
+		writeFile(filepath.Join(repoPath, "repo.20200101111111.bundle")),
+		writeFile(filepath.Join(repoPath, "repo.20200101111111.manifest")),
+		writeFile(filepath.Join(repoPath, "repo.20200101111111.bundle.sha256")),
+		// a bundle without a manifest, as created before manifests were written
+		writeFile(filepath.Join(repoPath, "repo.20200201111111.bundle")),
+		// invalid bundles are left for inspection
+		writeFile(filepath.Join(repoPath, "repo.20200301111111.bundle.invalid")),
+		// unrelated files are left alone
+		writeFile(filepath.Join(repoPath, "notes.txt")),
+		// working clones aren't backups
+		writeFile(filepath.Join(backupDir, workingDIRName, gitHubDomain, "owner", "repo", "repo.20200501111111.manifest")),
+	}
+
+	orphans := []string{
+		// the sidecars of a bundle renamed as invalid
+		writeFile(filepath.Join(repoPath, "repo.20200301111111.manifest")),
+		writeFile(filepath.Join(repoPath, "repo.20200301111111.bundle.sha256")),
+		// the manifest of a pruned bundle
+		writeFile(filepath.Join(repoPath, "repo.20200401111111.manifest")),
+		writeFile(filepath.Join(backupDir, gitLabDomain, "group", "other", "other.20200101111111.bundle.sha256")),
+	}
+
+	removed, err := CleanOrphans(backupDir)
+	require.NoError(t, err)
+	require.ElementsMatch(t, orphans, removed)
+
+	for _, path := range kept {
+		require.FileExists(t, path)
+	}
+
+	for _, path := range orphans {
+		require.NoFileExists(t, path)
+	}
+
+	// nothing is left to remove
+	removed, err = CleanOrphans(backupDir)
+	require.NoError(t, err)
+	require.Empty(t, removed)
+
+	_, err = CleanOrphans("")
+	require.Error(t, err)
+}
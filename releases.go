@@ -0,0 +1,265 @@
+package githosts
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/hashicorp/go-retryablehttp"
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	// releasesDIRName is the directory in a repository's backup path its releases are kept in, as
+	// releases/<tag>/<asset>
+	releasesDIRName = "releases"
+	// releaseManifestName is the name of the manifest of the assets in the releases directory
+	releaseManifestName = "manifest.json"
+)
+
+// release is a release of a repository with the files uploaded to it.
+type release struct {
+	Tag    string
+	Assets []releaseAsset
+}
+
+// releaseAsset is a file uploaded to a release. Its size is zero if the provider doesn't report it.
+type releaseAsset struct {
+	Name string
+	URL  string
+	Size int64
+}
+
+// releaseSource lists the releases of a host's repositories and downloads their assets.
+type releaseSource interface {
+	listReleases(ctx context.Context, repo repository) ([]release, errors.E)
+	downloadAsset(ctx context.Context, asset releaseAsset, w io.Writer) errors.E
+}
+
+// ReleaseManifest describes the release assets downloaded for a repository.
+type ReleaseManifest struct {
+	Assets []ReleaseManifestAsset `json:"assets"`
+}
+
+// ReleaseManifestAsset describes a release asset, kept in releases/<tag>/<file>.
+type ReleaseManifestAsset struct {
+	Tag    string `json:"tag"`
+	Name   string `json:"name"`
+	File   string `json:"file"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// backupReleases downloads the assets of the repository's releases to the releases directory in
+// backupPath, and records them in its manifest. Assets already downloaded, of the size reported,
+// aren't downloaded again.
+func backupReleases(ctx context.Context, logger Logger, source releaseSource, backupPath string, repo repository) errors.E {
+	releases, err := source.listReleases(ctx, repo)
+	if err != nil {
+		return err
+	}
+
+	if len(releases) == 0 {
+		return nil
+	}
+
+	releasesPath := filepath.Join(backupPath, releasesDIRName)
+	manifestPath := filepath.Join(releasesPath, releaseManifestName)
+
+	// a missing or unreadable manifest only means every asset is downloaded
+	previous, _ := readReleaseManifest(manifestPath)
+
+	downloaded := make(map[string]ReleaseManifestAsset, len(previous.Assets))
+	for _, asset := range previous.Assets {
+		downloaded[asset.File] = asset
+	}
+
+	var manifest ReleaseManifest
+
+	// the manifest records the assets downloaded even if others fail
+	dErr := downloadReleases(ctx, logger, source, releasesPath, repo, releases, downloaded, &manifest)
+
+	if len(manifest.Assets) == 0 {
+		return dErr
+	}
+
+	data, mErr := json.MarshalIndent(manifest, "", "  ")
+	if mErr != nil {
+		return errors.Errorf("failed to marshal release manifest: %s", mErr)
+	}
+
+	if wErr := os.WriteFile(manifestPath, data, manifestFileMode); wErr != nil {
+		return errors.Errorf("failed to write release manifest: %s", wErr)
+	}
+
+	return dErr
+}
+
+// downloadReleases downloads the assets of the releases to releasesPath, other than those already
+// downloaded, adding each to the manifest. An asset that fails to download doesn't stop the rest,
+// and keeps its entry from the previous manifest if its earlier download is still in place.
+func downloadReleases(ctx context.Context, logger Logger, source releaseSource, releasesPath string, repo repository, releases []release, downloaded map[string]ReleaseManifestAsset, manifest *ReleaseManifest) errors.E {
+	var errs []error
+
+	for _, rel := range releases {
+		for _, asset := range rel.Assets {
+			file := filepath.ToSlash(filepath.Join(safePathElement(rel.Tag), safePathElement(asset.Name)))
+			assetPath := filepath.Join(releasesPath, file)
+
+			prev, ok := downloaded[file]
+			prevInPlace := ok && getFileSize(logger, assetPath) == prev.Size
+
+			if prevInPlace && (asset.Size == 0 || asset.Size == prev.Size) {
+				manifest.Assets = append(manifest.Assets, prev)
+
+				continue
+			}
+
+			logger.Printf("downloading %s repo '%s' release %s asset: %s", repo.Domain, repo.PathWithNameSpace, rel.Tag, asset.Name)
+
+			size, hash, dErr := downloadReleaseAsset(ctx, source, asset, assetPath)
+			if dErr != nil {
+				errs = append(errs, dErr)
+
+				if prevInPlace {
+					manifest.Assets = append(manifest.Assets, prev)
+				}
+
+				continue
+			}
+
+			manifest.Assets = append(manifest.Assets, ReleaseManifestAsset{
+				Tag:    rel.Tag,
+				Name:   asset.Name,
+				File:   file,
+				Size:   size,
+				SHA256: hash,
+			})
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// isReleasesDir returns whether the directory holds the assets of a repository's releases, rather
+// than the backups of a repository named releases.
+func isReleasesDir(path string, d fs.DirEntry) bool {
+	if !d.IsDir() || d.Name() != releasesDIRName {
+		return false
+	}
+
+	_, err := os.Stat(filepath.Join(path, releaseManifestName))
+
+	return err == nil
+}
+
+// downloadReleaseAsset downloads the asset to assetPath and returns its size and SHA-256 hash. The
+// asset is only given its name once complete, so a partial download is never mistaken for it.
+func downloadReleaseAsset(ctx context.Context, source releaseSource, asset releaseAsset, assetPath string) (int64, string, errors.E) {
+	if err := createDirIfAbsent(filepath.Dir(assetPath)); err != nil {
+		return 0, "", errors.Errorf("failed to create release directory: %s", err)
+	}
+
+	partialPath := assetPath + partialExtension
+
+	file, err := os.OpenFile(partialPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, manifestFileMode)
+	if err != nil {
+		return 0, "", errors.Errorf("failed to create release asset: %s", err)
+	}
+
+	hash := sha256.New()
+	counter := &countingWriter{}
+
+	dErr := source.downloadAsset(ctx, asset, io.MultiWriter(file, hash, counter))
+
+	if cErr := file.Close(); dErr == nil && cErr != nil {
+		dErr = errors.Errorf("failed to write release asset: %s", cErr)
+	}
+
+	if dErr != nil {
+		_ = os.Remove(partialPath)
+
+		return 0, "", dErr
+	}
+
+	if rErr := os.Rename(partialPath, assetPath); rErr != nil {
+		return 0, "", errors.Errorf("failed to move release asset: %s", rErr)
+	}
+
+	return counter.n, hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// downloadURL writes the body of the response to a GET request for reqURL, made with the headers
+// specified, to w.
+func downloadURL(ctx context.Context, client *retryablehttp.Client, reqURL string, header http.Header, w io.Writer) errors.E {
+	req, err := retryablehttp.NewRequestWithContext(ctx, http.MethodGet, reqURL, nil)
+	if err != nil {
+		return errors.Wrap(err, "failed to create request")
+	}
+
+	for key, values := range header {
+		req.Header[key] = values
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return errors.Wrap(err, "failed to make request")
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errors.Errorf("failed to download %s: %s", reqURL, resp.Status)
+	}
+
+	if _, err = io.Copy(w, resp.Body); err != nil {
+		return errors.Errorf("failed to download %s: %s", reqURL, err)
+	}
+
+	return nil
+}
+
+func readReleaseManifest(manifestPath string) (ReleaseManifest, errors.E) {
+	var manifest ReleaseManifest
+
+	data, err := os.ReadFile(manifestPath)
+	if err != nil {
+		return manifest, errors.Wrap(err, "failed to read release manifest")
+	}
+
+	if err = json.Unmarshal(data, &manifest); err != nil {
+		return manifest, errors.Wrap(err, "failed to unmarshal release manifest")
+	}
+
+	return manifest, nil
+}
+
+// safePathElement returns the name as a single element of a path, so tags and asset names can't
+// refer to files outside their directory.
+func safePathElement(name string) string {
+	name = strings.NewReplacer("/", "_", `\`, "_").Replace(name)
+
+	if name == "" || name == "." || name == ".." || name == releaseManifestName {
+		return "_" + name
+	}
+
+	return name
+}
+
+// countingWriter counts the bytes written to it.
+type countingWriter struct {
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+
+	return len(p), nil
+}
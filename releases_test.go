@@ -0,0 +1,279 @@
+package githosts
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/tozd/go/errors"
+)
+
+func TestGitHubBackupReleases(t *testing.T) {
+	t.Parallel()
+
+	var (
+		srvURL    string
+		downloads atomic.Int32
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "bearer test-token", r.Header.Get("Authorization"))
+
+		switch r.URL.Path {
+		case "/api/v3/repos/owner/repo/releases":
+			_, _ = w.Write([]byte(`[{"tag_name":"v1.0.0","assets":[` +
+				`{"name":"app-linux.tar.gz","url":"` + srvURL + `/api/v3/assets/1","size":5},` +
+				`{"name":"checksums.txt","url":"` + srvURL + `/api/v3/assets/2","size":12}]},` +
+				`{"tag_name":"v0.1.0","assets":[]}]`))
+		case "/api/v3/assets/1":
+			assert.Equal(t, "application/octet-stream", r.Header.Get("Accept"))
+			downloads.Add(1)
+			_, _ = w.Write([]byte("12345"))
+		case "/api/v3/assets/2":
+			downloads.Add(1)
+			_, _ = w.Write([]byte("abc  app.tgz"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	srvURL = srv.URL
+
+	gh, err := NewGitHubHost(NewGitHubHostInput{
+		APIURL:         srv.URL,
+		Token:          "test-token",
+		BackupReleases: true,
+	})
+	require.NoError(t, err)
+	require.NotNil(t, gh.backupInput().Releases)
+
+	backupPath := t.TempDir()
+	repo := repository{PathWithNameSpace: "owner/repo", Domain: gitHubDomain}
+
+	for range 2 {
+		require.NoError(t, backupReleases(context.Background(), logger, gh, backupPath, repo))
+	}
+
+	// assets already downloaded aren't downloaded again
+	require.Equal(t, int32(2), downloads.Load())
+
+	releasesPath := filepath.Join(backupPath, releasesDIRName)
+
+	for name, size := range map[string]int64{"app-linux.tar.gz": 5, "checksums.txt": 12} {
+		info, sErr := os.Stat(filepath.Join(releasesPath, "v1.0.0", name))
+		require.NoError(t, sErr)
+		require.Equal(t, size, info.Size())
+	}
+
+	manifest, mErr := readReleaseManifest(filepath.Join(releasesPath, releaseManifestName))
+	require.NoError(t, mErr)
+	require.Len(t, manifest.Assets, 2)
+	require.Equal(t, ReleaseManifestAsset{
+		Tag:    "v1.0.0",
+		Name:   "app-linux.tar.gz",
+		File:   "v1.0.0/app-linux.tar.gz",
+		Size:   5,
+		SHA256: "5994471abb01112afcc18159f6cc74b4f511b99806da59b3caf5a9c173cacfc5",
+	}, manifest.Assets[0])
+
+	// the releases aren't mistaken for backups
+	require.False(t, dirHasBundles(logger, releasesPath))
+
+	gh.BackupReleases = false
+	require.Nil(t, gh.backupInput().Releases)
+}
+
+func TestGitLabBackupReleases(t *testing.T) {
+	t.Parallel()
+
+	var srvURL string
+
+	external := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the token is only sent to the GitLab instance
+		assert.Empty(t, r.Header.Get("Private-Token"))
+		_, _ = w.Write([]byte("external"))
+	}))
+	defer external.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "test-token", r.Header.Get("Private-Token"))
+
+		switch r.URL.EscapedPath() {
+		case "/projects/group%2Fproject/releases":
+			_, _ = w.Write([]byte(`[{"tag_name":"release/1","assets":{"links":[` +
+				`{"name":"package.zip","url":"` + srvURL + `/uploads/package.zip","direct_asset_url":"` + srvURL + `/downloads/package.zip"},` +
+				`{"name":"docs.pdf","url":"` + external.URL + `/docs.pdf"}]}}]`))
+		case "/downloads/package.zip":
+			_, _ = w.Write([]byte("package"))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	srvURL = srv.URL
+
+	gl, err := NewGitLabHost(NewGitLabHostInput{
+		APIURL:         srv.URL,
+		Token:          "test-token",
+		BackupReleases: true,
+	})
+	require.NoError(t, err)
+
+	backupPath := t.TempDir()
+	repo := repository{PathWithNameSpace: "group/project", Domain: gitLabDomain}
+
+	require.NoError(t, backupReleases(context.Background(), logger, gl, backupPath, repo))
+
+	// tags with slashes are kept in a single directory
+	tagPath := filepath.Join(backupPath, releasesDIRName, "release_1")
+
+	data, rErr := os.ReadFile(filepath.Join(tagPath, "package.zip"))
+	require.NoError(t, rErr)
+	require.Equal(t, "package", string(data))
+
+	data, rErr = os.ReadFile(filepath.Join(tagPath, "docs.pdf"))
+	require.NoError(t, rErr)
+	require.Equal(t, "external", string(data))
+}
+
+// testReleaseSource is a source of a single release with an asset of the content specified.
+type testReleaseSource struct {
+	content string
+	err     errors.E
+}
+
+func (s testReleaseSource) listReleases(context.Context, repository) ([]release, errors.E) {
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	return []release{{Tag: "v1", Assets: []releaseAsset{{Name: "asset.bin", Size: int64(len(s.content))}}}}, nil
+}
+
+func (s testReleaseSource) downloadAsset(_ context.Context, _ releaseAsset, w io.Writer) errors.E {
+	_, err := w.Write([]byte(s.content))
+
+	return errors.WithStack(err)
+}
+
+func TestBackupRepositoryWithReleases(t *testing.T) {
+	t.Parallel()
+
+	repoDir := setupTestRepo(t)
+	backupDir := t.TempDir()
+
+	in := processBackupInput{
+		Repo: repository{
+			Name:              "repo",
+			PathWithNameSpace: "owner/repo",
+			Domain:            "local",
+			HTTPSUrl:          "file://" + repoDir,
+		},
+		BackupDIR: backupDir,
+		Releases:  testReleaseSource{content: "binary"},
+	}
+
+	result := backupRepository(context.Background(), genericProviderName, in)
+	require.NoError(t, result.Error)
+	require.Equal(t, statusOk, result.Status)
+
+	backupPath := filepath.Join(backupDir, "local", "owner", "repo")
+	require.FileExists(t, filepath.Join(backupPath, releasesDIRName, "v1", "asset.bin"))
+
+	// pruning and verification leave the releases alone
+	require.NoError(t, pruneBackups(logger, []string{backupPath}, 1))
+	require.FileExists(t, filepath.Join(backupPath, releasesDIRName, "v1", "asset.bin"))
+
+	results, err := VerifyBackup(backupDir)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+
+	data, rErr := os.ReadFile(filepath.Join(backupPath, releasesDIRName, releaseManifestName))
+	require.NoError(t, rErr)
+
+	var manifest ReleaseManifest
+	require.NoError(t, json.Unmarshal(data, &manifest))
+	require.Equal(t, int64(6), manifest.Assets[0].Size)
+
+	// failing to list releases fails the repository's backup in the releases phase
+	in.Releases = testReleaseSource{err: errors.New("releases unavailable")}
+
+	result = backupRepository(context.Background(), genericProviderName, in)
+	require.Equal(t, statusFailed, result.Status)
+
+	var backupErr *BackupError
+
+	require.ErrorAs(t, result.Error, &backupErr)
+	require.Equal(t, BackupPhaseReleases, backupErr.Phase)
+	require.ErrorContains(t, result.Error, "releases unavailable")
+}
+
+// testAssetsReleaseSource is a source of a single release with the assets specified, each of
+// content its name, other than those that fail to download.
+type testAssetsReleaseSource struct {
+	assets  []releaseAsset
+	failing map[string]bool
+}
+
+func (s testAssetsReleaseSource) listReleases(context.Context, repository) ([]release, errors.E) {
+	return []release{{Tag: "v1", Assets: s.assets}}, nil
+}
+
+func (s testAssetsReleaseSource) downloadAsset(_ context.Context, asset releaseAsset, w io.Writer) errors.E {
+	if s.failing[asset.Name] {
+		return errors.Errorf("failed to download %s", asset.Name)
+	}
+
+	_, err := w.Write([]byte(asset.Name))
+
+	return errors.WithStack(err)
+}
+
+func TestBackupReleasesDownloadFailure(t *testing.T) {
+	t.Parallel()
+
+	backupPath := t.TempDir()
+	repo := repository{PathWithNameSpace: "owner/repo", Domain: "local"}
+	manifestPath := filepath.Join(backupPath, releasesDIRName, releaseManifestName)
+
+	manifestFiles := func() []string {
+		t.Helper()
+
+		manifest, err := readReleaseManifest(manifestPath)
+		require.NoError(t, err)
+
+		files := make([]string, 0, len(manifest.Assets))
+		for _, asset := range manifest.Assets {
+			files = append(files, asset.File)
+		}
+
+		return files
+	}
+
+	// the assets after one that fails are still downloaded and recorded
+	source := testAssetsReleaseSource{
+		assets:  []releaseAsset{{Name: "first"}, {Name: "second", Size: 6}, {Name: "third"}},
+		failing: map[string]bool{"first": true},
+	}
+
+	require.ErrorContains(t, backupReleases(context.Background(), logger, source, backupPath, repo), "failed to download first")
+	require.Equal(t, []string{"v1/second", "v1/third"}, manifestFiles())
+
+	// an asset that changed but fails to download again keeps its earlier download's entry
+	source.assets[1].Size = 7
+	source.failing = map[string]bool{"second": true}
+
+	require.ErrorContains(t, backupReleases(context.Background(), logger, source, backupPath, repo), "failed to download second")
+	require.Equal(t, []string{"v1/first", "v1/second", "v1/third"}, manifestFiles())
+	require.FileExists(t, filepath.Join(backupPath, releasesDIRName, "v1", "second"))
+}
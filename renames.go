@@ -0,0 +1,172 @@
+package githosts
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// repoIDIndex maps the IDs of repositories, recorded in the manifests of their latest bundles, to
+// the directories holding their backups. It's built on first use, so the backup directory is walked
+// once per backup however many repositories are checked for having been renamed.
+type repoIDIndex struct {
+	once  sync.Once
+	mu    sync.Mutex
+	paths map[string][]string
+}
+
+// newRepoIDIndex returns the index of the host's backups by repository ID, or nil if renamed
+// repositories aren't detected.
+func newRepoIDIndex(detectRenames bool) *repoIDIndex {
+	if !detectRenames {
+		return nil
+	}
+
+	return &repoIDIndex{}
+}
+
+// build indexes the backups under backupDIR, once. Directories of either layout, and in any date
+// directory, are indexed so backups are also found after switching between them.
+func (x *repoIDIndex) build(backupDIR string) {
+	x.once.Do(func() {
+		x.paths = map[string][]string{}
+
+		_ = filepath.WalkDir(backupDIR, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || !d.IsDir() {
+				return nil
+			}
+
+			if d.Name() == workingDIRName || isReleasesDir(path, d) {
+				return filepath.SkipDir
+			}
+
+			latest, lErr := getLatestBundlePath(path)
+			if lErr != nil {
+				return nil
+			}
+
+			manifest, mErr := readBundleManifest(manifestPathForBundle(latest))
+			if mErr == nil && manifest.RepoID != "" {
+				x.paths[manifest.RepoID] = append(x.paths[manifest.RepoID], path)
+			}
+
+			return nil
+		})
+	})
+}
+
+// find returns the directory under root, other than backupPath, holding backups of the repository
+// on the same domain, or an empty string if there isn't one.
+func (x *repoIDIndex) find(backupDIR, root, backupPath string, repo repository, flatLayoutSeparator string) string {
+	x.build(backupDIR)
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	for _, path := range x.paths[repo.ID] {
+		if path == backupPath || !inDomainBackupDir(root, path, repo.Domain, flatLayoutSeparator) {
+			continue
+		}
+
+		return path
+	}
+
+	return ""
+}
+
+// moved records that the backups at previousPath have been moved to backupPath.
+func (x *repoIDIndex) moved(id, previousPath, backupPath string) {
+	x.mu.Lock()
+	defer x.mu.Unlock()
+
+	x.paths[id] = append(slices.DeleteFunc(x.paths[id], func(path string) bool {
+		return path == previousPath
+	}), backupPath)
+}
+
+// inDomainBackupDir returns whether path is a directory under root of the domain's backups: within
+// its directory or, with the flat layout, one named after it.
+func inDomainBackupDir(root, path, domain, flatLayoutSeparator string) bool {
+	rel, err := filepath.Rel(root, path)
+	if err != nil {
+		return false
+	}
+
+	top, _, _ := strings.Cut(filepath.ToSlash(rel), "/")
+	if top == ".." {
+		return false
+	}
+
+	if flatLayoutSeparator == "" {
+		flatLayoutSeparator = defaultFlatLayoutSeparator
+	}
+
+	return top == domain || strings.HasPrefix(top, domain+flatLayoutSeparator)
+}
+
+// migrateRenamedBackup moves the backups of a renamed repository from the directory of its
+// previous path under root to backupPath, finding them by the repository ID recorded in their
+// manifests. Nothing is moved if the repository's ID isn't known or it already has backups at
+// backupPath.
+func migrateRenamedBackup(logger Logger, in processBackupInput, root, backupPath string) errors.E {
+	repo := in.Repo
+
+	if repo.ID == "" || dirHasBundles(logger, backupPath) {
+		return nil
+	}
+
+	index := in.RepoIDs
+	if index == nil {
+		index = &repoIDIndex{}
+	}
+
+	previousPath := index.find(in.BackupDIR, root, backupPath, repo, in.FlatLayoutSeparator)
+	if previousPath == "" {
+		return nil
+	}
+
+	// a directory left by an earlier backup without bundles is replaced
+	if err := os.Remove(backupPath); err != nil && !os.IsNotExist(err) {
+		return errors.Errorf("failed to remove backup directory: %s: %s", backupPath, err)
+	}
+
+	if err := createDirIfAbsent(filepath.Dir(backupPath)); err != nil {
+		return errors.Errorf("failed to create backup directory: %s: %s", filepath.Dir(backupPath), err)
+	}
+
+	if err := os.Rename(previousPath, backupPath); err != nil {
+		return errors.Errorf("failed to move backups of renamed repository: %s", err)
+	}
+
+	index.moved(repo.ID, previousPath, backupPath)
+
+	logger.Printf("moved backups of renamed %s repo '%s' from %s", repo.Domain, repo.PathWithNameSpace, previousPath)
+
+	removeEmptyParents(logger, filepath.Dir(previousPath), root)
+
+	return nil
+}
+
+// removeEmptyParents removes dir, and then each of its parents up to, but excluding, root, until
+// one isn't empty.
+func removeEmptyParents(logger Logger, dir, root string) {
+	for dir != root && strings.HasPrefix(dir, root) {
+		entries, err := os.ReadDir(dir)
+		if err != nil || len(entries) > 0 {
+			return
+		}
+
+		if err = os.Remove(dir); err != nil {
+			logger.Printf("failed to remove empty backup directory: %s", err)
+
+			return
+		}
+
+		dir = filepath.Dir(dir)
+	}
+}
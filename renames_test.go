@@ -0,0 +1,148 @@
+package githosts
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessBackupDetectsRename(t *testing.T) {
+	t.Parallel()
+
+	repoDir := setupTestRepo(t)
+	backupDir := t.TempDir()
+
+	repo := repository{
+		ID:                "42",
+		Name:              "old",
+		PathWithNameSpace: "owner/old",
+		Domain:            "local",
+		HTTPSUrl:          "file://" + repoDir,
+	}
+
+	_, err := processBackup(context.Background(), processBackupInput{Repo: repo, BackupDIR: backupDir, DetectRenames: true})
+	require.NoError(t, err)
+
+	oldPath := filepath.Join(backupDir, "local", "owner", "old")
+	latest, lErr := getLatestBundlePath(oldPath)
+	require.NoError(t, lErr)
+
+	manifest, mErr := readBundleManifest(manifestPathForBundle(latest))
+	require.NoError(t, mErr)
+	require.Equal(t, "42", manifest.RepoID)
+
+	// the same repository under a new path
+	renamed := repo
+	renamed.Name = "new"
+	renamed.PathWithNameSpace = "renamed-owner/new"
+
+	result, err := processBackup(context.Background(), processBackupInput{Repo: renamed, BackupDIR: backupDir, DetectRenames: true})
+	require.NoError(t, err)
+	require.True(t, result.Skipped)
+	require.Equal(t, skipReasonDuplicateBundle, result.SkipReason)
+
+	bundles, bErr := getBundleFiles(filepath.Join(backupDir, "local", "renamed-owner", "new"))
+	require.NoError(t, bErr)
+	require.Len(t, bundles, 1)
+
+	// the old directories are removed once empty
+	_, sErr := os.Stat(filepath.Join(backupDir, "local", "owner"))
+	require.True(t, os.IsNotExist(sErr))
+}
+
+func TestProcessBackupRenameNotDetected(t *testing.T) {
+	t.Parallel()
+
+	repoDir := setupTestRepo(t)
+
+	repo := repository{
+		ID:                "42",
+		Name:              "old",
+		PathWithNameSpace: "owner/old",
+		Domain:            "local",
+		HTTPSUrl:          "file://" + repoDir,
+	}
+
+	for _, tc := range []struct {
+		name          string
+		id            string
+		detectRenames bool
+	}{
+		{name: "disabled", id: "42"},
+		{name: "different id", id: "43", detectRenames: true},
+		{name: "unknown id", detectRenames: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			backupDir := t.TempDir()
+
+			_, err := processBackup(context.Background(), processBackupInput{Repo: repo, BackupDIR: backupDir})
+			require.NoError(t, err)
+
+			other := repo
+			other.ID = tc.id
+			other.PathWithNameSpace = "owner/new"
+
+			result, err := processBackup(context.Background(), processBackupInput{Repo: other, BackupDIR: backupDir, DetectRenames: tc.detectRenames})
+			require.NoError(t, err)
+			require.True(t, result.Updated)
+
+			// the backups of the original path are left in place
+			require.True(t, dirHasBundles(logger, filepath.Join(backupDir, "local", "owner", "old")))
+		})
+	}
+}
+
+func TestFindRepoBackupPathAcrossLayouts(t *testing.T) {
+	t.Parallel()
+
+	repoDir := setupTestRepo(t)
+	backupDir := t.TempDir()
+
+	repo := repository{
+		ID:                "42",
+		Name:              "repo",
+		PathWithNameSpace: "owner/repo",
+		Domain:            "local",
+		HTTPSUrl:          "file://" + repoDir,
+	}
+
+	_, err := processBackup(context.Background(), processBackupInput{Repo: repo, BackupDIR: backupDir, FlatLayout: true})
+	require.NoError(t, err)
+
+	flatPath := filepath.Join(backupDir, "local__owner__repo")
+	index := &repoIDIndex{}
+	require.Equal(t, flatPath, index.find(backupDir, backupDir, filepath.Join(backupDir, "local", "owner", "renamed"), repo, ""))
+
+	// the same ID on another domain is a different repository, even one the domain prefixes
+	other := repo
+	other.Domain = "example.com"
+	require.Empty(t, index.find(backupDir, backupDir, filepath.Join(backupDir, "example.com", "owner", "repo"), other, ""))
+
+	other.Domain = "loc"
+	require.Empty(t, index.find(backupDir, backupDir, filepath.Join(backupDir, "loc", "owner", "repo"), other, ""))
+
+	// those moved are found at their new path
+	index.moved(repo.ID, flatPath, filepath.Join(backupDir, "local", "owner", "moved"))
+	require.Equal(t, filepath.Join(backupDir, "local", "owner", "moved"),
+		index.find(backupDir, backupDir, filepath.Join(backupDir, "local", "owner", "renamed"), repo, ""))
+}
+
+func TestInDomainBackupDir(t *testing.T) {
+	t.Parallel()
+
+	root := filepath.Join("backups", "2024-01-01")
+
+	require.True(t, inDomainBackupDir(root, filepath.Join(root, "gitlab.com", "owner", "repo"), "gitlab.com", ""))
+	require.True(t, inDomainBackupDir(root, filepath.Join(root, "gitlab.com__owner__repo"), "gitlab.com", ""))
+	require.True(t, inDomainBackupDir(root, filepath.Join(root, "gitlab.com--owner--repo"), "gitlab.com", "--"))
+	require.False(t, inDomainBackupDir(root, filepath.Join(root, "gitlab.company.com", "owner", "repo"), "gitlab.com", ""))
+	require.False(t, inDomainBackupDir(root, filepath.Join(root, "gitlab.company.com__owner__repo"), "gitlab.com", ""))
+
+	// nor are those outside the root, such as in other date directories
+	require.False(t, inDomainBackupDir(root, filepath.Join("backups", "2024-01-02", "gitlab.com", "owner", "repo"), "gitlab.com", ""))
+}
@@ -0,0 +1,73 @@
+package githosts
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+type RestoreBundleInput struct {
+	// BundlePath is either a bundle file or a repository's backup directory, in which case
+	// the latest bundle is restored
+	BundlePath string
+	// TargetDir is the directory to clone the repository into and must not already contain files
+	TargetDir string
+	Logger    Logger
+}
+
+// RestoreBundle restores a repository from a bundle by cloning it into the target directory.
+func RestoreBundle(input RestoreBundleInput) error {
+	if input.BundlePath == "" {
+		return errors.New("bundle path not specified")
+	}
+
+	if input.TargetDir == "" {
+		return errors.New("target directory not specified")
+	}
+
+	info, err := os.Stat(input.BundlePath)
+	if err != nil {
+		return errors.Errorf("failed to read bundle path: %s", err)
+	}
+
+	bundlePath := input.BundlePath
+
+	if info.IsDir() {
+		bundlePath, err = getLatestBundlePath(input.BundlePath)
+		if err != nil {
+			return errors.Errorf("failed to find a bundle in %s: %s", input.BundlePath, err)
+		}
+	}
+
+	getLogger(input.Logger).Printf("restoring %s to %s", bundlePath, input.TargetDir)
+
+	readablePath, remove, rErr := readableBundlePath(bundlePath)
+	if rErr != nil {
+		return rErr
+	}
+
+	defer remove()
+
+	cloneCmd := exec.Command("git", "clone", readablePath, input.TargetDir)
+
+	if out, cloneErr := cloneCmd.CombinedOutput(); cloneErr != nil {
+		return errors.Errorf("failed to restore bundle: %s: %s: %s", bundlePath, strings.TrimSpace(string(out)), cloneErr)
+	}
+
+	// bundles don't record which branch HEAD referred to, so it's taken from the manifest, if any
+	manifest, mErr := readBundleManifest(manifestPathForBundle(bundlePath))
+	if mErr != nil || manifest.DefaultBranch == "" {
+		return nil
+	}
+
+	checkoutCmd := exec.Command("git", "checkout", manifest.DefaultBranch)
+	checkoutCmd.Dir = input.TargetDir
+
+	if out, checkoutErr := checkoutCmd.CombinedOutput(); checkoutErr != nil {
+		return errors.Errorf("failed to check out default branch: %s: %s: %s", manifest.DefaultBranch, strings.TrimSpace(string(out)), checkoutErr)
+	}
+
+	return nil
+}
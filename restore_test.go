@@ -0,0 +1,81 @@
+package githosts
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestoreBundle(t *testing.T) {
+	t.Parallel()
+
+	repoDir := setupTestRepo(t)
+	backupDir := t.TempDir()
+
+	gh, err := NewGenericHost(NewGenericHostInput{
+		BackupDir: backupDir,
+		URLs:      []string{"file://" + repoDir},
+	})
+	require.NoError(t, err)
+	require.NoError(t, gh.Backup().BackupResults[0].Error)
+
+	backupPath := filepath.Join(backupDir, genericLocalDomain, strings.Trim(repoDir, "/"))
+
+	// restore from the backup directory
+	targetDir := filepath.Join(t.TempDir(), "restored")
+	require.NoError(t, RestoreBundle(RestoreBundleInput{BundlePath: backupPath, TargetDir: targetDir}))
+
+	content, err := os.ReadFile(filepath.Join(targetDir, "test.txt"))
+	require.NoError(t, err)
+	require.Equal(t, txtSomeContent, string(content))
+
+	// restore from the bundle file
+	bundlePath, err := getLatestBundlePath(backupPath)
+	require.NoError(t, err)
+
+	targetDir = filepath.Join(t.TempDir(), "restored")
+	require.NoError(t, RestoreBundle(RestoreBundleInput{BundlePath: bundlePath, TargetDir: targetDir}))
+
+	content, err = os.ReadFile(filepath.Join(targetDir, "test.txt"))
+	require.NoError(t, err)
+	require.Equal(t, txtSomeContent, string(content))
+
+	// the target must not already contain files
+	require.Error(t, RestoreBundle(RestoreBundleInput{BundlePath: bundlePath, TargetDir: targetDir}))
+}
+
+func TestRestoreBundleChecksOutDefaultBranch(t *testing.T) {
+	t.Parallel()
+
+	repoDir := setupTestRepo(t)
+	runGitCmd(t, repoDir, "branch", "develop")
+	runGitCmd(t, repoDir, "symbolic-ref", "HEAD", "refs/heads/develop")
+
+	backupDir := t.TempDir()
+
+	gh, err := NewGenericHost(NewGenericHostInput{
+		BackupDir: backupDir,
+		URLs:      []string{"file://" + repoDir},
+	})
+	require.NoError(t, err)
+	require.NoError(t, gh.Backup().BackupResults[0].Error)
+
+	targetDir := filepath.Join(t.TempDir(), "restored")
+	require.NoError(t, RestoreBundle(RestoreBundleInput{
+		BundlePath: filepath.Join(backupDir, genericLocalDomain, strings.Trim(repoDir, "/")),
+		TargetDir:  targetDir,
+	}))
+
+	require.Equal(t, "develop", strings.TrimSpace(runGitCmd(t, targetDir, "symbolic-ref", "--short", "HEAD")))
+}
+
+func TestRestoreBundleInvalidInput(t *testing.T) {
+	t.Parallel()
+
+	require.ErrorContains(t, RestoreBundle(RestoreBundleInput{TargetDir: t.TempDir()}), "bundle path not specified")
+	require.ErrorContains(t, RestoreBundle(RestoreBundleInput{BundlePath: t.TempDir()}), "target directory not specified")
+	require.ErrorContains(t, RestoreBundle(RestoreBundleInput{BundlePath: t.TempDir(), TargetDir: t.TempDir()}), "failed to find a bundle")
+}
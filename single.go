@@ -0,0 +1,198 @@
+package githosts
+
+import (
+	"context"
+	"net/url"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// SingleRepoInput describes a repository to back up by its clone URL, without using a provider API.
+type SingleRepoInput struct {
+	Caller string
+	// CloneURL is the repository's clone URL in either URL or scp-like (user@host:path) form
+	CloneURL string
+	// Token, when set, authenticates HTTP(S) clones, with Username if the host requires one
+	Token                 string
+	Username              string
+	BackupDir             string
+	DiffRemoteMethod      string
+	BundleRefSpec         string
+	BundleNameTemplate    string
+	FlatLayout            bool
+	FlatLayoutSeparator   string
+	DateDirLayout         bool
+	PartialClone          bool
+	KeepWorkingDir        bool
+	VerifyAfterCreate     *bool // defaults to true
+	CompressBundles       bool
+	ArchivePerRepo        bool
+	KeepArchivedFiles     bool
+	SSHPrivateKeyPath     string
+	SSHKnownHostsPath     string
+	BackupsToRetain       int
+	KeepForDays           int
+	CloneRetries          int // defaults to 2, -1 disables retries
+	MinFreeDiskMB         int
+	LogLevel              int
+	Logger                Logger
+	RemoteStore           RemoteStore
+	RepoBackupTimeout     time.Duration
+	LockTimeout           time.Duration
+	GitBinaryPath         string
+	ExtraGitConfig        []string
+	ProxyURL              string
+	CACertPath            string
+	InsecureSkipTLSVerify bool
+}
+
+// BackupSingleRepo backs up the repository with the clone URL specified. Its backups are kept in
+// <backup dir>/<domain>/<path>, as if backed up by a GenericHost.
+func BackupSingleRepo(input SingleRepoInput) RepoBackupResults {
+	ctx := context.Background()
+
+	if input.Logger == nil {
+		setLoggerPrefix(input.Caller)
+	}
+
+	repo, err := singleRepository(input)
+	if err != nil {
+		return RepoBackupResults{
+			Repo:   redactURLCredentials(input.CloneURL),
+			Status: statusFailed,
+			Error:  err,
+		}
+	}
+
+	in, vErr := singleRepoBackupInput(input, repo)
+	if vErr != nil {
+		return RepoBackupResults{
+			Repo:   repo.PathWithNameSpace,
+			Domain: repo.Domain,
+			Status: statusFailed,
+			Error:  errors.WithStack(vErr),
+		}
+	}
+
+	release, lErr := acquireBackupLock(ctx, input.BackupDir, input.LockTimeout)
+	if lErr != nil {
+		return RepoBackupResults{
+			Repo:   repo.PathWithNameSpace,
+			Domain: repo.Domain,
+			Status: statusFailed,
+			Error:  lErr,
+		}
+	}
+
+	defer release()
+
+	result := backupRepository(ctx, genericProviderName, in)
+	if result.Error != nil {
+		getLogger(input.Logger).Printf("backup failed: %+v\n", result.Error)
+	}
+
+	return result
+}
+
+// singleRepository returns the repository described by the input's clone URL, with credentials
+// added to its HTTP(S) URL if a token was specified.
+func singleRepository(input SingleRepoInput) (repository, errors.E) {
+	repo, err := parseCloneURL(input.CloneURL)
+	if err != nil {
+		return repository{}, err
+	}
+
+	if input.Token == "" || repo.HTTPSUrl == "" {
+		return repo, nil
+	}
+
+	u, pErr := url.Parse(repo.HTTPSUrl)
+	if pErr != nil {
+		return repository{}, errors.Errorf("failed to parse repository URL: %s", pErr)
+	}
+
+	if input.Username == "" {
+		u.User = url.User(input.Token)
+		repo.URLWithToken = u.String()
+
+		return repo, nil
+	}
+
+	u.User = url.UserPassword(input.Username, input.Token)
+	repo.URLWithBasicAuth = u.String()
+
+	return repo, nil
+}
+
+// Validate checks the input's settings, returning an error listing each that's missing or invalid.
+func (input SingleRepoInput) Validate() error {
+	return errors.Join(
+		validRequired(input.BackupDir, "backup directory"),
+		validBackupDir(input.BackupDir),
+		validDiffRemoteMethodSetting(input.DiffRemoteMethod),
+		validBundleRefSpec(input.BundleRefSpec, nil),
+		validBundleNameTemplate(input.BundleNameTemplate),
+		validFlatLayoutSeparator(input.FlatLayoutSeparator),
+		validCloneRetries(input.CloneRetries),
+		validMinFreeDiskMB(input.MinFreeDiskMB),
+		validSSHAuth(input.SSHPrivateKeyPath, input.SSHKnownHostsPath),
+		validRepoBackupTimeout(input.RepoBackupTimeout),
+		validLockTimeout(input.LockTimeout),
+		validExtraGitConfig(input.ExtraGitConfig),
+		validProxyURL(input.ProxyURL),
+		validTLSConfig(input.CACertPath, input.InsecureSkipTLSVerify),
+	)
+}
+
+// singleRepoBackupInput validates the input's settings and returns the input to back up the
+// repository with.
+func singleRepoBackupInput(input SingleRepoInput, repo repository) (processBackupInput, error) {
+	if err := input.Validate(); err != nil {
+		return processBackupInput{}, err
+	}
+
+	diffRemoteMethod, err := getDiffRemoteMethod(getLogger(input.Logger), input.DiffRemoteMethod)
+	if err != nil {
+		return processBackupInput{}, err
+	}
+
+	bundleRefSpec, err := getBundleRefSpec(input.BundleRefSpec)
+	if err != nil {
+		return processBackupInput{}, err
+	}
+
+	return processBackupInput{
+		LogLevel:            input.LogLevel,
+		Logger:              input.Logger,
+		RemoteStore:         input.RemoteStore,
+		RepoBackupTimeout:   input.RepoBackupTimeout,
+		Repo:                repo,
+		BackupDIR:           input.BackupDir,
+		BackupsToKeep:       input.BackupsToRetain,
+		KeepForDays:         input.KeepForDays,
+		CloneRetries:        input.CloneRetries,
+		MinFreeDiskMB:       input.MinFreeDiskMB,
+		DiffRemoteMethod:    diffRemoteMethod,
+		BundleRefSpec:       bundleRefSpec,
+		BundleNameTemplate:  input.BundleNameTemplate,
+		FlatLayout:          input.FlatLayout,
+		FlatLayoutSeparator: input.FlatLayoutSeparator,
+		DateDir:             backupDateDir(input.DateDirLayout),
+		PartialClone:        input.PartialClone,
+		KeepWorkingDir:      input.KeepWorkingDir,
+		SkipVerify:          input.VerifyAfterCreate != nil && !*input.VerifyAfterCreate,
+		CompressBundles:     input.CompressBundles,
+		ArchivePerRepo:      input.ArchivePerRepo,
+		KeepArchivedFiles:   input.KeepArchivedFiles,
+		SSHPrivateKeyPath:   input.SSHPrivateKeyPath,
+		SSHKnownHostsPath:   input.SSHKnownHostsPath,
+		Git: gitOptions{
+			BinaryPath:            input.GitBinaryPath,
+			ExtraConfig:           input.ExtraGitConfig,
+			ProxyURL:              input.ProxyURL,
+			CACertPath:            input.CACertPath,
+			InsecureSkipTLSVerify: input.InsecureSkipTLSVerify,
+		},
+	}, nil
+}
@@ -0,0 +1,228 @@
+package githosts
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	s3Service         = "s3"
+	s3SigningAlgo     = "AWS4-HMAC-SHA256"
+	s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+	s3DateFormat      = "20060102"
+	s3DateTimeFormat  = "20060102T150405Z"
+)
+
+// RemoteStore is where bundles, and their manifests, are uploaded to once backed up.
+type RemoteStore interface {
+	Put(ctx context.Context, key string, r io.Reader) error
+}
+
+// S3Store uploads to a bucket of an S3-compatible object store.
+type S3Store struct {
+	Endpoint   *url.URL
+	Bucket     string
+	Region     string
+	AccessKey  string
+	SecretKey  string
+	HTTPClient *http.Client
+}
+
+// NewS3Store returns a store that uploads objects to the bucket using path-style requests, e.g.
+// https://s3.eu-west-1.amazonaws.com/bucket/key, signed with AWS Signature Version 4.
+func NewS3Store(endpoint, bucket, region, accessKey, secretKey string) (*S3Store, error) {
+	if endpoint == "" {
+		return nil, errors.New("S3 endpoint not specified")
+	}
+
+	if bucket == "" {
+		return nil, errors.New("S3 bucket not specified")
+	}
+
+	if region == "" {
+		return nil, errors.New("S3 region not specified")
+	}
+
+	if accessKey == "" || secretKey == "" {
+		return nil, errors.New("S3 access key and secret key must both be specified")
+	}
+
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "https://" + endpoint
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, errors.Errorf("failed to parse S3 endpoint: %s", err)
+	}
+
+	if u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, errors.Errorf("invalid S3 endpoint: %s", endpoint)
+	}
+
+	return &S3Store{
+		Endpoint:   u,
+		Bucket:     bucket,
+		Region:     region,
+		AccessKey:  accessKey,
+		SecretKey:  secretKey,
+		HTTPClient: &http.Client{},
+	}, nil
+}
+
+// Put uploads the content of r to the bucket with the key.
+func (s *S3Store) Put(ctx context.Context, key string, r io.Reader) error {
+	body, size, err := readerWithSize(r)
+	if err != nil {
+		return errors.Errorf("failed to read content for %s: %s", key, err)
+	}
+
+	objectURL := *s.Endpoint
+	objectURL.Path = strings.TrimSuffix(s.Endpoint.Path, "/") + "/" + s.Bucket + "/" + strings.TrimPrefix(key, "/")
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, objectURL.String(), body)
+	if err != nil {
+		return errors.Errorf("failed to create request: %s", err)
+	}
+
+	req.ContentLength = size
+
+	s.sign(req, time.Now().UTC())
+
+	resp, err := s.HTTPClient.Do(req)
+	if err != nil {
+		return errors.Errorf("failed to upload %s: %s", key, err)
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+
+		return errors.Errorf("failed to upload %s: %s: %s", key, resp.Status, strings.TrimSpace(string(respBody)))
+	}
+
+	return nil
+}
+
+// sign adds the headers that authenticate the request with AWS Signature Version 4. The payload
+// is left unsigned so that bundles don't need to be read twice.
+func (s *S3Store) sign(req *http.Request, now time.Time) {
+	amzDate := now.Format(s3DateTimeFormat)
+	scope := strings.Join([]string{now.Format(s3DateFormat), s.Region, s3Service, "aws4_request"}, "/")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + s3UnsignedPayload + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		s3UnsignedPayload,
+	}, "\n")
+
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+
+	stringToSign := strings.Join([]string{
+		s3SigningAlgo,
+		amzDate,
+		scope,
+		hex.EncodeToString(canonicalHash[:]),
+	}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+s.SecretKey), now.Format(s3DateFormat))
+	signingKey = hmacSHA256(signingKey, s.Region)
+	signingKey = hmacSHA256(signingKey, s3Service)
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", s3SigningAlgo+" Credential="+s.AccessKey+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+
+	return h.Sum(nil)
+}
+
+// readerWithSize returns the reader and the length of its remaining content, which S3 requires
+// up front. Content that can't be seeked, unlike files, is read into memory.
+func readerWithSize(r io.Reader) (io.Reader, int64, error) {
+	if seeker, ok := r.(io.Seeker); ok {
+		current, err := seeker.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		end, err := seeker.Seek(0, io.SeekEnd)
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if _, err = seeker.Seek(current, io.SeekStart); err != nil {
+			return nil, 0, err
+		}
+
+		return r, end - current, nil
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return bytes.NewReader(data), int64(len(data)), nil
+}
+
+// uploadBundle uploads the bundle and its manifest to the store, keyed by the prefix followed by
+// their paths relative to the backup directory, which begin with the repository's domain, e.g.
+// github.com/owner/repo/repo.20240101000000.bundle.
+func uploadBundle(ctx context.Context, store RemoteStore, keyPrefix, backupDIR, bundlePath string) errors.E {
+	for _, path := range []string{bundlePath, manifestPathForBundle(bundlePath)} {
+		rel, err := filepath.Rel(backupDIR, path)
+		if err != nil {
+			return errors.Errorf("failed to determine key for %s: %s", path, err)
+		}
+
+		key := filepath.ToSlash(filepath.Join(keyPrefix, rel))
+
+		if err = uploadFile(ctx, store, key, path); err != nil {
+			return errors.Errorf("failed to upload %s: %s", path, err)
+		}
+	}
+
+	return nil
+}
+
+func uploadFile(ctx context.Context, store RemoteStore, key, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+
+	defer f.Close()
+
+	return store.Put(ctx, key, f)
+}
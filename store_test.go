@@ -0,0 +1,168 @@
+package githosts
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gitlab.com/tozd/go/errors"
+)
+
+// memoryStore records the objects put to it, or fails every put if err is set.
+type memoryStore struct {
+	mu      sync.Mutex
+	objects map[string][]byte
+	err     error
+}
+
+func (m *memoryStore) Put(_ context.Context, key string, r io.Reader) error {
+	if m.err != nil {
+		return m.err
+	}
+
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.objects == nil {
+		m.objects = make(map[string][]byte)
+	}
+
+	m.objects[key] = data
+
+	return nil
+}
+
+func TestBackupUploadsToRemoteStore(t *testing.T) {
+	t.Parallel()
+
+	repoDir := setupTestRepo(t)
+	backupDir := t.TempDir()
+	store := &memoryStore{}
+
+	// hosts sharing the store, with and without a namespace prefix, back up the same repository
+	for _, prefix := range []string{"personal", ""} {
+		gh, err := NewGenericHost(NewGenericHostInput{
+			BackupDir:       backupDir,
+			NamespacePrefix: prefix,
+			URLs:            []string{"file://" + repoDir},
+			RemoteStore:     store,
+		})
+		require.NoError(t, err)
+
+		result := gh.Backup()
+		require.NoError(t, result.Error)
+		require.Equal(t, statusOk, result.BackupResults[0].Status)
+	}
+
+	repoPath := filepath.Join(genericLocalDomain, strings.Trim(repoDir, "/"))
+
+	// keys begin with the namespace prefix, if any, followed by the domain
+	for _, prefix := range []string{"personal", ""} {
+		bundlePath, err := getLatestBundlePath(filepath.Join(backupDir, prefix, repoPath))
+		require.NoError(t, err)
+
+		for _, path := range []string{bundlePath, manifestPathForBundle(bundlePath)} {
+			key := filepath.ToSlash(filepath.Join(prefix, repoPath, filepath.Base(path)))
+			require.Contains(t, store.objects, key)
+
+			local, rErr := os.ReadFile(path)
+			require.NoError(t, rErr)
+			require.Equal(t, local, store.objects[key])
+		}
+	}
+
+	require.Len(t, store.objects, 4)
+}
+
+func TestBackupUploadFailureKeepsLocalCopy(t *testing.T) {
+	t.Parallel()
+
+	repoDir := setupTestRepo(t)
+	backupDir := t.TempDir()
+
+	gh, err := NewGenericHost(NewGenericHostInput{
+		BackupDir:   backupDir,
+		URLs:        []string{"file://" + repoDir},
+		RemoteStore: &memoryStore{err: errors.New("store unavailable")},
+	})
+	require.NoError(t, err)
+
+	result := gh.Backup()
+	require.Equal(t, statusFailed, result.BackupResults[0].Status)
+	require.ErrorContains(t, result.BackupResults[0].Error, "store unavailable")
+	require.True(t, result.BackupResults[0].Updated)
+
+	_, err = getLatestBundlePath(filepath.Join(backupDir, genericLocalDomain, strings.Trim(repoDir, "/")))
+	require.NoError(t, err)
+}
+
+func TestS3StorePut(t *testing.T) {
+	t.Parallel()
+
+	var (
+		gotPath, gotAuth, gotDate, gotContentHash string
+		gotBody                                   []byte
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPut, r.Method)
+
+		gotPath = r.URL.Path
+		gotAuth = r.Header.Get("Authorization")
+		gotDate = r.Header.Get("X-Amz-Date")
+		gotContentHash = r.Header.Get("X-Amz-Content-Sha256")
+		gotBody, _ = io.ReadAll(r.Body)
+
+		if strings.HasSuffix(r.URL.Path, "denied") {
+			w.WriteHeader(http.StatusForbidden)
+			_, _ = w.Write([]byte("<Error><Code>AccessDenied</Code></Error>"))
+		}
+	}))
+	defer srv.Close()
+
+	store, err := NewS3Store(srv.URL, "backups", "eu-west-1", "access-key", "secret-key")
+	require.NoError(t, err)
+
+	require.NoError(t, store.Put(context.Background(), "github.com/owner/repo/repo.20240101000000.bundle", strings.NewReader("bundle")))
+	require.Equal(t, "/backups/github.com/owner/repo/repo.20240101000000.bundle", gotPath)
+	require.Equal(t, []byte("bundle"), gotBody)
+	require.Equal(t, s3UnsignedPayload, gotContentHash)
+	require.NotEmpty(t, gotDate)
+	require.True(t, strings.HasPrefix(gotAuth, "AWS4-HMAC-SHA256 Credential=access-key/"+gotDate[:8]+"/eu-west-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature="), gotAuth)
+	require.NotContains(t, gotAuth, "secret-key")
+
+	err = store.Put(context.Background(), "denied", strings.NewReader("bundle"))
+	require.ErrorContains(t, err, "AccessDenied")
+}
+
+func TestNewS3Store(t *testing.T) {
+	t.Parallel()
+
+	store, err := NewS3Store("s3.eu-west-1.amazonaws.com", "backups", "eu-west-1", "key", "secret")
+	require.NoError(t, err)
+	require.Equal(t, "https", store.Endpoint.Scheme)
+
+	_, err = NewS3Store("", "backups", "eu-west-1", "key", "secret")
+	require.Error(t, err)
+	_, err = NewS3Store("https://s3.example.com", "", "eu-west-1", "key", "secret")
+	require.Error(t, err)
+	_, err = NewS3Store("https://s3.example.com", "backups", "", "key", "secret")
+	require.Error(t, err)
+	_, err = NewS3Store("https://s3.example.com", "backups", "eu-west-1", "key", "")
+	require.Error(t, err)
+	_, err = NewS3Store("ftp://s3.example.com", "backups", "eu-west-1", "key", "secret")
+	require.Error(t, err)
+}
@@ -0,0 +1,215 @@
+package githosts
+
+import (
+	"context"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// submoduleJob is the repository of a submodule to back up. Those on the same host as the
+// repository they were found in are cloned with the host's credentials.
+type submoduleJob struct {
+	repo     repository
+	sameHost bool
+}
+
+// submoduleQueue collects the repositories of the submodules found while backing up a host's
+// repositories, each once however many repositories use it.
+type submoduleQueue struct {
+	mu      sync.Mutex
+	seen    map[string]bool
+	pending []submoduleJob
+}
+
+// newSubmoduleQueue returns the queue of the host's submodules, or nil if they're not backed up.
+// Submodules of the host's repositories are backed up with them, so aren't queued.
+func newSubmoduleQueue(backupSubmodules bool, repos []repository) *submoduleQueue {
+	if !backupSubmodules {
+		return nil
+	}
+
+	q := &submoduleQueue{seen: map[string]bool{}}
+
+	for _, repo := range repos {
+		q.seen[submoduleKey(repo)] = true
+	}
+
+	return q
+}
+
+// submoduleKey identifies the repository regardless of the URL it's cloned with.
+func submoduleKey(repo repository) string {
+	return strings.ToLower(repo.Domain + "/" + repo.PathWithNameSpace)
+}
+
+// add queues the jobs of repositories that haven't been seen before.
+func (q *submoduleQueue) add(jobs ...submoduleJob) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for _, job := range jobs {
+		key := submoduleKey(job.repo)
+		if q.seen[key] {
+			continue
+		}
+
+		q.seen[key] = true
+		q.pending = append(q.pending, job)
+	}
+}
+
+// take returns, and removes, the queued jobs.
+func (q *submoduleQueue) take() []submoduleJob {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	jobs := q.pending
+	q.pending = nil
+
+	return jobs
+}
+
+// findSubmodules returns the jobs of the submodules in .gitmodules of the default branch of the
+// repository cloned to workingPath. Relative URLs are resolved against the URL it was cloned from.
+func findSubmodules(ctx context.Context, logger Logger, in processBackupInput, workingPath string) []submoduleJob {
+	// a mirror clone has no working tree, so the file is read from the commit
+	configCmd := gitCommand(ctx, in.Git, "", "config", "--blob", "HEAD:.gitmodules", "--get-regexp", `^submodule\..*\.url$`)
+	configCmd.Dir = workingPath
+
+	// the file doesn't exist in repositories without submodules
+	out, err := configCmd.Output()
+	if err != nil {
+		return nil
+	}
+
+	parentURL := redactURLCredentials(getCloneURL(in.Repo, in.SSHPrivateKeyPath))
+
+	parent, pErr := parseCloneURL(parentURL)
+	if pErr != nil {
+		return nil
+	}
+
+	var jobs []submoduleJob
+
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		_, rawURL, found := strings.Cut(line, " ")
+		if !found {
+			continue
+		}
+
+		subURL := resolveSubmoduleURL(parentURL, strings.TrimSpace(rawURL))
+
+		repo, rErr := parseSubmoduleURL(parentURL, subURL)
+		if rErr != nil {
+			logger.Printf("skipping submodule of %s repo '%s': %s", in.Repo.Domain, in.Repo.PathWithNameSpace, rErr)
+
+			continue
+		}
+
+		job := submoduleJob{repo: repo, sameHost: repo.Domain == parent.Domain}
+
+		// the backups of those on the same host are kept alongside the repository's
+		if job.sameHost {
+			job.repo.Domain = in.Repo.Domain
+		}
+
+		jobs = append(jobs, job)
+	}
+
+	return jobs
+}
+
+// parseSubmoduleURL derives the repository of the submodule from its URL. As the URL comes from
+// the content of the repository, local repositories may only be referred to by those that are
+// themselves local, and paths leaving the domain's backup directory are refused.
+func parseSubmoduleURL(parentURL, subURL string) (repository, errors.E) {
+	if isLocalSubmoduleURL(subURL) && !strings.HasPrefix(parentURL, "file://") {
+		return repository{}, errors.Errorf("local submodule URL not permitted: %s", subURL)
+	}
+
+	// parseCloneURL refuses paths containing ..
+	return parseCloneURL(subURL)
+}
+
+// isLocalSubmoduleURL returns whether the URL refers to a repository on the local filesystem,
+// either with the file scheme or as a path, which git doesn't treat as scp-like syntax if a slash
+// precedes any colon.
+func isLocalSubmoduleURL(subURL string) bool {
+	if scheme, _, found := strings.Cut(subURL, "://"); found {
+		return strings.EqualFold(scheme, "file")
+	}
+
+	hostPart, _, found := strings.Cut(subURL, ":")
+
+	return !found || strings.Contains(hostPart, "/")
+}
+
+// resolveSubmoduleURL returns the submodule's URL, resolving one relative to the repository's, as
+// git does, e.g. ../lib.git of https://example.com/owner/app.git is https://example.com/owner/lib.git.
+func resolveSubmoduleURL(parentURL, subURL string) string {
+	if !strings.HasPrefix(subURL, "./") && !strings.HasPrefix(subURL, "../") {
+		return subURL
+	}
+
+	if u, err := url.Parse(parentURL); err == nil && u.Scheme != "" {
+		u.Path = path.Join(u.Path, subURL)
+
+		return u.String()
+	}
+
+	// scp-like syntax, e.g. git@example.com:owner/repo.git
+	host, repoPath, found := strings.Cut(parentURL, ":")
+	if !found {
+		return subURL
+	}
+
+	return host + ":" + path.Join(repoPath, subURL)
+}
+
+// backupSubmodules backs up the repositories of the submodules found while backing up the host's
+// repositories, and those of their own submodules, in turn, returning the results. Each holds a
+// token from cloneTokens, if specified, while in progress, and those on the host are prepared with
+// setupRepo, if specified. When failing fast, none are backed up after the first to fail.
+func backupSubmodules(ctx context.Context, provider string, in processBackupInput, setupRepo func(repository) repository, cloneTokens chan struct{}, failFast bool) []RepoBackupResults {
+	if in.Submodules == nil {
+		return nil
+	}
+
+	var results []RepoBackupResults
+
+	for {
+		jobs := in.Submodules.take()
+		if len(jobs) == 0 {
+			return results
+		}
+
+		for _, job := range jobs {
+			// credentials are only added to HTTPS URLs
+			repo := job.repo
+			if job.sameHost && repo.HTTPSUrl != "" && setupRepo != nil {
+				repo = setupRepo(repo)
+			}
+
+			release := acquireCloneToken(ctx, cloneTokens)
+
+			in.Repo = repo
+			result := backupRepository(ctx, provider, in)
+
+			release()
+
+			results = append(results, result)
+
+			if result.Error != nil {
+				getLogger(in.Logger).Printf("backup failed: %+v\n", result.Error)
+
+				if failFast {
+					return results
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package githosts
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolveSubmoduleURL(t *testing.T) {
+	t.Parallel()
+
+	for _, tc := range []struct {
+		parent, sub, expected string
+	}{
+		{"https://example.com/owner/app.git", "https://other.com/owner/lib.git", "https://other.com/owner/lib.git"},
+		{"https://example.com/owner/app.git", "../lib.git", "https://example.com/owner/lib.git"},
+		{"https://example.com/owner/app.git", "../../team/lib.git", "https://example.com/team/lib.git"},
+		{"https://example.com/owner/app.git", "./lib.git", "https://example.com/owner/app.git/lib.git"},
+		{"git@example.com:owner/app.git", "../lib.git", "git@example.com:owner/lib.git"},
+		{"file:///repos/owner/app", "../lib", "file:///repos/owner/lib"},
+	} {
+		require.Equal(t, tc.expected, resolveSubmoduleURL(tc.parent, tc.sub), tc.sub)
+	}
+}
+
+func TestParseSubmoduleURL(t *testing.T) {
+	t.Parallel()
+
+	repo, err := parseSubmoduleURL("https://example.com/owner/app.git", "https://other.com/owner/lib.git")
+	require.NoError(t, err)
+	require.Equal(t, "owner/lib", repo.PathWithNameSpace)
+
+	repo, err = parseSubmoduleURL("file:///repos/owner/app", "file:///repos/owner/lib")
+	require.NoError(t, err)
+	require.Equal(t, "repos/owner/lib", repo.PathWithNameSpace)
+
+	// local repositories can't be referred to by hosted ones
+	for _, subURL := range []string{"file:///etc/repo", "FILE:///etc/repo", "/etc/repo", "./repo/x:y"} {
+		_, err = parseSubmoduleURL("https://example.com/owner/app.git", subURL)
+		require.ErrorContains(t, err, "local submodule URL not permitted", subURL)
+	}
+
+	// nor can paths leave the domain's backup directory
+	_, err = parseSubmoduleURL("https://example.com/owner/app.git", "https://example.com/../../tmp/x")
+	require.ErrorContains(t, err, "must not contain '..'")
+}
+
+func TestGenericHostBackupSubmodules(t *testing.T) {
+	t.Parallel()
+
+	// the library is used by both applications, one referring to it relative to its own URL
+	reposDir := t.TempDir()
+	libDir := filepath.Join(reposDir, "lib")
+	appOneDir := filepath.Join(reposDir, "app-one")
+	appTwoDir := filepath.Join(reposDir, "app-two")
+
+	for _, dir := range []string{libDir, appOneDir, appTwoDir} {
+		runGitCmd(t, reposDir, "init", "-b", "main", dir)
+		runGitCmd(t, dir, "commit", "--allow-empty", "-m", "initial commit")
+	}
+
+	runGitCmd(t, appOneDir, "-c", "protocol.file.allow=always", "submodule", "add", "file://"+libDir, "lib")
+	runGitCmd(t, appOneDir, "commit", "-m", "add lib")
+	runGitCmd(t, appTwoDir, "-c", "protocol.file.allow=always", "submodule", "add", "file://"+libDir, "lib")
+	runGitCmd(t, appTwoDir, "config", "--file", ".gitmodules", "submodule.lib.url", "../lib")
+	runGitCmd(t, appTwoDir, "commit", "-am", "add lib")
+
+	backup := func(backupSubmodules bool, dirs ...string) []RepoBackupResults {
+		var urls []string
+		for _, dir := range dirs {
+			urls = append(urls, "file://"+dir)
+		}
+
+		gh, err := NewGenericHost(NewGenericHostInput{
+			BackupDir:        t.TempDir(),
+			URLs:             urls,
+			BackupSubmodules: backupSubmodules,
+		})
+		require.NoError(t, err)
+
+		result := gh.Backup()
+		require.NoError(t, result.Error)
+
+		return result.BackupResults
+	}
+
+	// only the gitlinks are backed up by default
+	require.Len(t, backup(false, appOneDir, appTwoDir), 2)
+
+	// the library is backed up once, however many repositories use it
+	results := backup(true, appOneDir, appTwoDir)
+	require.Len(t, results, 3)
+
+	libResult := results[2]
+	require.Equal(t, strings.Trim(libDir, "/"), libResult.Repo)
+	require.Equal(t, genericLocalDomain, libResult.Domain)
+	require.Equal(t, statusOk, libResult.Status)
+	require.True(t, libResult.Updated)
+
+	// nor again if it's backed up itself
+	require.Len(t, backup(true, appOneDir, libDir), 2)
+}
@@ -0,0 +1,93 @@
+package githosts
+
+import (
+	"os"
+	"strings"
+	"unicode"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+// validRequired checks the setting with the description specified isn't empty.
+func validRequired(value, description string) error {
+	if strings.TrimSpace(value) == "" {
+		return errors.Errorf("%s not specified", description)
+	}
+
+	return nil
+}
+
+// validBackupDir checks the backup directory, if specified and already present, is a directory
+// that can be written to. One that's absent is created when backing up.
+func validBackupDir(backupDIR string) error {
+	if backupDIR == "" {
+		return nil
+	}
+
+	info, err := os.Stat(backupDIR)
+	if os.IsNotExist(err) {
+		return nil
+	}
+
+	if err != nil {
+		return errors.Errorf("invalid backup directory: %s", err)
+	}
+
+	if !info.IsDir() {
+		return errors.Errorf("invalid backup directory: %s is not a directory", backupDIR)
+	}
+
+	file, err := os.CreateTemp(backupDIR, ".githosts-write-test-*")
+	if err != nil {
+		return errors.Errorf("invalid backup directory: %s is not writable: %s", backupDIR, err)
+	}
+
+	_ = file.Close()
+	_ = os.Remove(file.Name())
+
+	return nil
+}
+
+// validDiffRemoteMethodSetting checks the diff remote method, if specified, is supported.
+func validDiffRemoteMethodSetting(method string) error {
+	method = strings.ToLower(strings.TrimSpace(method))
+	if method == "" {
+		return nil
+	}
+
+	return validDiffRemoteMethod(method)
+}
+
+// validBundleRefSpec checks the refs to bundle are specified in only one way, and supported.
+func validBundleRefSpec(bundleRefSpec string, refSpec []string) error {
+	if len(refSpec) > 0 && strings.TrimSpace(bundleRefSpec) != "" {
+		return errors.New("bundle ref spec and ref spec cannot both be specified")
+	}
+
+	if _, err := getBundleRefSpec(bundleRefSpec); err != nil {
+		return err
+	}
+
+	for _, pattern := range refSpec {
+		// as with git's ref globs, * is the only wildcard
+		if !strings.HasPrefix(pattern, "refs/") || strings.ContainsFunc(pattern, unicode.IsSpace) || strings.Contains(pattern, "?") {
+			return errors.Errorf("invalid ref spec: %s", pattern)
+		}
+	}
+
+	return nil
+}
+
+// validRepoList checks the repository list file, if specified, can be read, and the mode is supported.
+func validRepoList(file, mode string) error {
+	_, _, err := readRepoList(file, mode)
+
+	return err
+}
+
+// validTLSConfig checks the CA certificate, if specified, can be loaded.
+func validTLSConfig(caCertPath string, insecureSkipTLSVerify bool) error {
+	_, err := getTLSConfig(caCertPath, insecureSkipTLSVerify)
+
+	return err
+}
@@ -0,0 +1,119 @@
+package githosts
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHostInputValidate(t *testing.T) {
+	t.Parallel()
+
+	backupDir := t.TempDir()
+
+	for _, tc := range []struct {
+		name    string
+		valid   interface{ Validate() error }
+		missing interface{ Validate() error }
+		invalid interface{ Validate() error }
+		errs    []string
+	}{
+		{
+			name:    "GitHub",
+			valid:   NewGitHubHostInput{Token: "token", BackupDir: backupDir},
+			missing: NewGitHubHostInput{BackupDir: backupDir},
+			invalid: NewGitHubHostInput{Token: "token", APIURL: "ftp://github.com", MaxConcurrent: -1},
+			errs:    []string{"token not specified", "invalid GitHub API URL", "invalid max concurrent"},
+		},
+		{
+			name:    "GitLab",
+			valid:   NewGitLabHostInput{Token: "token", BackupDir: backupDir},
+			missing: NewGitLabHostInput{BackupDir: backupDir},
+			invalid: NewGitLabHostInput{Token: "token", DiffRemoteMethod: "fetch", PageDelayMs: -1},
+			errs:    []string{"token not specified", "invalid diff remote method", "invalid page delay"},
+		},
+		{
+			name:    "Gitea",
+			valid:   NewGiteaHostInput{APIURL: "https://gitea.example.com/api/v1", Token: "token"},
+			missing: NewGiteaHostInput{Token: "token"},
+			invalid: NewGiteaHostInput{APIURL: "https://gitea.example.com/api/v1", Token: "token", CloneRetries: -2},
+			errs:    []string{"API URL missing", "invalid clone retries"},
+		},
+		{
+			name:    "Bitbucket",
+			valid:   NewBitBucketHostInput{User: "user", Key: "key", Secret: "secret"},
+			missing: NewBitBucketHostInput{User: "user", Key: "key"},
+			invalid: NewBitBucketHostInput{User: "user", Key: "key", Secret: "secret", BundleRefSpec: "--everything"},
+			errs:    []string{"OAuth consumer secret not specified", "invalid bundle ref spec"},
+		},
+		{
+			name:    "Azure DevOps",
+			valid:   NewAzureDevOpsHostInput{BackupDir: backupDir, UserName: "user", PAT: "pat", Orgs: []string{"org"}},
+			missing: NewAzureDevOpsHostInput{BackupDir: backupDir, UserName: "user", PAT: "pat"},
+			invalid: NewAzureDevOpsHostInput{BackupDir: backupDir, UserName: "user", PAT: "pat", Orgs: []string{"org"}, LockTimeout: -1},
+			errs:    []string{"no organizations specified", "invalid lock timeout"},
+		},
+		{
+			name:    "Generic",
+			valid:   NewGenericHostInput{URLs: []string{"https://example.com/owner/repo.git"}},
+			missing: NewGenericHostInput{},
+			invalid: NewGenericHostInput{URLs: []string{"https://example.com/owner/repo.git"}, ExtraGitConfig: []string{"core.askPass"}},
+			errs:    []string{"no repository URLs specified", "invalid extra git config"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Parallel()
+
+			require.NoError(t, tc.valid.Validate())
+			require.ErrorContains(t, tc.missing.Validate(), tc.errs[0])
+
+			err := tc.invalid.Validate()
+
+			for _, e := range tc.errs[1:] {
+				require.ErrorContains(t, err, e)
+			}
+		})
+	}
+}
+
+func TestNewHostReportsAllInvalidSettings(t *testing.T) {
+	t.Parallel()
+
+	_, err := NewGitHubHost(NewGitHubHostInput{
+		MaxConcurrent:     -1,
+		CloneRetries:      -2,
+		NotifyWebhookURL:  "ftp://example.com/hook",
+		RepoBackupTimeout: -1,
+	})
+	require.ErrorContains(t, err, "token not specified")
+	require.ErrorContains(t, err, "invalid max concurrent")
+	require.ErrorContains(t, err, "invalid clone retries")
+	require.ErrorContains(t, err, "invalid repository backup timeout")
+}
+
+func TestValidBackupDir(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+
+	require.NoError(t, validBackupDir(""))
+	require.NoError(t, validBackupDir(dir))
+	require.NoError(t, validBackupDir(filepath.Join(dir, "absent")))
+
+	// nothing is left behind by the check
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+
+	file := filepath.Join(dir, "file")
+	require.NoError(t, os.WriteFile(file, nil, 0o600))
+	require.ErrorContains(t, validBackupDir(file), "is not a directory")
+
+	if os.Geteuid() != 0 {
+		readOnly := filepath.Join(dir, "read-only")
+		require.NoError(t, os.Mkdir(readOnly, 0o500))
+		require.ErrorContains(t, validBackupDir(readOnly), "is not writable")
+	}
+}
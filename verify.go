@@ -0,0 +1,176 @@
+package githosts
+
+import (
+	"context"
+
+	"encoding/hex"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"gitlab.com/tozd/go/errors"
+)
+
+const (
+	verifyStatusOk              = "ok"
+	verifyStatusMismatch        = "mismatch"
+	verifyStatusMissingManifest = "missing-manifest"
+	verifyStatusInvalid         = "invalid"
+)
+
+type VerifyResult struct {
+	Repo   string `json:"repo"`   // path of the repository's backups relative to the backup directory
+	Bundle string `json:"bundle"` // bundle file name
+	Status string `json:"status"` // ok, mismatch, missing-manifest, invalid
+	Error  error  `json:"error,omitempty"`
+}
+
+// VerifyBackup checks every bundle in the backup directory. Bundles with a manifest are compared
+// against the hash it records, and those without are checked with git bundle verify.
+func VerifyBackup(backupDir string) ([]VerifyResult, error) {
+	if backupDir == "" {
+		return nil, errors.New("backup directory not specified")
+	}
+
+	// git requires a repository to verify a bundle in, but as bundles are complete an empty one will do
+	verifyRepoPath, err := os.MkdirTemp("", "githosts-verify-")
+	if err != nil {
+		return nil, errors.Errorf("failed to create verification repository: %s", err)
+	}
+
+	defer os.RemoveAll(verifyRepoPath)
+
+	if out, initErr := exec.Command("git", "init", "--bare", "-q", verifyRepoPath).CombinedOutput(); initErr != nil {
+		return nil, errors.Errorf("failed to create verification repository: %s: %s", strings.TrimSpace(string(out)), initErr)
+	}
+
+	var results []VerifyResult
+
+	err = filepath.WalkDir(backupDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			// working clones and release assets are not backups
+			if d.Name() == workingDIRName || isReleasesDir(path, d) {
+				return filepath.SkipDir
+			}
+
+			return nil
+		}
+
+		if !isBundleFileName(d.Name()) {
+			return nil
+		}
+
+		repoPath, err := filepath.Rel(backupDir, filepath.Dir(path))
+		if err != nil {
+			return err
+		}
+
+		result := verifyBundleFile(verifyRepoPath, path)
+		result.Repo = filepath.ToSlash(repoPath)
+
+		results = append(results, result)
+
+		return nil
+	})
+	if err != nil {
+		return results, errors.Errorf("failed to walk backup directory: %s", err)
+	}
+
+	return results, nil
+}
+
+func verifyBundleFile(verifyRepoPath, bundlePath string) VerifyResult {
+	result := VerifyResult{
+		Bundle: filepath.Base(bundlePath),
+	}
+
+	manifestPath := manifestPathForBundle(bundlePath)
+
+	if _, err := os.Stat(manifestPath); err != nil {
+		// without a manifest the best check is that git can read the bundle
+		result.Status = verifyStatusMissingManifest
+
+		if vErr := verifyBundle(context.Background(), gitOptions{}, verifyRepoPath, bundlePath); vErr != nil {
+			result.Status = verifyStatusInvalid
+			result.Error = vErr
+		}
+
+		return result
+	}
+
+	manifest, err := readBundleManifest(manifestPath)
+	if err != nil {
+		result.Status = verifyStatusInvalid
+		result.Error = err
+
+		return result
+	}
+
+	hash, hErr := getSHA2Hash(bundlePath)
+	if hErr != nil {
+		result.Status = verifyStatusInvalid
+		result.Error = hErr
+
+		return result
+	}
+
+	if hex.EncodeToString(hash) != manifest.BundleHash {
+		result.Status = verifyStatusMismatch
+		result.Error = errors.Errorf("bundle hash does not match manifest: %s", manifestPath)
+
+		return result
+	}
+
+	result.Status = verifyStatusOk
+
+	return result
+}
+
+// CheckRepoHealth checks that a bundle produces a consistent repository by cloning it into a
+// temporary mirror and running git fsck against its objects.
+func CheckRepoHealth(bundlePath string) error {
+	if bundlePath == "" {
+		return errors.New("bundle path not specified")
+	}
+
+	if _, err := getBundleRefs(context.Background(), gitOptions{}, bundlePath); err != nil {
+		if strings.Contains(err.Error(), invalidBundleStringCheck) {
+			return errors.Errorf("invalid bundle: %s", bundlePath)
+		}
+
+		return errors.Errorf("failed to read bundle: %s: %s", bundlePath, strings.TrimSpace(err.Error()))
+	}
+
+	mirrorPath, err := os.MkdirTemp("", "githosts-health-")
+	if err != nil {
+		return errors.Errorf("failed to create health check repository: %s", err)
+	}
+
+	defer os.RemoveAll(mirrorPath)
+
+	readablePath, remove, err := readableBundlePath(bundlePath)
+	if err != nil {
+		return err
+	}
+
+	defer remove()
+
+	if out, cloneErr := exec.Command("git", "clone", "--mirror", "-q", readablePath, mirrorPath).CombinedOutput(); cloneErr != nil {
+		return errors.Errorf("failed to clone bundle: %s: %s: %s", bundlePath, strings.TrimSpace(string(out)), cloneErr)
+	}
+
+	fsckCmd := exec.Command("git", "fsck", "--full")
+	fsckCmd.Dir = mirrorPath
+
+	if out, fsckErr := fsckCmd.CombinedOutput(); fsckErr != nil {
+		return errors.Errorf("repository health check failed: %s: %s: %s", bundlePath, strings.TrimSpace(string(out)), fsckErr)
+	}
+
+	return nil
+}
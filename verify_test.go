@@ -0,0 +1,108 @@
+package githosts
+
+import (
+	"context"
+
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifyBackup(t *testing.T) {
+	t.Parallel()
+
+	repoDir := setupTestRepo(t)
+	backupDir := t.TempDir()
+
+	createTestBundle := func(repoPath string) string {
+		bundleDir := filepath.Join(backupDir, "local", repoPath)
+		require.NoError(t, os.MkdirAll(bundleDir, 0o755))
+
+		bundlePath := filepath.Join(bundleDir, "repo.20200401111111.bundle")
+		runGitCmd(t, repoDir, "bundle", "create", bundlePath, "--all")
+
+		return bundlePath
+	}
+
+	// a good bundle with a manifest
+	require.NoError(t, createBundleManifest(context.Background(), gitOptions{}, repoDir, createTestBundle("owner/good"), ""))
+
+	// a bundle modified after its manifest was created
+	corruptedPath := createTestBundle("owner/corrupted")
+	require.NoError(t, createBundleManifest(context.Background(), gitOptions{}, repoDir, corruptedPath, ""))
+
+	f, err := os.OpenFile(corruptedPath, os.O_APPEND|os.O_WRONLY, 0o600)
+	require.NoError(t, err)
+	_, err = f.WriteString("corrupted")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	// a valid bundle without a manifest
+	createTestBundle("owner/nomanifest")
+
+	// an unreadable bundle without a manifest
+	invalidPath := createTestBundle("owner/invalid")
+	require.NoError(t, os.WriteFile(invalidPath, []byte("not a bundle"), 0o600))
+
+	// working clones are ignored
+	require.NoError(t, os.MkdirAll(filepath.Join(backupDir, workingDIRName, "local", "owner", "good"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(backupDir, workingDIRName, "local", "owner", "good", "repo.20200401111111.bundle"), []byte("ignored"), 0o600))
+
+	results, err := VerifyBackup(backupDir)
+	require.NoError(t, err)
+	require.Len(t, results, 4)
+
+	statuses := make(map[string]string)
+	for _, result := range results {
+		require.Equal(t, "repo.20200401111111.bundle", result.Bundle)
+		statuses[result.Repo] = result.Status
+	}
+
+	require.Equal(t, map[string]string{
+		"local/owner/good":       verifyStatusOk,
+		"local/owner/corrupted":  verifyStatusMismatch,
+		"local/owner/nomanifest": verifyStatusMissingManifest,
+		"local/owner/invalid":    verifyStatusInvalid,
+	}, statuses)
+}
+
+func TestVerifyBackupMissingDir(t *testing.T) {
+	t.Parallel()
+
+	_, err := VerifyBackup("")
+	require.Error(t, err)
+
+	_, err = VerifyBackup(filepath.Join(t.TempDir(), "missing"))
+	require.Error(t, err)
+}
+
+func TestCheckRepoHealth(t *testing.T) {
+	t.Parallel()
+
+	repoDir := setupTestRepo(t)
+	dir := t.TempDir()
+
+	bundlePath := filepath.Join(dir, "repo.20200401111111.bundle")
+	runGitCmd(t, repoDir, "bundle", "create", bundlePath, "--all")
+
+	require.NoError(t, CheckRepoHealth(bundlePath))
+
+	content, err := os.ReadFile(bundlePath)
+	require.NoError(t, err)
+
+	// refs remain readable when the pack is truncated, but the objects aren't
+	truncatedPath := filepath.Join(dir, "repo.20200501111111.bundle")
+	require.NoError(t, os.WriteFile(truncatedPath, content[:len(content)-20], 0o600))
+
+	err = CheckRepoHealth(truncatedPath)
+	require.Error(t, err)
+	require.ErrorContains(t, err, truncatedPath)
+
+	notBundlePath := filepath.Join(dir, "repo.20200601111111.bundle")
+	require.NoError(t, os.WriteFile(notBundlePath, []byte("not a bundle"), 0o600))
+	require.ErrorContains(t, CheckRepoHealth(notBundlePath), "invalid bundle")
+
+	require.Error(t, CheckRepoHealth(""))
+}